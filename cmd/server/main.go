@@ -2,17 +2,23 @@ package main
 
 import (
 	"log"
-	"os"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
 
+	"github.com/pandeptwidyaop/tempfile/internal/clamd"
 	"github.com/pandeptwidyaop/tempfile/internal/config"
+	"github.com/pandeptwidyaop/tempfile/internal/encryption"
 	"github.com/pandeptwidyaop/tempfile/internal/handlers"
+	"github.com/pandeptwidyaop/tempfile/internal/metadata"
 	"github.com/pandeptwidyaop/tempfile/internal/middleware"
 	"github.com/pandeptwidyaop/tempfile/internal/ratelimit"
 	"github.com/pandeptwidyaop/tempfile/internal/services"
+	"github.com/pandeptwidyaop/tempfile/internal/storage"
 	"github.com/pandeptwidyaop/tempfile/internal/utils"
 	"github.com/pandeptwidyaop/tempfile/web"
 )
@@ -36,14 +42,79 @@ func main() {
 		}
 	}
 
-	// Create upload directory if it doesn't exist
-	if err := os.MkdirAll(cfg.UploadDir, 0750); err != nil {
-		log.Fatal("Failed to create upload directory:", err)
+	// Initialize storage backend
+	var backend storage.Backend
+	switch cfg.StorageBackend {
+	case "local":
+		// Creates the upload directory if it doesn't exist
+		backend, err = storage.NewLocalBackend(cfg.UploadDir)
+		if err != nil {
+			log.Fatal("Failed to create local storage backend:", err)
+		}
+		log.Printf("✅ Local storage backend initialized")
+	case "s3":
+		backend, err = storage.NewS3Backend(&storage.S3Config{
+			Endpoint:     cfg.S3Endpoint,
+			Bucket:       cfg.S3Bucket,
+			Region:       cfg.S3Region,
+			AccessKey:    cfg.S3AccessKey,
+			SecretKey:    cfg.S3SecretKey,
+			UsePathStyle: cfg.S3UsePathStyle,
+			Timeout:      cfg.S3Timeout,
+		})
+		if err != nil {
+			log.Fatal("Failed to create S3 storage backend:", err)
+		}
+		log.Printf("✅ S3 storage backend initialized (bucket: %s)", cfg.S3Bucket)
+	default:
+		log.Fatal("Invalid storage backend:", cfg.StorageBackend)
+	}
+
+	// Initialize metadata stores (JSON objects next to the stored files)
+	metadataStore := metadata.NewSidecarStore(backend)
+	collectionStore := metadata.NewCollectionStore(backend)
+	blobStore := metadata.NewBlobStore(backend)
+
+	// Initialize encryption at rest if a master key is configured
+	keyring, err := newKeyring(cfg)
+	if err != nil {
+		log.Fatal("Failed to load encryption keys:", err)
+	}
+
+	// clamd may well start after the server, so it only needs to answer by the first upload
+	if cfg.ScanningEnabled() {
+		network, address := cfg.ClamdEndpoint()
+		if err := clamd.NewClient(network, address, cfg.ClamdTimeout).Ping(); err != nil {
+			log.Printf("⚠️  clamd at %s is not answering yet: %v", cfg.ClamdAddress, err)
+		} else {
+			log.Printf("✅ Malware scanning enabled (clamd at %s)", cfg.ClamdAddress)
+		}
 	}
 
 	// Initialize services
-	uploadService := services.NewUploadService(cfg)
-	cleanupService := services.NewCleanupService(cfg)
+	fileService := services.NewFileService(cfg, backend, metadataStore, blobStore, keyring)
+	collectionService := services.NewCollectionService(cfg, fileService, collectionStore)
+	uploadService := services.NewUploadService(cfg, fileService, collectionService)
+
+	var tusService *services.TusService
+	if cfg.EnableTus {
+		tusService = services.NewTusService(cfg, fileService)
+	}
+
+	cleanupService := services.NewCleanupService(cfg, fileService, tusService, collectionService)
+
+	// Move data keys still wrapped by a previous master key to the current one
+	if keyring != nil {
+		go func() {
+			rewrapped, err := fileService.RewrapKeys()
+			if err != nil {
+				log.Printf("Error re-wrapping data keys: %v", err)
+			}
+			if rewrapped > 0 {
+				log.Printf("🔑 Re-wrapped %d data key(s) with the current encryption key", rewrapped)
+			}
+		}()
+	}
 
 	var templateService *services.TemplateService
 	var staticService *services.StaticService
@@ -64,7 +135,17 @@ func main() {
 
 	// Initialize handlers
 	apiHandler := handlers.NewAPIHandler(cfg, uploadService)
-	fileHandler := handlers.NewFileHandler(cfg)
+	passwordAttempts, err := newPasswordAttemptLimiter(cfg)
+	if err != nil {
+		log.Fatal("Failed to create password attempt limiter:", err)
+	}
+	fileHandler := handlers.NewFileHandler(cfg, fileService, templateService, passwordAttempts)
+	collectionHandler := handlers.NewCollectionHandler(cfg, collectionService, fileService, templateService)
+
+	var tusHandler *handlers.TusHandler
+	if cfg.EnableTus {
+		tusHandler = handlers.NewTusHandler(cfg, tusService)
+	}
 
 	var webHandler *handlers.WebHandler
 	if cfg.EnableWebUI {
@@ -120,15 +201,19 @@ func main() {
 	}
 
 	// Initialize Fiber app
+	// Request bodies are streamed rather than buffered, so uploads go to
+	// storage as they arrive and are checked against the limits as they do
 	app := fiber.New(fiber.Config{
-		BodyLimit: int(cfg.MaxFileSize),
+		BodyLimit:                    int(cfg.MaxRequestSize),
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
 	})
 
 	// Setup middleware
 	setupMiddleware(app, cfg, staticService, rateLimiter)
 
 	// Setup routes
-	setupRoutes(app, cfg, apiHandler, webHandler, fileHandler, rateLimiter)
+	setupRoutes(app, cfg, apiHandler, webHandler, fileHandler, collectionHandler, tusHandler, rateLimiter)
 
 	// Start cleanup routine
 	go cleanupService.Start()
@@ -151,6 +236,14 @@ func setupMiddleware(app *fiber.App, cfg *config.Config, staticService *services
 		return c.Next()
 	})
 
+	// Request bodies are streamed, see NewStreamedBodyGuard
+	app.Use(middleware.NewStreamedBodyGuard(cfg.MaxRequestSize))
+
+	// User content gets an origin of its own
+	if cfg.DownloadOrigin != "" {
+		app.Use(middleware.NewDownloadOriginGuard(cfg.DownloadHost()))
+	}
+
 	// Conditionally add middleware based on config
 	if cfg.EnableLogging {
 		app.Use(logger.New(logger.Config{
@@ -159,13 +252,14 @@ func setupMiddleware(app *fiber.App, cfg *config.Config, staticService *services
 	}
 
 	if cfg.EnableCORS {
-		corsConfig := cors.New()
+		// Browser tus clients need to read the upload headers
+		corsConfig := cors.Config{
+			ExposeHeaders: handlers.TusExposedHeaders,
+		}
 		if cfg.CORSOrigins != "*" {
-			corsConfig = cors.New(cors.Config{
-				AllowOrigins: cfg.CORSOrigins,
-			})
+			corsConfig.AllowOrigins = cfg.CORSOrigins
 		}
-		app.Use(corsConfig)
+		app.Use(cors.New(corsConfig))
 	}
 
 	// Rate limiting middleware (before routes)
@@ -207,35 +301,119 @@ func convertCustomLimits(configLimits map[string]config.RateLimitEndpointConfig)
 }
 
 // setupRoutes configures application routes
-func setupRoutes(app *fiber.App, cfg *config.Config, apiHandler *handlers.APIHandler, webHandler *handlers.WebHandler, fileHandler *handlers.FileHandler, rateLimiter ratelimit.RateLimiter) {
+func setupRoutes(app *fiber.App, cfg *config.Config, apiHandler *handlers.APIHandler, webHandler *handlers.WebHandler, fileHandler *handlers.FileHandler, collectionHandler *handlers.CollectionHandler, tusHandler *handlers.TusHandler, rateLimiter ratelimit.RateLimiter) {
 	// Health check endpoint (most specific first)
 	app.Get("/health", apiHandler.HealthCheck)
 
+	// Resumable uploads (tus 1.0)
+	if cfg.EnableTus && tusHandler != nil {
+		tus := app.Group("/api/tus", tusHandler.Protocol)
+		if cfg.EnableRateLimit && rateLimiter != nil {
+			tus.Use(middleware.NewRateLimiterChunkCounter(rateLimiter))
+		}
+
+		tus.Options("", tusHandler.Options)
+		tus.Options("/:id", tusHandler.Options)
+		tus.Post("", tusHandler.CreateUpload)
+		tus.Head("/:id", tusHandler.GetUploadOffset)
+		tus.Patch("/:id", tusHandler.PatchUpload)
+		tus.Delete("/:id", tusHandler.TerminateUpload)
+	}
+
 	// Routes
 	if cfg.EnableWebUI && webHandler != nil {
 		// Web UI routes (specific routes first)
 		app.Get("/success", webHandler.SuccessPage)
 		app.Get("/", webHandler.UploadPage)
 
-		// Upload route with post-processing middleware
+		// Upload routes with post-processing middleware, which counts the upload once stored
 		if cfg.EnableRateLimit && rateLimiter != nil {
 			postProcessMiddleware := middleware.NewRateLimiterPostProcess(rateLimiter)
-			app.Post("/", webHandler.UploadFileHandler, postProcessMiddleware)
+			app.Post("/", postProcessMiddleware, webHandler.UploadFileHandler)
+			app.Put("/:filename", postProcessMiddleware, apiHandler.UploadRaw)
 		} else {
 			app.Post("/", webHandler.UploadFileHandler)
+			app.Put("/:filename", apiHandler.UploadRaw)
 		}
 	} else {
 		// API only routes
 		if cfg.EnableRateLimit && rateLimiter != nil {
 			postProcessMiddleware := middleware.NewRateLimiterPostProcess(rateLimiter)
-			app.Post("/", apiHandler.UploadFile, postProcessMiddleware)
+			app.Post("/", postProcessMiddleware, apiHandler.UploadFile)
+			app.Put("/:filename", postProcessMiddleware, apiHandler.UploadRaw)
 		} else {
 			app.Post("/", apiHandler.UploadFile)
+			app.Put("/:filename", apiHandler.UploadRaw)
 		}
 	}
 
-	// File download route (wildcard route LAST)
+	// Collections of files shared under one link
+	app.Post("/api/collections", collectionHandler.CreateCollection)
+	app.Get("/c/:id", collectionHandler.ViewCollection)
+	app.Get("/c/:id/zip", collectionHandler.DownloadCollection)
+	app.Get("/api/collections/:id/archive", collectionHandler.DownloadCollection)
+	app.Get("/api/archive", fileHandler.DownloadArchive)
+	app.Get("/api/stats", fileHandler.Stats)
+
+	// File management by the uploader, authorized by the delete token
+	app.Patch("/api/files/:id", fileHandler.UpdateFile)
+	app.Post("/api/files/:id/links", fileHandler.CreateLink)
+	app.Get("/:filename/delete", fileHandler.DeletePage)
+	app.Post("/:filename/delete", fileHandler.ConfirmDelete)
+	app.Delete("/:filename", fileHandler.DeleteFile)
+
+	// Link previews of landing pages
+	if cfg.EnableWebUI && cfg.EnableLandingPage {
+		app.Get("/oembed", fileHandler.OEmbed)
+	}
+
+	// File download routes (wildcard routes LAST); the password prompt posts back
+	app.Get("/:filename/raw", fileHandler.DownloadRaw)
+	app.Post("/:filename/raw", fileHandler.DownloadRaw)
 	app.Get("/:filename", fileHandler.DownloadFile)
+	app.Post("/:filename", fileHandler.DownloadFile)
+}
+
+// newPasswordAttemptLimiter creates the limiter for wrong download passwords.
+// It shares Redis with the rate limiter when configured, so that every
+// instance sees the same failures
+func newPasswordAttemptLimiter(cfg *config.Config) (ratelimit.AttemptLimiter, error) {
+	var store ratelimit.Store
+	if cfg.EnableRateLimit && cfg.RateLimitStore == "redis" {
+		var err error
+		store, err = ratelimit.NewRedisStore(cfg.RedisURL, cfg.RedisPassword, cfg.RedisDB, cfg.RedisPoolSize, cfg.RedisTimeout)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		store = ratelimit.NewMemoryStore(10000, 5*time.Minute)
+	}
+
+	return ratelimit.NewAttemptLimiter(store, cfg.PasswordMaxAttempts, cfg.PasswordAttemptWindow), nil
+}
+
+// newKeyring loads the master keys for encryption at rest, or returns nil when
+// encryption is disabled
+func newKeyring(cfg *config.Config) (*encryption.Keyring, error) {
+	if !cfg.EncryptionEnabled() {
+		return nil, nil
+	}
+
+	keys := []string{cfg.EncryptionKey}
+	if cfg.EncryptionKeyFile != "" {
+		var err error
+		if keys, err = encryption.ReadKeyFile(cfg.EncryptionKeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	keyring, err := encryption.NewKeyring(append(keys, cfg.EncryptionPreviousKeys...))
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("✅ Encryption at rest enabled (key %s)", keyring.CurrentKeyID())
+	return keyring, nil
 }
 
 // printStartupInfo prints configuration information at startup
@@ -244,15 +422,50 @@ func printStartupInfo(cfg *config.Config) {
 	log.Printf("   Environment: %s", cfg.AppEnv)
 	log.Printf("   Port: %s", cfg.Port)
 	log.Printf("   Public URL: %s", cfg.PublicURL)
-	log.Printf("   Upload Directory: %s", cfg.UploadDir)
+	if cfg.DownloadOrigin != "" {
+		log.Printf("   Download Origin: %s", cfg.DownloadOrigin)
+	}
+	log.Printf("   Storage Backend: %s", cfg.StorageBackend)
+	if cfg.StorageBackend == "local" {
+		log.Printf("   Upload Directory: %s", cfg.UploadDir)
+	} else if cfg.StorageBackend == "s3" {
+		log.Printf("   S3 Bucket: %s (region: %s)", cfg.S3Bucket, cfg.S3Region)
+		if cfg.S3Endpoint != "" {
+			log.Printf("   S3 Endpoint: %s", cfg.S3Endpoint)
+		}
+	}
+	log.Printf("   Encryption at Rest: %v", cfg.EncryptionEnabled())
+	log.Printf("   Signed Download Links: %v", cfg.SignedLinksEnabled())
 	log.Printf("   Max File Size: %s", utils.FormatBytes(cfg.MaxFileSize))
-	log.Printf("   File Expiry: %d hour(s)", cfg.FileExpiryHours)
+	log.Printf("   Max Upload Request: %d file(s), %s", cfg.MaxFilesPerUpload, utils.FormatBytes(cfg.MaxRequestSize))
+	log.Printf("   File Expiry: %s", utils.FormatDuration(cfg.DefaultExpiry()))
+	log.Printf("   Type Mismatches: %s", cfg.TypeMismatchAction)
+	if cfg.ScanningEnabled() {
+		log.Printf("   Malware Scanning: clamd at %s (infected files: %s, fail %s)", cfg.ClamdAddress, cfg.ScanInfectedAction, cfg.ScanFailMode)
+	} else {
+		log.Printf("   Malware Scanning: Disabled")
+	}
+	if len(cfg.AllowedTypes) > 0 || len(cfg.AllowedExtensions) > 0 {
+		log.Printf("   Allowed File Types: %s", strings.Join(slices.Concat(cfg.AllowedTypes, cfg.AllowedExtensions), ", "))
+	}
+	if len(cfg.DeniedTypes) > 0 || len(cfg.DeniedExtensions) > 0 {
+		log.Printf("   Denied File Types: %s", strings.Join(slices.Concat(cfg.DeniedTypes, cfg.DeniedExtensions), ", "))
+	}
+	if !cfg.ClientEncryptionAllowed() {
+		log.Printf("   Client-Encrypted Uploads: Refused (their content cannot be checked)")
+	}
+	if cfg.EnableTus {
+		log.Printf("   Resumable Uploads: Enabled at /api/tus (unfinished uploads kept %d hour(s))", cfg.TusUploadExpiryHours)
+	} else {
+		log.Printf("   Resumable Uploads: Disabled")
+	}
 	log.Printf("   Cleanup Interval: %d second(s)", cfg.CleanupIntervalSeconds)
 	log.Printf("   CORS Enabled: %v", cfg.EnableCORS)
 	log.Printf("   Logging Enabled: %v", cfg.EnableLogging)
 	log.Printf("   Web UI Enabled: %v", cfg.EnableWebUI)
 	if cfg.EnableWebUI {
 		log.Printf("   Static Assets: Embedded (standalone binary)")
+		log.Printf("   Landing Pages: %v", cfg.EnableLandingPage)
 	}
 	log.Printf("   Debug Mode: %v", cfg.Debug)
 
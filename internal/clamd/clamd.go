@@ -0,0 +1,163 @@
+package clamd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// chunkSize is how much content is sent to clamd in one INSTREAM chunk
+const chunkSize = 64 * 1024
+
+// ErrScanFailed indicates a reply of clamd that is an error or cannot be
+// understood, such as when content exceeds its StreamMaxLength
+var ErrScanFailed = errors.New("clamd scan failed")
+
+// Result is the verdict of clamd on scanned content
+type Result struct {
+	// Infected is set when clamd found malware, named by Signature
+	Infected  bool
+	Signature string
+}
+
+// Client talks to a ClamAV daemon over its TCP or unix socket. Every command
+// opens a connection of its own, so a Client may be used concurrently
+type Client struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// NewClient returns a client of the clamd listening at address on network,
+// tcp or unix. timeout limits how long clamd may take to accept content or
+// reply before the command fails
+func NewClient(network, address string, timeout time.Duration) *Client {
+	return &Client{network: network, address: address, timeout: timeout}
+}
+
+// Ping checks that clamd is up and answering
+func (c *Client) Ping() error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("zPING\x00")); err != nil {
+		return fmt.Errorf("failed to send PING: %w", err)
+	}
+
+	reply, err := c.readReply(conn)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("%w: %s", ErrScanFailed, reply)
+	}
+
+	return nil
+}
+
+// Scan streams content to clamd with the INSTREAM command and returns its
+// verdict. Content is sent in chunks as it is read, so it is never held in
+// memory as a whole
+func (c *Client) Scan(content io.Reader) (*Result, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := c.stream(conn, content); err != nil {
+		// clamd stops reading content it won't scan, and says why
+		if reply, replyErr := c.readReply(conn); replyErr == nil && strings.HasSuffix(reply, "ERROR") {
+			return nil, fmt.Errorf("%w: %s", ErrScanFailed, reply)
+		}
+		return nil, err
+	}
+
+	reply, err := c.readReply(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseReply(reply)
+}
+
+// stream sends the INSTREAM command with content as length-prefixed chunks,
+// ending with an empty one
+func (c *Client) stream(conn net.Conn, content io.Reader) error {
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return fmt.Errorf("failed to send INSTREAM: %w", err)
+	}
+
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, readErr := io.ReadFull(content, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			_ = conn.SetDeadline(time.Now().Add(c.timeout))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return fmt.Errorf("failed to send content: %w", err)
+			}
+		}
+
+		if errors.Is(readErr, io.EOF) || errors.Is(readErr, io.ErrUnexpectedEOF) {
+			break
+		}
+		if readErr != nil {
+			return fmt.Errorf("failed to read content: %w", readErr)
+		}
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return fmt.Errorf("failed to send content: %w", err)
+	}
+
+	return nil
+}
+
+// dial connects to clamd
+func (c *Client) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout(c.network, c.address, c.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(c.timeout))
+
+	return conn, nil
+}
+
+// readReply reads a reply to a z-prefixed command, which ends with a NUL byte
+func (c *Client) readReply(conn net.Conn) (string, error) {
+	_ = conn.SetDeadline(time.Now().Add(c.timeout))
+
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && !(errors.Is(err, io.EOF) && len(reply) > 0) {
+		return "", fmt.Errorf("failed to read clamd reply: %w", err)
+	}
+
+	return string(bytes.TrimSpace(bytes.TrimSuffix(reply, []byte{0}))), nil
+}
+
+// parseReply reads the verdict from a reply to INSTREAM, such as
+// "stream: OK" or "stream: Eicar-Signature FOUND"
+func parseReply(reply string) (*Result, error) {
+	verdict := strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case verdict == "OK":
+		return &Result{}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return &Result{Infected: true, Signature: strings.TrimSuffix(verdict, " FOUND")}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrScanFailed, reply)
+	}
+}
@@ -0,0 +1,178 @@
+package clamd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClamd answers clamd commands on a listener, finding "EICAR" in any
+// content and refusing content of more than maxLength bytes
+type fakeClamd struct {
+	maxLength int
+	received  chan []byte
+}
+
+// startFakeClamd serves a fake clamd on network and returns its address
+func startFakeClamd(t *testing.T, network string, maxLength int) (*fakeClamd, string) {
+	t.Helper()
+
+	address := "127.0.0.1:0"
+	if network == "unix" {
+		address = filepath.Join(t.TempDir(), "clamd.sock")
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	fake := &fakeClamd{maxLength: maxLength, received: make(chan []byte, 1)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(conn)
+		}
+	}()
+
+	return fake, listener.Addr().String()
+}
+
+func (f *fakeClamd) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	command, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+
+	switch command {
+	case "zPING\x00":
+		_, _ = conn.Write([]byte("PONG\x00"))
+	case "zINSTREAM\x00":
+		var content []byte
+		for {
+			var size uint32
+			if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+				return
+			}
+			if size == 0 {
+				break
+			}
+			if len(content)+int(size) > f.maxLength {
+				_, _ = conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+				return
+			}
+			chunk := make([]byte, size)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return
+			}
+			content = append(content, chunk...)
+		}
+
+		f.received <- content
+		if bytes.Contains(content, []byte("EICAR")) {
+			_, _ = conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+		} else {
+			_, _ = conn.Write([]byte("stream: OK\x00"))
+		}
+	default:
+		_, _ = conn.Write([]byte("UNKNOWN COMMAND\x00"))
+	}
+}
+
+func TestClient_Scan(t *testing.T) {
+	for _, network := range []string{"tcp", "unix"} {
+		t.Run(network, func(t *testing.T) {
+			fake, address := startFakeClamd(t, network, 1<<20)
+			client := NewClient(network, address, 5*time.Second)
+
+			if err := client.Ping(); err != nil {
+				t.Fatalf("Ping() error = %v", err)
+			}
+
+			// Content spanning several chunks arrives whole
+			content := strings.Repeat("clean content ", chunkSize/7)
+			result, err := client.Scan(strings.NewReader(content))
+			if err != nil {
+				t.Fatalf("Scan() error = %v", err)
+			}
+			if result.Infected {
+				t.Errorf("Scan() = %+v, want clean", result)
+			}
+			if got := <-fake.received; string(got) != content {
+				t.Errorf("clamd received %d bytes, want %d", len(got), len(content))
+			}
+
+			result, err = client.Scan(strings.NewReader("X5O!P%@AP EICAR test"))
+			if err != nil {
+				t.Fatalf("Scan() error = %v", err)
+			}
+			<-fake.received
+			if !result.Infected || result.Signature != "Eicar-Test-Signature" {
+				t.Errorf("Scan() = %+v, want infected with Eicar-Test-Signature", result)
+			}
+		})
+	}
+}
+
+func TestClient_ScanFailed(t *testing.T) {
+	_, address := startFakeClamd(t, "tcp", 16)
+	client := NewClient("tcp", address, 5*time.Second)
+
+	// Content clamd won't take is an error, not a verdict
+	_, err := client.Scan(strings.NewReader(strings.Repeat("x", 64)))
+	if !errors.Is(err, ErrScanFailed) {
+		t.Errorf("Scan() error = %v, want ErrScanFailed", err)
+	}
+
+	// Nothing listens on a closed port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	_ = listener.Close()
+
+	down := NewClient("tcp", listener.Addr().String(), time.Second)
+	if _, err := down.Scan(strings.NewReader("content")); err == nil {
+		t.Error("Scan() error = nil, want an error while clamd is down")
+	}
+	if err := down.Ping(); err == nil {
+		t.Error("Ping() error = nil, want an error while clamd is down")
+	}
+}
+
+func TestParseReply(t *testing.T) {
+	tests := []struct {
+		reply   string
+		want    *Result
+		wantErr bool
+	}{
+		{"stream: OK", &Result{}, false},
+		{"stream: Win.Test.EICAR_HDB-1 FOUND", &Result{Infected: true, Signature: "Win.Test.EICAR_HDB-1"}, false},
+		{"INSTREAM size limit exceeded. ERROR", nil, true},
+		{"", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseReply(tt.reply)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseReply(%q) error = %v, wantErr %v", tt.reply, err, tt.wantErr)
+			continue
+		}
+		if err == nil && *got != *tt.want {
+			t.Errorf("parseReply(%q) = %+v, want %+v", tt.reply, got, tt.want)
+		}
+	}
+}
@@ -4,11 +4,14 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/pandeptwidyaop/tempfile/internal/utils"
 )
 
 // Config holds all configuration for the application
@@ -17,10 +20,83 @@ type Config struct {
 	Port      string
 	PublicURL string
 
+	// DownloadOrigin is a separate origin, such as https://dl.example.com,
+	// that browsers are sent to for file content, so that uploads never run
+	// on the origin of the web UI
+	DownloadOrigin string
+
 	// File storage config
-	UploadDir       string
-	MaxFileSize     int64
-	FileExpiryHours int
+	StorageBackend    string
+	UploadDir         string
+	MaxFileSize       int64
+	MaxRequestSize    int64
+	MaxFilesPerUpload int
+	FileExpiryHours   int
+	MinExpiry         time.Duration
+	MaxExpiry         time.Duration
+
+	// Upload type config. Types are MIME types such as image/png or image/*,
+	// checked against the type detected from the content; extensions are
+	// those of the original names. Empty allow lists allow anything.
+	// TypeMismatchAction is what happens to uploads whose content does not
+	// agree with their extension: allow, flag or reject. TypeClientEncrypted
+	// is whether files encrypted by the client, whose type cannot be
+	// detected, are stored (allow) or refused (reject) while type lists are set
+	AllowedTypes        []string
+	DeniedTypes         []string
+	AllowedExtensions   []string
+	DeniedExtensions    []string
+	TypeMismatchAction  string
+	TypeClientEncrypted string
+
+	// S3 storage config
+	S3Endpoint     string
+	S3Bucket       string
+	S3Region       string
+	S3AccessKey    string
+	S3SecretKey    string
+	S3UsePathStyle bool
+	S3Timeout      time.Duration
+
+	// Encryption at rest config. The current master key comes from
+	// EncryptionKey or, one key per line with the current key first, from
+	// EncryptionKeyFile. Previous keys only unwrap existing data keys
+	EncryptionKey          string
+	EncryptionKeyFile      string
+	EncryptionPreviousKeys []string
+
+	// Signed download link config. With a secret every download link carries
+	// an HMAC signature and its own expiry, and unsigned links are refused.
+	// SignedLinkExpiry is how long minted links last unless asked otherwise
+	LinkSigningSecret string
+	SignedLinkExpiry  time.Duration
+
+	// AdminToken is the bearer token admins send to see figures that must
+	// not be public, such as how much deduplication saves. Nobody sees them
+	// without one
+	AdminToken string
+
+	// Malware scanning config. ClamdAddress is where a ClamAV daemon listens,
+	// as tcp://host:port, host:port, unix:///path or /path; scanning is off
+	// without one. ScanInfectedAction is what happens to infected uploads,
+	// reject or quarantine, and ScanFailMode whether uploads are stored
+	// (open) or refused (closed) while clamd cannot scan them.
+	// ScanClientEncrypted is whether files encrypted by the client, which
+	// cannot be scanned, are stored (allow) or refused (reject); left empty
+	// it follows ScanFailMode
+	ClamdAddress        string
+	ClamdTimeout        time.Duration
+	ScanInfectedAction  string
+	ScanFailMode        string
+	ScanClientEncrypted string
+
+	// Resumable upload (tus) config
+	EnableTus            bool
+	TusUploadExpiryHours int
+
+	// Password protected download config
+	PasswordMaxAttempts   int
+	PasswordAttemptWindow time.Duration
 
 	// Middleware config
 	EnableCORS    bool
@@ -41,6 +117,10 @@ type Config struct {
 	TemplatesDir string
 	DefaultTheme string
 
+	// EnableLandingPage shows browsers and link previews a page describing a
+	// file at its download URL, and serves the bytes at /:filename/raw
+	EnableLandingPage bool
+
 	// Rate limiting config
 	EnableRateLimit           bool
 	RateLimitStore            string
@@ -79,11 +159,60 @@ func Load() (*Config, error) {
 		Port:      getEnvOrDefault("PORT", "3000"),
 		PublicURL: getEnvOrDefault("PUBLIC_URL", "http://localhost:3000"),
 
+		DownloadOrigin: strings.TrimSuffix(getEnvOrDefault("DOWNLOAD_ORIGIN", ""), "/"),
+
 		// File storage config
+		StorageBackend:  getEnvOrDefault("STORAGE_BACKEND", "local"),
 		UploadDir:       getEnvOrDefault("UPLOAD_DIR", "./uploads"),
 		MaxFileSize:     getEnvAsInt64OrDefault("MAX_FILE_SIZE", 100*1024*1024), // 100MB
 		FileExpiryHours: getEnvAsIntOrDefault("FILE_EXPIRY_HOURS", 1),
 
+		MaxFilesPerUpload: getEnvAsIntOrDefault("MAX_FILES_PER_UPLOAD", 10),
+
+		// Upload type config
+		AllowedTypes:        getEnvAsStringSliceOrDefault("ALLOWED_TYPES", []string{}),
+		DeniedTypes:         getEnvAsStringSliceOrDefault("DENIED_TYPES", []string{}),
+		AllowedExtensions:   getEnvAsStringSliceOrDefault("ALLOWED_EXTENSIONS", []string{}),
+		DeniedExtensions:    getEnvAsStringSliceOrDefault("DENIED_EXTENSIONS", []string{}),
+		TypeMismatchAction:  getEnvOrDefault("TYPE_MISMATCH_ACTION", "flag"),
+		TypeClientEncrypted: getEnvOrDefault("TYPE_CLIENT_ENCRYPTED", "reject"),
+
+		// S3 storage config
+		S3Endpoint:     getEnvOrDefault("S3_ENDPOINT", ""),
+		S3Bucket:       getEnvOrDefault("S3_BUCKET", ""),
+		S3Region:       getEnvOrDefault("S3_REGION", "us-east-1"),
+		S3AccessKey:    getEnvOrDefault("S3_ACCESS_KEY_ID", ""),
+		S3SecretKey:    getEnvOrDefault("S3_SECRET_ACCESS_KEY", ""),
+		S3UsePathStyle: getEnvAsBoolOrDefault("S3_USE_PATH_STYLE", false),
+		S3Timeout:      getEnvAsDurationOrDefault("S3_TIMEOUT", 30*time.Second),
+
+		// Encryption at rest config
+		EncryptionKey:          getEnvOrDefault("ENCRYPTION_KEY", ""),
+		EncryptionKeyFile:      getEnvOrDefault("ENCRYPTION_KEY_FILE", ""),
+		EncryptionPreviousKeys: getEnvAsStringSliceOrDefault("ENCRYPTION_PREVIOUS_KEYS", []string{}),
+
+		// Signed download link config
+		LinkSigningSecret: getEnvOrDefault("LINK_SIGNING_SECRET", ""),
+		SignedLinkExpiry:  getEnvAsDurationOrDefault("SIGNED_LINK_EXPIRY", time.Hour),
+
+		// Admin config
+		AdminToken: getEnvOrDefault("ADMIN_TOKEN", ""),
+
+		// Malware scanning config
+		ClamdAddress:        getEnvOrDefault("CLAMD_ADDRESS", ""),
+		ClamdTimeout:        getEnvAsDurationOrDefault("CLAMD_TIMEOUT", time.Minute),
+		ScanInfectedAction:  getEnvOrDefault("SCAN_INFECTED_ACTION", "reject"),
+		ScanFailMode:        getEnvOrDefault("SCAN_FAIL_MODE", "closed"),
+		ScanClientEncrypted: getEnvOrDefault("SCAN_CLIENT_ENCRYPTED", ""),
+
+		// Resumable upload (tus) config
+		EnableTus:            getEnvAsBoolOrDefault("ENABLE_TUS", true),
+		TusUploadExpiryHours: getEnvAsIntOrDefault("TUS_UPLOAD_EXPIRY_HOURS", 24),
+
+		// Password protected download config
+		PasswordMaxAttempts:   getEnvAsIntOrDefault("PASSWORD_MAX_ATTEMPTS", 5),
+		PasswordAttemptWindow: getEnvAsDurationOrDefault("PASSWORD_ATTEMPT_WINDOW", 15*time.Minute),
+
 		// Middleware config
 		EnableCORS:    getEnvAsBoolOrDefault("ENABLE_CORS", true),
 		CORSOrigins:   getEnvOrDefault("CORS_ORIGINS", "*"),
@@ -103,6 +232,8 @@ func Load() (*Config, error) {
 		TemplatesDir: getEnvOrDefault("TEMPLATES_DIR", "./web/templates"),
 		DefaultTheme: getEnvOrDefault("DEFAULT_THEME", "dark"),
 
+		EnableLandingPage: getEnvAsBoolOrDefault("ENABLE_LANDING_PAGE", false),
+
 		// Rate limiting config
 		EnableRateLimit:           getEnvAsBoolOrDefault("ENABLE_RATE_LIMIT", false),
 		RateLimitStore:            getEnvOrDefault("RATE_LIMIT_STORE", "memory"),
@@ -122,6 +253,18 @@ func Load() (*Config, error) {
 		RedisTimeout:  getEnvAsIntOrDefault("REDIS_TIMEOUT", 5),
 	}
 
+	// Per-upload expiry bounds; by default they always include the default expiry
+	defaultExpiry := time.Duration(config.FileExpiryHours) * time.Hour
+	minExpiry := 5 * time.Minute
+	if defaultExpiry > 0 {
+		minExpiry = min(minExpiry, defaultExpiry)
+	}
+	config.MinExpiry = getEnvAsDurationOrDefault("MIN_EXPIRY", minExpiry)
+	config.MaxExpiry = getEnvAsDurationOrDefault("MAX_EXPIRY", max(24*time.Hour, defaultExpiry))
+
+	// Several files may be sent in one request, by default no more than one file's worth
+	config.MaxRequestSize = getEnvAsInt64OrDefault("MAX_REQUEST_SIZE", config.MaxFileSize)
+
 	// Add colon prefix to port if not present
 	if !strings.HasPrefix(config.Port, ":") {
 		config.Port = ":" + config.Port
@@ -130,9 +273,178 @@ func Load() (*Config, error) {
 	return config, nil
 }
 
+// DefaultExpiry returns how long files are kept unless the upload asks
+// otherwise. A FILE_EXPIRY_HOURS of zero or less, which once expired files
+// right away, is still accepted and now keeps them for MIN_EXPIRY
+func (c *Config) DefaultExpiry() time.Duration {
+	return max(time.Duration(c.FileExpiryHours)*time.Hour, c.MinExpiry)
+}
+
+// EncryptionEnabled reports whether uploaded content is encrypted at rest
+func (c *Config) EncryptionEnabled() bool {
+	return c.EncryptionKey != "" || c.EncryptionKeyFile != ""
+}
+
+// SignedLinksEnabled reports whether download links are signed
+func (c *Config) SignedLinksEnabled() bool {
+	return c.LinkSigningSecret != ""
+}
+
+// ClientEncryptionAllowed reports whether files encrypted by the client are
+// accepted. Their content looks like random bytes, so they are refused while
+// it must be checked against allowed or denied types unless
+// TypeClientEncrypted allows them, and while uploads must be scanned for
+// malware unless ScanClientEncrypted allows them
+func (c *Config) ClientEncryptionAllowed() bool {
+	if c.TypeClientEncrypted != "allow" && (len(c.AllowedTypes) > 0 || len(c.DeniedTypes) > 0) {
+		return false
+	}
+	if !c.ScanningEnabled() {
+		return true
+	}
+
+	switch c.ScanClientEncrypted {
+	case "allow":
+		return true
+	case "reject":
+		return false
+	default:
+		return c.ScanFailMode == "open"
+	}
+}
+
+// ScanningEnabled reports whether uploads are scanned for malware
+func (c *Config) ScanningEnabled() bool {
+	return c.ClamdAddress != ""
+}
+
+// ClamdEndpoint returns the network, tcp or unix, and address to reach clamd at
+func (c *Config) ClamdEndpoint() (network, address string) {
+	switch {
+	case strings.HasPrefix(c.ClamdAddress, "unix://"):
+		return "unix", strings.TrimPrefix(c.ClamdAddress, "unix://")
+	case strings.HasPrefix(c.ClamdAddress, "tcp://"):
+		return "tcp", strings.TrimPrefix(c.ClamdAddress, "tcp://")
+	case strings.HasPrefix(c.ClamdAddress, "/"):
+		return "unix", c.ClamdAddress
+	default:
+		return "tcp", c.ClamdAddress
+	}
+}
+
+// DownloadHost returns the host of DownloadOrigin, or an empty string without one
+func (c *Config) DownloadHost() string {
+	origin, err := url.Parse(c.DownloadOrigin)
+	if err != nil {
+		return ""
+	}
+	return origin.Host
+}
+
 // Validate validates the configuration
 func (c *Config) Validate() error {
-	// Add validation logic here if needed
+	switch c.StorageBackend {
+	case "local":
+	case "s3":
+		if c.S3Bucket == "" {
+			return fmt.Errorf("S3_BUCKET is required when STORAGE_BACKEND is 's3'")
+		}
+		if c.S3Timeout <= 0 {
+			return fmt.Errorf("S3_TIMEOUT must be positive, got %s", c.S3Timeout)
+		}
+	default:
+		return fmt.Errorf("storage backend must be 'local' or 's3', got '%s'", c.StorageBackend)
+	}
+
+	if c.EncryptionKey != "" && c.EncryptionKeyFile != "" {
+		return fmt.Errorf("set either ENCRYPTION_KEY or ENCRYPTION_KEY_FILE, not both")
+	}
+
+	// The secret is all that keeps links from being forged
+	if c.SignedLinksEnabled() && len(c.LinkSigningSecret) < 32 {
+		return fmt.Errorf("LINK_SIGNING_SECRET must be at least 32 characters long")
+	}
+	if c.SignedLinkExpiry <= 0 {
+		return fmt.Errorf("SIGNED_LINK_EXPIRY must be positive, got %s", c.SignedLinkExpiry)
+	}
+
+	if c.AdminToken != "" && len(c.AdminToken) < 32 {
+		return fmt.Errorf("ADMIN_TOKEN must be at least 32 characters long")
+	}
+
+	if c.DownloadOrigin != "" {
+		origin, err := url.Parse(c.DownloadOrigin)
+		if err != nil || (origin.Scheme != "http" && origin.Scheme != "https") || origin.Host == "" || origin.Path != "" || origin.RawQuery != "" {
+			return fmt.Errorf("DOWNLOAD_ORIGIN must be an origin such as https://dl.example.com, got '%s'", c.DownloadOrigin)
+		}
+		if public, err := url.Parse(c.PublicURL); err == nil && strings.EqualFold(public.Host, origin.Host) {
+			return fmt.Errorf("DOWNLOAD_ORIGIN must differ from the host of PUBLIC_URL")
+		}
+	}
+
+	if c.ScanningEnabled() {
+		network, address := c.ClamdEndpoint()
+		if network == "tcp" {
+			if _, _, err := net.SplitHostPort(address); err != nil {
+				return fmt.Errorf("CLAMD_ADDRESS must be tcp://host:port, host:port, unix:///path or /path, got '%s'", c.ClamdAddress)
+			}
+		} else if address == "" {
+			return fmt.Errorf("CLAMD_ADDRESS must name the path of the unix socket, got '%s'", c.ClamdAddress)
+		}
+		if c.ClamdTimeout <= 0 {
+			return fmt.Errorf("CLAMD_TIMEOUT must be positive, got %s", c.ClamdTimeout)
+		}
+	}
+	switch c.ScanInfectedAction {
+	case "reject", "quarantine":
+	default:
+		return fmt.Errorf("SCAN_INFECTED_ACTION must be 'reject' or 'quarantine', got '%s'", c.ScanInfectedAction)
+	}
+	switch c.ScanFailMode {
+	case "open", "closed":
+	default:
+		return fmt.Errorf("SCAN_FAIL_MODE must be 'open' or 'closed', got '%s'", c.ScanFailMode)
+	}
+	switch c.ScanClientEncrypted {
+	case "", "allow", "reject":
+	default:
+		return fmt.Errorf("SCAN_CLIENT_ENCRYPTED must be 'allow' or 'reject', got '%s'", c.ScanClientEncrypted)
+	}
+
+	if c.MaxFileSize <= 0 || c.MaxRequestSize < c.MaxFileSize {
+		return fmt.Errorf("MAX_FILE_SIZE must be positive and not exceed MAX_REQUEST_SIZE, got %d and %d", c.MaxFileSize, c.MaxRequestSize)
+	}
+	if c.MaxFilesPerUpload <= 0 {
+		return fmt.Errorf("MAX_FILES_PER_UPLOAD must be positive, got %d", c.MaxFilesPerUpload)
+	}
+
+	switch c.TypeMismatchAction {
+	case "allow", "flag", "reject":
+	default:
+		return fmt.Errorf("TYPE_MISMATCH_ACTION must be 'allow', 'flag' or 'reject', got '%s'", c.TypeMismatchAction)
+	}
+	switch c.TypeClientEncrypted {
+	case "allow", "reject":
+	default:
+		return fmt.Errorf("TYPE_CLIENT_ENCRYPTED must be 'allow' or 'reject', got '%s'", c.TypeClientEncrypted)
+	}
+
+	defaultExpiry := time.Duration(c.FileExpiryHours) * time.Hour
+	if c.MinExpiry <= 0 || c.MinExpiry > c.MaxExpiry {
+		return fmt.Errorf("MIN_EXPIRY must be positive and not exceed MAX_EXPIRY, got %s and %s", c.MinExpiry, c.MaxExpiry)
+	}
+	if defaultExpiry > 0 && (defaultExpiry < c.MinExpiry || defaultExpiry > c.MaxExpiry) {
+		return fmt.Errorf("FILE_EXPIRY_HOURS must lie between MIN_EXPIRY and MAX_EXPIRY, got %s", defaultExpiry)
+	}
+
+	if c.EnableTus && c.TusUploadExpiryHours <= 0 {
+		return fmt.Errorf("TUS_UPLOAD_EXPIRY_HOURS must be positive, got %d", c.TusUploadExpiryHours)
+	}
+
+	if c.PasswordMaxAttempts <= 0 || c.PasswordAttemptWindow <= 0 {
+		return fmt.Errorf("PASSWORD_MAX_ATTEMPTS and PASSWORD_ATTEMPT_WINDOW must be positive, got %d and %s", c.PasswordMaxAttempts, c.PasswordAttemptWindow)
+	}
+
 	return nil
 }
 
@@ -163,6 +475,15 @@ func getEnvAsInt64OrDefault(key string, defaultValue int64) int64 {
 	return defaultValue
 }
 
+func getEnvAsDurationOrDefault(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if duration, err := utils.ParseDuration(value); err == nil {
+			return duration
+		}
+	}
+	return defaultValue
+}
+
 func getEnvAsBoolOrDefault(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
 		if boolValue, err := strconv.ParseBool(value); err == nil {
@@ -174,7 +495,13 @@ func getEnvAsBoolOrDefault(key string, defaultValue bool) bool {
 
 func getEnvAsStringSliceOrDefault(key string, defaultValue []string) []string {
 	if value := os.Getenv(key); value != "" {
-		return strings.Split(value, ",")
+		var values []string
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				values = append(values, entry)
+			}
+		}
+		return values
 	}
 	return defaultValue
 }
@@ -0,0 +1,245 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestKey returns a random base64 encoded master key
+func newTestKey(t *testing.T) string {
+	t.Helper()
+
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("rand.Read() error = %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// encrypt returns content encrypted with dataKey
+func encrypt(t *testing.T, content, dataKey []byte) []byte {
+	t.Helper()
+
+	reader, err := NewEncryptReader(bytes.NewReader(content), dataKey)
+	if err != nil {
+		t.Fatalf("NewEncryptReader() error = %v", err)
+	}
+	encrypted, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	return encrypted
+}
+
+func TestKeyring_WrapRewrap(t *testing.T) {
+	oldKey, newKey := newTestKey(t), newTestKey(t)
+
+	old, err := NewKeyring([]string{oldKey})
+	if err != nil {
+		t.Fatalf("NewKeyring() error = %v", err)
+	}
+	dataKey, _ := old.GenerateDataKey()
+
+	wrapped, keyID, err := old.Wrap(dataKey, "blob-a")
+	if err != nil {
+		t.Fatalf("Wrap() error = %v", err)
+	}
+	if _, err := old.Unwrap(wrapped, keyID, "blob-b"); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("Unwrap() with another context error = %v, want %v", err, ErrDecrypt)
+	}
+
+	// After rotation the old key still unwraps, and re-wrapping moves to the new key
+	rotated, err := NewKeyring([]string{newKey, oldKey})
+	if err != nil {
+		t.Fatalf("NewKeyring() error = %v", err)
+	}
+	rewrapped, newKeyID, err := rotated.Rewrap(wrapped, keyID, "blob-a")
+	if err != nil {
+		t.Fatalf("Rewrap() error = %v", err)
+	}
+	if newKeyID == keyID || newKeyID != rotated.CurrentKeyID() {
+		t.Errorf("Rewrap() key ID = %s, want the current key %s", newKeyID, rotated.CurrentKeyID())
+	}
+
+	current, _ := NewKeyring([]string{newKey})
+	got, err := current.Unwrap(rewrapped, newKeyID, "blob-a")
+	if err != nil || !bytes.Equal(got, dataKey) {
+		t.Errorf("Unwrap() = %x, %v, want the original data key", got, err)
+	}
+	if _, err := current.Unwrap(wrapped, keyID, "blob-a"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Unwrap() with a removed key error = %v, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestKeyring_BlobName(t *testing.T) {
+	oldKey, newKey := newTestKey(t), newTestKey(t)
+	digest := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	keyring, err := NewKeyring([]string{oldKey})
+	if err != nil {
+		t.Fatalf("NewKeyring() error = %v", err)
+	}
+	name := keyring.BlobName(digest)
+	if name == digest || len(name) != len(digest) {
+		t.Errorf("BlobName() = %s, want 64 hex digits other than the digest", name)
+	}
+	if again := keyring.BlobName(digest); again != name {
+		t.Errorf("BlobName() = %s, then %s", name, again)
+	}
+
+	// Names follow the current master key
+	rotated, err := NewKeyring([]string{newKey, oldKey})
+	if err != nil {
+		t.Fatalf("NewKeyring() error = %v", err)
+	}
+	if rotated.BlobName(digest) == name {
+		t.Error("BlobName() is the same after rotating the master key")
+	}
+}
+
+func TestNewKeyring_Invalid(t *testing.T) {
+	for _, keys := range [][]string{nil, {"not base64"}, {base64.StdEncoding.EncodeToString([]byte("short"))}} {
+		if _, err := NewKeyring(keys); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("NewKeyring(%q) error = %v, want %v", keys, err, ErrInvalidKey)
+		}
+	}
+}
+
+func TestReadKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte("# current\nAAAA\n\nBBBB\n"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	keys, err := ReadKeyFile(path)
+	if err != nil {
+		t.Fatalf("ReadKeyFile() error = %v", err)
+	}
+	if len(keys) != 2 || keys[0] != "AAAA" || keys[1] != "BBBB" {
+		t.Errorf("ReadKeyFile() = %q, want [AAAA BBBB]", keys)
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	dataKey := make([]byte, KeySize)
+
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 100} {
+		content := make([]byte, size)
+		_, _ = rand.Read(content)
+
+		encrypted := encrypt(t, content, dataKey)
+		if int64(len(encrypted)) != EncryptedSize(int64(size)) {
+			t.Errorf("size %d: encrypted to %d bytes, want %d", size, len(encrypted), EncryptedSize(int64(size)))
+		}
+		if PlainSize(int64(len(encrypted))) != int64(size) {
+			t.Errorf("size %d: PlainSize() = %d", size, PlainSize(int64(len(encrypted))))
+		}
+
+		reader, err := NewDecryptReader(io.NopCloser(bytes.NewReader(encrypted)), dataKey, int64(size))
+		if err != nil {
+			t.Fatalf("NewDecryptReader() error = %v", err)
+		}
+		decrypted, err := io.ReadAll(reader)
+		if err != nil || !bytes.Equal(decrypted, content) {
+			t.Errorf("size %d: decrypted %d bytes, %v, want the original content", size, len(decrypted), err)
+		}
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	dataKey := make([]byte, KeySize)
+	first, second := make([]byte, SaltSize), make([]byte, SaltSize)
+	_, _ = rand.Read(first)
+	_, _ = rand.Read(second)
+
+	key, err := DeriveKey(dataKey, first)
+	if err != nil {
+		t.Fatalf("DeriveKey() error = %v", err)
+	}
+	again, _ := DeriveKey(dataKey, first)
+	other, _ := DeriveKey(dataKey, second)
+	if len(key) != KeySize || !bytes.Equal(key, again) {
+		t.Errorf("DeriveKey() = %x, then %x, want the same %d byte key", key, again, KeySize)
+	}
+	if bytes.Equal(key, other) || bytes.Equal(key, dataKey) {
+		t.Error("DeriveKey() with another salt gave the same key")
+	}
+
+	// The same content sealed under keys of different salts never matches,
+	// though its nonces do
+	if bytes.Equal(encrypt(t, []byte("content"), key), encrypt(t, []byte("content"), other)) {
+		t.Error("content encrypted alike under keys of different salts")
+	}
+
+	if _, err := DeriveKey(dataKey, first[:16]); err == nil {
+		t.Error("DeriveKey() with a short salt error = nil, want an error")
+	}
+}
+
+func TestDecryptRange(t *testing.T) {
+	dataKey := make([]byte, KeySize)
+	content := make([]byte, 3*ChunkSize+100)
+	_, _ = rand.Read(content)
+	encrypted := encrypt(t, content, dataKey)
+
+	var read int64
+	open := func(offset, length int64) (io.ReadCloser, error) {
+		read = length
+		return io.NopCloser(bytes.NewReader(encrypted[offset : offset+length])), nil
+	}
+
+	tests := []struct {
+		offset, length int64
+		wantRead       int64
+	}{
+		{0, 10, encryptedChunkSize},
+		{ChunkSize - 5, 10, 2 * encryptedChunkSize},
+		{2*ChunkSize + 1, ChunkSize + 99, encryptedChunkSize + 100 + Overhead},
+		{ChunkSize, 0, encryptedChunkSize},
+	}
+
+	for _, tt := range tests {
+		reader, err := DecryptRange(open, dataKey, int64(len(content)), tt.offset, tt.length)
+		if err != nil {
+			t.Fatalf("DecryptRange(%d, %d) error = %v", tt.offset, tt.length, err)
+		}
+		got, err := io.ReadAll(reader)
+		if err != nil || !bytes.Equal(got, content[tt.offset:tt.offset+tt.length]) {
+			t.Errorf("DecryptRange(%d, %d) = %d bytes, %v, want the matching content", tt.offset, tt.length, len(got), err)
+		}
+		if read != tt.wantRead {
+			t.Errorf("DecryptRange(%d, %d) read %d stored bytes, want %d", tt.offset, tt.length, read, tt.wantRead)
+		}
+	}
+}
+
+func TestDecrypt_Tampered(t *testing.T) {
+	dataKey := make([]byte, KeySize)
+	content := bytes.Repeat([]byte("x"), 2*ChunkSize)
+	encrypted := encrypt(t, content, dataKey)
+
+	flipped := bytes.Clone(encrypted)
+	flipped[10] ^= 1
+
+	// Dropping the final chunk must not pass for the complete content
+	truncated := encrypted[:encryptedChunkSize]
+
+	for name, stored := range map[string][]byte{"Flipped": flipped, "Truncated": truncated} {
+		reader, _ := NewDecryptReader(io.NopCloser(bytes.NewReader(stored)), dataKey, int64(len(content)))
+		if _, err := io.ReadAll(reader); err == nil {
+			t.Errorf("%s: ReadAll() error = nil, want an error", name)
+		}
+	}
+
+	// A truncated file claiming to be shorter fails on the missing final flag
+	reader, _ := NewDecryptReader(io.NopCloser(bytes.NewReader(truncated)), dataKey, ChunkSize)
+	if _, err := io.ReadAll(reader); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("ReadAll() error = %v, want %v", err, ErrDecrypt)
+	}
+}
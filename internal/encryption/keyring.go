@@ -0,0 +1,204 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeySize is the size of master and data keys, for AES-256
+const KeySize = 32
+
+// SaltSize is the size of the random salts keys are derived with
+const SaltSize = 32
+
+var (
+	// ErrInvalidKey indicates a master key that is not 32 base64 encoded bytes
+	ErrInvalidKey = errors.New("invalid encryption key")
+
+	// ErrUnknownKey indicates a data key wrapped with a master key that is not configured
+	ErrUnknownKey = errors.New("unknown encryption key")
+
+	// ErrDecrypt indicates content or a data key that fails authentication
+	ErrDecrypt = errors.New("decryption failed")
+)
+
+// Keyring holds the master keys that wrap the per-file data keys. New data
+// keys are wrapped with the current key; the previous keys only unwrap data
+// keys that have not been re-wrapped yet
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+
+	// nameKey is derived from the current master key to name encrypted blobs
+	nameKey []byte
+}
+
+// NewKeyring creates a keyring from base64 encoded 32 byte master keys. The
+// first key is the current one, any others are previous keys
+func NewKeyring(encodedKeys []string) (*Keyring, error) {
+	if len(encodedKeys) == 0 {
+		return nil, ErrInvalidKey
+	}
+
+	keyring := &Keyring{keys: make(map[string]cipher.AEAD, len(encodedKeys))}
+	for i, encoded := range encodedKeys {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(key) != KeySize {
+			return nil, fmt.Errorf("%w: key %d must be %d base64 encoded bytes", ErrInvalidKey, i+1, KeySize)
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+
+		id := keyID(key)
+		if i == 0 {
+			keyring.current = id
+			if keyring.nameKey, err = hkdf.Key(sha256.New, key, nil, "tempfile-blob-name", KeySize); err != nil {
+				return nil, fmt.Errorf("failed to derive key: %w", err)
+			}
+		}
+		keyring.keys[id] = aead
+	}
+
+	return keyring, nil
+}
+
+// ReadKeyFile reads master keys from a file holding one base64 encoded key
+// per line, the current key first. Empty lines and lines starting with # are skipped
+func ReadKeyFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	var keys []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+
+	return keys, nil
+}
+
+// CurrentKeyID returns the ID of the master key new data keys are wrapped with
+func (k *Keyring) CurrentKeyID() string {
+	return k.current
+}
+
+// BlobName returns the name of the encrypted blob holding content with the
+// given digest, an HMAC of the digest keyed by the current master key. Unlike
+// the digest itself, it does not tell anyone who can list the storage whether
+// some known content is stored
+func (k *Keyring) BlobName(digest string) string {
+	mac := hmac.New(sha256.New, k.nameKey)
+	mac.Write([]byte(digest))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// GenerateDataKey returns a new random data key
+func (k *Keyring) GenerateDataKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	return key, nil
+}
+
+// Wrap encrypts a data key with the current master key, returning it base64
+// encoded together with the ID of the master key. context is authenticated
+// along with the key, so it can only be unwrapped for the same context
+func (k *Keyring) Wrap(dataKey []byte, context string) (string, string, error) {
+	aead := k.keys[k.current]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := aead.Seal(nonce, nonce, dataKey, []byte(context))
+	return base64.StdEncoding.EncodeToString(sealed), k.current, nil
+}
+
+// Unwrap decrypts a data key wrapped by Wrap with the master key keyID
+func (k *Keyring) Unwrap(wrapped, keyID, context string) ([]byte, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+
+	dataKey, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(context))
+	if err != nil || len(dataKey) != KeySize {
+		return nil, ErrDecrypt
+	}
+
+	return dataKey, nil
+}
+
+// Rewrap re-encrypts a data key with the current master key. Data keys that
+// already use it are returned unchanged
+func (k *Keyring) Rewrap(wrapped, keyID, context string) (string, string, error) {
+	if keyID == k.current {
+		return wrapped, keyID, nil
+	}
+
+	dataKey, err := k.Unwrap(wrapped, keyID, context)
+	if err != nil {
+		return "", "", err
+	}
+
+	return k.Wrap(dataKey, context)
+}
+
+// DeriveKey returns a key derived from dataKey and salt with HKDF-SHA256.
+// Content sealed in independent pieces under one data key must use a key
+// derived with a fresh random salt for each piece: the nonces of every piece
+// count from zero, and must never repeat under the same key
+func DeriveKey(dataKey, salt []byte) ([]byte, error) {
+	if len(salt) != SaltSize {
+		return nil, fmt.Errorf("salt must be %d bytes, got %d", SaltSize, len(salt))
+	}
+
+	key, err := hkdf.Key(sha256.New, dataKey, salt, "tempfile-derived-key", KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+
+	return key, nil
+}
+
+// keyID identifies a master key without revealing it
+func keyID(key []byte) string {
+	sum := sha256.Sum256(append([]byte("tempfile-key-id:"), key...))
+	return hex.EncodeToString(sum[:8])
+}
+
+// newAEAD returns AES-256-GCM for key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	return cipher.NewGCM(block)
+}
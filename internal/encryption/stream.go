@@ -0,0 +1,247 @@
+package encryption
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Content is encrypted in chunks of ChunkSize bytes, each sealed on its own
+// with AES-256-GCM. The nonce of a chunk is its index plus a flag marking the
+// final chunk, so chunks can neither be reordered nor cut off unnoticed, and
+// any range can be decrypted by reading only the chunks it spans
+const (
+	// ChunkSize is the amount of plaintext sealed per chunk
+	ChunkSize = 64 * 1024
+
+	// Overhead is what sealing adds to every chunk, the GCM tag
+	Overhead = 16
+
+	// encryptedChunkSize is the stored size of a full chunk
+	encryptedChunkSize = ChunkSize + Overhead
+)
+
+// EncryptedSize returns the stored size of plainSize bytes of content. Even
+// empty content is stored as one sealed chunk
+func EncryptedSize(plainSize int64) int64 {
+	return plainSize + chunkCount(plainSize)*Overhead
+}
+
+// PlainSize returns the size of the content stored as encryptedSize bytes,
+// or -1 if no content encrypts to that size
+func PlainSize(encryptedSize int64) int64 {
+	chunks := (encryptedSize + encryptedChunkSize - 1) / encryptedChunkSize
+	plainSize := encryptedSize - chunks*Overhead
+	if chunks == 0 || plainSize < 0 || EncryptedSize(plainSize) != encryptedSize {
+		return -1
+	}
+
+	return plainSize
+}
+
+// chunkCount returns how many chunks plainSize bytes of content are sealed in
+func chunkCount(plainSize int64) int64 {
+	if plainSize <= 0 {
+		return 1
+	}
+	return (plainSize + ChunkSize - 1) / ChunkSize
+}
+
+// chunkNonce returns the nonce of the chunk at index
+func chunkNonce(index int64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptReader encrypts the content read from src chunk by chunk
+type encryptReader struct {
+	src   *bufio.Reader
+	aead  cipher.AEAD
+	index int64
+	plain []byte
+	buf   []byte
+	out   []byte
+	done  bool
+}
+
+// NewEncryptReader returns a reader of the content read from r, encrypted with dataKey
+func NewEncryptReader(r io.Reader, dataKey []byte) (io.Reader, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptReader{
+		src:   bufio.NewReader(r),
+		aead:  aead,
+		plain: make([]byte, ChunkSize),
+		buf:   make([]byte, 0, encryptedChunkSize),
+	}, nil
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.seal(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// seal reads and encrypts the next chunk
+func (r *encryptReader) seal() error {
+	n, err := io.ReadFull(r.src, r.plain)
+
+	final := false
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		final = true
+	case err != nil:
+		return err
+	default:
+		// A full chunk is only the final one if nothing follows it
+		if _, err := r.src.Peek(1); errors.Is(err, io.EOF) {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	r.out = r.aead.Seal(r.buf[:0], chunkNonce(r.index, final), r.plain[:n], nil)
+	r.index++
+	r.done = final
+	return nil
+}
+
+// decryptReader decrypts a run of chunks, returning only the requested range
+type decryptReader struct {
+	src       io.ReadCloser
+	aead      cipher.AEAD
+	index     int64
+	last      int64
+	skip      int64
+	remaining int64
+	buf       []byte
+	out       []byte
+}
+
+// NewDecryptReader returns a reader of the plainSize bytes of content read
+// encrypted from r. Closing it closes r
+func NewDecryptReader(r io.ReadCloser, dataKey []byte, plainSize int64) (io.ReadCloser, error) {
+	return newDecryptReader(r, dataKey, plainSize, 0, plainSize)
+}
+
+// DecryptRange returns a reader of length bytes starting at offset of content
+// with plainSize bytes, encrypted with dataKey. open opens a byte range of the
+// stored content, of which only the chunks spanning the range are read
+func DecryptRange(open func(offset, length int64) (io.ReadCloser, error), dataKey []byte, plainSize, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 || length < 0 || offset+length > plainSize {
+		return nil, fmt.Errorf("range %d+%d outside content of %d bytes", offset, length, plainSize)
+	}
+
+	first := offset / ChunkSize
+	end := first
+	if length > 0 {
+		end = (offset + length - 1) / ChunkSize
+	}
+
+	start := first * encryptedChunkSize
+	stop := min((end+1)*encryptedChunkSize, EncryptedSize(plainSize))
+
+	src, err := open(start, stop-start)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := newDecryptReader(src, dataKey, plainSize, first, length)
+	if err != nil {
+		_ = src.Close()
+		return nil, err
+	}
+	reader.skip = offset - first*ChunkSize
+
+	return reader, nil
+}
+
+// newDecryptReader returns a reader decrypting chunks from src, starting at the
+// chunk at index first, and returning length bytes
+func newDecryptReader(src io.ReadCloser, dataKey []byte, plainSize, first, length int64) (*decryptReader, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		src:       src,
+		aead:      aead,
+		index:     first,
+		last:      chunkCount(plainSize) - 1,
+		remaining: length,
+		buf:       make([]byte, encryptedChunkSize),
+	}, nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.remaining <= 0 {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	r.remaining -= int64(n)
+	return n, nil
+}
+
+// open reads and decrypts the next chunk
+func (r *decryptReader) open() error {
+	n, err := io.ReadFull(r.src, r.buf)
+	if errors.Is(err, io.ErrUnexpectedEOF) && r.index == r.last {
+		err = nil
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	plain, err := r.aead.Open(r.buf[:0], chunkNonce(r.index, r.index == r.last), r.buf[:n], nil)
+	if err != nil {
+		return ErrDecrypt
+	}
+	r.index++
+
+	if r.skip > 0 {
+		skip := min(r.skip, int64(len(plain)))
+		plain = plain[skip:]
+		r.skip -= skip
+	}
+	if int64(len(plain)) > r.remaining {
+		plain = plain[:r.remaining]
+	}
+
+	r.out = plain
+	return nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.src.Close()
+}
@@ -1,12 +1,14 @@
 package handlers
 
 import (
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/pandeptwidyaop/tempfile/internal/config"
 	"github.com/pandeptwidyaop/tempfile/internal/models"
 	"github.com/pandeptwidyaop/tempfile/internal/services"
+	"github.com/pandeptwidyaop/tempfile/internal/utils"
 )
 
 // APIHandler handles API endpoints
@@ -23,14 +25,50 @@ func NewAPIHandler(cfg *config.Config, uploadSvc *services.UploadService) *APIHa
 	}
 }
 
-// UploadFile handles API file upload
+// UploadFile handles API file upload. Bodies that are not multipart forms are
+// stored as they are, like UploadRaw
 func (h *APIHandler) UploadFile(c *fiber.Ctx) error {
-	result, err := h.uploadService.ProcessFileUpload(c)
+	if !isMultipartRequest(c) {
+		return h.UploadRaw(c)
+	}
+
+	results, err := h.uploadService.ProcessFileUploads(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(uploadResponseBody(results))
+}
+
+// UploadRaw handles an upload sent as the raw request body (PUT /:filename or
+// a non-multipart POST /)
+func (h *APIHandler) UploadRaw(c *fiber.Ctx) error {
+	return rawUpload(c, h.config, h.uploadService)
+}
+
+// rawUpload stores the raw request body under the filename from the path or
+// the X-Filename header. The response is the download URL as plain text, or
+// the usual JSON when the client asks for it
+func rawUpload(c *fiber.Ctx, cfg *config.Config, uploadService *services.UploadService) error {
+	name := c.Params("filename")
+	if name == "" {
+		name = c.Get("X-Filename")
+	}
+
+	result, err := uploadService.ProcessRawUpload(c, name)
 	if err != nil {
 		return err
 	}
 
-	// Convert to API response format
+	if c.Accepts(fiber.MIMETextPlain, fiber.MIMEApplicationJSON) == fiber.MIMEApplicationJSON {
+		return c.JSON(uploadResponseMap(result))
+	}
+
+	return c.SendString(utils.GetBaseURL(c, cfg.PublicURL) + result.DownloadURL + "\n")
+}
+
+// uploadResponseMap converts an upload result to the API response format
+func uploadResponseMap(result *models.UploadResponse) fiber.Map {
 	response := fiber.Map{
 		"message":       result.Message,
 		"filename":      result.Filename,
@@ -39,10 +77,55 @@ func (h *APIHandler) UploadFile(c *fiber.Ctx) error {
 		"size_human":    result.SizeHuman,
 		"expires_at":    result.ExpiresAt.Format(time.RFC3339),
 		"expires_in":    result.ExpiresIn,
+		"sha256":        result.SHA256,
+		"content_type":  result.ContentType,
 		"download_url":  result.DownloadURL,
+		"delete_token":  result.DeleteToken,
+		"delete_url":    result.DeleteURL,
 	}
 
-	return c.JSON(response)
+	if result.MaxDownloads > 0 {
+		response["max_downloads"] = result.MaxDownloads
+	}
+	if result.Protected {
+		response["password_protected"] = true
+	}
+	if result.ClientEncrypted {
+		response["client_encrypted"] = true
+	}
+	if result.TypeMismatch {
+		response["type_mismatch"] = true
+	}
+	if result.ScanStatus != "" {
+		response["scan_status"] = result.ScanStatus
+	}
+	if result.CollectionID != "" {
+		response["collection_id"] = result.CollectionID
+		response["collection_url"] = result.CollectionURL
+	}
+
+	return response
+}
+
+// uploadResponseBody converts the results of a multipart upload to the API
+// response format: an object for a single file, as before multiple files were
+// accepted, and an array of them for several files
+func uploadResponseBody(results []*models.UploadResponse) interface{} {
+	if len(results) == 1 {
+		return uploadResponseMap(results[0])
+	}
+
+	response := make([]fiber.Map, 0, len(results))
+	for _, result := range results {
+		response = append(response, uploadResponseMap(result))
+	}
+
+	return response
+}
+
+// isMultipartRequest reports whether the request body is a multipart form
+func isMultipartRequest(c *fiber.Ctx) bool {
+	return strings.HasPrefix(strings.ToLower(c.Get("Content-Type")), fiber.MIMEMultipartForm)
 }
 
 // HealthCheck handles health check endpoint
@@ -0,0 +1,805 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandeptwidyaop/tempfile/internal/config"
+	"github.com/pandeptwidyaop/tempfile/internal/encryption"
+	"github.com/pandeptwidyaop/tempfile/internal/metadata"
+	"github.com/pandeptwidyaop/tempfile/internal/middleware"
+	"github.com/pandeptwidyaop/tempfile/internal/models"
+	"github.com/pandeptwidyaop/tempfile/internal/services"
+	"github.com/pandeptwidyaop/tempfile/internal/storage"
+	"github.com/pandeptwidyaop/tempfile/internal/utils"
+	"github.com/pandeptwidyaop/tempfile/web"
+)
+
+// newTestUploadApp returns an app serving uploads, their management and collections
+func newTestUploadApp(t *testing.T) (*fiber.App, *services.FileService) {
+	backend, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+
+	return newTestUploadAppWithBackend(t, backend)
+}
+
+// newTestUploadAppWithBackend returns the app of newTestUploadApp storing files in backend
+func newTestUploadAppWithBackend(t *testing.T, backend storage.Backend) (*fiber.App, *services.FileService) {
+	return newTestUploadAppWithConfig(t, backend, newTestUploadConfig())
+}
+
+// newTestUploadConfig returns the configuration of the upload test app
+func newTestUploadConfig() *config.Config {
+	return &config.Config{
+		PublicURL:         "https://files.example.com",
+		MaxFileSize:       16,
+		MaxRequestSize:    24,
+		MaxFilesPerUpload: 3,
+		FileExpiryHours:   1,
+		MinExpiry:         10 * time.Minute,
+		MaxExpiry:         72 * time.Hour,
+	}
+}
+
+// newTestUploadAppWithConfig returns the upload test app configured with cfg,
+// encrypting content at rest if cfg sets an encryption key
+func newTestUploadAppWithConfig(t *testing.T, backend storage.Backend, cfg *config.Config) (*fiber.App, *services.FileService) {
+	var keyring *encryption.Keyring
+	if cfg.EncryptionKey != "" {
+		var err error
+		if keyring, err = encryption.NewKeyring(append([]string{cfg.EncryptionKey}, cfg.EncryptionPreviousKeys...)); err != nil {
+			t.Fatalf("NewKeyring() error = %v", err)
+		}
+	}
+
+	fileService := services.NewFileService(cfg, backend, metadata.NewSidecarStore(backend), metadata.NewBlobStore(backend), keyring)
+	collectionService := services.NewCollectionService(cfg, fileService, metadata.NewCollectionStore(backend))
+	apiHandler := NewAPIHandler(cfg, services.NewUploadService(cfg, fileService, collectionService))
+
+	templateService := services.NewTemplateService(cfg, web.TemplateFiles)
+	if err := templateService.Initialize(); err != nil {
+		t.Fatalf("Initialize() error = %v", err)
+	}
+	fileHandler := NewFileHandler(cfg, fileService, templateService, newTestAttemptLimiter(t))
+	collectionHandler := NewCollectionHandler(cfg, collectionService, fileService, nil)
+
+	// Request bodies are streamed like in production, but the limits on the
+	// whole body leave room for the multipart overhead of small test files
+	app := fiber.New(fiber.Config{
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+	})
+	app.Use(middleware.NewStreamedBodyGuard(fiber.DefaultBodyLimit))
+	if cfg.DownloadOrigin != "" {
+		app.Use(middleware.NewDownloadOriginGuard(cfg.DownloadHost()))
+	}
+	app.Post("/", apiHandler.UploadFile)
+	app.Put("/:filename", apiHandler.UploadRaw)
+	app.Post("/api/collections", collectionHandler.CreateCollection)
+	app.Get("/c/:id", collectionHandler.ViewCollection)
+	app.Get("/c/:id/zip", collectionHandler.DownloadCollection)
+	app.Get("/api/collections/:id/archive", collectionHandler.DownloadCollection)
+	app.Get("/api/archive", fileHandler.DownloadArchive)
+	app.Get("/:filename/delete", fileHandler.DeletePage)
+	app.Post("/:filename/delete", fileHandler.ConfirmDelete)
+	app.Delete("/:filename", fileHandler.DeleteFile)
+	app.Patch("/api/files/:id", fileHandler.UpdateFile)
+	app.Post("/api/files/:id/links", fileHandler.CreateLink)
+	app.Get("/api/stats", fileHandler.Stats)
+	if cfg.EnableLandingPage {
+		app.Get("/oembed", fileHandler.OEmbed)
+	}
+	app.Get("/:filename/raw", fileHandler.DownloadRaw)
+	app.Post("/:filename/raw", fileHandler.DownloadRaw)
+	app.Get("/:filename", fileHandler.DownloadFile)
+	app.Post("/:filename", fileHandler.DownloadFile)
+
+	return app, fileService
+}
+
+func TestUploadRaw_PlainText(t *testing.T) {
+	app, fileService := newTestUploadApp(t)
+
+	req := httptest.NewRequest("PUT", "/build.log", strings.NewReader("all green"))
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != 200 {
+		t.Fatalf("status = %d, want 200 (%s)", resp.StatusCode, body)
+	}
+
+	url := strings.TrimSpace(string(body))
+	if !strings.HasPrefix(url, "https://files.example.com/") || !strings.HasSuffix(url, ".log") {
+		t.Fatalf("body = %q, want a download URL ending in .log", body)
+	}
+
+	record, err := fileService.Lookup(strings.TrimPrefix(url, "https://files.example.com/"))
+	if err != nil {
+		t.Fatalf("Lookup() error = %v", err)
+	}
+	if record.OriginalName != "build.log" || record.Size != 9 {
+		t.Errorf("record = %+v, want build.log with 9 bytes", record)
+	}
+}
+
+func TestUploadRaw_JSON(t *testing.T) {
+	app, _ := newTestUploadApp(t)
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader("{}"))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Filename", "report.json")
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if result["original_name"] != "report.json" {
+		t.Errorf("original_name = %v, want report.json", result["original_name"])
+	}
+	if result["size"] != float64(2) {
+		t.Errorf("size = %v, want 2", result["size"])
+	}
+}
+
+func TestUploadRaw_Rejected(t *testing.T) {
+	app, _ := newTestUploadApp(t)
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"Empty", ""},
+		{"TooLarge", strings.Repeat("x", 17)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("PUT", "/data.bin", strings.NewReader(tt.body))
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("app.Test() error = %v", err)
+			}
+			if resp.StatusCode != 400 {
+				t.Errorf("status = %d, want 400", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestUploadRaw_Expiry(t *testing.T) {
+	app, fileService := newTestUploadApp(t)
+
+	tests := []struct {
+		name      string
+		expiresIn string
+		want      time.Duration
+	}{
+		{"Default", "", time.Hour},
+		{"Duration", "6h", 6 * time.Hour},
+		{"Days", "2d", 48 * time.Hour},
+		{"Absolute", time.Now().Add(3 * time.Hour).UTC().Format(time.RFC3339), 3 * time.Hour},
+		{"ClampedToMin", "1m", 10 * time.Minute},
+		{"ClampedToMax", "30d", 72 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("PUT", "/notes.txt", strings.NewReader("hi"))
+			req.Header.Set("X-Expires-In", tt.expiresIn)
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("app.Test() error = %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != 200 {
+				t.Fatalf("status = %d, want 200 (%s)", resp.StatusCode, body)
+			}
+
+			record, err := fileService.Lookup(strings.TrimPrefix(strings.TrimSpace(string(body)), "https://files.example.com/"))
+			if err != nil {
+				t.Fatalf("Lookup() error = %v", err)
+			}
+			if got := record.ExpiresAt.Sub(record.CreatedAt); got < tt.want-time.Second || got > tt.want+time.Second {
+				t.Errorf("expiry = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadFile_ExpiresInField(t *testing.T) {
+	app, _ := newTestUploadApp(t)
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	part, _ := writer.CreateFormFile("file", "notes.txt")
+	_, _ = part.Write([]byte("hi"))
+	_ = writer.WriteField("expires_in", "90m")
+	_ = writer.Close()
+
+	req := httptest.NewRequest("POST", "/", &buf)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if result["expires_in"] != "1 hour 30 minutes" {
+		t.Errorf("expires_in = %v, want 1 hour 30 minutes", result["expires_in"])
+	}
+}
+
+// newMultipartUpload builds a multipart upload of the given files, keyed by
+// field and filename, with one file part per entry
+func newMultipartUpload(t *testing.T, files [][3]string) *http.Request {
+	t.Helper()
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	for _, file := range files {
+		part, err := writer.CreateFormFile(file[0], file[1])
+		if err != nil {
+			t.Fatalf("CreateFormFile() error = %v", err)
+		}
+		_, _ = part.Write([]byte(file[2]))
+	}
+	_ = writer.Close()
+
+	req := httptest.NewRequest("POST", "/", &buf)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	return req
+}
+
+func TestUploadFile_MultipleFiles(t *testing.T) {
+	app, fileService := newTestUploadApp(t)
+
+	req := newMultipartUpload(t, [][3]string{
+		{"file", "a.txt", "alpha"},
+		{"files[]", "b.txt", "bravo!"},
+	})
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	var results []map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+
+	for i, want := range []struct {
+		name string
+		size int64
+	}{{"a.txt", 5}, {"b.txt", 6}} {
+		record, err := fileService.Lookup(results[i]["filename"].(string))
+		if err != nil {
+			t.Fatalf("Lookup(%v) error = %v", results[i]["filename"], err)
+		}
+		if record.OriginalName != want.name || record.Size != want.size {
+			t.Errorf("record %d = %+v, want %s with %d bytes", i, record, want.name, want.size)
+		}
+		if results[i]["delete_token"] == "" {
+			t.Errorf("result %d has no delete token", i)
+		}
+	}
+}
+
+func TestUploadFile_MultipleFilesRejected(t *testing.T) {
+	app, _ := newTestUploadApp(t)
+
+	tests := []struct {
+		name  string
+		files [][3]string
+	}{
+		{"None", nil},
+		{"TooMany", [][3]string{{"file", "a", "a"}, {"file", "b", "b"}, {"file", "c", "c"}, {"file", "d", "d"}}},
+		{"FileTooLarge", [][3]string{{"file", "a", "a"}, {"file", "big", strings.Repeat("x", 17)}}},
+		{"RequestTooLarge", [][3]string{{"file", "a", strings.Repeat("x", 12)}, {"files[]", "b", strings.Repeat("x", 13)}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := app.Test(newMultipartUpload(t, tt.files))
+			if err != nil {
+				t.Fatalf("app.Test() error = %v", err)
+			}
+			if resp.StatusCode != 400 {
+				t.Errorf("status = %d, want 400", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestUpload_StreamedLimits(t *testing.T) {
+	backend, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+	app, fileService := newTestUploadAppWithBackend(t, backend)
+
+	// Without a Content-Length the size is only known once the body has arrived
+	chunked := func(body string) *http.Request {
+		req := httptest.NewRequest("PUT", "/data.bin", strings.NewReader(body))
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+		return req
+	}
+
+	tests := []struct {
+		name string
+		req  *http.Request
+	}{
+		{"ChunkedTooLarge", chunked(strings.Repeat("x", 17))},
+		{"FileTooLarge", newMultipartUpload(t, [][3]string{{"file", "a", "a"}, {"file", "big", strings.Repeat("x", 17)}})},
+		{"RequestTooLarge", newMultipartUpload(t, [][3]string{{"file", "a", strings.Repeat("x", 12)}, {"files[]", "b", strings.Repeat("x", 13)}})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := app.Test(tt.req)
+			if err != nil {
+				t.Fatalf("app.Test() error = %v", err)
+			}
+			if resp.StatusCode != 400 {
+				t.Errorf("status = %d, want 400", resp.StatusCode)
+			}
+		})
+	}
+
+	// Nothing received by a rejected upload is left behind
+	objects, err := backend.List("")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(objects) != 0 {
+		t.Errorf("storage holds %d objects after rejected uploads, want 0", len(objects))
+	}
+
+	resp, err := app.Test(chunked(strings.Repeat("x", 16)))
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		t.Fatalf("status = %d, want 200 (%s)", resp.StatusCode, body)
+	}
+
+	record, err := fileService.Lookup(strings.TrimPrefix(strings.TrimSpace(string(body)), "https://files.example.com/"))
+	if err != nil {
+		t.Fatalf("Lookup() error = %v", err)
+	}
+	if record.Size != 16 {
+		t.Errorf("size = %d, want 16", record.Size)
+	}
+}
+
+func TestUploadRaw_InvalidExpiry(t *testing.T) {
+	app, _ := newTestUploadApp(t)
+
+	req := httptest.NewRequest("PUT", "/notes.txt", strings.NewReader("hi"))
+	req.Header.Set("X-Expires-In", "tomorrow")
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	if resp.StatusCode != 400 {
+		t.Errorf("status = %d, want 400", resp.StatusCode)
+	}
+}
+
+// helloSHA256 is the SHA-256 digest of "hello"
+const helloSHA256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+func TestUploadRaw_ContentDigest(t *testing.T) {
+	app, fileService := newTestUploadApp(t)
+
+	tests := []struct {
+		name       string
+		digest     string
+		wantStatus int
+	}{
+		{"None", "", 200},
+		{"Match", "sha-256=:LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=:", 200},
+		{"Mismatch", "sha-256=:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=:", 400},
+		{"Malformed", "sha-256=:hello:", 400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("PUT", "/hello.txt", strings.NewReader("hello"))
+			req.Header.Set("Accept", "application/json")
+			if tt.digest != "" {
+				req.Header.Set("Content-Digest", tt.digest)
+			}
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("app.Test() error = %v", err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus != 200 {
+				return
+			}
+
+			var result map[string]interface{}
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if result["sha256"] != helloSHA256 {
+				t.Errorf("sha256 = %v, want %s", result["sha256"], helloSHA256)
+			}
+
+			record, err := fileService.Lookup(result["filename"].(string))
+			if err != nil {
+				t.Fatalf("Lookup() error = %v", err)
+			}
+			if record.SHA256 != helloSHA256 {
+				t.Errorf("stored sha256 = %q, want %s", record.SHA256, helloSHA256)
+			}
+		})
+	}
+}
+
+func TestUploadFile_SHA256Field(t *testing.T) {
+	app, _ := newTestUploadApp(t)
+
+	upload := func(digests ...string) *http.Response {
+		var buf bytes.Buffer
+		writer := multipart.NewWriter(&buf)
+		for _, name := range []string{"a.txt", "b.txt"} {
+			part, _ := writer.CreateFormFile("files[]", name)
+			_, _ = part.Write([]byte("hello"))
+		}
+		for _, digest := range digests {
+			_ = writer.WriteField("sha256", digest)
+		}
+		_ = writer.Close()
+
+		req := httptest.NewRequest("POST", "/", &buf)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test() error = %v", err)
+		}
+		return resp
+	}
+
+	if resp := upload(helloSHA256, strings.ToUpper(helloSHA256)); resp.StatusCode != 200 {
+		t.Fatalf("matching digests status = %d, want 200", resp.StatusCode)
+	}
+
+	// A mismatch in any file rejects the whole upload
+	for _, digests := range [][]string{
+		{helloSHA256, strings.Repeat("0", 64)},
+		{helloSHA256},
+		{helloSHA256, "not a digest"},
+	} {
+		if resp := upload(digests...); resp.StatusCode != 400 {
+			t.Errorf("digests %q status = %d, want 400", digests, resp.StatusCode)
+		}
+	}
+}
+
+func TestUploadRaw_ClientEncrypted(t *testing.T) {
+	app, fileService := newTestUploadApp(t)
+
+	req := httptest.NewRequest("PUT", "/secret.pdf", strings.NewReader("ciphertext"))
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/pdf")
+	req.Header.Set("X-Client-Encrypted", "1")
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if result["client_encrypted"] != true {
+		t.Errorf("client_encrypted = %v, want true", result["client_encrypted"])
+	}
+
+	// The claimed type says nothing about encrypted content
+	record, err := fileService.Lookup(result["filename"].(string))
+	if err != nil {
+		t.Fatalf("Lookup() error = %v", err)
+	}
+	if !record.ClientEncrypted || record.ContentType != "application/octet-stream" {
+		t.Errorf("record = %+v, want a client encrypted octet stream", record)
+	}
+}
+
+func TestUpload_FileTypes(t *testing.T) {
+	const exe = "MZ\x90\x00\x03\x00"
+
+	tests := []struct {
+		name         string
+		configure    func(cfg *config.Config)
+		filename     string
+		content      string
+		encrypted    bool
+		wantStatus   int
+		wantType     string
+		wantMismatch bool
+	}{
+		{"Detected", nil, "photo.jpg", "\x89PNG\r\n\x1a\n", false, 200, "image/png", false},
+		{"Extension", nil, "notes.csv", "a,b\n1,2\n", false, 200, "text/csv; charset=utf-8", false},
+		{"MismatchFlagged", nil, "photo.jpg", exe, false, 200, utils.TypePE, true},
+		{"MismatchAllowed", func(cfg *config.Config) { cfg.TypeMismatchAction = "allow" }, "photo.jpg", exe, false, 200, utils.TypePE, false},
+		{"MismatchRejected", func(cfg *config.Config) { cfg.TypeMismatchAction = "reject" }, "photo.jpg", exe, false, 415, "", false},
+		{"DeniedType", func(cfg *config.Config) { cfg.DeniedTypes = []string{utils.TypeELF} }, "tool", "\x7fELF\x02\x01", false, 415, "", false},
+		{"DeniedExtension", func(cfg *config.Config) { cfg.DeniedExtensions = []string{"exe"} }, "setup.exe", "hello", false, 415, "", false},
+		{"NotAllowedType", func(cfg *config.Config) { cfg.AllowedTypes = []string{"image/*"} }, "notes.txt", "hello", false, 415, "", false},
+		{"AllowedType", func(cfg *config.Config) { cfg.AllowedTypes = []string{"image/*"} }, "photo.png", "\x89PNG\r\n\x1a\n", false, 200, "image/png", false},
+		{"NotAllowedExtension", func(cfg *config.Config) { cfg.AllowedExtensions = []string{".png"} }, "notes.txt", "hello", false, 415, "", false},
+		{"ClientEncrypted", func(cfg *config.Config) { cfg.TypeMismatchAction = "reject" }, "photo.jpg", exe, true, 200, "application/octet-stream", false},
+		{"ClientEncryptedDeniedType", func(cfg *config.Config) { cfg.DeniedTypes = []string{utils.TypePE} }, "photo.jpg", exe, true, 415, "", false},
+		{"ClientEncryptedNotAllowedType", func(cfg *config.Config) { cfg.AllowedTypes = []string{"image/*"} }, "photo.jpg", "\x89PNG\r\n\x1a\n", true, 415, "", false},
+		{"ClientEncryptedTypeAllowed", func(cfg *config.Config) { cfg.DeniedTypes, cfg.TypeClientEncrypted = []string{utils.TypePE}, "allow" }, "photo.jpg", exe, true, 200, "application/octet-stream", false},
+		{"ClientEncryptedDeniedExtension", func(cfg *config.Config) { cfg.DeniedExtensions = []string{"exe"} }, "setup.exe", exe, true, 415, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend, err := storage.NewLocalBackend(t.TempDir())
+			if err != nil {
+				t.Fatalf("NewLocalBackend() error = %v", err)
+			}
+			cfg := newTestUploadConfig()
+			if tt.configure != nil {
+				tt.configure(cfg)
+			}
+			app, _ := newTestUploadAppWithConfig(t, backend, cfg)
+
+			req := httptest.NewRequest("PUT", "/"+tt.filename, strings.NewReader(tt.content))
+			req.Header.Set("Accept", "application/json")
+			if tt.encrypted {
+				req.Header.Set("X-Client-Encrypted", "1")
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("app.Test() error = %v", err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("status = %d, want %d (%s)", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantStatus != 200 {
+				return
+			}
+
+			var uploaded models.UploadResponse
+			if err := json.NewDecoder(resp.Body).Decode(&uploaded); err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if uploaded.ContentType != tt.wantType || uploaded.TypeMismatch != tt.wantMismatch {
+				t.Errorf("content_type = %q, type_mismatch = %v, want %q, %v",
+					uploaded.ContentType, uploaded.TypeMismatch, tt.wantType, tt.wantMismatch)
+			}
+		})
+	}
+}
+
+func TestUploadFile_FileTypeRejected(t *testing.T) {
+	backend, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+	cfg := newTestUploadConfig()
+	cfg.TypeMismatchAction = "reject"
+	app, _ := newTestUploadAppWithConfig(t, backend, cfg)
+
+	// One disguised file fails the whole upload
+	req := newMultipartUpload(t, [][3]string{
+		{"files[]", "a.txt", "alpha"},
+		{"files[]", "b.png", "MZ\x90\x00"},
+	})
+	req.Header.Set("Accept", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	if resp.StatusCode != 415 {
+		t.Fatalf("status = %d, want 415", resp.StatusCode)
+	}
+
+	// Nothing is left behind, not even the file that was fine
+	objects, err := backend.List("")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(objects) != 0 {
+		t.Errorf("stored objects = %v, want none", objects)
+	}
+}
+
+// startFakeClamd serves a clamd that finds "EICAR" in content streamed to it
+// with INSTREAM, and returns its address
+func startFakeClamd(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				if command, err := r.ReadString(0); err != nil || command != "zINSTREAM\x00" {
+					return
+				}
+
+				var content []byte
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					chunk := make([]byte, size)
+					if _, err := io.ReadFull(r, chunk); err != nil {
+						return
+					}
+					content = append(content, chunk...)
+				}
+
+				if bytes.Contains(content, []byte("EICAR")) {
+					_, _ = conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				} else {
+					_, _ = conn.Write([]byte("stream: OK\x00"))
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestUpload_MalwareScanning(t *testing.T) {
+	clamdAddress := startFakeClamd(t)
+
+	// Nothing listens on a closed port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	downAddress := listener.Addr().String()
+	_ = listener.Close()
+
+	tests := []struct {
+		name           string
+		address        string
+		infectedAction string
+		failMode       string
+		scanEncrypted  string
+		content        string
+		encrypted      bool
+		wantStatus     int
+		wantScan       string
+		wantStored     bool
+	}{
+		{"Clean", clamdAddress, "reject", "closed", "", "hello", false, 200, metadata.ScanClean, true},
+		{"InfectedRejected", clamdAddress, "reject", "closed", "", "EICAR", false, 422, "", false},
+		{"InfectedQuarantined", clamdAddress, "quarantine", "closed", "", "EICAR", false, 422, metadata.ScanInfected, true},
+		{"DownFailClosed", downAddress, "reject", "closed", "", "hello", false, 503, "", false},
+		{"DownFailOpen", downAddress, "reject", "open", "", "hello", false, 200, metadata.ScanFailed, true},
+		{"ClientEncryptedFailClosed", clamdAddress, "reject", "closed", "", "EICAR", true, 415, "", false},
+		{"ClientEncryptedRejected", clamdAddress, "reject", "open", "reject", "EICAR", true, 415, "", false},
+		{"ClientEncryptedFailOpen", clamdAddress, "reject", "open", "", "EICAR", true, 200, metadata.ScanSkipped, true},
+		{"ClientEncryptedAllowed", clamdAddress, "reject", "closed", "allow", "EICAR", true, 200, metadata.ScanSkipped, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend, err := storage.NewLocalBackend(t.TempDir())
+			if err != nil {
+				t.Fatalf("NewLocalBackend() error = %v", err)
+			}
+			cfg := newTestUploadConfig()
+			cfg.ClamdAddress = tt.address
+			cfg.ClamdTimeout = 5 * time.Second
+			cfg.ScanInfectedAction = tt.infectedAction
+			cfg.ScanFailMode = tt.failMode
+			cfg.ScanClientEncrypted = tt.scanEncrypted
+			app, _ := newTestUploadAppWithConfig(t, backend, cfg)
+
+			req := httptest.NewRequest("PUT", "/notes.txt", strings.NewReader(tt.content))
+			req.Header.Set("Accept", "application/json")
+			if tt.encrypted {
+				req.Header.Set("X-Client-Encrypted", "1")
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("app.Test() error = %v", err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("status = %d, want %d (%s)", resp.StatusCode, tt.wantStatus, body)
+			}
+
+			records, err := metadata.NewSidecarStore(backend).List()
+			if err != nil {
+				t.Fatalf("List() error = %v", err)
+			}
+			if (len(records) == 1) != tt.wantStored {
+				t.Fatalf("stored records = %d, want stored %v", len(records), tt.wantStored)
+			}
+			if !tt.wantStored {
+				return
+			}
+			if scan := records[0].Scan; scan == nil || scan.Status != tt.wantScan {
+				t.Fatalf("scan = %+v, want status %s", scan, tt.wantScan)
+			}
+
+			// Quarantined files are kept, but never served
+			download, err := app.Test(httptest.NewRequest("GET", "/"+records[0].ID, nil))
+			if err != nil {
+				t.Fatalf("app.Test() error = %v", err)
+			}
+			wantDownload := 200
+			if tt.wantScan == metadata.ScanInfected {
+				wantDownload = 404
+			}
+			if download.StatusCode != wantDownload {
+				t.Errorf("download status = %d, want %d", download.StatusCode, wantDownload)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandeptwidyaop/tempfile/internal/metadata"
+	"github.com/pandeptwidyaop/tempfile/internal/services"
+	"github.com/pandeptwidyaop/tempfile/internal/utils"
+)
+
+// archiveManifestName is the name of the archive entry listing the files left out
+const archiveManifestName = "MANIFEST.txt"
+
+// archiveEntry is a file to be added to an archive under its name in the archive
+type archiveEntry struct {
+	record *metadata.Record
+	name   string
+}
+
+// DownloadArchive streams the files listed in the files query parameter,
+// comma separated, as one zip archive. With signed links the files are listed
+// by their signed download links
+func (h *FileHandler) DownloadArchive(c *fiber.Ctx) error {
+	now := time.Now()
+
+	var ids []string
+	for _, entry := range strings.Split(c.Query("files"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		id, _, err := linkedFileID(h.fileService, entry, now)
+		if err != nil {
+			return h.linkError(c, err)
+		}
+		ids = append(ids, id)
+	}
+
+	if len(ids) == 0 || len(ids) > services.MaxCollectionFiles {
+		return c.Status(400).JSON(fiber.Map{
+			"error": fmt.Sprintf("List 1 to %d comma separated filenames in the files parameter", services.MaxCollectionFiles),
+		})
+	}
+
+	return sendArchive(c, h.fileService, "archive.zip", ids, h.config.Debug)
+}
+
+// sendArchive streams a zip archive of the files with the given IDs as the
+// response, each under its original name. The files are read one at a time
+// while the archive is written, so neither the archive nor a whole file is
+// ever held in memory or written to disk.
+//
+// Files that are missing, expired, used up or password protected are left out
+// and listed in a manifest entry instead; only if none is left is the request
+// answered with 404. Every file with a download limit counts a download
+func sendArchive(c *fiber.Ctx, fileService *services.FileService, name string, ids []string, debug bool) error {
+	now := time.Now()
+	used := map[string]bool{strings.ToLower(archiveManifestName): true}
+
+	var entries []archiveEntry
+	var skipped []string
+	seen := make(map[string]bool, len(ids))
+
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		record, reason := archiveRecord(c, fileService, id, now)
+		if reason != "" {
+			skipped = append(skipped, id+": "+reason)
+			continue
+		}
+
+		entries = append(entries, archiveEntry{record: record, name: uniqueArchiveName(record.OriginalName, used)})
+	}
+
+	if len(entries) == 0 {
+		return c.Status(404).JSON(fiber.Map{
+			"error":   "None of the files are available",
+			"skipped": skipped,
+		})
+	}
+
+	c.Set("Content-Type", "application/zip")
+	c.Set("Content-Disposition", utils.ContentDisposition("attachment", name))
+	c.Set("Cache-Control", "no-store")
+	c.Set("Content-Security-Policy", fileContentSecurityPolicy)
+
+	if c.Method() == fiber.MethodHead {
+		return nil
+	}
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		// Files whose last download went into the archive are gone either way
+		defer removeUsedUp(fileService, entries, debug)
+
+		archive := zip.NewWriter(w)
+		for _, entry := range entries {
+			written, err := writeArchiveEntry(archive, fileService, entry)
+			if err != nil {
+				// Most likely the client went away; the archive stays truncated
+				log.Printf("Error writing %s to archive %s: %v", entry.record.ID, name, err)
+				return
+			}
+			if !written {
+				skipped = append(skipped, entry.record.ID+": not found")
+			}
+		}
+
+		if len(skipped) > 0 {
+			if err := writeArchiveManifest(archive, skipped, now); err != nil {
+				log.Printf("Error writing manifest to archive %s: %v", name, err)
+				return
+			}
+		}
+
+		if err := archive.Close(); err != nil {
+			log.Printf("Error finishing archive %s: %v", name, err)
+			return
+		}
+		_ = w.Flush()
+	})
+
+	return nil
+}
+
+// archiveRecord returns the record of a file to be archived, claiming a
+// download if it has a limit. If the file cannot be archived the reason is
+// returned instead. HEAD requests only peek and claim nothing, and bots may not
+// claim downloads at all
+func archiveRecord(c *fiber.Ctx, fileService *services.FileService, id string, now time.Time) (*metadata.Record, string) {
+	record, err := fileService.Lookup(id)
+	switch {
+	case errors.Is(err, metadata.ErrNotFound), errors.Is(err, services.ErrInvalidFilename):
+		return nil, "not found"
+	case err != nil:
+		log.Printf("Error reading file %s for an archive: %v", id, err)
+		return nil, "could not be read"
+	case record.IsExpired(now):
+		return nil, "expired"
+	case record.PasswordHash != "":
+		return nil, "password protected, download it on its own"
+	case record.DownloadsExhausted():
+		return nil, "download limit reached"
+	case record.MaxDownloads > 0 && utils.IsBot(c.Get("User-Agent")):
+		return nil, "has a download limit, download it in a browser"
+	case record.MaxDownloads == 0 || c.Method() == fiber.MethodHead:
+		return record, ""
+	}
+
+	claimed, err := fileService.ClaimDownload(record.ID)
+	switch {
+	case errors.Is(err, services.ErrDownloadsExhausted):
+		return nil, "download limit reached"
+	case errors.Is(err, metadata.ErrNotFound):
+		return nil, "not found"
+	case err != nil:
+		log.Printf("Error counting download of %s for an archive: %v", id, err)
+		return nil, "could not be read"
+	}
+
+	return claimed, ""
+}
+
+// writeArchiveEntry copies one file into the archive, reporting false for a
+// file removed since it was looked up
+func writeArchiveEntry(archive *zip.Writer, fileService *services.FileService, entry archiveEntry) (bool, error) {
+	reader, _, err := fileService.Open(entry.record)
+	if err != nil {
+		if errors.Is(err, metadata.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer reader.Close()
+
+	writer, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     entry.name,
+		Method:   zip.Deflate,
+		Modified: entry.record.CreatedAt,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := io.Copy(writer, reader); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// writeArchiveManifest adds the entry listing the files left out of the archive
+func writeArchiveManifest(archive *zip.Writer, skipped []string, now time.Time) error {
+	writer, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     archiveManifestName,
+		Method:   zip.Deflate,
+		Modified: now,
+	})
+	if err != nil {
+		return err
+	}
+
+	var manifest strings.Builder
+	manifest.WriteString("These files could not be included in the archive:\n\n")
+	for _, line := range skipped {
+		manifest.WriteString(line + "\n")
+	}
+
+	_, err = io.WriteString(writer, manifest.String())
+	return err
+}
+
+// removeUsedUp removes the archived files that have used up their downloads
+func removeUsedUp(fileService *services.FileService, entries []archiveEntry, debug bool) {
+	for _, entry := range entries {
+		if !entry.record.DownloadsExhausted() {
+			continue
+		}
+
+		if err := fileService.Remove(entry.record.ID); err != nil {
+			log.Printf("Error removing used up file %s: %v", entry.record.ID, err)
+		} else if debug {
+			log.Printf("Removed used up file: %s", entry.record.ID)
+		}
+	}
+}
+
+// uniqueArchiveName returns name, numbered like "name (2).ext" if an earlier
+// entry already uses it, and marks the result as used
+func uniqueArchiveName(name string, used map[string]bool) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	candidate := name
+	for i := 2; used[strings.ToLower(candidate)]; i++ {
+		candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	used[strings.ToLower(candidate)] = true
+
+	return candidate
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pandeptwidyaop/tempfile/internal/metadata"
+)
+
+// readArchive returns the entries of a zip archive by name
+func readArchive(t *testing.T, body []byte) map[string]string {
+	t.Helper()
+
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("zip.NewReader() error = %v", err)
+	}
+
+	entries := make(map[string]string, len(archive.File))
+	for _, file := range archive.File {
+		reader, err := file.Open()
+		if err != nil {
+			t.Fatalf("Open(%s) error = %v", file.Name, err)
+		}
+		content, _ := io.ReadAll(reader)
+		reader.Close()
+
+		entries[file.Name] = string(content)
+	}
+
+	return entries
+}
+
+func TestDownloadArchive(t *testing.T) {
+	app, fileService := newTestUploadApp(t)
+
+	now := time.Now()
+	records := []*metadata.Record{
+		{ID: "a_1.txt", OriginalName: "report.txt", Size: 6, ExpiresAt: now.Add(time.Hour)},
+		{ID: "b_1.txt", OriginalName: "once.txt", Size: 4, ExpiresAt: now.Add(time.Hour), MaxDownloads: 1},
+		{ID: "c_1.txt", OriginalName: "old.txt", Size: 3, ExpiresAt: now.Add(-time.Minute)},
+		{ID: "d_1.txt", OriginalName: "secret.txt", Size: 6, ExpiresAt: now.Add(time.Hour), PasswordHash: "$argon2id$"},
+	}
+	contents := []string{"report", "once", "old", "secret"}
+	for i, record := range records {
+		record.CreatedAt = now
+		if err := fileService.Create(record, strings.NewReader(contents[i])); err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+	}
+
+	// Link previews leave files with a download limit out
+	req := httptest.NewRequest("GET", "/api/archive?files=a_1.txt,b_1.txt", nil)
+	req.Header.Set("User-Agent", testBotUserAgent)
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if entries := readArchive(t, body); entries["once.txt"] != "" || !strings.Contains(entries[archiveManifestName], "b_1.txt: has a download limit") {
+		t.Errorf("archive for a bot = %v, want once.txt left out", entries)
+	}
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/api/archive?files=a_1.txt,b_1.txt,c_1.txt,d_1.txt,missing_1.txt", nil))
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		t.Fatalf("status = %d, want 200 (%s)", resp.StatusCode, body)
+	}
+
+	entries := readArchive(t, body)
+	if entries["report.txt"] != "report" || entries["once.txt"] != "once" {
+		t.Errorf("archive = %v, want report.txt and once.txt under their original names", entries)
+	}
+
+	manifest := entries[archiveManifestName]
+	for _, want := range []string{"c_1.txt: expired", "d_1.txt: password protected", "missing_1.txt: not found"} {
+		if !strings.Contains(manifest, want) {
+			t.Errorf("manifest does not contain %q:\n%s", want, manifest)
+		}
+	}
+	if len(entries) != 3 {
+		t.Errorf("archive has %d entries, want 3", len(entries))
+	}
+
+	// The archive used up the burn-after-read file
+	waitForRemoval(t, fileService, "b_1.txt")
+}
+
+func TestDownloadArchive_NothingAvailable(t *testing.T) {
+	app, _ := newTestUploadApp(t)
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+	}{
+		{"NoFiles", "", 400},
+		{"Missing", "?files=missing_1.txt,missing_2.txt", 404},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := app.Test(httptest.NewRequest("GET", "/api/archive"+tt.query, nil))
+			if err != nil {
+				t.Fatalf("app.Test() error = %v", err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestDownloadCollectionArchive_Manifest(t *testing.T) {
+	app, fileService := newTestUploadApp(t)
+	id := uploadCollection(t, app, [][3]string{{"file", "a.txt", "a"}, {"file", "b.txt", "b"}})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/api/collections/"+id+"/archive", nil))
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if entries := readArchive(t, body); len(entries) != 2 {
+		t.Fatalf("archive = %v, want a.txt and b.txt without a manifest", entries)
+	}
+
+	// Remove one member; the archive lists it instead of failing
+	resp, err = app.Test(httptest.NewRequest("GET", "/c/"+id, nil))
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	var collection struct {
+		Files []struct {
+			Filename string `json:"filename"`
+		} `json:"files"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&collection); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	removed := collection.Files[0].Filename
+	if err := fileService.Remove(removed); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/api/collections/"+id+"/archive", nil))
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+
+	entries := readArchive(t, body)
+	if entries["b.txt"] != "b" || !strings.Contains(entries[archiveManifestName], removed+": not found") {
+		t.Errorf("archive = %v, want b.txt and a manifest listing %s", entries, removed)
+	}
+}
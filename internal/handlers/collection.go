@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandeptwidyaop/tempfile/internal/config"
+	"github.com/pandeptwidyaop/tempfile/internal/metadata"
+	"github.com/pandeptwidyaop/tempfile/internal/services"
+	"github.com/pandeptwidyaop/tempfile/internal/utils"
+)
+
+// CollectionHandler handles collections of files shared under one link
+type CollectionHandler struct {
+	config            *config.Config
+	collectionService *services.CollectionService
+	fileService       *services.FileService
+	templateService   *services.TemplateService
+}
+
+// NewCollectionHandler creates a new collection handler instance. templateSvc
+// may be nil when the web UI is disabled
+func NewCollectionHandler(cfg *config.Config, collectionSvc *services.CollectionService, fileSvc *services.FileService, templateSvc *services.TemplateService) *CollectionHandler {
+	return &CollectionHandler{
+		config:            cfg,
+		collectionService: collectionSvc,
+		fileService:       fileSvc,
+		templateService:   templateSvc,
+	}
+}
+
+// CreateCollection groups already uploaded files into a collection. The files
+// are sent as files in a JSON or form body, either as a list or comma
+// separated, with an optional expires_in ending the collection early. With
+// signed links the files are listed by their signed download links
+func (h *CollectionHandler) CreateCollection(c *fiber.Ctx) error {
+	var body struct {
+		Files     []string `json:"files" form:"files"`
+		ExpiresIn string   `json:"expires_in" form:"expires_in"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	now := time.Now()
+
+	// The collection must not outlast the links it was made from
+	var fileIDs []string
+	var linksExpireAt time.Time
+	for _, value := range body.Files {
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.TrimSpace(entry); entry == "" {
+				continue
+			}
+
+			id, expiresAt, err := linkedFileID(h.fileService, entry, now)
+			if err != nil {
+				return c.Status(403).JSON(fiber.Map{
+					"error": "Invalid or expired link: list the files by their signed download links",
+				})
+			}
+			fileIDs = append(fileIDs, id)
+			if !expiresAt.IsZero() && (linksExpireAt.IsZero() || expiresAt.Before(linksExpireAt)) {
+				linksExpireAt = expiresAt
+			}
+		}
+	}
+	collection, err := h.collectionService.Create(fileIDs, body.ExpiresIn, linksExpireAt, now)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidCollection):
+			return c.Status(400).JSON(fiber.Map{
+				"error": fmt.Sprintf("A collection needs 1 to %d files that exist and have not expired", services.MaxCollectionFiles),
+			})
+		case errors.Is(err, services.ErrInvalidExpiry):
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid expires_in: use a duration such as 10m, 6h or 3d, or an RFC 3339 time",
+			})
+		default:
+			log.Printf("Error creating collection: %v", err)
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to create collection",
+			})
+		}
+	}
+
+	_, members, err := h.collectionService.Lookup(collection.ID, now)
+	if err != nil {
+		return h.collectionError(c, collection.ID, err)
+	}
+
+	if h.config.Debug {
+		log.Printf("Collection created: %s (%d files)", collection.ID, len(collection.FileIDs))
+	}
+
+	response := collectionResponseMap(h.fileService, collection, members, now)
+	response["message"] = "Collection created successfully"
+
+	return c.Status(fiber.StatusCreated).JSON(response)
+}
+
+// ViewCollection shows the landing page of a collection to browsers, and the
+// collection with its available files as JSON otherwise
+func (h *CollectionHandler) ViewCollection(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	now := time.Now()
+	collection, members, err := h.collectionService.Lookup(id, now)
+	if err != nil {
+		return h.collectionError(c, id, err)
+	}
+
+	if h.templateService == nil || !wantsHTML(c) {
+		return c.JSON(collectionResponseMap(h.fileService, collection, members, now))
+	}
+
+	return h.templateService.RenderCollectionPage(c, utils.GetBaseURL(c, h.config.PublicURL), collection, members)
+}
+
+// DownloadCollection streams the files of a collection as one zip archive.
+// Files that are no longer available are listed in its manifest
+func (h *CollectionHandler) DownloadCollection(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	collection, _, err := h.collectionService.Lookup(id, time.Now())
+	if err != nil {
+		return h.collectionError(c, id, err)
+	}
+
+	if h.config.Debug {
+		log.Printf("Collection downloaded: %s", collection.ID)
+	}
+
+	return sendArchive(c, h.fileService, "collection-"+shortID(collection.ID)+".zip", collection.FileIDs, h.config.Debug)
+}
+
+// collectionError writes the response for a collection that cannot be shown
+func (h *CollectionHandler) collectionError(c *fiber.Ctx, id string, err error) error {
+	status, title, message := 500, "Collection Unavailable", "Failed to read collection"
+	if errors.Is(err, metadata.ErrNotFound) {
+		status, title, message = 404, "Collection Not Found", "Collection not found"
+	} else {
+		log.Printf("Error reading collection %s: %v", id, err)
+	}
+
+	if h.templateService == nil || !wantsHTML(c) {
+		return c.Status(status).JSON(fiber.Map{
+			"error": message,
+		})
+	}
+
+	c.Status(status)
+	return h.templateService.RenderErrorPage(c, title, "The collection does not exist or all of its files have expired.", "Files are removed automatically once they expire.")
+}
+
+// collectionResponseMap converts a collection and its available files to the API response format
+func collectionResponseMap(fileService *services.FileService, collection *metadata.Collection, members []*metadata.Record, now time.Time) fiber.Map {
+	// Links to the members last no longer than the collection
+	expiresAt := services.CollectionExpiresAt(collection, members)
+
+	files := make([]fiber.Map, 0, len(members))
+	for _, record := range members {
+		file := fiber.Map{
+			"filename":      record.ID,
+			"original_name": record.OriginalName,
+			"size":          record.Size,
+			"size_human":    utils.FormatBytes(record.Size),
+			"expires_at":    record.ExpiresAt.Format(time.RFC3339),
+			"download_url":  fileService.DownloadURLUntil(record, expiresAt),
+		}
+		if record.MaxDownloads > 0 {
+			file["max_downloads"] = record.MaxDownloads
+		}
+		if record.PasswordHash != "" {
+			file["password_protected"] = true
+		}
+		if record.SHA256 != "" {
+			file["sha256"] = record.SHA256
+		}
+		files = append(files, file)
+	}
+
+	url := services.CollectionURL(collection.ID)
+
+	return fiber.Map{
+		"collection_id":  collection.ID,
+		"collection_url": url,
+		"zip_url":        url + "/zip",
+		"created_at":     collection.CreatedAt.Format(time.RFC3339),
+		"expires_at":     expiresAt.Format(time.RFC3339),
+		"expires_in":     utils.FormatDuration(expiresAt.Sub(now)),
+		"files":          files,
+	}
+}
+
+// shortID returns the first part of an ID, enough to tell downloads apart
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandeptwidyaop/tempfile/internal/models"
+)
+
+// uploadCollection uploads files in one request and returns the collection they share
+func uploadCollection(t *testing.T, app *fiber.App, files [][3]string) string {
+	t.Helper()
+
+	resp, err := app.Test(newMultipartUpload(t, files))
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("upload status = %d, want 200", resp.StatusCode)
+	}
+
+	var results []map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+
+	id, _ := results[0]["collection_id"].(string)
+	for i, result := range results {
+		if result["collection_id"] != id || result["collection_url"] != "/c/"+id {
+			t.Fatalf("result %d collection = %v %v, want %q", i, result["collection_id"], result["collection_url"], id)
+		}
+	}
+	if id == "" {
+		t.Fatal("upload of several files returned no collection")
+	}
+
+	return id
+}
+
+func TestViewCollection(t *testing.T) {
+	app, _ := newTestUploadApp(t)
+	id := uploadCollection(t, app, [][3]string{{"file", "build.log", "ok"}, {"file", "app.bin", "binary"}})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/c/"+id, nil))
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	var result struct {
+		ZipURL string `json:"zip_url"`
+		Files  []struct {
+			OriginalName string `json:"original_name"`
+			Size         int64  `json:"size"`
+		} `json:"files"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if result.ZipURL != "/c/"+id+"/zip" {
+		t.Errorf("zip_url = %q, want /c/%s/zip", result.ZipURL, id)
+	}
+	if len(result.Files) != 2 || result.Files[0].OriginalName != "build.log" || result.Files[1].Size != 6 {
+		t.Errorf("files = %+v, want build.log and app.bin", result.Files)
+	}
+}
+
+func TestDownloadCollection(t *testing.T) {
+	app, _ := newTestUploadApp(t)
+	id := uploadCollection(t, app, [][3]string{{"file", "notes.txt", "first"}, {"files[]", "notes.txt", "second"}})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/c/"+id+"/zip", nil))
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "application/zip" {
+		t.Fatalf("status = %d, Content-Type = %q, want 200 application/zip", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	// Files sharing an original name are numbered instead of overwritten
+	entries := readArchive(t, body)
+	want := map[string]string{"notes.txt": "first", "notes (2).txt": "second"}
+	if len(entries) != len(want) {
+		t.Fatalf("archive = %v, want %v", entries, want)
+	}
+	for name, content := range want {
+		if entries[name] != content {
+			t.Errorf("%s = %q, want %q", name, entries[name], content)
+		}
+	}
+}
+
+func TestCreateCollection(t *testing.T) {
+	app, _ := newTestUploadApp(t)
+
+	var ids []string
+	for _, name := range []string{"a.txt", "b.txt"} {
+		req := httptest.NewRequest("PUT", "/"+name, strings.NewReader(name))
+		req.Header.Set("Accept", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test() error = %v", err)
+		}
+
+		var result map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("Decode() error = %v", err)
+		}
+		ids = append(ids, result["filename"].(string))
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{"List", `{"files": ["` + ids[0] + `", "` + ids[1] + `"], "expires_in": "30m"}`, 201},
+		{"CommaSeparated", `{"files": ["` + ids[0] + `,` + ids[1] + `"]}`, 201},
+		{"Empty", `{"files": []}`, 400},
+		{"UnknownFile", `{"files": ["` + ids[0] + `", "missing_1.txt"]}`, 400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/collections", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("app.Test() error = %v", err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus != 201 {
+				return
+			}
+
+			var result struct {
+				Files     []map[string]interface{} `json:"files"`
+				ExpiresIn string                   `json:"expires_in"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if len(result.Files) != 2 {
+				t.Errorf("collection has %d files, want 2", len(result.Files))
+			}
+			if tt.name == "List" && result.ExpiresIn != "30 minutes" {
+				t.Errorf("expires_in = %q, want the collection's own 30 minutes", result.ExpiresIn)
+			}
+		})
+	}
+}
+
+func TestViewCollection_ExpiresWithLastMember(t *testing.T) {
+	app, fileService := newTestUploadApp(t)
+	id := uploadCollection(t, app, [][3]string{{"file", "a.txt", "a"}, {"file", "b.txt", "b"}})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/c/"+id, nil))
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+
+	var result struct {
+		Files []struct {
+			Filename string `json:"filename"`
+		} `json:"files"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+
+	for i, file := range result.Files {
+		if err := fileService.Remove(file.Filename); err != nil {
+			t.Fatalf("Remove() error = %v", err)
+		}
+
+		resp, err := app.Test(httptest.NewRequest("GET", "/c/"+id, nil))
+		if err != nil {
+			t.Fatalf("app.Test() error = %v", err)
+		}
+
+		wantStatus := 200
+		if i == len(result.Files)-1 {
+			wantStatus = 404
+		}
+		if resp.StatusCode != wantStatus {
+			t.Errorf("status after removing %d file(s) = %d, want %d", i+1, resp.StatusCode, wantStatus)
+		}
+	}
+}
+
+func TestCreateCollection_SignedLinks(t *testing.T) {
+	app := newTestSignedApp(t)
+
+	req := httptest.NewRequest("PUT", "/notes.txt", strings.NewReader("hi"))
+	req.Header.Set("Accept", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	var uploaded models.UploadResponse
+	if err := json.NewDecoder(resp.Body).Decode(&uploaded); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+
+	// A link shared for a few minutes, to a file kept for an hour
+	req = httptest.NewRequest("POST", "/api/files/"+uploaded.Filename+"/links", strings.NewReader(`{"expires_in": "5m"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Delete-Token", uploaded.DeleteToken)
+	resp, err = app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	var minted struct {
+		DownloadURL string `json:"download_url"`
+		ExpiresAt   string `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&minted); err != nil || resp.StatusCode != 201 {
+		t.Fatalf("POST links = %d, %v, want 201", resp.StatusCode, err)
+	}
+
+	body, _ := json.Marshal(map[string][]string{"files": {minted.DownloadURL}})
+	req = httptest.NewRequest("POST", "/api/collections", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	var collection struct {
+		ExpiresAt string `json:"expires_at"`
+		Files     []struct {
+			DownloadURL string `json:"download_url"`
+		} `json:"files"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&collection); err != nil || resp.StatusCode != 201 {
+		t.Fatalf("POST collections = %d, %v, want 201", resp.StatusCode, err)
+	}
+
+	// Neither the collection nor the links it hands out outlast the link it was made from
+	if collection.ExpiresAt != minted.ExpiresAt {
+		t.Errorf("collection expires_at = %s, want the link's %s", collection.ExpiresAt, minted.ExpiresAt)
+	}
+	mintedLink, _ := url.Parse(minted.DownloadURL)
+	memberLink, _ := url.Parse(collection.Files[0].DownloadURL)
+	if got, want := memberLink.Query().Get("expires"), mintedLink.Query().Get("expires"); got != want {
+		t.Errorf("member link expires = %s, want %s", got, want)
+	}
+}
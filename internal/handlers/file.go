@@ -1,60 +1,494 @@
 package handlers
 
 import (
+	"crypto/subtle"
+	"errors"
+	"io"
 	"log"
-	"os"
-	"path/filepath"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/pandeptwidyaop/tempfile/internal/config"
+	"github.com/pandeptwidyaop/tempfile/internal/metadata"
+	"github.com/pandeptwidyaop/tempfile/internal/models"
+	"github.com/pandeptwidyaop/tempfile/internal/ratelimit"
+	"github.com/pandeptwidyaop/tempfile/internal/services"
 	"github.com/pandeptwidyaop/tempfile/internal/utils"
 )
 
+// fileContentSecurityPolicy is sent with file content, so that a file a
+// browser renders anyway runs no scripts, loads nothing and is treated as
+// coming from an origin of its own
+const fileContentSecurityPolicy = "default-src 'none'; img-src 'self' data:; media-src 'self'; style-src 'unsafe-inline'; sandbox"
+
+// pdfContentSecurityPolicy is sent with PDFs instead, which browsers do not
+// preview within a sandbox. Their viewers keep scripts in PDFs away from the
+// origin themselves
+const pdfContentSecurityPolicy = "default-src 'none'; img-src 'self' data:; media-src 'self'; style-src 'unsafe-inline'"
+
+// publicStatsTTL is how long the stats shown to anyone are reused. Collecting
+// them reads every file's metadata, which must not happen on every request
+const publicStatsTTL = time.Minute
+
 // FileHandler handles file operations
 type FileHandler struct {
-	config *config.Config
+	config          *config.Config
+	fileService     *services.FileService
+	templateService *services.TemplateService
+	attempts        ratelimit.AttemptLimiter
+	ipDetector      ratelimit.IPDetector
+
+	// downloadHost is the host of DOWNLOAD_ORIGIN, if any
+	downloadHost string
+
+	// statsMu guards the public stats, collected at most once per publicStatsTTL
+	statsMu     sync.Mutex
+	publicStats *models.StatsResponse
+	statsAt     time.Time
 }
 
-// NewFileHandler creates a new file handler instance
-func NewFileHandler(cfg *config.Config) *FileHandler {
+// NewFileHandler creates a new file handler instance. templateSvc may be nil
+// when the web UI is disabled; attempts limits wrong download passwords
+func NewFileHandler(cfg *config.Config, fileSvc *services.FileService, templateSvc *services.TemplateService, attempts ratelimit.AttemptLimiter) *FileHandler {
 	return &FileHandler{
-		config: cfg,
+		config:          cfg,
+		fileService:     fileSvc,
+		templateService: templateSvc,
+		attempts:        attempts,
+		ipDetector:      ratelimit.NewIPDetector(cfg.RateLimitTrustedProxies, cfg.RateLimitIPHeaders),
+		downloadHost:    cfg.DownloadHost(),
 	}
 }
 
-// DownloadFile handles file download
+// DownloadFile handles file download. Protected files are also downloaded
+// with POST, from the password prompt. With landing pages enabled, browsers
+// and link previews get the landing page of the file instead
 func (h *FileHandler) DownloadFile(c *fiber.Ctx) error {
+	return h.download(c, false)
+}
+
+// DownloadRaw serves the content of a file at /:filename/raw, which is never
+// answered with its landing page
+func (h *FileHandler) DownloadRaw(c *fiber.Ctx) error {
+	return h.download(c, true)
+}
+
+// download serves a file, or one of the pages standing in for its content
+func (h *FileHandler) download(c *fiber.Ctx, raw bool) error {
 	filename := c.Params("filename")
-	filePath := filepath.Join(h.config.UploadDir, filename)
 
-	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return c.Status(404).JSON(fiber.Map{
-			"error": "File not found",
-		})
+	// The download origin serves nothing but content
+	if h.onDownloadOrigin(c) {
+		raw = true
+	}
+
+	// With signed links only the links handed out by the server are honored
+	if err := h.fileService.VerifyLink(filename, c.Query("expires"), c.Query("signature"), time.Now()); err != nil {
+		return h.linkError(c, err)
 	}
 
-	// Check if file has expired using utility function
-	expired, err := utils.IsFileExpired(filename, time.Now())
+	// Look up file metadata (falls back to the expiry in the filename)
+	record, err := h.fileService.Lookup(filename)
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{
-			"error": "Invalid filename format",
-		})
+		return h.lookupError(c, filename, err)
 	}
 
-	if expired {
+	// Check if file has expired
+	if record.IsExpired(time.Now()) {
 		// Remove expired file
-		_ = os.Remove(filePath)
+		_ = h.fileService.Remove(filename)
 		return c.Status(404).JSON(fiber.Map{
 			"error": "File has expired",
 		})
 	}
 
+	// Link previews and scanners never count as downloads
+	bot := utils.IsBot(c.Get("User-Agent"))
+	if h.config.EnableLandingPage && !raw {
+		c.Vary("Accept", "User-Agent")
+	}
+	if h.showsLandingPage(c, record, raw, bot) {
+		c.Set("Cache-Control", "no-store")
+		return h.templateService.RenderFilePage(c, utils.GetBaseURL(c, h.config.PublicURL), record)
+	}
+	if bot && record.MaxDownloads > 0 && c.Method() != fiber.MethodHead {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Files with a download limit cannot be downloaded by automated clients",
+		})
+	}
+
+	// Files encrypted by the uploader's browser can only be decrypted by a
+	// browser holding the key from the link, so browsers get a page that does
+	// that instead of the bytes, which scripts still get as they are
+	if record.ClientEncrypted {
+		if c.QueryBool("inline") {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Preview is not available for end-to-end encrypted files",
+			})
+		}
+
+		c.Vary("Accept")
+		if !raw && h.templateService != nil && c.Method() == fiber.MethodGet && wantsHTML(c) {
+			c.Set("Cache-Control", "no-store")
+			return h.templateService.RenderDecryptPage(c, record)
+		}
+	}
+
+	if ok, err := h.authorize(c, record); !ok {
+		return err
+	}
+
+	// Browsers only ever render content on the download origin; scripts and
+	// fetches of the web UI read it anywhere. The redirect keeps the method and
+	// body, so a password sent with the prompt follows it
+	if h.downloadHost != "" && !h.onDownloadOrigin(c) && rendersInBrowser(c) {
+		return c.Redirect(h.config.DownloadOrigin+string(c.Request().URI().RequestURI()), fiber.StatusTemporaryRedirect)
+	}
+
 	if h.config.Debug {
 		log.Printf("File downloaded: %s", filename)
 	}
 
-	// Download file
-	return c.SendFile(filePath)
+	// Files stored before types were detected only have the one their name says
+	contentType := record.ContentType
+	if contentType == "" {
+		contentType = utils.GetContentType(filename)
+	}
+	disposition := h.dispositionType(c, contentType)
+	if record.TypeMismatch {
+		disposition = "attachment"
+	}
+	if record.ClientEncrypted {
+		contentType, disposition = services.ClientEncryptedContentType, "attachment"
+	}
+
+	// Content a browser would run as a page is only ever downloaded, as bytes
+	// of no particular type
+	if utils.IsActiveContent(contentType) {
+		contentType, disposition = "application/octet-stream", "attachment"
+	}
+	if contentType == "application/pdf" {
+		c.Set("Content-Security-Policy", pdfContentSecurityPolicy)
+	} else {
+		c.Set("Content-Security-Policy", fileContentSecurityPolicy)
+	}
+
+	// Serve under the original filename instead of the generated one
+	c.Set("Content-Disposition", utils.ContentDisposition(disposition, record.OriginalName))
+
+	// Let clients verify the whole file, both in the current and the older digest header format
+	if record.SHA256 != "" {
+		digest := utils.DigestBase64(record.SHA256)
+		c.Set("Repr-Digest", "sha-256=:"+digest+":")
+		c.Set("Digest", "SHA-256="+digest)
+	}
+
+	if record.MaxDownloads > 0 {
+		return h.serveLimited(c, record, contentType)
+	}
+
+	return h.serveContent(c, record, contentType)
+}
+
+// OEmbed describes the landing page of a file given in the url query parameter
+// to link previews, as an oEmbed link (https://oembed.com)
+func (h *FileHandler) OEmbed(c *fiber.Ctx) error {
+	if format := c.Query("format", "json"); format != "json" {
+		return c.Status(501).JSON(fiber.Map{
+			"error": "Only the json format is supported",
+		})
+	}
+
+	now := time.Now()
+	id, _, err := linkedFileID(h.fileService, c.Query("url"), now)
+	if err != nil {
+		return h.linkError(c, err)
+	}
+
+	record, err := h.fileService.Lookup(id)
+	if err != nil {
+		return h.lookupError(c, id, err)
+	}
+	if record.IsExpired(now) {
+		return h.lookupError(c, id, metadata.ErrNotFound)
+	}
+	if record.DownloadsExhausted() {
+		return h.lookupError(c, id, services.ErrDownloadsExhausted)
+	}
+
+	title := record.OriginalName
+	if record.ClientEncrypted {
+		title = "Encrypted File"
+	}
+
+	return c.JSON(fiber.Map{
+		"version":       "1.0",
+		"type":          "link",
+		"title":         title,
+		"provider_name": "TempFiles",
+		"provider_url":  utils.GetBaseURL(c, h.config.PublicURL),
+		"cache_age":     int(record.ExpiresAt.Sub(now).Seconds()),
+	})
+}
+
+// onDownloadOrigin reports whether a request was made to DOWNLOAD_ORIGIN
+func (h *FileHandler) onDownloadOrigin(c *fiber.Ctx) bool {
+	return h.downloadHost != "" && strings.EqualFold(c.Hostname(), h.downloadHost)
+}
+
+// rendersInBrowser reports whether a response may be rendered by a browser,
+// as opposed to read by a script. Browsers tell with Sec-Fetch-Dest, and
+// otherwise ask for HTML when navigating
+func rendersInBrowser(c *fiber.Ctx) bool {
+	if dest := c.Get("Sec-Fetch-Dest"); dest != "" {
+		return dest != "empty"
+	}
+	return wantsHTML(c)
+}
+
+// showsLandingPage reports whether a request for a file is answered with its
+// landing page. Bots get it in place of a file with a download limit
+// wherever they ask, as a preview must not use up a download. With landing
+// pages enabled, browsers and bots get it at the download URL, except that
+// browsers get the decrypt page of end-to-end encrypted files
+func (h *FileHandler) showsLandingPage(c *fiber.Ctx, record *metadata.Record, raw, bot bool) bool {
+	if h.templateService == nil || (c.Method() != fiber.MethodGet && c.Method() != fiber.MethodHead) {
+		return false
+	}
+	if bot && record.MaxDownloads > 0 {
+		return true
+	}
+	if raw || !h.config.EnableLandingPage {
+		return false
+	}
+
+	return bot || (wantsHTML(c) && !record.ClientEncrypted)
+}
+
+// Stats reports the number of stored files and the space they take up.
+// What is saved by keeping identical content only once is only reported to
+// admins: watching it change would tell anyone whether the content they just
+// uploaded had been uploaded by someone else. Admins get current figures,
+// everyone else figures up to publicStatsTTL old
+func (h *FileHandler) Stats(c *fiber.Ctx) error {
+	if !isAdmin(c, h.config.AdminToken) {
+		stats, err := h.cachedStats(time.Now())
+		if err != nil {
+			return h.statsError(c, err)
+		}
+		return c.JSON(stats)
+	}
+
+	stats, err := h.fileService.Stats()
+	if err != nil {
+		return h.statsError(c, err)
+	}
+
+	return c.JSON(stats)
+}
+
+// cachedStats returns the public stats, collecting them again once they are
+// publicStatsTTL old. Requests arriving meanwhile wait for them instead of
+// collecting them too
+func (h *FileHandler) cachedStats(now time.Time) (*models.StatsResponse, error) {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+
+	if h.publicStats != nil && now.Sub(h.statsAt) < publicStatsTTL {
+		return h.publicStats, nil
+	}
+
+	stats, err := h.fileService.Stats()
+	if err != nil {
+		return nil, err
+	}
+	stats.StorageStats = nil
+
+	h.publicStats, h.statsAt = stats, now
+	return stats, nil
+}
+
+// statsError reports stats that could not be collected
+func (h *FileHandler) statsError(c *fiber.Ctx, err error) error {
+	log.Printf("Error collecting storage stats: %v", err)
+	return c.Status(500).JSON(fiber.Map{
+		"error": "Failed to collect stats",
+	})
+}
+
+// isAdmin reports whether the request carries the admin token as a bearer
+// token. No request does while no admin token is configured
+func isAdmin(c *fiber.Ctx, adminToken string) bool {
+	token, ok := strings.CutPrefix(c.Get("Authorization"), "Bearer ")
+	if adminToken == "" || !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// serveLimited serves a file with a download limit. Every GET counts as a
+// download, so ranges and conditional requests are not supported, and the
+// file is removed as soon as its last download has been sent
+func (h *FileHandler) serveLimited(c *fiber.Ctx, record *metadata.Record, contentType string) error {
+	c.Set("Cache-Control", "no-store")
+	c.Set("Content-Type", contentType)
+
+	// HEAD requests only peek and are not counted
+	if c.Method() == fiber.MethodHead {
+		if record.DownloadsExhausted() {
+			return h.lookupError(c, record.ID, services.ErrDownloadsExhausted)
+		}
+		c.Set("X-Downloads-Remaining", strconv.Itoa(record.MaxDownloads-record.Downloads))
+		c.Response().Header.SetContentLength(int(record.Size))
+		return nil
+	}
+
+	// Content that can't be opened must not use up a download
+	reader, _, err := h.fileService.Open(record)
+	if err != nil {
+		return h.lookupError(c, record.ID, err)
+	}
+
+	claimed, err := h.fileService.ClaimDownload(record.ID)
+	if err != nil {
+		reader.Close()
+		return h.lookupError(c, record.ID, err)
+	}
+
+	if claimed.DownloadsExhausted() {
+		reader = &removeOnClose{ReadCloser: reader, remove: func() {
+			if err := h.fileService.Remove(claimed.ID); err != nil {
+				log.Printf("Error removing used up file %s: %v", claimed.ID, err)
+			} else if h.config.Debug {
+				log.Printf("Removed used up file: %s", claimed.ID)
+			}
+		}}
+	}
+
+	c.Set("X-Downloads-Remaining", strconv.Itoa(claimed.MaxDownloads-claimed.Downloads))
+
+	// The stream is closed once fully sent or when the client goes away
+	return c.SendStream(reader, int(claimed.Size))
+}
+
+// dispositionType chooses between inline preview and attachment download.
+// ?download=1 forces a download, ?inline=1 forces a browser preview, and
+// otherwise only types browsers can display are shown inline
+func (h *FileHandler) dispositionType(c *fiber.Ctx, contentType string) string {
+	if c.QueryBool("download") {
+		return "attachment"
+	}
+	if c.QueryBool("inline") {
+		return "inline"
+	}
+
+	switch {
+	case strings.HasPrefix(contentType, "image/"),
+		strings.HasPrefix(contentType, "video/"),
+		strings.HasPrefix(contentType, "audio/"),
+		strings.HasPrefix(contentType, "text/plain"),
+		contentType == "application/pdf":
+		return "inline"
+	default:
+		return "attachment"
+	}
+}
+
+// lookupError converts file lookup errors into responses
+func (h *FileHandler) lookupError(c *fiber.Ctx, filename string, err error) error {
+	switch {
+	case errors.Is(err, metadata.ErrNotFound):
+		return c.Status(404).JSON(fiber.Map{
+			"error": "File not found",
+		})
+	case errors.Is(err, services.ErrDownloadsExhausted):
+		return c.Status(404).JSON(fiber.Map{
+			"error": "File has reached its download limit",
+		})
+	case errors.Is(err, services.ErrInvalidToken):
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Invalid delete token",
+		})
+	case errors.Is(err, services.ErrInvalidFilename):
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid filename format",
+		})
+	default:
+		log.Printf("Error reading file %s: %v", filename, err)
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to read file",
+		})
+	}
+}
+
+// linkError refuses a download from a link that is not signed or has expired
+func (h *FileHandler) linkError(c *fiber.Ctx, err error) error {
+	message, detail := "Invalid or missing link signature", "Check that the whole link was copied, or ask the uploader for a new one."
+	if errors.Is(err, services.ErrLinkExpired) {
+		message, detail = "Link has expired", "Ask the uploader for a new link."
+	}
+
+	c.Status(403)
+	if h.templateService == nil || !wantsHTML(c) {
+		return c.JSON(fiber.Map{
+			"error": message,
+		})
+	}
+
+	return h.templateService.RenderErrorPage(c, "Link Not Valid", message+".", detail)
+}
+
+// linkedFileID returns the file an entry of a files list refers to: either a
+// filename, or a download link such as /<filename>?expires=…&signature=…,
+// also to its content at /<filename>/raw. With signed links only an entry
+// carrying a valid signature is accepted, and when it expires is returned
+// too; it is zero for links that are not signed
+func linkedFileID(fileService *services.FileService, entry string, now time.Time) (string, time.Time, error) {
+	link, err := url.Parse(entry)
+	if err != nil {
+		return "", time.Time{}, services.ErrInvalidSignature
+	}
+
+	linkPath := link.Path
+	if trimmed, ok := strings.CutSuffix(linkPath, "/raw"); ok && strings.Trim(trimmed, "/") != "" {
+		linkPath = trimmed
+	}
+
+	id := path.Base(linkPath)
+	query := link.Query()
+	if err := fileService.VerifyLink(id, query.Get("expires"), query.Get("signature"), now); err != nil {
+		return "", time.Time{}, err
+	}
+
+	var expiresAt time.Time
+	if query.Get("signature") != "" {
+		if unix, err := strconv.ParseInt(query.Get("expires"), 10, 64); err == nil {
+			expiresAt = time.Unix(unix, 0)
+		}
+	}
+
+	return id, expiresAt, nil
+}
+
+// wantsHTML reports whether the client prefers an HTML page to JSON, as browsers do
+func wantsHTML(c *fiber.Ctx) bool {
+	return c.Accepts(fiber.MIMEApplicationJSON, fiber.MIMETextHTML) == fiber.MIMETextHTML
+}
+
+// removeOnClose calls remove once the wrapped reader has been closed
+type removeOnClose struct {
+	io.ReadCloser
+	remove func()
+	once   sync.Once
+}
+
+func (r *removeOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.remove)
+	return err
 }
@@ -0,0 +1,1160 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandeptwidyaop/tempfile/internal/config"
+	"github.com/pandeptwidyaop/tempfile/internal/encryption"
+	"github.com/pandeptwidyaop/tempfile/internal/metadata"
+	"github.com/pandeptwidyaop/tempfile/internal/models"
+	"github.com/pandeptwidyaop/tempfile/internal/ratelimit"
+	"github.com/pandeptwidyaop/tempfile/internal/services"
+	"github.com/pandeptwidyaop/tempfile/internal/storage"
+	"github.com/pandeptwidyaop/tempfile/internal/storage/storagetest"
+	"github.com/pandeptwidyaop/tempfile/internal/utils"
+)
+
+// newTestAttemptLimiter returns a password attempt limiter allowing two failures
+func newTestAttemptLimiter(t *testing.T) ratelimit.AttemptLimiter {
+	store := ratelimit.NewMemoryStore(100, time.Minute)
+	t.Cleanup(func() { _ = store.Close() })
+
+	return ratelimit.NewAttemptLimiter(store, 2, time.Minute)
+}
+
+// testFile is a file stored before a test app serves it
+type testFile struct {
+	record  *metadata.Record
+	content string
+}
+
+// newTestSeededApp returns the upload test app configured with cfg, storing
+// files in backend first. A nil backend is a fresh local one, and records
+// without times expire in an hour
+func newTestSeededApp(t *testing.T, backend storage.Backend, cfg *config.Config, files ...testFile) (*fiber.App, *services.FileService) {
+	if backend == nil {
+		var err error
+		if backend, err = storage.NewLocalBackend(t.TempDir()); err != nil {
+			t.Fatalf("NewLocalBackend() error = %v", err)
+		}
+	}
+
+	app, fileService := newTestUploadAppWithConfig(t, backend, cfg)
+
+	for _, file := range files {
+		record := file.record
+		if record.CreatedAt.IsZero() {
+			record.CreatedAt = time.Now()
+			record.ExpiresAt = record.CreatedAt.Add(time.Hour)
+		}
+		record.Size = int64(len(file.content))
+		if err := fileService.Create(record, strings.NewReader(file.content)); err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+	}
+
+	return app, fileService
+}
+
+// newTestLimitedFileApp returns an app serving one file that may be downloaded maxDownloads times
+func newTestLimitedFileApp(t *testing.T, maxDownloads int) (*fiber.App, *services.FileService, string) {
+	record := &metadata.Record{ID: "secret.txt", OriginalName: "secret.txt", MaxDownloads: maxDownloads}
+	app, fileService := newTestSeededApp(t, nil, newTestUploadConfig(), testFile{record, "s3cr3t"})
+
+	return app, fileService, record.ID
+}
+
+// waitForRemoval waits until the file is gone, as removal follows the end of the response
+func waitForRemoval(t *testing.T, fileService *services.FileService, id string) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, err := fileService.Lookup(id)
+		if errors.Is(err, metadata.ErrNotFound) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Lookup() error = %v, want the file to be removed", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDownloadFile_BurnAfterRead(t *testing.T) {
+	app, fileService, id := newTestLimitedFileApp(t, 1)
+
+	// Peeking does not use up the download
+	resp, err := app.Test(httptest.NewRequest("HEAD", "/"+id, nil))
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	if resp.StatusCode != 200 || resp.Header.Get("X-Downloads-Remaining") != "1" {
+		t.Fatalf("HEAD status = %d, remaining = %q, want 200 and 1", resp.StatusCode, resp.Header.Get("X-Downloads-Remaining"))
+	}
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/"+id, nil))
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(body) != "s3cr3t" {
+		t.Fatalf("first GET = %d %q, want 200 %q", resp.StatusCode, body, "s3cr3t")
+	}
+	if got := resp.Header.Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", got)
+	}
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/"+id, nil))
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	if resp.StatusCode != 404 {
+		t.Errorf("second GET status = %d, want 404", resp.StatusCode)
+	}
+
+	waitForRemoval(t, fileService, id)
+}
+
+func TestDownloadFile_ConcurrentLimit(t *testing.T) {
+	const limit = 3
+	app, fileService, id := newTestLimitedFileApp(t, limit)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			resp, err := app.Test(httptest.NewRequest("GET", "/"+id, nil))
+			if err != nil {
+				t.Errorf("app.Test() error = %v", err)
+				return
+			}
+			if resp.StatusCode == 200 {
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if succeeded != limit {
+		t.Errorf("%d downloads succeeded, want %d", succeeded, limit)
+	}
+
+	waitForRemoval(t, fileService, id)
+}
+
+func TestDownloadFile_UnreadableContentKeepsDownload(t *testing.T) {
+	backend, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+	record := &metadata.Record{ID: "secret.txt", OriginalName: "secret.txt", MaxDownloads: 1}
+	app, fileService := newTestSeededApp(t, backend, newTestUploadConfig(), testFile{record, "s3cr3t"})
+
+	// The content went missing, so the download fails without counting
+	if err := backend.Delete(record.BlobKey); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	resp, err := app.Test(httptest.NewRequest("GET", "/"+record.ID, nil))
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	if resp.StatusCode == 200 {
+		t.Fatal("GET of missing content succeeded")
+	}
+
+	stored, err := fileService.Lookup(record.ID)
+	if err != nil {
+		t.Fatalf("Lookup() error = %v", err)
+	}
+	if stored.Downloads != 0 {
+		t.Errorf("downloads = %d after a failed download, want 0", stored.Downloads)
+	}
+}
+
+// newTestProtectedFileApp returns an app serving one file protected by the password "hunter2"
+func newTestProtectedFileApp(t *testing.T) (*fiber.App, string) {
+	hash, err := utils.HashPassword("hunter2")
+	if err != nil {
+		t.Fatalf("HashPassword() error = %v", err)
+	}
+	record := &metadata.Record{ID: "report.txt", OriginalName: "report.txt", PasswordHash: hash}
+	app, _ := newTestSeededApp(t, nil, newTestUploadConfig(), testFile{record, "report"})
+
+	return app, record.ID
+}
+
+func TestDownloadFile_Password(t *testing.T) {
+	app, id := newTestProtectedFileApp(t)
+
+	tests := []struct {
+		name       string
+		header     string
+		value      string
+		wantStatus int
+	}{
+		{"Missing", "", "", 401},
+		{"Header", "X-File-Password", "hunter2", 200},
+		{"Basic", "Authorization", "Basic " + base64.StdEncoding.EncodeToString([]byte(":hunter2")), 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/"+id, nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("app.Test() error = %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantStatus == 200 && string(body) != "report" {
+				t.Errorf("body = %q, want %q", body, "report")
+			}
+			if tt.wantStatus == 401 && resp.Header.Get("WWW-Authenticate") == "" {
+				t.Error("WWW-Authenticate header is missing")
+			}
+		})
+	}
+}
+
+func TestDownloadFile_PasswordPrompt(t *testing.T) {
+	app, id := newTestProtectedFileApp(t)
+
+	req := httptest.NewRequest("GET", "/"+id, nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != 401 {
+		t.Errorf("status = %d, want 401", resp.StatusCode)
+	}
+	if !strings.Contains(string(body), `action="/report.txt" method="POST"`) {
+		t.Errorf("body does not contain the password form:\n%s", body)
+	}
+
+	// The prompt posts the password back to the same URL
+	req = httptest.NewRequest("POST", "/"+id, strings.NewReader("password=hunter2"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "text/html")
+
+	resp, err = app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(body) != "report" {
+		t.Errorf("POST = %d %q, want 200 %q", resp.StatusCode, body, "report")
+	}
+}
+
+func TestDownloadFile_PasswordAttemptsLimited(t *testing.T) {
+	app, id := newTestProtectedFileApp(t)
+
+	download := func(password string) int {
+		req := httptest.NewRequest("GET", "/"+id, nil)
+		req.Header.Set("X-File-Password", password)
+
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test() error = %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	// Right passwords don't use up attempts
+	for i := 0; i < 3; i++ {
+		if status := download("hunter2"); status != 200 {
+			t.Fatalf("right password %d status = %d, want 200", i+1, status)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if status := download("wrong"); status != 401 {
+			t.Fatalf("wrong password %d status = %d, want 401", i+1, status)
+		}
+	}
+
+	// Once limited even the right password is refused
+	if status := download("hunter2"); status != 429 {
+		t.Errorf("status after too many failures = %d, want 429", status)
+	}
+}
+
+func TestDownloadFile_ConcurrentPasswordGuesses(t *testing.T) {
+	app, id := newTestProtectedFileApp(t)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	statuses := make(map[int]int)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req := httptest.NewRequest("GET", "/"+id, nil)
+			req.Header.Set("X-File-Password", "wrong")
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Errorf("app.Test() error = %v", err)
+				return
+			}
+			mu.Lock()
+			statuses[resp.StatusCode]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// Guesses sent at once still only get the two attempts
+	if statuses[401] != 2 || statuses[429] != 8 {
+		t.Errorf("statuses = %v, want 2 x 401 and 8 x 429", statuses)
+	}
+}
+
+func TestDownloadFile_Digest(t *testing.T) {
+	backend, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+
+	record := &metadata.Record{ID: "hello.txt", OriginalName: "hello.txt"}
+	app, fileService := newTestSeededApp(t, backend, newTestUploadConfig(), testFile{record, "hello"})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/hello.txt", nil))
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(body) != "hello" {
+		t.Fatalf("GET = %d %q, want 200 %q", resp.StatusCode, body, "hello")
+	}
+
+	if got := resp.Header.Get("ETag"); got != `"`+helloSHA256+`"` {
+		t.Errorf("ETag = %q, want the SHA-256 digest", got)
+	}
+	if got := resp.Header.Get("Repr-Digest"); got != "sha-256=:LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=:" {
+		t.Errorf("Repr-Digest = %q", got)
+	}
+	if got := resp.Header.Get("Digest"); got != "SHA-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=" {
+		t.Errorf("Digest = %q", got)
+	}
+
+	// Content that rotted on disk is never served as a complete file
+	if err := backend.Put(record.BlobKey, strings.NewReader("jello"), 5); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	reader, _, err := fileService.Open(record)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer reader.Close()
+
+	if _, err := io.ReadAll(reader); !errors.Is(err, services.ErrDigestMismatch) {
+		t.Errorf("ReadAll() error = %v, want %v", err, services.ErrDigestMismatch)
+	}
+}
+
+func TestUpload_Deduplicated(t *testing.T) {
+	cfg := newTestUploadConfig()
+	cfg.AdminToken = strings.Repeat("a", 32)
+	app, fileService := newTestSeededApp(t, nil, cfg)
+
+	upload := func() string {
+		req := httptest.NewRequest("PUT", "/setup.exe", strings.NewReader("installer"))
+		req.Header.Set("Accept", "application/json")
+
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test() error = %v", err)
+		}
+		var result map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("Decode() error = %v", err)
+		}
+		return result["filename"].(string)
+	}
+
+	statsAs := func(token string) models.StatsResponse {
+		req := httptest.NewRequest("GET", "/api/stats", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test() error = %v", err)
+		}
+		var result models.StatsResponse
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("Decode() error = %v", err)
+		}
+		return result
+	}
+	stats := func() models.StatsResponse {
+		result := statsAs(cfg.AdminToken)
+		if result.StorageStats == nil {
+			t.Fatal("stats report no storage to the admin")
+		}
+		return result
+	}
+
+	first, second := upload(), upload()
+	if first == second {
+		t.Fatalf("both uploads got the ID %s", first)
+	}
+
+	got := stats()
+	if got.Files != 2 || got.StoredObjects != 1 || got.LogicalBytes != 18 || got.StoredBytes != 9 || got.SavedBytes != 9 {
+		t.Errorf("stats = %+v, want 2 files stored once, saving 9 bytes", got)
+	}
+
+	// Anyone else only gets the totals, which say nothing about what is stored already
+	for _, token := range []string{"", "wrong"} {
+		if public := statsAs(token); public.Files != 2 || public.LogicalBytes != 18 || public.StorageStats != nil {
+			t.Errorf("stats with token %q = %+v, want totals only", token, public)
+		}
+	}
+
+	// Removing one upload leaves the shared content to the other
+	if err := fileService.Remove(first); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+
+	// The public figures are reused for a while, the admin's are current
+	if public := statsAs(""); public.Files != 2 {
+		t.Errorf("public stats = %+v, want the cached 2 files", public)
+	}
+	if got := stats(); got.Files != 1 {
+		t.Errorf("stats = %+v, want 1 file", got)
+	}
+	resp, err := app.Test(httptest.NewRequest("GET", "/"+second, nil))
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(body) != "installer" {
+		t.Fatalf("GET = %d %q, want 200 %q", resp.StatusCode, body, "installer")
+	}
+
+	if err := fileService.Remove(second); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if got := stats(); got.Files != 0 || got.StoredBytes != 0 {
+		t.Errorf("stats = %+v, want nothing stored", got)
+	}
+
+	// The blob went with its last reference, so new content is stored afresh
+	third := upload()
+	record, err := fileService.Lookup(third)
+	if err != nil {
+		t.Fatalf("Lookup() error = %v", err)
+	}
+	reader, _, err := fileService.Open(record)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer reader.Close()
+	if data, err := io.ReadAll(reader); err != nil || string(data) != "installer" {
+		t.Errorf("ReadAll() = %q, %v, want %q", data, err, "installer")
+	}
+}
+
+func TestUpload_DeduplicatedAcrossServers(t *testing.T) {
+	fake, endpoint := storagetest.StartFakeS3(t, "tempfiles")
+	newServer := func() (storage.Backend, *services.FileService) {
+		backend, err := storage.NewS3Backend(&storage.S3Config{
+			Endpoint:     endpoint,
+			Bucket:       "tempfiles",
+			Region:       "us-east-1",
+			AccessKey:    storagetest.AccessKey,
+			SecretKey:    "test-secret",
+			UsePathStyle: true,
+		})
+		if err != nil {
+			t.Fatalf("NewS3Backend() error = %v", err)
+		}
+		_, fileService := newTestSeededApp(t, backend, newTestUploadConfig())
+		return backend, fileService
+	}
+	backend, first := newServer()
+	_, second := newServer()
+	servers := []*services.FileService{first, second}
+
+	// Two servers store the same content at the same time, removing every
+	// other file again right away
+	const files = 16
+	now := time.Now()
+	records := make([]*metadata.Record, files)
+	var wg sync.WaitGroup
+	for i := range records {
+		records[i] = &metadata.Record{
+			ID:           "setup" + strconv.Itoa(i) + ".txt",
+			OriginalName: "setup.txt",
+			Size:         9,
+			CreatedAt:    now,
+			ExpiresAt:    now.Add(time.Hour),
+		}
+		wg.Add(1)
+		go func(server *services.FileService, record *metadata.Record, remove bool) {
+			defer wg.Done()
+			if err := server.Create(record, strings.NewReader("installer")); err != nil {
+				t.Errorf("Create() error = %v", err)
+				return
+			}
+			if remove {
+				if err := server.Remove(record.ID); err != nil {
+					t.Errorf("Remove() error = %v", err)
+				}
+			}
+		}(servers[i%2], records[i], i%4 < 2)
+	}
+	wg.Wait()
+
+	// Every file still there is counted, and can be read from either server
+	kept := 0
+	for i, record := range records {
+		if i%4 < 2 {
+			continue
+		}
+		kept++
+		reader, _, err := servers[(i+1)%2].Open(record)
+		if err != nil {
+			t.Fatalf("Open(%s) error = %v", record.ID, err)
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil || string(data) != "installer" {
+			t.Errorf("ReadAll(%s) = %q, %v, want %q", record.ID, data, err, "installer")
+		}
+	}
+	blob, err := metadata.NewBlobStore(backend).Get(records[0].SHA256)
+	if err != nil {
+		t.Fatalf("blob Get() error = %v", err)
+	}
+	if blob.Refs != kept {
+		t.Errorf("blob has %d references, want %d", blob.Refs, kept)
+	}
+
+	// Removing the rest from both servers at once leaves nothing behind
+	for i, record := range records {
+		if i%4 < 2 {
+			continue
+		}
+		wg.Add(1)
+		go func(server *services.FileService, id string) {
+			defer wg.Done()
+			if err := server.Remove(id); err != nil {
+				t.Errorf("Remove() error = %v", err)
+			}
+		}(servers[i%2], record.ID)
+	}
+	wg.Wait()
+
+	for _, prefix := range []string{"blobs/", "refs/"} {
+		if keys := fake.Keys(prefix); len(keys) != 0 {
+			t.Errorf("objects left behind: %v", keys)
+		}
+	}
+}
+
+func TestDownloadFile_Encrypted(t *testing.T) {
+	backend, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+
+	oldKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, encryption.KeySize))
+	newKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, encryption.KeySize))
+
+	cfg := newTestUploadConfig()
+	cfg.EncryptionKey = oldKey
+
+	content := strings.Repeat("0123456789", 2*encryption.ChunkSize/10)
+	record := &metadata.Record{ID: "digits.txt", OriginalName: "digits.txt"}
+	newTestSeededApp(t, backend, cfg, testFile{record, content})
+
+	// Only ciphertext reaches the storage backend
+	stored, _, err := backend.Get(record.BlobKey)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	data, _ := io.ReadAll(stored)
+	stored.Close()
+	if int64(len(data)) != encryption.EncryptedSize(record.Size) || bytes.Contains(data, []byte("0123456789")) {
+		t.Errorf("stored %d bytes, want %d bytes of ciphertext", len(data), encryption.EncryptedSize(record.Size))
+	}
+
+	// After rotating the master key, re-wrapped data keys no longer need the old one
+	rotated := newTestUploadConfig()
+	rotated.EncryptionKey, rotated.EncryptionPreviousKeys = newKey, []string{oldKey}
+	_, fileService := newTestSeededApp(t, backend, rotated)
+	if n, err := fileService.RewrapKeys(); err != nil || n != 1 {
+		t.Fatalf("RewrapKeys() = %d, %v, want 1 key re-wrapped", n, err)
+	}
+	current := newTestUploadConfig()
+	current.EncryptionKey = newKey
+	app, _ := newTestSeededApp(t, backend, current)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/digits.txt", nil), -1)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(body) != content {
+		t.Fatalf("GET = %d with %d bytes, want 200 with the original content", resp.StatusCode, len(body))
+	}
+
+	// A range across a chunk boundary decrypts only what it covers
+	req := httptest.NewRequest("GET", "/digits.txt", nil)
+	req.Header.Set("Range", "bytes=65530-65545")
+	resp, err = app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	if resp.StatusCode != 206 || string(body) != content[65530:65546] {
+		t.Errorf("GET range = %d %q, want 206 %q", resp.StatusCode, body, content[65530:65546])
+	}
+}
+
+func TestUpload_DeduplicatedPerEncryption(t *testing.T) {
+	backend, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+	encrypted := newTestUploadConfig()
+	encrypted.EncryptionKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, encryption.KeySize))
+
+	// The same content stored with and without encryption is kept twice
+	plain := &metadata.Record{ID: "plain.txt", OriginalName: "plain.txt"}
+	newTestSeededApp(t, backend, newTestUploadConfig(), testFile{plain, "hello"})
+	sealed := &metadata.Record{ID: "sealed.txt", OriginalName: "sealed.txt"}
+	_, fileService := newTestSeededApp(t, backend, encrypted, testFile{sealed, "hello"})
+
+	if plain.Encrypted || !sealed.Encrypted || plain.BlobKey == sealed.BlobKey {
+		t.Fatalf("plain = %+v, sealed = %+v, want blobs of their own", plain, sealed)
+	}
+	stored, _, err := backend.Get(plain.BlobKey)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	data, _ := io.ReadAll(stored)
+	stored.Close()
+	if string(data) != "hello" {
+		t.Errorf("plaintext blob holds %q, want %q", data, "hello")
+	}
+
+	// Nothing in the storage names the encrypted blob by its digest
+	refs, err := backend.List("refs/")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	keys := []string{sealed.BlobKey}
+	for _, ref := range refs {
+		keys = append(keys, ref.Key)
+	}
+	for _, key := range keys {
+		if key == "refs/"+plain.SHA256+".json" {
+			continue
+		}
+		if strings.Contains(key, helloSHA256) {
+			t.Errorf("encrypted blob stored as %s, which names its digest", key)
+		}
+		if reader, _, err := backend.Get(key); err == nil {
+			data, _ := io.ReadAll(reader)
+			reader.Close()
+			if strings.Contains(string(data), helloSHA256) {
+				t.Errorf("%s holds the digest of the encrypted content", key)
+			}
+		}
+	}
+
+	// Both are served as stored
+	for _, record := range []*metadata.Record{plain, sealed} {
+		reader, _, err := fileService.Open(record)
+		if err != nil {
+			t.Fatalf("Open(%s) error = %v", record.ID, err)
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil || string(data) != "hello" {
+			t.Errorf("ReadAll(%s) = %q, %v, want %q", record.ID, data, err, "hello")
+		}
+	}
+}
+
+func TestUpload_LegacyEncryptedBlob(t *testing.T) {
+	backend, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+
+	// A blob encrypted before blobs were named by a keyed hash, with
+	// encryption disabled since
+	legacy := `{"sha256":"` + helloSHA256 + `","size":5,"refs":1,"data_key":"c2VhbGVk","key_id":"retired"}`
+	if err := backend.Put("refs/"+helloSHA256+".json", strings.NewReader(legacy), int64(len(legacy))); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if err := backend.Put("blobs/"+helloSHA256, strings.NewReader("ciphertext"), 10); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	// Plaintext is not shared with it, but kept on its own
+	record := &metadata.Record{ID: "hello.txt", OriginalName: "hello.txt"}
+	_, fileService := newTestSeededApp(t, backend, newTestUploadConfig(), testFile{record, "hello"})
+	if record.Blob || record.Encrypted {
+		t.Errorf("record = %+v, want content of its own in plaintext", record)
+	}
+	reader, _, err := fileService.Open(record)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(data) != "hello" {
+		t.Errorf("ReadAll() = %q, %v, want %q", data, err, "hello")
+	}
+
+	if err := fileService.Remove(record.ID); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	blob, err := metadata.NewBlobStore(backend).Get(helloSHA256)
+	if err != nil || blob.Refs != 1 {
+		t.Errorf("legacy blob = %+v, %v, want its 1 reference kept", blob, err)
+	}
+	if _, err := backend.Stat(record.ID); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Stat() error = %v, want the content removed", err)
+	}
+}
+
+func TestDownloadFile_ClientEncrypted(t *testing.T) {
+	app, _ := newTestSeededApp(t, nil, newTestUploadConfig(), testFile{&metadata.Record{
+		ID:              "photo.jpg",
+		OriginalName:    "encrypted.bin",
+		ContentType:     "application/octet-stream",
+		MaxDownloads:    1,
+		ClientEncrypted: true,
+	}, "ciphertext"})
+
+	get := func(path, accept string) (*http.Response, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept", accept)
+
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test() error = %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	// Browsers get the page decrypting the file, which does not count as a download
+	resp, body := get("/photo.jpg", "text/html,application/xhtml+xml,*/*;q=0.8")
+	if resp.StatusCode != 200 || !strings.Contains(body, `id="decryptPage" data-url="/photo.jpg/raw"`) {
+		t.Fatalf("GET page = %d, want the decrypt page:\n%s", resp.StatusCode, body)
+	}
+	if strings.Contains(body, "ciphertext") {
+		t.Error("decrypt page contains the file content")
+	}
+
+	if resp, _ := get("/photo.jpg?inline=1", "*/*"); resp.StatusCode != 400 {
+		t.Errorf("GET preview status = %d, want 400", resp.StatusCode)
+	}
+
+	// The page fetches the encrypted bytes, never shown inline whatever the name
+	resp, body = get("/photo.jpg", "application/octet-stream")
+	if resp.StatusCode != 200 || body != "ciphertext" {
+		t.Fatalf("GET = %d %q, want 200 %q", resp.StatusCode, body, "ciphertext")
+	}
+	if got := resp.Header.Get("Content-Type"); got != "application/octet-stream" {
+		t.Errorf("Content-Type = %q, want application/octet-stream", got)
+	}
+	if got := resp.Header.Get("Content-Disposition"); !strings.HasPrefix(got, "attachment") {
+		t.Errorf("Content-Disposition = %q, want attachment", got)
+	}
+}
+
+// newTestSignedApp returns the upload test app with signed download links
+func newTestSignedApp(t *testing.T) *fiber.App {
+	cfg := newTestUploadConfig()
+	cfg.LinkSigningSecret = strings.Repeat("s", 32)
+	cfg.SignedLinkExpiry = 10 * time.Minute
+
+	app, _ := newTestSeededApp(t, nil, cfg)
+	return app
+}
+
+func TestDownloadFile_SignedLinks(t *testing.T) {
+	app := newTestSignedApp(t)
+
+	req := httptest.NewRequest("PUT", "/notes.txt", strings.NewReader("hi"))
+	req.Header.Set("Accept", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	var uploaded models.UploadResponse
+	if err := json.NewDecoder(resp.Body).Decode(&uploaded); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if !strings.HasPrefix(uploaded.DownloadURL, "/"+uploaded.Filename+"?") || !strings.Contains(uploaded.DownloadURL, "signature=") {
+		t.Fatalf("download_url = %q, want a signed link", uploaded.DownloadURL)
+	}
+
+	link, _ := url.Parse(uploaded.DownloadURL)
+	query := link.Query()
+
+	// A link signed with the server secret that expired a minute ago
+	expired := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(strings.Repeat("s", 32)))
+	mac.Write([]byte(uploaded.Filename + "\n" + expired))
+	expiredQuery := url.Values{"expires": {expired}, "signature": {base64.RawURLEncoding.EncodeToString(mac.Sum(nil))}}
+
+	tamperedExpiry := url.Values{"expires": {query.Get("expires") + "0"}, "signature": {query.Get("signature")}}
+	tamperedSignature := url.Values{"expires": {query.Get("expires")}, "signature": {"A" + query.Get("signature")[1:]}}
+	if query.Get("signature")[0] == 'A' {
+		tamperedSignature.Set("signature", "B"+query.Get("signature")[1:])
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantError  string
+	}{
+		{"Unsigned", "/" + uploaded.Filename, 403, "Invalid or missing link signature"},
+		{"TamperedExpiry", "/" + uploaded.Filename + "?" + tamperedExpiry.Encode(), 403, "Invalid or missing link signature"},
+		{"TamperedSignature", "/" + uploaded.Filename + "?" + tamperedSignature.Encode(), 403, "Invalid or missing link signature"},
+		{"OtherFile", "/other.txt?" + query.Encode(), 403, "Invalid or missing link signature"},
+		{"Expired", "/" + uploaded.Filename + "?" + expiredQuery.Encode(), 403, "Link has expired"},
+		{"Signed", uploaded.DownloadURL, 200, ""},
+		{"ArchiveUnsigned", "/api/archive?files=" + uploaded.Filename, 403, "Invalid or missing link signature"},
+		{"ArchiveSigned", "/api/archive?files=" + url.QueryEscape(uploaded.DownloadURL), 200, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := app.Test(httptest.NewRequest("GET", tt.path, nil))
+			if err != nil {
+				t.Fatalf("app.Test() error = %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantError != "" && !strings.Contains(string(body), tt.wantError) {
+				t.Errorf("body = %s, want error %q", body, tt.wantError)
+			}
+			if tt.name == "Signed" && string(body) != "hi" {
+				t.Errorf("body = %q, want the file content", body)
+			}
+		})
+	}
+}
+
+// newTestLandingApp returns an app serving notes.txt and once.txt, which may be
+// downloaded once, with or without landing pages
+func newTestLandingApp(t *testing.T, landingPage bool) (*fiber.App, *services.FileService) {
+	cfg := newTestUploadConfig()
+	cfg.EnableLandingPage = landingPage
+
+	return newTestSeededApp(t, nil, cfg,
+		testFile{&metadata.Record{ID: "notes.txt", OriginalName: "meeting notes.txt", ContentType: "text/plain; charset=utf-8"}, "hello"},
+		testFile{&metadata.Record{ID: "once.txt", OriginalName: "secret.txt", ContentType: "text/plain; charset=utf-8", MaxDownloads: 1}, "hello"},
+	)
+}
+
+const (
+	testBrowserUserAgent = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0 Safari/537.36"
+	testBotUserAgent     = "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)"
+)
+
+func TestDownloadFile_LandingPage(t *testing.T) {
+	app, fileService := newTestLandingApp(t, true)
+
+	get := func(path, userAgent, accept string) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("User-Agent", userAgent)
+		req.Header.Set("Accept", accept)
+
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test() error = %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	downloads := func(id string) int {
+		record, err := fileService.Lookup(id)
+		if err != nil {
+			t.Fatalf("Lookup() error = %v", err)
+		}
+		return record.Downloads
+	}
+
+	const html = "text/html,application/xhtml+xml,*/*;q=0.8"
+
+	status, body := get("/notes.txt", testBrowserUserAgent, html)
+	for _, want := range []string{
+		"meeting notes.txt", "5 B", "text/plain; charset=utf-8", `data-expiry="`,
+		`<meta property="og:title" content="meeting notes.txt">`,
+		`href="https://files.example.com/oembed?format=json&amp;url=https%3A%2F%2Ffiles.example.com%2Fnotes.txt"`,
+		`href="/notes.txt/raw"`,
+	} {
+		if status != 200 || !strings.Contains(body, want) {
+			t.Fatalf("GET page = %d, want the landing page with %q:\n%s", status, want, body)
+		}
+	}
+
+	// Scripts still get the content at the download URL, and everyone at /raw
+	if status, body := get("/notes.txt", "curl/8.5.0", "*/*"); status != 200 || body != "hello" {
+		t.Errorf("GET with curl = %d %q, want the content", status, body)
+	}
+	if status, body := get("/notes.txt/raw", testBrowserUserAgent, html); status != 200 || body != "hello" {
+		t.Errorf("GET raw = %d %q, want the content", status, body)
+	}
+
+	// Link previews get the page whatever they accept, and never count a download
+	for _, path := range []string{"/notes.txt", "/once.txt", "/once.txt/raw"} {
+		if status, body := get(path, testBotUserAgent, "*/*"); status != 200 || !strings.Contains(body, "og:title") {
+			t.Errorf("GET %s by a bot = %d, want the landing page:\n%s", path, status, body)
+		}
+	}
+	if got := downloads("once.txt"); got != 0 {
+		t.Fatalf("downloads = %d after link previews, want 0", got)
+	}
+
+	if status, body := get("/once.txt/raw", testBrowserUserAgent, html); status != 200 || body != "hello" {
+		t.Errorf("GET raw = %d %q, want the content", status, body)
+	}
+	waitForRemoval(t, fileService, "once.txt")
+
+	// oEmbed describes the page behind a link
+	status, body = get("/oembed?url="+url.QueryEscape("https://files.example.com/notes.txt"), testBotUserAgent, "application/json")
+	var oembed map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &oembed); err != nil || status != 200 {
+		t.Fatalf("GET oembed = %d %s, want JSON", status, body)
+	}
+	if oembed["type"] != "link" || oembed["title"] != "meeting notes.txt" || oembed["provider_url"] != "https://files.example.com" {
+		t.Errorf("oembed = %v, want a link to meeting notes.txt", oembed)
+	}
+	status, body = get("/oembed?url="+url.QueryEscape("https://files.example.com/notes.txt/raw"), testBotUserAgent, "application/json")
+	if status != 200 || !strings.Contains(body, `"title":"meeting notes.txt"`) {
+		t.Errorf("GET oembed of a raw link = %d %s, want meeting notes.txt", status, body)
+	}
+	if status, _ := get("/oembed?url=%2Fmissing.txt", testBotUserAgent, "application/json"); status != 404 {
+		t.Errorf("GET oembed of a missing file = %d, want 404", status)
+	}
+}
+
+func TestDownloadFile_BotsDoNotCountDownloads(t *testing.T) {
+	app, fileService := newTestLandingApp(t, false)
+
+	get := func(path string) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("User-Agent", testBotUserAgent)
+
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test() error = %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// Without landing pages bots get the content, unless it would use up a download
+	if status, body := get("/notes.txt"); status != 200 || body != "hello" {
+		t.Errorf("GET = %d %q, want the content", status, body)
+	}
+	if status, body := get("/once.txt"); status != 200 || !strings.Contains(body, "og:title") {
+		t.Errorf("GET limited file = %d, want the landing page:\n%s", status, body)
+	}
+
+	record, err := fileService.Lookup("once.txt")
+	if err != nil {
+		t.Fatalf("Lookup() error = %v", err)
+	}
+	if record.Downloads != 0 {
+		t.Errorf("downloads = %d, want 0", record.Downloads)
+	}
+}
+
+func TestDownloadFile_ActiveContent(t *testing.T) {
+	app, _ := newTestUploadApp(t)
+
+	tests := []struct {
+		name            string
+		filename        string
+		content         string
+		wantType        string
+		wantDisposition string
+		wantSandbox     bool
+	}{
+		{"HTML", "page.html", "<b onclick=x>", "application/octet-stream", "attachment", true},
+		{"SVG", "logo.svg", "<svg onload=x/>", "application/octet-stream", "attachment", true},
+		{"XML", "feed.xml", "<?xml?><a/>", "application/octet-stream", "attachment", true},
+		{"Image", "photo.png", "\x89PNG\r\n\x1a\n", "image/png", "inline", true},
+		{"PDF", "doc.pdf", "%PDF-1.7", "application/pdf", "inline", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("PUT", "/"+tt.filename, strings.NewReader(tt.content))
+			req.Header.Set("Accept", "application/json")
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("app.Test() error = %v", err)
+			}
+			var uploaded models.UploadResponse
+			if err := json.NewDecoder(resp.Body).Decode(&uploaded); err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+
+			// Not even asking for a preview renders active content
+			resp, err = app.Test(httptest.NewRequest("GET", uploaded.DownloadURL+"?inline=1", nil))
+			if err != nil {
+				t.Fatalf("app.Test() error = %v", err)
+			}
+			if resp.StatusCode != 200 {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+
+			if got := resp.Header.Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			if got := resp.Header.Get("Content-Disposition"); !strings.HasPrefix(got, tt.wantDisposition+";") {
+				t.Errorf("Content-Disposition = %q, want %s", got, tt.wantDisposition)
+			}
+
+			csp := resp.Header.Get("Content-Security-Policy")
+			if !strings.Contains(csp, "default-src 'none'") || strings.Contains(csp, "sandbox") != tt.wantSandbox {
+				t.Errorf("Content-Security-Policy = %q, want sandbox %v", csp, tt.wantSandbox)
+			}
+		})
+	}
+}
+
+func TestDownloadFile_DownloadOrigin(t *testing.T) {
+	cfg := newTestUploadConfig()
+	cfg.DownloadOrigin = "https://dl.example.com"
+	app, _ := newTestSeededApp(t, nil, cfg)
+
+	req := httptest.NewRequest("PUT", "https://files.example.com/notes.txt", strings.NewReader("hi"))
+	req.Header.Set("Accept", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	var uploaded models.UploadResponse
+	if err := json.NewDecoder(resp.Body).Decode(&uploaded); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+
+	get := func(target string, header map[string]string) *http.Response {
+		req := httptest.NewRequest("GET", target, nil)
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test() error = %v", err)
+		}
+		return resp
+	}
+
+	// Browsers are sent to the download origin for the content
+	resp = get("https://files.example.com"+uploaded.DownloadURL+"?download=1", map[string]string{"Accept": "text/html,*/*;q=0.8"})
+	if want := "https://dl.example.com" + uploaded.DownloadURL + "?download=1"; resp.StatusCode != 307 || resp.Header.Get("Location") != want {
+		t.Errorf("GET by a browser = %d to %q, want 307 to %q", resp.StatusCode, resp.Header.Get("Location"), want)
+	}
+
+	// Scripts and fetches read it on the web UI origin
+	for _, header := range []map[string]string{{"Accept": "*/*"}, {"Accept": "text/html", "Sec-Fetch-Dest": "empty"}} {
+		if resp := get("https://files.example.com"+uploaded.DownloadURL, header); resp.StatusCode != 200 {
+			t.Errorf("GET with %v = %d, want 200", header, resp.StatusCode)
+		}
+	}
+
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		{uploaded.DownloadURL, 200},
+		{uploaded.DownloadURL + "/raw", 200},
+		{"/", 404},
+		{"/api/stats", 404},
+		{uploaded.DeleteURL, 404},
+	}
+
+	// The download origin serves the content and nothing else
+	for _, tt := range tests {
+		resp := get("https://dl.example.com"+tt.path, map[string]string{"Accept": "text/html,*/*;q=0.8"})
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("GET %s on the download origin = %d, want %d", tt.path, resp.StatusCode, tt.wantStatus)
+		}
+	}
+}
+
+func TestDownloadFile_TypeMismatch(t *testing.T) {
+	app, _ := newTestUploadApp(t)
+
+	req := httptest.NewRequest("PUT", "/photo.jpg", strings.NewReader("MZ\x90\x00\x03\x00"))
+	req.Header.Set("Accept", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	var uploaded models.UploadResponse
+	if err := json.NewDecoder(resp.Body).Decode(&uploaded); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+
+	// A disguised file is served as what it really is, and never inline
+	resp, err = app.Test(httptest.NewRequest("GET", uploaded.DownloadURL+"?inline=1", nil))
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Type"); got != utils.TypePE {
+		t.Errorf("Content-Type = %q, want %q", got, utils.TypePE)
+	}
+	if got := resp.Header.Get("Content-Disposition"); !strings.HasPrefix(got, "attachment;") {
+		t.Errorf("Content-Disposition = %q, want attachment", got)
+	}
+}
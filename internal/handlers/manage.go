@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandeptwidyaop/tempfile/internal/metadata"
+	"github.com/pandeptwidyaop/tempfile/internal/services"
+	"github.com/pandeptwidyaop/tempfile/internal/utils"
+)
+
+// DeleteFile removes a file before it expires, given its delete token
+func (h *FileHandler) DeleteFile(c *fiber.Ctx) error {
+	filename := c.Params("filename")
+
+	record, err := h.fileService.Authorize(filename, deleteToken(c))
+	if err != nil {
+		return h.lookupError(c, filename, err)
+	}
+
+	if err := h.remove(record); err != nil {
+		return h.lookupError(c, filename, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "File deleted successfully",
+	})
+}
+
+// UpdateFile changes the expiry of a file, given its delete token, while
+// keeping its download URL. The new expiry is sent as expires_in in a JSON or
+// form body, or in the X-Expires-In header
+func (h *FileHandler) UpdateFile(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	expiresIn, ok := expiresInParam(c)
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	now := time.Now()
+	record, err := h.fileService.UpdateExpiry(id, deleteToken(c), expiresIn, now)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidExpiry) {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid expires_in: use a duration such as 10m, 6h or 3d, or an RFC 3339 time",
+			})
+		}
+		return h.lookupError(c, id, err)
+	}
+
+	if h.config.Debug {
+		log.Printf("File expiry updated: %s (expires %s)", record.ID, record.ExpiresAt.Format(time.RFC3339))
+	}
+
+	return c.JSON(fiber.Map{
+		"message":      "Expiry updated successfully",
+		"filename":     record.ID,
+		"expires_at":   record.ExpiresAt.Format(time.RFC3339),
+		"expires_in":   utils.FormatDuration(record.ExpiresAt.Sub(now)),
+		"download_url": h.fileService.DownloadURL(record),
+	})
+}
+
+// CreateLink mints an additional signed download link to a file, given its
+// delete token. The link expires after expires_in, sent like UpdateFile's, or
+// after SIGNED_LINK_EXPIRY, and never outlives the file
+func (h *FileHandler) CreateLink(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	expiresIn, ok := expiresInParam(c)
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	now := time.Now()
+	link, expiresAt, err := h.fileService.MintLink(id, deleteToken(c), expiresIn, now)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrSignedLinksDisabled):
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Signed links are not enabled",
+			})
+		case errors.Is(err, services.ErrInvalidExpiry):
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid expires_in: use a duration such as 10m or 6h, or a future RFC 3339 time",
+			})
+		}
+		return h.lookupError(c, id, err)
+	}
+
+	if h.config.Debug {
+		log.Printf("Download link created: %s (expires %s)", id, expiresAt.Format(time.RFC3339))
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message":      "Link created successfully",
+		"filename":     id,
+		"download_url": link,
+		"expires_at":   expiresAt.Format(time.RFC3339),
+		"expires_in":   utils.FormatDuration(expiresAt.Sub(now)),
+	})
+}
+
+// expiresInParam returns the expires_in of a JSON or form body, or of the
+// X-Expires-In header. It reports false for a malformed body
+func expiresInParam(c *fiber.Ctx) (string, bool) {
+	var body struct {
+		ExpiresIn string `json:"expires_in" form:"expires_in"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&body); err != nil {
+			return "", false
+		}
+	}
+	if body.ExpiresIn == "" {
+		body.ExpiresIn = c.Get("X-Expires-In")
+	}
+
+	return body.ExpiresIn, true
+}
+
+// deleteToken returns the delete token sent with a request, from the
+// X-Delete-Token header, a Bearer authorization or the token query parameter
+func deleteToken(c *fiber.Ctx) string {
+	if token := c.Get("X-Delete-Token"); token != "" {
+		return token
+	}
+
+	if scheme, token, ok := strings.Cut(c.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+
+	return c.Query("token")
+}
+
+// DeletePage asks for confirmation before deleting a file, so that link
+// previews and prefetching can never delete it by following the delete URL.
+// The delete URL carries the token in its fragment, which never reaches the
+// server or its logs; the page reads it from there and posts it with the
+// confirmation. Older links with the token in the query are checked right away
+func (h *FileHandler) DeletePage(c *fiber.Ctx) error {
+	filename := c.Params("filename")
+	token := c.Query("token")
+
+	var record *metadata.Record
+	var err error
+	if token != "" {
+		record, err = h.fileService.Authorize(filename, token)
+	} else {
+		record, err = h.fileService.Lookup(filename)
+	}
+	if err != nil {
+		return h.deleteError(c, filename, err)
+	}
+
+	// Without the token the name the file was uploaded with stays private
+	originalName := ""
+	if token != "" {
+		originalName = record.OriginalName
+	}
+
+	c.Set("Cache-Control", "no-store")
+
+	if h.templateService == nil {
+		return c.JSON(fiber.Map{
+			"message":  "POST the delete token to this URL to delete the file",
+			"filename": record.ID,
+		})
+	}
+
+	return h.templateService.RenderDeletePage(c, record.ID, originalName, token, false)
+}
+
+// ConfirmDelete deletes a file once confirmed on the delete page
+func (h *FileHandler) ConfirmDelete(c *fiber.Ctx) error {
+	filename := c.Params("filename")
+
+	token := c.FormValue("token")
+	if token == "" {
+		token = c.Query("token")
+	}
+
+	record, err := h.fileService.Authorize(filename, token)
+	if err != nil {
+		return h.deleteError(c, filename, err)
+	}
+
+	if err := h.remove(record); err != nil {
+		return h.deleteError(c, filename, err)
+	}
+
+	if h.templateService == nil || !wantsHTML(c) {
+		return c.JSON(fiber.Map{
+			"message": "File deleted successfully",
+		})
+	}
+
+	return h.templateService.RenderDeletePage(c, record.ID, record.OriginalName, "", true)
+}
+
+// remove deletes a file on behalf of its uploader
+func (h *FileHandler) remove(record *metadata.Record) error {
+	if err := h.fileService.Remove(record.ID); err != nil {
+		return err
+	}
+
+	if h.config.Debug {
+		log.Printf("File deleted by uploader: %s", record.ID)
+	}
+
+	return nil
+}
+
+// deleteError writes a failed deletion as an error page for browsers, and
+// like any other lookup error otherwise
+func (h *FileHandler) deleteError(c *fiber.Ctx, filename string, err error) error {
+	if h.templateService == nil || !wantsHTML(c) {
+		return h.lookupError(c, filename, err)
+	}
+
+	switch {
+	case errors.Is(err, metadata.ErrNotFound), errors.Is(err, services.ErrInvalidFilename):
+		c.Status(404)
+		return h.templateService.RenderErrorPage(c, "File Not Found", "The file does not exist or has already been deleted.", "Files are removed automatically once they expire.")
+	case errors.Is(err, services.ErrInvalidToken):
+		c.Status(403)
+		return h.templateService.RenderErrorPage(c, "Delete Failed", "This delete link is not valid for the file.", "Check that the whole link was copied.")
+	default:
+		log.Printf("Error deleting file %s: %v", filename, err)
+		c.Status(500)
+		return h.templateService.RenderErrorPage(c, "Delete Failed", "The file could not be deleted.", "Please try again later.")
+	}
+}
@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandeptwidyaop/tempfile/internal/metadata"
+)
+
+// uploadForDeletion uploads a file and returns its ID and delete URL
+func uploadForDeletion(t *testing.T, app *fiber.App) (string, string) {
+	t.Helper()
+
+	req := httptest.NewRequest("PUT", "/notes.txt", strings.NewReader("hi"))
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+
+	id, _ := result["filename"].(string)
+	token, _ := result["delete_token"].(string)
+	deleteURL, _ := result["delete_url"].(string)
+	if id == "" || token == "" {
+		t.Fatalf("response = %v, want a filename and delete_token", result)
+	}
+	if deleteURL != "/"+id+"/delete#token="+token {
+		t.Errorf("delete_url = %q, want the confirmation page with the token in the fragment", deleteURL)
+	}
+
+	return id, deleteURL
+}
+
+func TestDeleteFile(t *testing.T) {
+	app, fileService := newTestUploadApp(t)
+	id, deleteURL := uploadForDeletion(t, app)
+	token := deleteURL[strings.Index(deleteURL, "token=")+len("token="):]
+
+	deleteRequest := func(token string) int {
+		req := httptest.NewRequest("DELETE", "/"+id, nil)
+		req.Header.Set("X-Delete-Token", token)
+
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test() error = %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	if status := deleteRequest("not-the-token"); status != 403 {
+		t.Errorf("wrong token status = %d, want 403", status)
+	}
+	if _, err := fileService.Lookup(id); err != nil {
+		t.Fatalf("file was removed with a wrong token: %v", err)
+	}
+
+	if status := deleteRequest(token); status != 200 {
+		t.Fatalf("status = %d, want 200", status)
+	}
+	if _, err := fileService.Lookup(id); !errors.Is(err, metadata.ErrNotFound) {
+		t.Errorf("Lookup() error = %v, want ErrNotFound", err)
+	}
+
+	if status := deleteRequest(token); status != 404 {
+		t.Errorf("second delete status = %d, want 404", status)
+	}
+}
+
+func TestDeletePage_RequiresConfirmation(t *testing.T) {
+	app, fileService := newTestUploadApp(t)
+	id, deleteURL := uploadForDeletion(t, app)
+	token := deleteURL[strings.Index(deleteURL, "token=")+len("token="):]
+
+	// Following the link only asks for confirmation, and the token in its
+	// fragment is not sent along
+	req := httptest.NewRequest("GET", deleteURL, nil)
+	req.Header.Set("Accept", "text/html")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		t.Fatalf("GET status = %d, want 200", resp.StatusCode)
+	}
+	if strings.Contains(string(body), token) || strings.Contains(string(body), "notes.txt") {
+		t.Errorf("page without the token shows it or the original name:\n%s", body)
+	}
+	if _, err := fileService.Lookup(id); err != nil {
+		t.Fatalf("file was removed by following the link: %v", err)
+	}
+
+	confirm := func(token string) int {
+		req := httptest.NewRequest("POST", "/"+id+"/delete", strings.NewReader(url.Values{"token": {token}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test() error = %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	if status := confirm(""); status != 403 {
+		t.Errorf("POST without the token status = %d, want 403", status)
+	}
+	if status := confirm(token); status != 200 {
+		t.Fatalf("POST status = %d, want 200", status)
+	}
+	if _, err := fileService.Lookup(id); !errors.Is(err, metadata.ErrNotFound) {
+		t.Errorf("Lookup() error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestUpdateFile_Expiry(t *testing.T) {
+	app, fileService := newTestUploadApp(t)
+	id, deleteURL := uploadForDeletion(t, app)
+	token := deleteURL[strings.Index(deleteURL, "token=")+len("token="):]
+
+	update := func(token, body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest("PATCH", "/api/files/"+id, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test() error = %v", err)
+		}
+
+		var result map[string]interface{}
+		_ = json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result
+	}
+
+	if status, _ := update("not-the-token", `{"expires_in": "2d"}`); status != 403 {
+		t.Errorf("wrong token status = %d, want 403", status)
+	}
+	if status, _ := update(token, `{"expires_in": "soon"}`); status != 400 {
+		t.Errorf("invalid expiry status = %d, want 400", status)
+	}
+
+	tests := []struct {
+		name      string
+		expiresIn string
+		want      time.Duration
+	}{
+		{"Extend", "2d", 48 * time.Hour},
+		{"Shorten", "30m", 30 * time.Minute},
+		{"ClampedToMax", "30d", 72 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, result := update(token, `{"expires_in": "`+tt.expiresIn+`"}`)
+			if status != 200 {
+				t.Fatalf("status = %d, want 200 (%v)", status, result)
+			}
+			if result["download_url"] != "/"+id {
+				t.Errorf("download_url = %v, want the unchanged /%s", result["download_url"], id)
+			}
+
+			record, err := fileService.Lookup(id)
+			if err != nil {
+				t.Fatalf("Lookup() error = %v", err)
+			}
+			if got := time.Until(record.ExpiresAt); got < tt.want-time.Minute || got > tt.want {
+				t.Errorf("expires in %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateLink(t *testing.T) {
+	app := newTestSignedApp(t)
+	id, deleteURL := uploadForDeletion(t, app)
+	token := deleteURL[strings.Index(deleteURL, "token=")+len("token="):]
+
+	create := func(token, body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest("POST", "/api/files/"+id+"/links", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test() error = %v", err)
+		}
+
+		var result map[string]interface{}
+		_ = json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result
+	}
+
+	if status, _ := create("not-the-token", ""); status != 403 {
+		t.Errorf("wrong token status = %d, want 403", status)
+	}
+	if status, _ := create(token, `{"expires_in": "-5m"}`); status != 400 {
+		t.Errorf("past expiry status = %d, want 400", status)
+	}
+
+	tests := []struct {
+		name      string
+		expiresIn string
+		want      time.Duration
+	}{
+		{"Default", "", 10 * time.Minute},
+		{"Duration", "5m", 5 * time.Minute},
+		{"ClampedToFile", "6h", time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := ""
+			if tt.expiresIn != "" {
+				body = `{"expires_in": "` + tt.expiresIn + `"}`
+			}
+
+			status, result := create(token, body)
+			if status != 201 {
+				t.Fatalf("status = %d, want 201 (%v)", status, result)
+			}
+
+			expiresAt, err := time.Parse(time.RFC3339, result["expires_at"].(string))
+			if err != nil {
+				t.Fatalf("expires_at = %v: %v", result["expires_at"], err)
+			}
+			if got := time.Until(expiresAt); got < tt.want-time.Minute || got > tt.want {
+				t.Errorf("link expires in %v, want %v", got, tt.want)
+			}
+
+			link, _ := result["download_url"].(string)
+			resp, err := app.Test(httptest.NewRequest("GET", link, nil))
+			if err != nil {
+				t.Fatalf("app.Test() error = %v", err)
+			}
+			if resp.StatusCode != 200 {
+				t.Errorf("GET %s = %d, want 200", link, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestCreateLink_Disabled(t *testing.T) {
+	app, _ := newTestUploadApp(t)
+	id, deleteURL := uploadForDeletion(t, app)
+	token := deleteURL[strings.Index(deleteURL, "token=")+len("token="):]
+
+	req := httptest.NewRequest("POST", "/api/files/"+id+"/links", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	if resp.StatusCode != 404 {
+		t.Errorf("status = %d, want 404 without signed links", resp.StatusCode)
+	}
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandeptwidyaop/tempfile/internal/metadata"
+	"github.com/pandeptwidyaop/tempfile/internal/utils"
+)
+
+// authorize checks the password of a protected file. When the request may
+// not download the file it writes the response and returns false
+func (h *FileHandler) authorize(c *fiber.Ctx, record *metadata.Record) (bool, error) {
+	if record.PasswordHash == "" {
+		return true, nil
+	}
+
+	// Responses depend on the password sent, so shared caches must not keep them
+	c.Vary("Authorization", "X-File-Password")
+
+	password := suppliedPassword(c)
+	if password == "" {
+		return false, h.passwordRequired(c, record, fiber.StatusUnauthorized, "Password required")
+	}
+
+	// Wrong passwords are limited per client across all files. The attempt is
+	// counted before the password is checked, so parallel guesses can't all
+	// pass the limit, and given back once the password turns out right
+	key := "password:" + utils.GetClientIP(c, h.ipDetector)
+	allowed, retryAfter, err := h.attempts.Reserve(key)
+	if err != nil {
+		log.Printf("Error checking password attempts for %s: %v", record.ID, err)
+		return false, c.Status(500).JSON(fiber.Map{
+			"error": "Failed to check password",
+		})
+	}
+	if !allowed {
+		c.Set("Retry-After", fmt.Sprintf("%d", int(retryAfter.Seconds())))
+		return false, h.passwordRequired(c, record, fiber.StatusTooManyRequests,
+			"Too many incorrect passwords, try again in "+utils.FormatDuration(retryAfter))
+	}
+
+	if !utils.VerifyPassword(record.PasswordHash, password) {
+		return false, h.passwordRequired(c, record, fiber.StatusUnauthorized, "Incorrect password")
+	}
+
+	if err := h.attempts.Refund(key); err != nil {
+		log.Printf("Error refunding password attempt for %s: %v", record.ID, err)
+	}
+
+	return true, nil
+}
+
+// passwordRequired asks for the password of a protected file, with the
+// prompt page for browsers and a JSON error for API clients
+func (h *FileHandler) passwordRequired(c *fiber.Ctx, record *metadata.Record, status int, message string) error {
+	c.Status(status)
+	c.Set("Cache-Control", "no-store")
+
+	if h.templateService != nil && wantsHTML(c) {
+		// Only a prompt that follows an attempt needs to explain itself
+		if c.Method() != fiber.MethodPost && status == fiber.StatusUnauthorized {
+			message = ""
+		}
+		return h.templateService.RenderPasswordPage(c, record.ID, record.OriginalName, message)
+	}
+
+	if status == fiber.StatusUnauthorized {
+		c.Set("WWW-Authenticate", `Basic realm="tempfile", charset="UTF-8"`)
+	}
+
+	return c.JSON(fiber.Map{
+		"error": message,
+	})
+}
+
+// suppliedPassword returns the password sent with a download request, from the
+// X-File-Password header, the password of Basic authorization, or the prompt form
+func suppliedPassword(c *fiber.Ctx) string {
+	if password := c.Get("X-File-Password"); password != "" {
+		return password
+	}
+
+	if scheme, credentials, ok := strings.Cut(c.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Basic") {
+		if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials)); err == nil {
+			// Any user name is accepted, e.g. curl -u :password
+			if _, password, ok := strings.Cut(string(decoded), ":"); ok {
+				return password
+			}
+		}
+	}
+
+	if c.Method() == fiber.MethodPost {
+		return c.FormValue("password")
+	}
+
+	return ""
+}
@@ -0,0 +1,330 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandeptwidyaop/tempfile/internal/metadata"
+)
+
+// maxRanges limits how many ranges a single request may ask for
+const maxRanges = 16
+
+var (
+	// errInvalidRange indicates a Range header that should be ignored
+	errInvalidRange = errors.New("invalid range")
+
+	// errUnsatisfiableRange indicates a Range header none of whose ranges overlap the file
+	errUnsatisfiableRange = errors.New("unsatisfiable range")
+)
+
+// byteRange is a satisfiable range of a file
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+// contentRange formats the range as a Content-Range header value
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// serveContent writes a file's content, honoring conditional and range requests
+func (h *FileHandler) serveContent(c *fiber.Ctx, record *metadata.Record, contentType string) error {
+	etag := fileETag(record)
+	lastModified := record.CreatedAt.UTC().Truncate(time.Second)
+
+	c.Set("Accept-Ranges", "bytes")
+	c.Set("ETag", etag)
+	c.Set("Last-Modified", lastModified.Format(http.TimeFormat))
+
+	// Caches must not keep serving the file once it has expired
+	maxAge := int64(time.Until(record.ExpiresAt).Seconds())
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	c.Set("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+	c.Set("Expires", record.ExpiresAt.UTC().Format(http.TimeFormat))
+
+	if isNotModified(c, etag, lastModified) {
+		c.Status(fiber.StatusNotModified)
+		return nil
+	}
+
+	size := record.Size
+	var ranges []byteRange
+
+	if rangeHeader := c.Get("Range"); rangeHeader != "" && ifRangeMatches(c, etag, lastModified) {
+		parsed, err := parseRange(rangeHeader, size)
+		switch {
+		case errors.Is(err, errUnsatisfiableRange):
+			c.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			return c.Status(fiber.StatusRequestedRangeNotSatisfiable).JSON(fiber.Map{
+				"error": "Requested range not satisfiable",
+			})
+		case err == nil:
+			ranges = parsed
+		}
+		// Malformed ranges are ignored and the whole file is served
+	}
+
+	switch len(ranges) {
+	case 0:
+		c.Set("Content-Type", contentType)
+		return h.sendRange(c, record, 0, size)
+	case 1:
+		c.Set("Content-Type", contentType)
+		c.Set("Content-Range", ranges[0].contentRange(size))
+		c.Status(fiber.StatusPartialContent)
+		return h.sendRange(c, record, ranges[0].start, ranges[0].length)
+	default:
+		c.Status(fiber.StatusPartialContent)
+		return h.sendMultipartRanges(c, record, ranges, contentType)
+	}
+}
+
+// sendRange streams length bytes of a file starting at offset
+func (h *FileHandler) sendRange(c *fiber.Ctx, record *metadata.Record, offset, length int64) error {
+	if c.Method() == fiber.MethodHead {
+		c.Response().Header.SetContentLength(int(length))
+		return nil
+	}
+
+	var reader io.ReadCloser
+	var err error
+	if offset == 0 && length == record.Size {
+		reader, _, err = h.fileService.Open(record)
+	} else {
+		reader, err = h.fileService.OpenRange(record, offset, length)
+	}
+	if err != nil {
+		return h.lookupError(c, record.ID, err)
+	}
+
+	// The stream is closed once fully sent
+	return c.SendStream(reader, int(length))
+}
+
+// sendMultipartRanges streams several ranges as a multipart/byteranges body
+func (h *FileHandler) sendMultipartRanges(c *fiber.Ctx, record *metadata.Record, ranges []byteRange, contentType string) error {
+	size := record.Size
+
+	// Dry run the multipart encoding to learn the exact body length
+	counter := &countingWriter{}
+	dryRun := multipart.NewWriter(counter)
+	for _, r := range ranges {
+		if _, err := dryRun.CreatePart(rangePartHeader(r, contentType, size)); err != nil {
+			return err
+		}
+		counter.n += r.length
+	}
+	if err := dryRun.Close(); err != nil {
+		return err
+	}
+	boundary := dryRun.Boundary()
+
+	c.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+
+	if c.Method() == fiber.MethodHead {
+		c.Response().Header.SetContentLength(int(counter.n))
+		return nil
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		mw := multipart.NewWriter(pw)
+		if err := mw.SetBoundary(boundary); err != nil {
+			_ = pw.CloseWithError(err)
+			return
+		}
+
+		for _, r := range ranges {
+			part, err := mw.CreatePart(rangePartHeader(r, contentType, size))
+			if err != nil {
+				_ = pw.CloseWithError(err)
+				return
+			}
+
+			reader, err := h.fileService.OpenRange(record, r.start, r.length)
+			if err != nil {
+				_ = pw.CloseWithError(err)
+				return
+			}
+
+			_, err = io.Copy(part, reader)
+			_ = reader.Close()
+			if err != nil {
+				_ = pw.CloseWithError(err)
+				return
+			}
+		}
+
+		_ = pw.CloseWithError(mw.Close())
+	}()
+
+	// Closing the pipe reader after sending also stops the writer goroutine
+	return c.SendStream(pr, int(counter.n))
+}
+
+// rangePartHeader returns the part header of one range in a multipart/byteranges body
+func rangePartHeader(r byteRange, contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Type":  {contentType},
+		"Content-Range": {r.contentRange(size)},
+	}
+}
+
+// parseRange parses a Range header such as "bytes=0-99,-500" for a file of the given size
+func parseRange(header string, size int64) ([]byteRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, errInvalidRange
+	}
+
+	var ranges []byteRange
+	var total int64
+	noOverlap := false
+
+	for _, spec := range strings.Split(header[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		startStr, endStr, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, errInvalidRange
+		}
+		startStr, endStr = strings.TrimSpace(startStr), strings.TrimSpace(endStr)
+
+		var r byteRange
+		if startStr == "" {
+			// Suffix range: the last N bytes
+			n, err := strconv.ParseInt(endStr, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errInvalidRange
+			}
+			if n == 0 || size == 0 {
+				noOverlap = true
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = byteRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(startStr, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errInvalidRange
+			}
+			if start >= size {
+				noOverlap = true
+				continue
+			}
+
+			end := size - 1
+			if endStr != "" {
+				e, err := strconv.ParseInt(endStr, 10, 64)
+				if err != nil || e < start {
+					return nil, errInvalidRange
+				}
+				if e < end {
+					end = e
+				}
+			}
+			r = byteRange{start: start, length: end - start + 1}
+		}
+
+		ranges = append(ranges, r)
+		total += r.length
+	}
+
+	if len(ranges) == 0 {
+		if noOverlap {
+			return nil, errUnsatisfiableRange
+		}
+		return nil, errInvalidRange
+	}
+
+	// Refuse to amplify: too many ranges, or more bytes than the file itself
+	if len(ranges) > maxRanges || total > size {
+		return nil, errInvalidRange
+	}
+
+	return ranges, nil
+}
+
+// fileETag returns a strong entity tag identifying a stored file's content:
+// its SHA-256 digest, or for files stored without one their creation time and size
+func fileETag(record *metadata.Record) string {
+	if record.SHA256 != "" {
+		return "\"" + record.SHA256 + "\""
+	}
+	return fmt.Sprintf("\"%x-%x\"", record.CreatedAt.UnixNano(), record.Size)
+}
+
+// isNotModified evaluates If-None-Match, falling back to If-Modified-Since
+func isNotModified(c *fiber.Ctx, etag string, lastModified time.Time) bool {
+	if ifNoneMatch := c.Get("If-None-Match"); ifNoneMatch != "" {
+		return strings.TrimSpace(ifNoneMatch) == "*" || etagListContains(ifNoneMatch, etag, true)
+	}
+
+	if ifModifiedSince := c.Get("If-Modified-Since"); ifModifiedSince != "" {
+		if since, err := http.ParseTime(ifModifiedSince); err == nil {
+			return !lastModified.After(since)
+		}
+	}
+
+	return false
+}
+
+// ifRangeMatches evaluates If-Range; ranges are only honored when the validator still matches
+func ifRangeMatches(c *fiber.Ctx, etag string, lastModified time.Time) bool {
+	ifRange := strings.TrimSpace(c.Get("If-Range"))
+	if ifRange == "" {
+		return true
+	}
+
+	if strings.HasPrefix(ifRange, "\"") || strings.HasPrefix(ifRange, "W/") {
+		return etagListContains(ifRange, etag, false)
+	}
+
+	since, err := http.ParseTime(ifRange)
+	return err == nil && since.Equal(lastModified)
+}
+
+// etagListContains reports whether a comma separated entity tag list contains etag,
+// using weak comparison if weak is set and strong comparison otherwise
+func etagListContains(list, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandeptwidyaop/tempfile/internal/config"
+	"github.com/pandeptwidyaop/tempfile/internal/metadata"
+	"github.com/pandeptwidyaop/tempfile/internal/services"
+	"github.com/pandeptwidyaop/tempfile/internal/storage"
+)
+
+// newTestFileApp stores content as a file with metadata and returns an app serving it
+func newTestFileApp(t *testing.T, id, content string, expiresAt time.Time) (*fiber.App, *metadata.Record) {
+	backend, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+	store := metadata.NewSidecarStore(backend)
+
+	if err := backend.Put(id, strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	record := &metadata.Record{
+		ID:           id,
+		OriginalName: "digits.txt",
+		Size:         int64(len(content)),
+		CreatedAt:    time.Now().Add(-time.Minute),
+		ExpiresAt:    expiresAt,
+	}
+	if err := store.Save(record); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	cfg := &config.Config{}
+	handler := NewFileHandler(cfg, services.NewFileService(cfg, backend, store, metadata.NewBlobStore(backend), nil), nil, newTestAttemptLimiter(t))
+
+	app := fiber.New()
+	app.Get("/:filename", handler.DownloadFile)
+
+	return app, record
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header  string
+		size    int64
+		want    []byteRange
+		wantErr error
+	}{
+		{"bytes=0-9", 100, []byteRange{{0, 10}}, nil},
+		{"bytes=90-", 100, []byteRange{{90, 10}}, nil},
+		{"bytes=-10", 100, []byteRange{{90, 10}}, nil},
+		{"bytes=-200", 100, []byteRange{{0, 100}}, nil},
+		{"bytes=95-200", 100, []byteRange{{95, 5}}, nil},
+		{"bytes=0-1, 5-6", 100, []byteRange{{0, 2}, {5, 2}}, nil},
+		{"bytes=100-", 100, nil, errUnsatisfiableRange},
+		{"bytes=-0", 100, nil, errUnsatisfiableRange},
+		{"bytes=0-", 0, nil, errUnsatisfiableRange},
+		{"bytes=5-1", 100, nil, errInvalidRange},
+		{"bytes=a-b", 100, nil, errInvalidRange},
+		{"items=0-1", 100, nil, errInvalidRange},
+		{"bytes=0-99,0-99", 100, nil, errInvalidRange},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			got, err := parseRange(tt.header, tt.size)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseRange() error = %v, want %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseRange() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("parseRange()[%d] = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadFile_Range(t *testing.T) {
+	app, _ := newTestFileApp(t, "digits_1.txt", "0123456789", time.Now().Add(time.Hour))
+
+	req := httptest.NewRequest("GET", "/digits_1.txt", nil)
+	req.Header.Set("Range", "bytes=2-5")
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != 206 {
+		t.Errorf("status = %d, want 206", resp.StatusCode)
+	}
+	if string(body) != "2345" {
+		t.Errorf("body = %q, want %q", body, "2345")
+	}
+	if got := resp.Header.Get("Content-Range"); got != "bytes 2-5/10" {
+		t.Errorf("Content-Range = %q, want %q", got, "bytes 2-5/10")
+	}
+}
+
+func TestDownloadFile_MultipleRanges(t *testing.T) {
+	app, _ := newTestFileApp(t, "digits_1.txt", "0123456789", time.Now().Add(time.Hour))
+
+	req := httptest.NewRequest("GET", "/digits_1.txt", nil)
+	req.Header.Set("Range", "bytes=0-1,8-")
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != 206 {
+		t.Errorf("status = %d, want 206", resp.StatusCode)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "multipart/byteranges; boundary=") {
+		t.Errorf("Content-Type = %q, want multipart/byteranges", resp.Header.Get("Content-Type"))
+	}
+	if int64(len(body)) != resp.ContentLength {
+		t.Errorf("body length = %d, Content-Length = %d", len(body), resp.ContentLength)
+	}
+	for _, want := range []string{"Content-Range: bytes 0-1/10\r\n", "\r\n\r\n01\r\n", "Content-Range: bytes 8-9/10\r\n", "\r\n\r\n89\r\n"} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("body %q does not contain %q", body, want)
+		}
+	}
+}
+
+func TestDownloadFile_Conditional(t *testing.T) {
+	app, record := newTestFileApp(t, "digits_1.txt", "0123456789", time.Now().Add(time.Hour))
+	etag := fileETag(record)
+
+	tests := []struct {
+		name       string
+		headers    map[string]string
+		wantStatus int
+	}{
+		{"NoConditions", nil, 200},
+		{"IfNoneMatchHit", map[string]string{"If-None-Match": etag}, 304},
+		{"IfNoneMatchWeak", map[string]string{"If-None-Match": "W/" + etag}, 304},
+		{"IfNoneMatchMiss", map[string]string{"If-None-Match": `"other"`}, 200},
+		{"IfModifiedSinceFuture", map[string]string{"If-Modified-Since": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}, 304},
+		{"IfModifiedSincePast", map[string]string{"If-Modified-Since": time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)}, 200},
+		{"IfRangeMatch", map[string]string{"Range": "bytes=0-1", "If-Range": etag}, 206},
+		{"IfRangeStale", map[string]string{"Range": "bytes=0-1", "If-Range": `"stale"`}, 200},
+		{"Unsatisfiable", map[string]string{"Range": "bytes=50-"}, 416},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/digits_1.txt", nil)
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("app.Test() error = %v", err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestDownloadFile_Expired(t *testing.T) {
+	app, _ := newTestFileApp(t, "digits_1.txt", "0123456789", time.Now().Add(-time.Second))
+
+	// An expired file must not be served, even for a resumed (ranged) request
+	req := httptest.NewRequest("GET", "/digits_1.txt", nil)
+	req.Header.Set("Range", "bytes=5-")
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	if resp.StatusCode != 404 {
+		t.Errorf("status = %d, want 404", resp.StatusCode)
+	}
+}
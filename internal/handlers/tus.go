@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandeptwidyaop/tempfile/internal/config"
+	"github.com/pandeptwidyaop/tempfile/internal/ratelimit"
+	"github.com/pandeptwidyaop/tempfile/internal/services"
+	"github.com/pandeptwidyaop/tempfile/internal/utils"
+)
+
+// tusVersion is the only tus protocol version supported
+const tusVersion = "1.0.0"
+
+// tusExtensions lists the supported tus protocol extensions
+const tusExtensions = "creation,termination,checksum,expiration"
+
+// TusExposedHeaders lists the response headers browser tus clients must be able to read
+const TusExposedHeaders = "Location,Tus-Resumable,Tus-Version,Tus-Max-Size,Tus-Extension,Tus-Checksum-Algorithm," +
+	"Upload-Offset,Upload-Length,Upload-Metadata,Upload-Expires,X-Download-URL,X-Delete-Token"
+
+// statusChecksumMismatch is the tus specific status for a chunk failing its checksum
+const statusChecksumMismatch = 460
+
+// TusHandler handles resumable uploads following the tus 1.0 protocol
+type TusHandler struct {
+	config     *config.Config
+	tusService *services.TusService
+	ipDetector ratelimit.IPDetector
+}
+
+// NewTusHandler creates a new tus handler instance
+func NewTusHandler(cfg *config.Config, tusSvc *services.TusService) *TusHandler {
+	return &TusHandler{
+		config:     cfg,
+		tusService: tusSvc,
+		ipDetector: ratelimit.NewIPDetector(cfg.RateLimitTrustedProxies, cfg.RateLimitIPHeaders),
+	}
+}
+
+// Protocol checks the protocol version of every tus request except OPTIONS
+func (h *TusHandler) Protocol(c *fiber.Ctx) error {
+	c.Set("Tus-Resumable", tusVersion)
+
+	if c.Method() != fiber.MethodOptions && c.Get("Tus-Resumable") != tusVersion {
+		c.Set("Tus-Version", tusVersion)
+		return c.Status(fiber.StatusPreconditionFailed).JSON(fiber.Map{
+			"error": "Unsupported tus version",
+		})
+	}
+
+	return c.Next()
+}
+
+// Options advertises the supported protocol version and extensions
+func (h *TusHandler) Options(c *fiber.Ctx) error {
+	c.Set("Tus-Version", tusVersion)
+	c.Set("Tus-Extension", tusExtensions)
+	c.Set("Tus-Max-Size", strconv.FormatInt(h.config.MaxFileSize, 10))
+	c.Set("Tus-Checksum-Algorithm", strings.Join(services.TusChecksumAlgorithms, ","))
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// CreateUpload starts a new resumable upload
+func (h *TusHandler) CreateUpload(c *fiber.Ctx) error {
+	if c.Get("Upload-Defer-Length") != "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Deferred upload length is not supported",
+		})
+	}
+
+	length, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Missing or invalid Upload-Length header",
+		})
+	}
+
+	upload, err := h.tusService.Create(length, c.Get("Upload-Metadata"), utils.GetClientIP(c, h.ipDetector), c.Get("User-Agent"))
+	if err != nil {
+		return h.uploadError(c, err)
+	}
+
+	if h.config.Debug {
+		log.Printf("Resumable upload created: %s (original: %s, size: %s)", upload.ID, upload.Filename, utils.FormatBytes(upload.Length))
+	}
+
+	c.Set("Location", utils.GetBaseURL(c, h.config.PublicURL)+"/api/tus/"+upload.ID)
+	c.Set("X-Delete-Token", upload.DeleteToken)
+	h.setUploadHeaders(c, upload)
+
+	return c.SendStatus(fiber.StatusCreated)
+}
+
+// GetUploadOffset reports how much of an upload has been received
+func (h *TusHandler) GetUploadOffset(c *fiber.Ctx) error {
+	upload, err := h.tusService.Get(c.Params("id"))
+	if err != nil {
+		return h.uploadError(c, err)
+	}
+
+	c.Set("Cache-Control", "no-store")
+	c.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.Metadata != "" {
+		c.Set("Upload-Metadata", upload.Metadata)
+	}
+	h.setUploadHeaders(c, upload)
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// PatchUpload appends a chunk to an upload
+func (h *TusHandler) PatchUpload(c *fiber.Ctx) error {
+	if c.Get("Content-Type") != "application/offset+octet-stream" {
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{
+			"error": "Content-Type must be application/offset+octet-stream",
+		})
+	}
+
+	offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Missing or invalid Upload-Offset header",
+		})
+	}
+
+	// The chunk is streamed to storage as it arrives. Received bytes count
+	// towards the rate limit whether or not the chunk is accepted
+	chunk := services.NewChunkReader(c)
+	size := int64(c.Request().Header.ContentLength())
+	if size < 0 {
+		size = -1
+	}
+
+	upload, err := h.tusService.WriteChunk(c.Params("id"), offset, chunk, size, c.Get("Upload-Checksum"))
+	c.Locals("actual_file_size", chunk.Received())
+	if err != nil {
+		return h.uploadError(c, err)
+	}
+
+	h.setUploadHeaders(c, upload)
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// TerminateUpload discards an upload and everything received so far
+func (h *TusHandler) TerminateUpload(c *fiber.Ctx) error {
+	if err := h.tusService.Terminate(c.Params("id")); err != nil {
+		return h.uploadError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// setUploadHeaders reports the offset of an upload, and either when it expires
+// or, once complete, where the stored file can be downloaded
+func (h *TusHandler) setUploadHeaders(c *fiber.Ctx, upload *services.TusUpload) {
+	c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+
+	if upload.IsComplete() {
+		c.Set("X-Download-URL", utils.GetBaseURL(c, h.config.PublicURL)+h.tusService.DownloadURL(upload))
+	} else {
+		c.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// uploadError writes the response for a failed resumable upload operation
+func (h *TusHandler) uploadError(c *fiber.Ctx, err error) error {
+	var status int
+	var message string
+
+	switch {
+	case errors.Is(err, services.ErrUploadNotFound):
+		status, message = fiber.StatusNotFound, "Upload not found"
+	case errors.Is(err, services.ErrUploadExpired):
+		status, message = fiber.StatusGone, "Upload has expired"
+	case errors.Is(err, services.ErrUploadLocked):
+		status, message = fiber.StatusLocked, "Upload is being written by another request"
+	case errors.Is(err, services.ErrUploadTooLarge):
+		status, message = fiber.StatusRequestEntityTooLarge, "File size exceeds "+utils.FormatBytes(h.config.MaxFileSize)+" limit"
+	case errors.Is(err, services.ErrChunkTooLarge):
+		status, message = fiber.StatusRequestEntityTooLarge, "Chunk exceeds Upload-Length"
+	case errors.Is(err, services.ErrOffsetMismatch):
+		status, message = fiber.StatusConflict, "Upload-Offset does not match the current offset"
+	case errors.Is(err, services.ErrInvalidUploadMetadata):
+		status, message = fiber.StatusBadRequest, "Invalid Upload-Metadata header"
+	case errors.Is(err, services.ErrInvalidExpiry):
+		status, message = fiber.StatusBadRequest, "Invalid expires_in: use a duration such as 10m, 6h or 3d, or an RFC 3339 time"
+	case errors.Is(err, services.ErrInvalidMaxDownloads):
+		status, message = fiber.StatusBadRequest, "Invalid max_downloads: use a whole number of at least 1"
+	case errors.Is(err, services.ErrInvalidChecksum):
+		status, message = fiber.StatusBadRequest, "Invalid or unsupported Upload-Checksum header"
+	case errors.Is(err, services.ErrChecksumMismatch):
+		status, message = statusChecksumMismatch, "Checksum mismatch"
+	case errors.Is(err, services.ErrFileTypeNotAllowed):
+		status, message = fiber.StatusUnsupportedMediaType, "File type not allowed"
+	case errors.Is(err, services.ErrClientEncryptedNotAllowed):
+		status, message = fiber.StatusUnsupportedMediaType, "Files encrypted by the client are not accepted"
+	case errors.Is(err, services.ErrFileTypeMismatch):
+		status, message = fiber.StatusUnsupportedMediaType, "File type mismatch: the content does not match the extension"
+	case errors.Is(err, services.ErrMalwareDetected):
+		status, message = fiber.StatusUnprocessableEntity, "Malware detected"
+	case errors.Is(err, services.ErrScannerUnavailable):
+		log.Printf("Error scanning resumable upload %s: %v", c.Params("id"), err)
+		status, message = fiber.StatusServiceUnavailable, "The file could not be scanned for malware, try again later"
+	case errors.Is(err, services.ErrRateLimited):
+		status, message = fiber.StatusTooManyRequests, "Rate limit exceeded"
+	case errors.Is(err, services.ErrUploadInterrupted):
+		status, message = fiber.StatusBadRequest, "Chunk interrupted before it was complete"
+	default:
+		log.Printf("Error handling resumable upload %s: %v", c.Params("id"), err)
+		status, message = fiber.StatusInternalServerError, "Failed to process upload"
+	}
+
+	return c.Status(status).JSON(fiber.Map{
+		"error": message,
+	})
+}
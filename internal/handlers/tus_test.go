@@ -0,0 +1,387 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandeptwidyaop/tempfile/internal/config"
+	"github.com/pandeptwidyaop/tempfile/internal/encryption"
+	"github.com/pandeptwidyaop/tempfile/internal/metadata"
+	"github.com/pandeptwidyaop/tempfile/internal/services"
+	"github.com/pandeptwidyaop/tempfile/internal/storage"
+)
+
+// newTestTusApp returns an app serving the tus endpoint and downloads
+func newTestTusApp(t *testing.T) (*fiber.App, *services.FileService) {
+	return newTestTusAppWithConfig(t, &config.Config{
+		MaxFileSize:          1024,
+		FileExpiryHours:      1,
+		TusUploadExpiryHours: 24,
+	})
+}
+
+// newTestTusAppWithConfig returns the resumable upload test app configured with cfg
+func newTestTusAppWithConfig(t *testing.T, cfg *config.Config) (*fiber.App, *services.FileService) {
+	backend, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+
+	return newTestTusAppWithBackend(t, cfg, backend, nil)
+}
+
+// newTestTusAppWithBackend returns the resumable upload test app storing
+// files in backend, encrypted with keyring unless it is nil
+func newTestTusAppWithBackend(t *testing.T, cfg *config.Config, backend storage.Backend, keyring *encryption.Keyring) (*fiber.App, *services.FileService) {
+	fileService := services.NewFileService(cfg, backend, metadata.NewSidecarStore(backend), metadata.NewBlobStore(backend), keyring)
+	tusHandler := NewTusHandler(cfg, services.NewTusService(cfg, fileService))
+
+	// Chunks are streamed like in production
+	app := fiber.New(fiber.Config{
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+	})
+	tus := app.Group("/api/tus", tusHandler.Protocol)
+	tus.Options("", tusHandler.Options)
+	tus.Post("", tusHandler.CreateUpload)
+	tus.Head("/:id", tusHandler.GetUploadOffset)
+	tus.Patch("/:id", tusHandler.PatchUpload)
+	tus.Delete("/:id", tusHandler.TerminateUpload)
+	app.Get("/:filename", NewFileHandler(cfg, fileService, nil, newTestAttemptLimiter(t)).DownloadFile)
+
+	return app, fileService
+}
+
+// tusRequest sends a tus request and returns the response
+func tusRequest(t *testing.T, app *fiber.App, method, target string, headers map[string]string, body string) *http.Response {
+	t.Helper()
+
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	return resp
+}
+
+// createTusUpload creates an upload of length bytes and returns its path
+func createTusUpload(t *testing.T, app *fiber.App, length string) string {
+	t.Helper()
+
+	resp := tusRequest(t, app, "POST", "/api/tus", map[string]string{
+		"Upload-Length":   length,
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("notes.txt")) + ",filetype " + base64.StdEncoding.EncodeToString([]byte("text/plain")),
+	}, "")
+	if resp.StatusCode != 201 {
+		t.Fatalf("create status = %d, want 201", resp.StatusCode)
+	}
+
+	location := resp.Header.Get("Location")
+	if !strings.Contains(location, "/api/tus/") {
+		t.Fatalf("Location = %q, want a /api/tus/ URL", location)
+	}
+	if resp.Header.Get("Upload-Expires") == "" {
+		t.Error("Upload-Expires header is missing")
+	}
+	if resp.Header.Get("X-Delete-Token") == "" {
+		t.Error("X-Delete-Token header is missing")
+	}
+
+	return location[strings.Index(location, "/api/tus/"):]
+}
+
+func TestTus_Options(t *testing.T) {
+	app, _ := newTestTusApp(t)
+
+	req := httptest.NewRequest("OPTIONS", "/api/tus", nil)
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+
+	if resp.StatusCode != 204 {
+		t.Errorf("status = %d, want 204", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Tus-Version"); got != "1.0.0" {
+		t.Errorf("Tus-Version = %q, want 1.0.0", got)
+	}
+	if got := resp.Header.Get("Tus-Max-Size"); got != "1024" {
+		t.Errorf("Tus-Max-Size = %q, want 1024", got)
+	}
+}
+
+func TestTus_UnsupportedVersion(t *testing.T) {
+	app, _ := newTestTusApp(t)
+
+	req := httptest.NewRequest("POST", "/api/tus", nil)
+	req.Header.Set("Tus-Resumable", "0.2.2")
+	req.Header.Set("Upload-Length", "10")
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	if resp.StatusCode != 412 {
+		t.Errorf("status = %d, want 412", resp.StatusCode)
+	}
+}
+
+func TestTus_CreateTooLarge(t *testing.T) {
+	app, _ := newTestTusApp(t)
+
+	resp := tusRequest(t, app, "POST", "/api/tus", map[string]string{"Upload-Length": "4096"}, "")
+	if resp.StatusCode != 413 {
+		t.Errorf("status = %d, want 413", resp.StatusCode)
+	}
+}
+
+func TestTus_ResumableUpload(t *testing.T) {
+	app, fileService := newTestTusApp(t)
+	uploadPath := createTusUpload(t, app, "11")
+
+	patch := func(offset, chunk string, extra map[string]string) *http.Response {
+		headers := map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": offset,
+		}
+		for key, value := range extra {
+			headers[key] = value
+		}
+		return tusRequest(t, app, "PATCH", uploadPath, headers, chunk)
+	}
+
+	// First chunk, with a valid checksum
+	sum := sha1.Sum([]byte("hello "))
+	resp := patch("0", "hello ", map[string]string{"Upload-Checksum": "sha1 " + base64.StdEncoding.EncodeToString(sum[:])})
+	if resp.StatusCode != 204 {
+		t.Fatalf("first PATCH status = %d, want 204", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Upload-Offset"); got != "6" {
+		t.Errorf("Upload-Offset = %q, want 6", got)
+	}
+
+	// A chunk at the wrong offset is refused
+	if resp := patch("3", "world", nil); resp.StatusCode != 409 {
+		t.Errorf("mismatched PATCH status = %d, want 409", resp.StatusCode)
+	}
+
+	// A chunk failing its checksum is refused and not stored
+	if resp := patch("6", "world", map[string]string{"Upload-Checksum": "sha1 " + base64.StdEncoding.EncodeToString(sum[:])}); resp.StatusCode != 460 {
+		t.Errorf("bad checksum PATCH status = %d, want 460", resp.StatusCode)
+	}
+
+	// The offset survives for resuming
+	resp = tusRequest(t, app, "HEAD", uploadPath, nil, "")
+	if resp.StatusCode != 200 {
+		t.Fatalf("HEAD status = %d, want 200", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Upload-Offset"); got != "6" {
+		t.Errorf("Upload-Offset = %q, want 6", got)
+	}
+	if got := resp.Header.Get("Upload-Length"); got != "11" {
+		t.Errorf("Upload-Length = %q, want 11", got)
+	}
+
+	// The last chunk completes the upload
+	resp = patch("6", "world", nil)
+	if resp.StatusCode != 204 {
+		t.Fatalf("last PATCH status = %d, want 204", resp.StatusCode)
+	}
+	downloadURL := resp.Header.Get("X-Download-URL")
+	if downloadURL == "" {
+		t.Fatal("X-Download-URL header is missing")
+	}
+
+	filename := downloadURL[strings.LastIndex(downloadURL, "/")+1:]
+	record, err := fileService.Lookup(filename)
+	if err != nil {
+		t.Fatalf("Lookup() error = %v", err)
+	}
+	if record.OriginalName != "notes.txt" || record.ContentType != "text/plain; charset=utf-8" || record.Size != 11 {
+		t.Errorf("record = %+v, want notes.txt, text/plain; charset=utf-8, 11 bytes", record)
+	}
+
+	req := httptest.NewRequest("GET", "/"+filename, nil)
+	getResp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	body, _ := io.ReadAll(getResp.Body)
+	if string(body) != "hello world" {
+		t.Errorf("downloaded body = %q, want %q", body, "hello world")
+	}
+}
+
+func TestTus_EncryptedChunks(t *testing.T) {
+	backend, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+	keyring, err := encryption.NewKeyring([]string{base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, encryption.KeySize))})
+	if err != nil {
+		t.Fatalf("NewKeyring() error = %v", err)
+	}
+	app, _ := newTestTusAppWithBackend(t, &config.Config{
+		MaxFileSize:          1024,
+		FileExpiryHours:      1,
+		TusUploadExpiryHours: 24,
+	}, backend, keyring)
+	uploadPath := createTusUpload(t, app, "11")
+
+	patch := func(offset, chunk string) *http.Response {
+		return tusRequest(t, app, "PATCH", uploadPath, map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": offset,
+		}, chunk)
+	}
+
+	// Two chunks with the same content, both sealed from nonce zero
+	for _, offset := range []string{"0", "5"} {
+		if resp := patch(offset, "hello"); resp.StatusCode != 204 {
+			t.Fatalf("PATCH at %s status = %d, want 204", offset, resp.StatusCode)
+		}
+	}
+
+	objects, err := backend.List("tus/")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	var stored [][]byte
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, ".part") {
+			continue
+		}
+		reader, _, err := backend.Get(object.Key)
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		data, _ := io.ReadAll(reader)
+		reader.Close()
+		stored = append(stored, data)
+	}
+	if len(stored) != 2 {
+		t.Fatalf("got %d stored chunks, want 2", len(stored))
+	}
+
+	// Each chunk has a salt of its own, so a key of its own
+	for i, data := range stored {
+		if want := encryption.SaltSize + encryption.EncryptedSize(5); int64(len(data)) != want {
+			t.Errorf("chunk %d is %d bytes, want %d", i, len(data), want)
+		}
+	}
+	saltA, saltB := stored[0][:encryption.SaltSize], stored[1][:encryption.SaltSize]
+	if bytes.Equal(saltA, saltB) {
+		t.Error("both chunks have the same salt")
+	}
+	if bytes.Equal(stored[0][encryption.SaltSize:], stored[1][encryption.SaltSize:]) {
+		t.Error("both chunks encrypted alike, reusing key and nonce")
+	}
+
+	resp := patch("10", "!")
+	if resp.StatusCode != 204 {
+		t.Fatalf("last PATCH status = %d, want 204", resp.StatusCode)
+	}
+
+	getResp, err := app.Test(httptest.NewRequest("GET", resp.Header.Get("X-Download-URL"), nil))
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	body, _ := io.ReadAll(getResp.Body)
+	if string(body) != "hellohello!" {
+		t.Errorf("downloaded body = %q, want %q", body, "hellohello!")
+	}
+}
+
+func TestTus_Terminate(t *testing.T) {
+	app, _ := newTestTusApp(t)
+	uploadPath := createTusUpload(t, app, "10")
+
+	if resp := tusRequest(t, app, "DELETE", uploadPath, nil, ""); resp.StatusCode != 204 {
+		t.Fatalf("DELETE status = %d, want 204", resp.StatusCode)
+	}
+	if resp := tusRequest(t, app, "HEAD", uploadPath, nil, ""); resp.StatusCode != 404 {
+		t.Errorf("HEAD after DELETE status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestTus_FileTypeRejected(t *testing.T) {
+	app, _ := newTestTusAppWithConfig(t, &config.Config{
+		MaxFileSize:          1024,
+		FileExpiryHours:      1,
+		TusUploadExpiryHours: 24,
+		DeniedExtensions:     []string{".exe"},
+		DeniedTypes:          []string{"application/x-executable"},
+		TypeMismatchAction:   "reject",
+	})
+
+	// A denied extension is rejected before anything is sent
+	resp := tusRequest(t, app, "POST", "/api/tus", map[string]string{
+		"Upload-Length":   "5",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("setup.exe")),
+	}, "")
+	if resp.StatusCode != 415 {
+		t.Errorf("create status = %d, want 415", resp.StatusCode)
+	}
+
+	// So is an encrypted file, whose content could not be checked
+	resp = tusRequest(t, app, "POST", "/api/tus", map[string]string{
+		"Upload-Length":   "5",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("encrypted.bin")) + ",client_encrypted " + base64.StdEncoding.EncodeToString([]byte("1")),
+	}, "")
+	if resp.StatusCode != 415 {
+		t.Errorf("encrypted create status = %d, want 415", resp.StatusCode)
+	}
+
+	// Content is only known once complete, and the upload is gone when it does not match
+	location := createTusUpload(t, app, "4")
+	resp = tusRequest(t, app, "PATCH", location, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	}, "MZ\x90\x00")
+	if resp.StatusCode != 415 {
+		t.Fatalf("PATCH status = %d, want 415", resp.StatusCode)
+	}
+
+	resp = tusRequest(t, app, "HEAD", location, nil, "")
+	if resp.StatusCode != 404 {
+		t.Errorf("HEAD status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestTus_MalwareRejected(t *testing.T) {
+	app, _ := newTestTusAppWithConfig(t, &config.Config{
+		MaxFileSize:          1024,
+		FileExpiryHours:      1,
+		TusUploadExpiryHours: 24,
+		ClamdAddress:         startFakeClamd(t),
+		ClamdTimeout:         5 * time.Second,
+	})
+
+	// The content is scanned once complete, and the upload is gone when infected
+	location := createTusUpload(t, app, "5")
+	resp := tusRequest(t, app, "PATCH", location, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	}, "EICAR")
+	if resp.StatusCode != 422 {
+		t.Fatalf("PATCH status = %d, want 422", resp.StatusCode)
+	}
+
+	resp = tusRequest(t, app, "HEAD", location, nil, "")
+	if resp.StatusCode != 404 {
+		t.Errorf("HEAD status = %d, want 404", resp.StatusCode)
+	}
+}
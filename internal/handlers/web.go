@@ -42,44 +42,58 @@ func (h *WebHandler) SuccessPage(c *fiber.Ctx) error {
 
 // UploadFileHandler handles both API and web upload
 func (h *WebHandler) UploadFileHandler(c *fiber.Ctx) error {
+	// Raw bodies come from scripts, never from the upload form
+	if !isMultipartRequest(c) {
+		return rawUpload(c, h.config, h.uploadService)
+	}
+
 	// Check if this is a web request (has Accept header with text/html)
 	acceptHeader := c.Get("Accept")
 	isWebRequest := strings.Contains(acceptHeader, "text/html")
 
-	// Use the upload service to process the file
-	result, err := h.uploadService.ProcessFileUpload(c)
+	// Use the upload service to process the files
+	results, err := h.uploadService.ProcessFileUploads(c)
 	if err != nil {
 		if isWebRequest {
-			return h.templateService.RenderErrorPage(c, "Upload Failed", err.Error(), "Please check your file and try again.")
+			return h.templateService.RenderErrorPage(c, "Upload Failed", err.Error(), "Please check your files and try again.")
 		}
 		return err // Return the fiber error for API
 	}
 
 	if isWebRequest {
-		// Use url.Values for proper URL encoding
+		// Use url.Values for proper URL encoding. The per-file values are
+		// repeated in upload order, the options are shared by every file
 		v := url.Values{}
-		v.Set("file", result.Filename)
-		v.Set("original", result.OriginalName)
-		v.Set("size", fmt.Sprintf("%d", result.Size))
-		v.Set("size_human", result.SizeHuman)
-		v.Set("expires_at", result.ExpiresAt.Format(time.RFC3339))
-		v.Set("expires_in", result.ExpiresIn)
+		tokens := url.Values{}
+		for _, result := range results {
+			v.Add("file", result.Filename)
+			v.Add("original", result.OriginalName)
+			v.Add("size", fmt.Sprintf("%d", result.Size))
+			v.Add("size_human", result.SizeHuman)
+			v.Add("link", result.DownloadURL)
+			tokens.Set(result.Filename, result.DeleteToken)
+		}
+
+		first := results[0]
+		v.Set("expires_at", first.ExpiresAt.Format(time.RFC3339))
+		v.Set("expires_in", first.ExpiresIn)
+		if first.MaxDownloads > 0 {
+			v.Set("max_downloads", fmt.Sprintf("%d", first.MaxDownloads))
+		}
+		if first.Protected {
+			v.Set("protected", "1")
+		}
+		if first.CollectionID != "" {
+			v.Set("collection", first.CollectionID)
+		}
+
+		// Delete tokens stay out of the redirect, where they would be logged
+		services.SetDeleteTokens(c, utils.GetBaseURL(c, h.config.PublicURL), tokens)
 
 		successURL := "/success?" + v.Encode()
 		return c.Redirect(successURL)
 	}
 
 	// Return JSON for API requests
-	response := fiber.Map{
-		"message":       result.Message,
-		"filename":      result.Filename,
-		"original_name": result.OriginalName,
-		"size":          result.Size,
-		"size_human":    result.SizeHuman,
-		"expires_at":    result.ExpiresAt.Format(time.RFC3339),
-		"expires_in":    result.ExpiresIn,
-		"download_url":  result.DownloadURL,
-	}
-
-	return c.JSON(response)
+	return c.JSON(uploadResponseBody(results))
 }
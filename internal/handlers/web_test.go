@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandeptwidyaop/tempfile/internal/metadata"
+	"github.com/pandeptwidyaop/tempfile/internal/services"
+	"github.com/pandeptwidyaop/tempfile/internal/storage"
+	"github.com/pandeptwidyaop/tempfile/web"
+)
+
+// newTestWebApp returns an app serving the upload form and its success page
+func newTestWebApp(t *testing.T) *fiber.App {
+	backend, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+
+	cfg := newTestUploadConfig()
+	fileService := services.NewFileService(cfg, backend, metadata.NewSidecarStore(backend), metadata.NewBlobStore(backend), nil)
+	collectionService := services.NewCollectionService(cfg, fileService, metadata.NewCollectionStore(backend))
+	templateService := services.NewTemplateService(cfg, web.TemplateFiles)
+	if err := templateService.Initialize(); err != nil {
+		t.Fatalf("Initialize() error = %v", err)
+	}
+	webHandler := NewWebHandler(cfg, services.NewUploadService(cfg, fileService, collectionService), templateService)
+
+	app := fiber.New(fiber.Config{
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+	})
+	app.Post("/", webHandler.UploadFileHandler)
+	app.Get("/success", webHandler.SuccessPage)
+
+	return app
+}
+
+func TestUploadFileHandler_DeleteTokenNotInRedirect(t *testing.T) {
+	app := newTestWebApp(t)
+
+	req := newMultipartUpload(t, [][3]string{{"file", "a.txt", "alpha"}})
+	req.Header.Set("Accept", "text/html")
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	if resp.StatusCode != fiber.StatusFound {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, fiber.StatusFound)
+	}
+
+	location := resp.Header.Get("Location")
+	if strings.Contains(location, "token") {
+		t.Errorf("Location = %q, want no delete token", location)
+	}
+
+	var cookie string
+	for _, c := range resp.Cookies() {
+		if c.Name == services.DeleteTokensCookie {
+			cookie = c.Value
+			if !c.HttpOnly || c.Path != "/success" || !c.Secure {
+				t.Errorf("cookie = %+v, want HttpOnly and Secure for /success", c)
+			}
+		}
+	}
+	redirect, _ := url.Parse(location)
+	filename := redirect.Query().Get("file")
+	tokens, _ := url.ParseQuery(cookie)
+	token := tokens.Get(filename)
+	if token == "" {
+		t.Fatalf("cookie %q has no delete token for %s", cookie, filename)
+	}
+
+	// The success page shows the delete link once, and clears the cookie
+	req = httptest.NewRequest("GET", location, nil)
+	req.Header.Set("Cookie", services.DeleteTokensCookie+"="+cookie)
+	resp, err = app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), services.DeleteURL(filename, token)) {
+		t.Error("success page has no delete link")
+	}
+
+	cleared := false
+	for _, c := range resp.Cookies() {
+		cleared = cleared || (c.Name == services.DeleteTokensCookie && c.Value == "")
+	}
+	if !cleared {
+		t.Error("success page did not clear the delete tokens cookie")
+	}
+
+	// Delete tokens in the query are no longer read
+	req = httptest.NewRequest("GET", location+"&delete_token=forged", nil)
+	resp, err = app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	if strings.Contains(string(body), "/delete#token=") {
+		t.Error("success page shows a delete link without the cookie")
+	}
+}
@@ -0,0 +1,229 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pandeptwidyaop/tempfile/internal/storage"
+)
+
+// blobPrefix is the storage key prefix under which blob reference counts are kept
+const blobPrefix = "refs/"
+
+// Blob counts the files sharing one stored copy of identical content
+type Blob struct {
+	// Name identifies the blob: the SHA256 of plaintext content, or a keyed
+	// hash of it for encrypted content. Blobs stored before names were
+	// recorded are named by their SHA256
+	Name string `json:"name"`
+
+	// SHA256 is the hex encoded digest of the content. Encrypted blobs do
+	// not record it, so that it cannot be read from the storage
+	SHA256    string    `json:"sha256,omitempty"`
+	Size      int64     `json:"size"`
+	Refs      int       `json:"refs"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Key is the storage key of the content, which is new every time the
+	// blob is created again. Blobs stored before keys were recorded have none
+	Key string `json:"key,omitempty"`
+
+	// ReleasedAt is set when the last reference was dropped, while the blob
+	// is being deleted
+	ReleasedAt time.Time `json:"released_at"`
+
+	// DataKey is the key the blob is encrypted with, wrapped by the master
+	// key KeyID. Both are empty for blobs stored in plaintext
+	DataKey string `json:"data_key,omitempty"`
+	KeyID   string `json:"key_id,omitempty"`
+}
+
+// BlobStore interface defines persistence for blob reference counts
+type BlobStore interface {
+	// Save creates or replaces the blob for blob.Name
+	Save(blob *Blob) error
+
+	// Get returns the blob with a name
+	Get(name string) (*Blob, error)
+
+	// Update applies update to the blob with a name and stores the result.
+	// A name without a blob is passed to update as a new blob without
+	// references. Like Store.Update, servers sharing the storage never
+	// overwrite each other's changes
+	Update(name string, update func(*Blob) error) (*Blob, error)
+
+	// Delete removes the blob with a name
+	Delete(name string) error
+
+	// List returns all stored blobs
+	List() ([]*Blob, error)
+}
+
+// blobStore implements the BlobStore interface with one JSON object per
+// blob, kept in the same storage backend as the blobs themselves. Reference
+// counts change with every upload, so nothing is cached
+type blobStore struct {
+	backend storage.Backend
+}
+
+// NewBlobStore creates a blob store that keeps JSON objects in backend
+func NewBlobStore(backend storage.Backend) BlobStore {
+	return &blobStore{backend: backend}
+}
+
+// Save creates or replaces the blob for blob.Name
+func (s *blobStore) Save(blob *Blob) error {
+	key, err := objectKey(blobPrefix, blob.Name)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(blob)
+	if err != nil {
+		return fmt.Errorf("failed to encode blob: %w", err)
+	}
+
+	if err := s.backend.Put(key, bytes.NewReader(data), int64(len(data))); err != nil {
+		return fmt.Errorf("failed to store blob: %w", err)
+	}
+
+	return nil
+}
+
+// Get returns the blob with a name
+func (s *blobStore) Get(name string) (*Blob, error) {
+	key, err := objectKey(blobPrefix, name)
+	if err != nil {
+		return nil, err
+	}
+
+	blob, _, err := s.read(key)
+	return blob, err
+}
+
+// Update applies update to the blob with a name and stores the result. On a
+// backend with conditional writes the blob is only replaced if it is still
+// the version update was applied to, and only created if there is none yet;
+// otherwise it is read again and update retried. Other backends are only ever
+// used by one server, whose callers serialize their updates
+func (s *blobStore) Update(name string, update func(*Blob) error) (*Blob, error) {
+	key, err := objectKey(blobPrefix, name)
+	if err != nil {
+		return nil, err
+	}
+	conditional, _ := s.backend.(storage.ConditionalBackend)
+
+	for attempt := 0; attempt < updateAttempts; attempt++ {
+		blob, etag, err := s.read(key)
+		exists := err == nil
+		if errors.Is(err, ErrNotFound) {
+			blob, err = &Blob{Name: name}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := update(blob); err != nil {
+			return nil, err
+		}
+
+		data, err := json.Marshal(blob)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode blob: %w", err)
+		}
+
+		switch {
+		case conditional != nil && !exists:
+			err = conditional.PutIfAbsent(key, bytes.NewReader(data), int64(len(data)))
+		case conditional != nil && etag != "":
+			err = conditional.PutIfMatch(key, bytes.NewReader(data), int64(len(data)), etag)
+		default:
+			err = s.backend.Put(key, bytes.NewReader(data), int64(len(data)))
+		}
+
+		switch {
+		case err == nil:
+			return blob, nil
+		// A blob deleted since it was read is created again
+		case errors.Is(err, storage.ErrPreconditionFailed), errors.Is(err, storage.ErrNotFound):
+			continue
+		default:
+			return nil, fmt.Errorf("failed to store blob: %w", err)
+		}
+	}
+
+	return nil, ErrConflict
+}
+
+// Delete removes the blob with a name
+func (s *blobStore) Delete(name string) error {
+	key, err := objectKey(blobPrefix, name)
+	if err != nil {
+		return err
+	}
+
+	if err := s.backend.Delete(key); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("failed to delete blob: %w", err)
+	}
+
+	return nil
+}
+
+// List returns all stored blobs
+func (s *blobStore) List() ([]*Blob, error) {
+	objects, err := s.backend.List(blobPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blobs: %w", err)
+	}
+
+	blobs := make([]*Blob, 0, len(objects))
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, ".json") {
+			continue
+		}
+
+		blob, _, err := s.read(object.Key)
+		if err != nil {
+			// Blob removed or unreadable since listing
+			continue
+		}
+		blobs = append(blobs, blob)
+	}
+
+	return blobs, nil
+}
+
+// read loads and decodes the blob stored under key, together with the ETag
+// of the object it was read from
+func (s *blobStore) read(key string) (*Blob, string, error) {
+	reader, info, err := s.backend.Get(key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, "", ErrNotFound
+		}
+		return nil, "", fmt.Errorf("failed to read blob: %w", err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read blob: %w", err)
+	}
+
+	var blob Blob
+	if err := json.Unmarshal(data, &blob); err != nil {
+		return nil, "", fmt.Errorf("failed to decode blob: %w", err)
+	}
+	if blob.Name == "" {
+		blob.Name = blob.SHA256
+	}
+
+	return &blob, info.ETag, nil
+}
@@ -0,0 +1,127 @@
+package metadata
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pandeptwidyaop/tempfile/internal/storage"
+)
+
+func TestBlobStore_SaveGetDelete(t *testing.T) {
+	backend, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+	store := NewBlobStore(backend)
+
+	digest := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if _, err := store.Get(digest); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get() error = %v, want %v", err, ErrNotFound)
+	}
+
+	blob := &Blob{Name: digest, SHA256: digest, Size: 5, Refs: 1, CreatedAt: time.Now()}
+	if err := store.Save(blob); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	// Reference counts are kept apart from both the blobs and the file records
+	if _, err := backend.Stat("refs/" + digest + ".json"); err != nil {
+		t.Errorf("blob Stat() error = %v", err)
+	}
+
+	blob.Refs = 2
+	if err := store.Save(blob); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	got, err := store.Get(digest)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got.Refs != 2 || got.Size != 5 {
+		t.Errorf("Get() = %+v, want 2 references to 5 bytes", got)
+	}
+
+	if err := store.Delete(digest); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if err := store.Delete(digest); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second Delete() error = %v, want %v", err, ErrNotFound)
+	}
+	if _, err := store.Get("../" + digest); !errors.Is(err, ErrInvalidID) {
+		t.Errorf("Get() error = %v, want %v", err, ErrInvalidID)
+	}
+	// Blobs stored before names were recorded are named by their digest
+	legacy := `{"sha256":"` + digest + `","size":5,"refs":1}`
+	if err := backend.Put("refs/"+digest+".json", strings.NewReader(legacy), int64(len(legacy))); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if got, err := store.Get(digest); err != nil || got.Name != digest {
+		t.Errorf("Get() = %+v, %v, want the blob named by its digest", got, err)
+	}
+}
+
+func TestBlobStore_Update(t *testing.T) {
+	local, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+	backend := &versionedBackend{Backend: local, versions: make(map[string]int)}
+	store := NewBlobStore(backend)
+	digest := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	// Another server creates the blob first, so the update is applied to its blob
+	other := NewBlobStore(backend)
+	attempts := 0
+	got, err := store.Update(digest, func(blob *Blob) error {
+		attempts++
+		if attempts == 1 {
+			if blob.Refs != 0 {
+				t.Errorf("missing blob has %d references, want 0", blob.Refs)
+			}
+			if err := other.Save(&Blob{Name: digest, SHA256: digest, Size: 5, Refs: 1}); err != nil {
+				t.Fatalf("Save() error = %v", err)
+			}
+		}
+		blob.Refs++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("update applied %d times, want 2", attempts)
+	}
+	if got.Refs != 2 || got.Size != 5 {
+		t.Errorf("Update() = %+v, want 2 references to 5 bytes", got)
+	}
+
+	// Nor is a change by another server overwritten
+	attempts = 0
+	got, err = store.Update(digest, func(blob *Blob) error {
+		attempts++
+		if attempts == 1 {
+			if err := other.Save(&Blob{Name: digest, SHA256: digest, Size: 5, Refs: 3}); err != nil {
+				t.Fatalf("Save() error = %v", err)
+			}
+		}
+		blob.Refs--
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if got.Refs != 2 {
+		t.Errorf("Update() Refs = %d, want 2", got.Refs)
+	}
+	if stored, _ := store.Get(digest); stored.Refs != 2 {
+		t.Errorf("stored Refs = %d, want 2", stored.Refs)
+	}
+
+	// A failing update leaves the blob alone
+	errReleasing := errors.New("releasing")
+	if _, err := store.Update(digest, func(*Blob) error { return errReleasing }); !errors.Is(err, errReleasing) {
+		t.Errorf("Update() error = %v, want %v", err, errReleasing)
+	}
+}
@@ -0,0 +1,198 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pandeptwidyaop/tempfile/internal/storage"
+)
+
+// collectionPrefix is the storage key prefix under which collections are kept
+const collectionPrefix = "collections/"
+
+// Collection groups files that are shared under one link
+type Collection struct {
+	ID        string    `json:"id"`
+	FileIDs   []string  `json:"file_ids"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// ExpiresAt ends the collection before its last member expires. Zero
+	// means the collection lasts as long as any of its members
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// IsExpired reports whether the collection's own expiry has passed at the
+// given time. Whether any member is left is up to the caller
+func (c *Collection) IsExpired(now time.Time) bool {
+	return !c.ExpiresAt.IsZero() && now.After(c.ExpiresAt)
+}
+
+// CollectionStore interface defines persistence for collections
+type CollectionStore interface {
+	// Save creates or replaces the collection for collection.ID
+	Save(collection *Collection) error
+
+	// Get returns the collection for an ID
+	Get(id string) (*Collection, error)
+
+	// Delete removes the collection for an ID
+	Delete(id string) error
+
+	// List returns all stored collections
+	List() ([]*Collection, error)
+}
+
+// collectionStore implements the CollectionStore interface with one JSON
+// object per collection, kept in the same storage backend as the files
+type collectionStore struct {
+	backend storage.Backend
+	mu      sync.Mutex
+	cache   map[string]*Collection
+}
+
+// NewCollectionStore creates a collection store that keeps JSON objects in backend
+func NewCollectionStore(backend storage.Backend) CollectionStore {
+	return &collectionStore{
+		backend: backend,
+		cache:   make(map[string]*Collection),
+	}
+}
+
+// Save creates or replaces the collection for collection.ID
+func (s *collectionStore) Save(collection *Collection) error {
+	key, err := objectKey(collectionPrefix, collection.ID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(collection)
+	if err != nil {
+		return fmt.Errorf("failed to encode collection: %w", err)
+	}
+
+	if err := s.backend.Put(key, bytes.NewReader(data), int64(len(data))); err != nil {
+		return fmt.Errorf("failed to store collection: %w", err)
+	}
+
+	s.mu.Lock()
+	delete(s.cache, key)
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Get returns the collection for an ID
+func (s *collectionStore) Get(id string) (*Collection, error) {
+	key, err := objectKey(collectionPrefix, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.read(key)
+}
+
+// Delete removes the collection for an ID
+func (s *collectionStore) Delete(id string) error {
+	key, err := objectKey(collectionPrefix, id)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.cache, key)
+	s.mu.Unlock()
+
+	if err := s.backend.Delete(key); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("failed to delete collection: %w", err)
+	}
+
+	return nil
+}
+
+// List returns all stored collections. Collections are only replaced by
+// Save, which forgets the cached copy, so each one is read just once
+func (s *collectionStore) List() ([]*Collection, error) {
+	objects, err := s.backend.List(collectionPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list collections: %w", err)
+	}
+
+	collections := make([]*Collection, 0, len(objects))
+	seen := make(map[string]bool, len(objects))
+
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, ".json") {
+			continue
+		}
+		seen[object.Key] = true
+
+		collection, err := s.read(object.Key)
+		if err != nil {
+			// Collection removed or unreadable since listing
+			continue
+		}
+		collections = append(collections, collection)
+	}
+
+	// Forget collections that no longer exist
+	s.mu.Lock()
+	for key := range s.cache {
+		if !seen[key] {
+			delete(s.cache, key)
+		}
+	}
+	s.mu.Unlock()
+
+	return collections, nil
+}
+
+// read returns the collection stored under key, from the cache if possible
+func (s *collectionStore) read(key string) (*Collection, error) {
+	s.mu.Lock()
+	cached, ok := s.cache[key]
+	s.mu.Unlock()
+	if ok {
+		return cached.clone(), nil
+	}
+
+	reader, _, err := s.backend.Get(key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to read collection: %w", err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read collection: %w", err)
+	}
+
+	var collection Collection
+	if err := json.Unmarshal(data, &collection); err != nil {
+		return nil, fmt.Errorf("failed to decode collection: %w", err)
+	}
+
+	s.mu.Lock()
+	s.cache[key] = collection.clone()
+	s.mu.Unlock()
+
+	return &collection, nil
+}
+
+// clone returns a copy of the collection so cached entries are never shared
+func (c *Collection) clone() *Collection {
+	copied := *c
+	copied.FileIDs = append([]string(nil), c.FileIDs...)
+	return &copied
+}
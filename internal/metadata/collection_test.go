@@ -0,0 +1,68 @@
+package metadata
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pandeptwidyaop/tempfile/internal/storage"
+)
+
+func TestCollectionStore_SaveGetDelete(t *testing.T) {
+	backend, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+	store := NewCollectionStore(backend)
+
+	collection := &Collection{
+		ID:        "6f1c2a",
+		FileIDs:   []string{"a_1.log", "b_1.tar.gz"},
+		CreatedAt: time.Now().Truncate(time.Second),
+	}
+	if err := store.Save(collection); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	// Collections are stored next to the files under their own prefix
+	if _, err := backend.Stat("collections/6f1c2a.json"); err != nil {
+		t.Errorf("collection Stat() error = %v", err)
+	}
+
+	got, err := store.Get("6f1c2a")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if len(got.FileIDs) != 2 || got.FileIDs[1] != "b_1.tar.gz" || !got.ExpiresAt.IsZero() {
+		t.Errorf("Get() = %+v, want %+v", got, collection)
+	}
+
+	// Cached copies are not shared with callers
+	got.FileIDs[0] = "changed"
+	if again, _ := store.Get("6f1c2a"); again.FileIDs[0] != "a_1.log" {
+		t.Errorf("Get() FileIDs[0] = %q after modifying a previous result", again.FileIDs[0])
+	}
+
+	listed, err := store.List()
+	if err != nil || len(listed) != 1 {
+		t.Fatalf("List() = %d collections, %v, want 1", len(listed), err)
+	}
+
+	if err := store.Delete("6f1c2a"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := store.Get("6f1c2a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() after Delete() error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestCollection_IsExpired(t *testing.T) {
+	now := time.Now()
+
+	if (&Collection{}).IsExpired(now) {
+		t.Error("collection without its own expiry reported as expired")
+	}
+	if !(&Collection{ExpiresAt: now.Add(-time.Second)}).IsExpired(now) {
+		t.Error("collection past its expiry not reported as expired")
+	}
+}
@@ -0,0 +1,16 @@
+package metadata
+
+import "errors"
+
+// Common metadata errors
+var (
+	// ErrNotFound indicates no metadata record exists for the file
+	ErrNotFound = errors.New("metadata record not found")
+
+	// ErrInvalidID indicates a file ID that cannot be used as a record key
+	ErrInvalidID = errors.New("invalid file ID")
+
+	// ErrConflict indicates a record that kept being changed by other
+	// servers while it was updated
+	ErrConflict = errors.New("metadata record changed concurrently")
+)
@@ -0,0 +1,246 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pandeptwidyaop/tempfile/internal/storage"
+)
+
+// sidecarPrefix is the storage key prefix under which records are kept
+const sidecarPrefix = "meta/"
+
+// updateAttempts is how often Update reads a record again after losing a
+// conditional write to another server, before giving up
+const updateAttempts = 10
+
+// cachedRecord is a decoded sidecar together with the object state it was read from
+type cachedRecord struct {
+	size    int64
+	modTime time.Time
+	record  *Record
+}
+
+// sidecarStore implements the Store interface with one JSON sidecar object
+// per file, kept in the same storage backend as the files themselves
+type sidecarStore struct {
+	backend storage.Backend
+	mu      sync.Mutex
+	cache   map[string]cachedRecord
+}
+
+// NewSidecarStore creates a metadata store that keeps JSON sidecars in backend
+func NewSidecarStore(backend storage.Backend) Store {
+	return &sidecarStore{
+		backend: backend,
+		cache:   make(map[string]cachedRecord),
+	}
+}
+
+// Save creates or replaces the record for record.ID
+func (s *sidecarStore) Save(record *Record) error {
+	key, err := sidecarKey(record.ID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+
+	if err := s.backend.Put(key, bytes.NewReader(data), int64(len(data))); err != nil {
+		return fmt.Errorf("failed to store metadata: %w", err)
+	}
+
+	s.mu.Lock()
+	delete(s.cache, key)
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Get returns the record for a file ID
+func (s *sidecarStore) Get(id string) (*Record, error) {
+	key, err := sidecarKey(id)
+	if err != nil {
+		return nil, err
+	}
+
+	record, _, err := s.read(key)
+	return record, err
+}
+
+// Update applies update to the current record for a file ID and stores the
+// result. On a backend with conditional writes the sidecar is only replaced
+// if it is still the version update was applied to; otherwise it is read
+// again and update retried. Other backends are only ever used by one server,
+// whose callers serialize their updates
+func (s *sidecarStore) Update(id string, update func(*Record) error) (*Record, error) {
+	key, err := sidecarKey(id)
+	if err != nil {
+		return nil, err
+	}
+	conditional, _ := s.backend.(storage.ConditionalBackend)
+
+	for attempt := 0; attempt < updateAttempts; attempt++ {
+		record, etag, err := s.read(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := update(record); err != nil {
+			return nil, err
+		}
+
+		data, err := json.Marshal(record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode metadata: %w", err)
+		}
+
+		if conditional != nil && etag != "" {
+			err = conditional.PutIfMatch(key, bytes.NewReader(data), int64(len(data)), etag)
+		} else {
+			err = s.backend.Put(key, bytes.NewReader(data), int64(len(data)))
+		}
+
+		s.mu.Lock()
+		delete(s.cache, key)
+		s.mu.Unlock()
+
+		switch {
+		case err == nil:
+			return record, nil
+		case errors.Is(err, storage.ErrPreconditionFailed):
+			continue
+		case errors.Is(err, storage.ErrNotFound):
+			return nil, ErrNotFound
+		default:
+			return nil, fmt.Errorf("failed to store metadata: %w", err)
+		}
+	}
+
+	return nil, ErrConflict
+}
+
+// Delete removes the record for a file ID
+func (s *sidecarStore) Delete(id string) error {
+	key, err := sidecarKey(id)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.cache, key)
+	s.mu.Unlock()
+
+	if err := s.backend.Delete(key); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("failed to delete metadata: %w", err)
+	}
+
+	return nil
+}
+
+// List returns all stored records. Sidecars are only re-read when their
+// size or modification time changed since the previous listing
+func (s *sidecarStore) List() ([]*Record, error) {
+	objects, err := s.backend.List(sidecarPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list metadata: %w", err)
+	}
+
+	records := make([]*Record, 0, len(objects))
+	seen := make(map[string]bool, len(objects))
+
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, ".json") {
+			continue
+		}
+		seen[object.Key] = true
+
+		s.mu.Lock()
+		cached, ok := s.cache[object.Key]
+		s.mu.Unlock()
+
+		if ok && cached.size == object.Size && cached.modTime.Equal(object.ModTime) {
+			records = append(records, cached.record.clone())
+			continue
+		}
+
+		record, _, err := s.read(object.Key)
+		if err != nil {
+			// Record removed or unreadable since listing
+			continue
+		}
+
+		// Cache against the listed state, which is what the next listing compares to
+		s.mu.Lock()
+		s.cache[object.Key] = cachedRecord{size: object.Size, modTime: object.ModTime, record: record.clone()}
+		s.mu.Unlock()
+
+		records = append(records, record)
+	}
+
+	// Forget records that no longer exist
+	s.mu.Lock()
+	for key := range s.cache {
+		if !seen[key] {
+			delete(s.cache, key)
+		}
+	}
+	s.mu.Unlock()
+
+	return records, nil
+}
+
+// read loads and decodes the sidecar stored under key, along with the ETag
+// of the version read, if the backend reports one
+func (s *sidecarStore) read(key string) (*Record, string, error) {
+	reader, info, err := s.backend.Get(key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, "", ErrNotFound
+		}
+		return nil, "", fmt.Errorf("failed to read metadata: %w", err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read metadata: %w", err)
+	}
+
+	var record Record
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, "", fmt.Errorf("failed to decode metadata: %w", err)
+	}
+
+	return &record, info.ETag, nil
+}
+
+// sidecarKey returns the storage key of the sidecar for a file ID
+func sidecarKey(id string) (string, error) {
+	return objectKey(sidecarPrefix, id)
+}
+
+// objectKey returns the storage key of the JSON object for an ID under prefix
+func objectKey(prefix, id string) (string, error) {
+	if id == "" || id == "." || id == ".." || strings.Contains(id, "/") {
+		return "", ErrInvalidID
+	}
+
+	key := prefix + id + ".json"
+	if err := storage.ValidateKey(key); err != nil {
+		return "", ErrInvalidID
+	}
+
+	return key, nil
+}
@@ -0,0 +1,247 @@
+package metadata
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pandeptwidyaop/tempfile/internal/storage"
+)
+
+func newTestStore(t *testing.T) (Store, storage.Backend) {
+	backend, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+	return NewSidecarStore(backend), backend
+}
+
+func TestSidecarStore_SaveGet(t *testing.T) {
+	store, backend := newTestStore(t)
+
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	record := &Record{
+		ID:           "abc_123.pdf",
+		OriginalName: "quarterly-report.pdf",
+		Size:         2048,
+		ContentType:  "application/pdf",
+		CreatedAt:    time.Now().Truncate(time.Second),
+		ExpiresAt:    expiresAt,
+		UploaderIP:   "203.0.113.1",
+	}
+
+	if err := store.Save(record); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	// Sidecar is stored next to the files under the metadata prefix
+	if _, err := backend.Stat("meta/abc_123.pdf.json"); err != nil {
+		t.Errorf("sidecar Stat() error = %v", err)
+	}
+
+	got, err := store.Get("abc_123.pdf")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got.OriginalName != record.OriginalName || got.Size != record.Size || got.UploaderIP != record.UploaderIP {
+		t.Errorf("Get() = %+v, want %+v", got, record)
+	}
+	if !got.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("Get() ExpiresAt = %v, want %v", got.ExpiresAt, expiresAt)
+	}
+}
+
+func TestSidecarStore_GetMissing(t *testing.T) {
+	store, _ := newTestStore(t)
+
+	if _, err := store.Get("missing_1.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestSidecarStore_InvalidID(t *testing.T) {
+	store, _ := newTestStore(t)
+
+	for _, id := range []string{"", "a/b", "..", "../x"} {
+		if _, err := store.Get(id); !errors.Is(err, ErrInvalidID) {
+			t.Errorf("Get(%q) error = %v, want %v", id, err, ErrInvalidID)
+		}
+	}
+}
+
+func TestSidecarStore_ListDelete(t *testing.T) {
+	store, _ := newTestStore(t)
+
+	for _, id := range []string{"a_1.txt", "b_2.txt"} {
+		if err := store.Save(&Record{ID: id, ExpiresAt: time.Now()}); err != nil {
+			t.Fatalf("Save(%s) error = %v", id, err)
+		}
+	}
+
+	records, err := store.List()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(records) != 2 {
+		t.Errorf("List() returned %d records, want 2", len(records))
+	}
+
+	if err := store.Delete("a_1.txt"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if err := store.Delete("a_1.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete() error = %v, want %v", err, ErrNotFound)
+	}
+
+	records, err = store.List()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(records) != 1 || records[0].ID != "b_2.txt" {
+		t.Errorf("List() = %v, want [b_2.txt]", records)
+	}
+}
+
+func TestSidecarStore_ListSeesUpdates(t *testing.T) {
+	store, _ := newTestStore(t)
+
+	record := &Record{ID: "a_1.txt", OriginalName: "first.txt"}
+	if err := store.Save(record); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if _, err := store.List(); err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+
+	record.OriginalName = "second-name.txt"
+	if err := store.Save(record); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	records, err := store.List()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(records) != 1 || records[0].OriginalName != "second-name.txt" {
+		t.Errorf("List() = %+v, want updated record", records)
+	}
+}
+
+// versionedBackend adds conditional writes to a backend, with ETags counting
+// how often each object was written, like an S3 bucket shared by servers
+type versionedBackend struct {
+	storage.Backend
+	mu       sync.Mutex
+	versions map[string]int
+}
+
+func (b *versionedBackend) Put(key string, r io.Reader, size int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Backend.Put(key, r, size); err != nil {
+		return err
+	}
+	b.versions[key]++
+	return nil
+}
+
+func (b *versionedBackend) PutIfMatch(key string, r io.Reader, size int64, etag string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if etag != strconv.Itoa(b.versions[key]) {
+		return storage.ErrPreconditionFailed
+	}
+	if err := b.Backend.Put(key, r, size); err != nil {
+		return err
+	}
+	b.versions[key]++
+	return nil
+}
+
+func (b *versionedBackend) PutIfAbsent(key string, r io.Reader, size int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.Backend.Stat(key); err == nil {
+		return storage.ErrPreconditionFailed
+	}
+	if err := b.Backend.Put(key, r, size); err != nil {
+		return err
+	}
+	b.versions[key]++
+	return nil
+}
+
+func (b *versionedBackend) Get(key string) (io.ReadCloser, *storage.ObjectInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	reader, info, err := b.Backend.Get(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	info.ETag = strconv.Itoa(b.versions[key])
+	return reader, info, nil
+}
+
+func TestSidecarStore_Update(t *testing.T) {
+	local, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+	backend := &versionedBackend{Backend: local, versions: make(map[string]int)}
+	store := NewSidecarStore(backend)
+
+	if err := store.Save(&Record{ID: "a_1.txt", MaxDownloads: 10}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	// Another server counts downloads while the first update is under way,
+	// which must not be overwritten
+	other := NewSidecarStore(backend)
+	attempts := 0
+	got, err := store.Update("a_1.txt", func(record *Record) error {
+		attempts++
+		if attempts == 1 {
+			if err := other.Save(&Record{ID: "a_1.txt", MaxDownloads: 10, Downloads: 5}); err != nil {
+				t.Fatalf("Save() error = %v", err)
+			}
+		}
+		record.Downloads++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("update applied %d times, want 2", attempts)
+	}
+	if got.Downloads != 6 {
+		t.Errorf("Update() Downloads = %d, want 6", got.Downloads)
+	}
+	if stored, _ := store.Get("a_1.txt"); stored.Downloads != 6 {
+		t.Errorf("stored Downloads = %d, want 6", stored.Downloads)
+	}
+
+	// A failing update leaves the record alone
+	errExhausted := errors.New("exhausted")
+	if _, err := store.Update("a_1.txt", func(*Record) error { return errExhausted }); !errors.Is(err, errExhausted) {
+		t.Errorf("Update() error = %v, want %v", err, errExhausted)
+	}
+	if _, err := store.Update("missing_1.txt", func(*Record) error { return nil }); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Update() error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestRecord_IsExpired(t *testing.T) {
+	now := time.Now()
+	record := &Record{ExpiresAt: now}
+
+	if record.IsExpired(now.Add(-time.Second)) {
+		t.Errorf("IsExpired() before expiry = true, want false")
+	}
+	if !record.IsExpired(now.Add(time.Second)) {
+		t.Errorf("IsExpired() after expiry = false, want true")
+	}
+}
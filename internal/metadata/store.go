@@ -0,0 +1,141 @@
+package metadata
+
+import (
+	"time"
+)
+
+// Record holds everything known about an uploaded file
+type Record struct {
+	// ID is the stored filename, also used in the download URL
+	ID           string    `json:"id"`
+	OriginalName string    `json:"original_name"`
+	Size         int64     `json:"size"`
+	CreatedAt    time.Time `json:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+
+	// ContentType is the type detected from the content as it was stored, and
+	// served as the file's Content-Type. TypeMismatch is set when it did not
+	// agree with the extension of the original name
+	ContentType  string `json:"content_type"`
+	TypeMismatch bool   `json:"type_mismatch,omitempty"`
+
+	// SHA256 is the hex encoded SHA-256 digest of the content, computed while
+	// it was stored. Files stored before digests were recorded have none
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Blob is set when the content is kept in the blob shared by all files
+	// with the same SHA256 stored the same way, rather than under the file's
+	// own ID
+	Blob bool `json:"blob,omitempty"`
+
+	// BlobName names the blob holding the content, and BlobKey is the
+	// storage key of the blob's content. Files stored before blobs were
+	// named have neither, and use the blob named by their SHA256
+	BlobName string `json:"blob_name,omitempty"`
+	BlobKey  string `json:"blob_key,omitempty"`
+
+	// Encrypted is set when the blob was encrypted at rest as the file was
+	// stored; its data key is kept with the blob
+	Encrypted bool `json:"encrypted,omitempty"`
+
+	// ClientEncrypted is set when the uploader's browser encrypted the file
+	// before sending it, with a key the server never sees. The content can
+	// only be passed on as it is, never previewed or inspected
+	ClientEncrypted bool `json:"client_encrypted,omitempty"`
+
+	// Scan is the result of scanning the content for malware as it was
+	// stored, if scanning was enabled
+	Scan *ScanResult `json:"scan,omitempty"`
+
+	// MaxDownloads limits how often the file may be downloaded, 0 meaning
+	// unlimited. Downloads counts the downloads served so far
+	MaxDownloads int `json:"max_downloads,omitempty"`
+	Downloads    int `json:"downloads,omitempty"`
+
+	// PasswordHash is the argon2id hash of the password required to download
+	// the file, if any. The password itself is never stored
+	PasswordHash string `json:"password_hash,omitempty"`
+
+	// DeleteTokenHash is the hash of the token that lets the uploader manage
+	// the file, such as deleting it early. The token itself is never stored
+	DeleteTokenHash string `json:"delete_token_hash,omitempty"`
+
+	// Uploader info
+	UploaderIP string `json:"uploader_ip,omitempty"`
+	UserAgent  string `json:"user_agent,omitempty"`
+
+	// Legacy is set for files without a stored record, whose details were
+	// recovered from the filename. Legacy records are never persisted
+	Legacy bool `json:"-"`
+}
+
+// Statuses of a malware scan
+const (
+	// ScanClean is the status of content in which no malware was found
+	ScanClean = "clean"
+
+	// ScanInfected is the status of content in which malware was found. Such
+	// files are only kept in quarantine, and never served
+	ScanInfected = "infected"
+
+	// ScanFailed is the status of content stored unscanned because the
+	// scanner was unavailable
+	ScanFailed = "failed"
+
+	// ScanSkipped is the status of content that cannot be scanned, such as
+	// files encrypted by the client
+	ScanSkipped = "skipped"
+)
+
+// ScanResult is the outcome of scanning a file's content for malware
+type ScanResult struct {
+	Status    string    `json:"status"`
+	Signature string    `json:"signature,omitempty"`
+	ScannedAt time.Time `json:"scanned_at"`
+}
+
+// IsQuarantined reports whether the file was kept despite malware found in it
+func (r *Record) IsQuarantined() bool {
+	return r.Scan != nil && r.Scan.Status == ScanInfected
+}
+
+// IsExpired reports whether the file has expired at the given time
+func (r *Record) IsExpired(now time.Time) bool {
+	return now.After(r.ExpiresAt)
+}
+
+// DownloadsExhausted reports whether a download limited file has used up its downloads
+func (r *Record) DownloadsExhausted() bool {
+	return r.MaxDownloads > 0 && r.Downloads >= r.MaxDownloads
+}
+
+// clone returns a copy of the record so cached entries are never shared
+func (r *Record) clone() *Record {
+	copied := *r
+	if r.Scan != nil {
+		scan := *r.Scan
+		copied.Scan = &scan
+	}
+	return &copied
+}
+
+// Store interface defines persistence for per-file metadata records
+type Store interface {
+	// Save creates or replaces the record for record.ID
+	Save(record *Record) error
+
+	// Get returns the record for a file ID
+	Get(id string) (*Record, error)
+
+	// Update applies update to the current record for a file ID and stores
+	// the result, unless update fails. Where the storage backend supports
+	// conditional writes, a record changed by another server in the meantime
+	// is read again and update retried, so no change is lost
+	Update(id string, update func(*Record) error) (*Record, error)
+
+	// Delete removes the record for a file ID
+	Delete(id string) error
+
+	// List returns all stored records
+	List() ([]*Record, error)
+}
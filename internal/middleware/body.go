@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandeptwidyaop/tempfile/internal/utils"
+)
+
+// NewStreamedBodyGuard creates a middleware for an app that streams request
+// bodies. Streamed bodies are not held to the app's BodyLimit, so one declared
+// larger than maxSize is rejected before it is read. A body that may not have
+// been read to its end would be taken for the next request on the connection,
+// so the connection is closed after an error response to a request with a body
+func NewStreamedBodyGuard(maxSize int64) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		contentLength := c.Request().Header.ContentLength()
+		if contentLength == 0 {
+			return c.Next()
+		}
+
+		if int64(contentLength) > maxSize {
+			c.Context().SetConnectionClose()
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+				"error": fmt.Sprintf("Request body exceeds %s limit", utils.FormatBytes(maxSize)),
+			})
+		}
+
+		err := c.Next()
+		if err != nil || c.Response().StatusCode() >= fiber.StatusBadRequest {
+			c.Context().SetConnectionClose()
+		}
+		return err
+	}
+}
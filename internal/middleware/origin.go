@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// downloadOriginPages are the single segment paths of the web UI, which are
+// not file downloads
+var downloadOriginPages = map[string]bool{"": true, "success": true, "oembed": true}
+
+// NewDownloadOriginGuard creates a middleware keeping the web UI and the API
+// off the separate origin that serves file content (DOWNLOAD_ORIGIN). On the
+// host of that origin only downloads, at /:filename and /:filename/raw, the
+// static assets of the pages standing in for them, and health checks are
+// served; anything else is not found
+func NewDownloadOriginGuard(host string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !strings.EqualFold(c.Hostname(), host) || isDownloadOriginPath(c) {
+			return c.Next()
+		}
+
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Not found",
+		})
+	}
+}
+
+// isDownloadOriginPath reports whether a request may be served on the download origin
+func isDownloadOriginPath(c *fiber.Ctx) bool {
+	switch c.Method() {
+	case fiber.MethodGet, fiber.MethodHead:
+		if c.Path() == "/health" || strings.HasPrefix(c.Path(), "/static/") {
+			return true
+		}
+	case fiber.MethodPost:
+		// The password prompt posts back
+	default:
+		return false
+	}
+
+	segments := strings.Split(strings.TrimPrefix(c.Path(), "/"), "/")
+	switch len(segments) {
+	case 1:
+		return !downloadOriginPages[segments[0]]
+	case 2:
+		return segments[0] != "" && segments[1] == "raw"
+	default:
+		return false
+	}
+}
@@ -104,6 +104,16 @@ func NewRateLimiter(config RateLimiterConfig) fiber.Handler {
 		c.Locals("rate_limit_estimated_size", fileSize)
 		c.Locals("rate_limit_endpoint", endpoint)
 
+		// Uploads are streamed, so the bytes actually received are checked
+		// against what the client may still upload while they arrive
+		if status != nil && status.BytesLimit >= 0 {
+			allowance := status.BytesLimit - status.BytesUsed
+			if allowance < fileSize {
+				allowance = fileSize
+			}
+			c.Locals("rate_limit_byte_allowance", allowance)
+		}
+
 		// Add rate limit headers to response
 		addRateLimitHeaders(c, status)
 
@@ -111,23 +121,27 @@ func NewRateLimiter(config RateLimiterConfig) fiber.Handler {
 	}
 }
 
-// PostProcess creates a middleware that updates counters after successful upload
+// PostProcess creates a middleware that updates counters after successful upload.
+// It must be registered before the upload handler, which it runs first
 func NewRateLimiterPostProcess(rateLimiter ratelimit.RateLimiter) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		if err := c.Next(); err != nil {
+			return err
+		}
+
 		// Only update if rate limit was checked and request was successful
 		if c.Locals("rate_limit_checked") == true && c.Response().StatusCode() < 400 {
 			key := c.Locals("rate_limit_key")
 			if key != nil {
-				// Get actual file size if available, otherwise use estimated
-				actualSize := getActualFileSize(c)
-				if actualSize == 0 {
-					if estimatedSize := c.Locals("rate_limit_estimated_size"); estimatedSize != nil {
-						actualSize = estimatedSize.(int64)
+				// Every stored file counts as an upload of its own
+				for i, size := range uploadedFileSizes(c) {
+					var err error
+					if i == 0 {
+						err = rateLimiter.UpdateCounters(key.(string), size)
+					} else {
+						err = rateLimiter.UpdateAdditionalUpload(key.(string), size)
 					}
-				}
 
-				// Update counters
-				if err := rateLimiter.UpdateCounters(key.(string), actualSize); err != nil {
 					// Log error but don't fail the request
 					// This is a background operation
 					// TODO: Add proper logging
@@ -136,7 +150,34 @@ func NewRateLimiterPostProcess(rateLimiter ratelimit.RateLimiter) fiber.Handler
 			}
 		}
 
-		return c.Next()
+		return nil
+	}
+}
+
+// NewRateLimiterChunkCounter creates a middleware that counts resumable upload
+// traffic as it arrives: creating an upload counts as one upload, and every
+// chunk adds the bytes received to the bytes used
+func NewRateLimiterChunkCounter(rateLimiter ratelimit.RateLimiter) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		err := c.Next()
+
+		key, ok := c.Locals("rate_limit_key").(string)
+		if c.Locals("rate_limit_checked") != true || !ok {
+			return err
+		}
+
+		switch c.Method() {
+		case fiber.MethodPost:
+			if c.Response().StatusCode() == fiber.StatusCreated {
+				_ = rateLimiter.UpdateCounters(key, 0)
+			}
+		case fiber.MethodPatch:
+			if size, ok := c.Locals("actual_file_size").(int64); ok && size > 0 {
+				_ = rateLimiter.UpdateBytes(key, size)
+			}
+		}
+
+		return err
 	}
 }
 
@@ -163,24 +204,35 @@ func defaultKeyGenerator(ipDetector ratelimit.IPDetector) func(c *fiber.Ctx) str
 	}
 }
 
-// getEstimatedFileSize attempts to get file size from Content-Length header
+// getEstimatedFileSize gets the file size from the Content-Length header. The
+// body is never read here: it is streamed to storage by the upload handler
 func getEstimatedFileSize(c *fiber.Ctx) int64 {
-	// Try Content-Length header first
 	if contentLength := c.Get("Content-Length"); contentLength != "" {
 		if size, err := strconv.ParseInt(contentLength, 10, 64); err == nil {
 			return size
 		}
 	}
 
-	// Try to get from multipart form (this might parse the form)
-	if form, err := c.MultipartForm(); err == nil && form != nil {
-		if files := form.File["file"]; len(files) > 0 {
-			return files[0].Size
+	// Default to 0 if we can't determine size
+	return 0
+}
+
+// uploadedFileSizes returns the size of every file stored by an upload
+// request, falling back to a single file of the actual or estimated size
+func uploadedFileSizes(c *fiber.Ctx) []int64 {
+	if sizes, ok := c.Locals("uploaded_file_sizes").([]int64); ok && len(sizes) > 0 {
+		return sizes
+	}
+
+	// Get actual file size if available, otherwise use estimated
+	actualSize := getActualFileSize(c)
+	if actualSize == 0 {
+		if estimatedSize, ok := c.Locals("rate_limit_estimated_size").(int64); ok {
+			actualSize = estimatedSize
 		}
 	}
 
-	// Default to 0 if we can't determine size
-	return 0
+	return []int64{actualSize}
 }
 
 // getActualFileSize gets the actual file size after processing
@@ -192,13 +244,6 @@ func getActualFileSize(c *fiber.Ctx) int64 {
 		}
 	}
 
-	// Try to get from multipart form again
-	if form, err := c.MultipartForm(); err == nil && form != nil {
-		if files := form.File["file"]; len(files) > 0 {
-			return files[0].Size
-		}
-	}
-
 	return 0
 }
 
@@ -11,7 +11,28 @@ type UploadResponse struct {
 	SizeHuman    string    `json:"size_human"`
 	ExpiresAt    time.Time `json:"expires_at"`
 	ExpiresIn    string    `json:"expires_in"`
+	SHA256       string    `json:"sha256"`
+	ContentType  string    `json:"content_type"`
+	MaxDownloads int       `json:"max_downloads,omitempty"`
+	Protected    bool      `json:"password_protected,omitempty"`
 	DownloadURL  string    `json:"download_url"`
+	DeleteToken  string    `json:"delete_token"`
+	DeleteURL    string    `json:"delete_url"`
+
+	// ClientEncrypted is set for files encrypted by the client before upload
+	ClientEncrypted bool `json:"client_encrypted,omitempty"`
+
+	// TypeMismatch is set when the content did not look like what the
+	// extension of the file says it is
+	TypeMismatch bool `json:"type_mismatch,omitempty"`
+
+	// ScanStatus is the result of scanning the file for malware, if enabled:
+	// clean, or failed or skipped when it could not be scanned
+	ScanStatus string `json:"scan_status,omitempty"`
+
+	// CollectionID and CollectionURL are set for files uploaded together
+	CollectionID  string `json:"collection_id,omitempty"`
+	CollectionURL string `json:"collection_url,omitempty"`
 }
 
 // ErrorResponse represents an error response
@@ -27,21 +48,78 @@ type HealthResponse struct {
 	Uptime      string `json:"uptime"`
 }
 
+// StatsResponse represents the storage statistics. Storage is only reported
+// to admins, since it tells whether content anyone uploaded is stored already
+type StatsResponse struct {
+	Files             int    `json:"files"`
+	LogicalBytes      int64  `json:"logical_bytes"`
+	LogicalBytesHuman string `json:"logical_bytes_human"`
+
+	*StorageStats
+}
+
+// StorageStats represents what the files take up once identical content is
+// only kept once, in StoredBytes, and what that saves
+type StorageStats struct {
+	StoredObjects    int    `json:"stored_objects"`
+	StoredBytes      int64  `json:"stored_bytes"`
+	StoredBytesHuman string `json:"stored_bytes_human"`
+	SavedBytes       int64  `json:"saved_bytes"`
+	SavedBytesHuman  string `json:"saved_bytes_human"`
+}
+
 // WebPageData represents data passed to web templates
 type WebPageData struct {
-	Title            string
-	Theme            string
-	FileExpiryHours  int
-	MaxFileSize      int64
-	MaxFileSizeHuman string
-	BaseURL          string
-	Filename         string
-	OriginalName     string
-	Size             string
-	SizeHuman        string
-	ExpiresAt        string
-	ExpiresIn        string
-	ErrorTitle       string
-	ErrorMessage     string
-	ErrorDetail      string
+	Title               string
+	Theme               string
+	FileExpiryHours     int
+	DefaultExpiry       string
+	ExpiryOptions       []ExpiryOption
+	MaxFileSize         int64
+	MaxFileSizeHuman    string
+	MaxFiles            int
+	MaxRequestSize      int64
+	MaxRequestSizeHuman string
+	ClientEncryption    bool
+	BaseURL             string
+	Filename            string
+	OriginalName        string
+	Size                string
+	SizeHuman           string
+	ExpiresAt           string
+	ExpiresIn           string
+	MaxDownloads        int
+	Protected           bool
+	ClientEncrypted     bool
+	DeleteToken         string
+	DownloadURL         string
+	DeleteURL           string
+	PageURL             string
+	OEmbedURL           string
+	ContentType         string
+	Deleted             bool
+	Files               []UploadedFile
+	CollectionURL       string
+	ErrorTitle          string
+	ErrorMessage        string
+	ErrorDetail         string
+}
+
+// ExpiryOption represents a choice in the upload page expiry selector
+type ExpiryOption struct {
+	Value    string
+	Label    string
+	Selected bool
+}
+
+// UploadedFile represents one of several files listed on a page, such as the
+// success page of a multi-file upload or a collection's landing page
+type UploadedFile struct {
+	Filename     string
+	OriginalName string
+	SizeHuman    string
+	ExpiresIn    string
+	Protected    bool
+	DownloadURL  string
+	DeleteURL    string
 }
@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// AttemptLimiter limits failed attempts at guessing a secret, such as a file
+// password. Attempts are counted in the same stores as uploads, under their own keys
+type AttemptLimiter interface {
+	// Reserve counts an attempt by key before it is checked, reporting false
+	// and how long to wait before retrying if key has no attempts left.
+	// Concurrent attempts each take one, so they can't exceed the limit together
+	Reserve(key string) (bool, time.Duration, error)
+
+	// Refund gives back an attempt by key that turned out to succeed
+	Refund(key string) error
+}
+
+// attemptKeyPrefix keeps failed attempts apart from upload counters in a shared store
+const attemptKeyPrefix = "attempts:"
+
+// attemptLimiter implements the AttemptLimiter interface on top of a Store
+type attemptLimiter struct {
+	store       Store
+	maxAttempts int
+	window      time.Duration
+
+	// mu makes reserving atomic on stores without an atomic check and increment
+	mu sync.Mutex
+}
+
+// NewAttemptLimiter creates a limiter allowing maxAttempts failed attempts per
+// key within a sliding window
+func NewAttemptLimiter(store Store, maxAttempts int, window time.Duration) AttemptLimiter {
+	return &attemptLimiter{
+		store:       store,
+		maxAttempts: maxAttempts,
+		window:      window,
+	}
+}
+
+// Reserve counts an attempt by key if it has any left
+func (l *attemptLimiter) Reserve(key string) (bool, time.Duration, error) {
+	key = attemptKeyPrefix + key
+
+	// Redis checks and counts in one script, shared by all servers
+	if atomicStore, ok := l.store.(AtomicStore); ok {
+		allowed, _, _, _, err := atomicStore.AtomicCheckAndIncrement(key, 0, l.window, l.maxAttempts, math.MaxInt64)
+		if err != nil {
+			return false, 0, fmt.Errorf("failed to reserve attempt: %w", err)
+		}
+		if !allowed {
+			return false, l.window, nil
+		}
+		return true, 0, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	attempts, err := l.store.GetUploadCount(key, l.window)
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to read attempts: %w", err)
+	}
+	if attempts >= l.maxAttempts {
+		return false, l.window, nil
+	}
+
+	if err := l.store.IncrementUpload(key, 0, l.window); err != nil {
+		return false, 0, fmt.Errorf("failed to reserve attempt: %w", err)
+	}
+
+	return true, 0, nil
+}
+
+// Refund gives back an attempt by key
+func (l *attemptLimiter) Refund(key string) error {
+	if err := l.store.DecrementUpload(attemptKeyPrefix + key); err != nil {
+		return fmt.Errorf("failed to refund attempt: %w", err)
+	}
+
+	return nil
+}
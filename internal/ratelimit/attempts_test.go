@@ -0,0 +1,83 @@
+package ratelimit
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAttemptLimiter(t *testing.T) {
+	store := NewMemoryStore(100, time.Minute)
+	defer store.Close()
+
+	limiter := NewAttemptLimiter(store, 2, time.Minute)
+	key := "password:203.0.113.1"
+
+	// A successful attempt is given back and uses up nothing
+	if allowed, _, err := limiter.Reserve(key); err != nil || !allowed {
+		t.Fatalf("Reserve() = %v, %v, want true", allowed, err)
+	}
+	if err := limiter.Refund(key); err != nil {
+		t.Fatalf("Refund() error = %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		allowed, _, err := limiter.Reserve(key)
+		if err != nil {
+			t.Fatalf("Reserve() error = %v", err)
+		}
+		if !allowed {
+			t.Fatalf("Reserve() after %d failures = false, want true", i)
+		}
+	}
+
+	allowed, retryAfter, err := limiter.Reserve(key)
+	if err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	if allowed || retryAfter != time.Minute {
+		t.Errorf("Reserve() = %v, %v, want false, 1m0s", allowed, retryAfter)
+	}
+
+	// Attempts are counted apart from uploads and from other keys
+	if count, _ := store.GetUploadCount("password:203.0.113.1", time.Minute); count != 0 {
+		t.Errorf("GetUploadCount() = %d, want 0 for the unprefixed key", count)
+	}
+	if allowed, _, _ := limiter.Reserve("password:203.0.113.2"); !allowed {
+		t.Error("Reserve() for another key = false, want true")
+	}
+}
+
+func TestAttemptLimiter_Concurrent(t *testing.T) {
+	store := NewMemoryStore(100, time.Minute)
+	defer store.Close()
+
+	limiter := NewAttemptLimiter(store, 3, time.Minute)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reserved := 0
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			allowed, _, err := limiter.Reserve("password:203.0.113.1")
+			if err != nil {
+				t.Errorf("Reserve() error = %v", err)
+				return
+			}
+			if allowed {
+				mu.Lock()
+				reserved++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if reserved != 3 {
+		t.Errorf("%d attempts reserved, want 3", reserved)
+	}
+}
@@ -29,6 +29,12 @@ type Store interface {
 	// IncrementUpload records a new upload for an IP with the given file size
 	IncrementUpload(ip string, fileSize int64, window time.Duration) error
 
+	// IncrementBytes records bytes uploaded by an IP without counting a new upload
+	IncrementBytes(ip string, bytes int64, window time.Duration) error
+
+	// DecrementUpload takes back the most recent upload counted for an IP
+	DecrementUpload(ip string) error
+
 	// Cleanup removes expired entries from the store
 	Cleanup() error
 
@@ -50,6 +56,14 @@ type RateLimiter interface {
 	// UpdateCounters increments the counters after a successful upload
 	UpdateCounters(ip string, fileSize int64) error
 
+	// UpdateAdditionalUpload counts another file stored by an upload request
+	// that has already been counted, as when several files are sent at once
+	UpdateAdditionalUpload(ip string, fileSize int64) error
+
+	// UpdateBytes increments the bytes counter for data received as part of an
+	// upload that is counted separately, such as a resumable upload chunk
+	UpdateBytes(ip string, bytes int64) error
+
 	// GetStatus returns the current rate limit status for an IP
 	GetStatus(ip string) (*LimitStatus, error)
 
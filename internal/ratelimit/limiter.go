@@ -184,11 +184,38 @@ func (r *rateLimiter) CheckLimitsForEndpoint(ip string, fileSize int64, endpoint
 
 // UpdateCounters increments the counters after a successful upload
 func (r *rateLimiter) UpdateCounters(ip string, fileSize int64) error {
+	// Atomic stores already recorded the upload while checking the limits
+	if _, ok := r.store.(AtomicStore); ok {
+		return nil
+	}
+
 	uploadWindow := time.Duration(r.windowMinutes) * time.Minute
 
 	return r.store.IncrementUpload(ip, fileSize, uploadWindow)
 }
 
+// UpdateAdditionalUpload counts another file of an upload request already counted
+func (r *rateLimiter) UpdateAdditionalUpload(ip string, fileSize int64) error {
+	// Atomic stores already recorded the bytes of the whole request while checking the limits
+	if _, ok := r.store.(AtomicStore); ok {
+		fileSize = 0
+	}
+
+	uploadWindow := time.Duration(r.windowMinutes) * time.Minute
+
+	return r.store.IncrementUpload(ip, fileSize, uploadWindow)
+}
+
+// UpdateBytes increments the bytes counter without counting a new upload
+func (r *rateLimiter) UpdateBytes(ip string, bytes int64) error {
+	// Atomic stores already recorded the bytes while checking the limits
+	if _, ok := r.store.(AtomicStore); ok {
+		return nil
+	}
+
+	return r.store.IncrementBytes(ip, bytes, time.Hour)
+}
+
 // GetStatus returns the current rate limit status for an IP
 func (r *rateLimiter) GetStatus(ip string) (*LimitStatus, error) {
 	now := time.Now()
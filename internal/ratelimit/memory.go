@@ -9,6 +9,7 @@ import (
 type UploadRecord struct {
 	Timestamp time.Time
 	FileSize  int64
+	BytesOnly bool // counts towards the bytes limit but not the upload count
 }
 
 // memoryStore implements the Store interface using in-memory storage
@@ -54,7 +55,7 @@ func (s *memoryStore) GetUploadCount(ip string, window time.Duration) (int, erro
 	count := 0
 
 	for _, record := range records {
-		if record.Timestamp.After(cutoff) {
+		if record.Timestamp.After(cutoff) && !record.BytesOnly {
 			count++
 		}
 	}
@@ -90,6 +91,36 @@ func (s *memoryStore) GetBytesUsed(ip string, window time.Duration) (int64, erro
 
 // IncrementUpload records a new upload for an IP with the given file size
 func (s *memoryStore) IncrementUpload(ip string, fileSize int64, window time.Duration) error {
+	return s.addRecord(ip, UploadRecord{Timestamp: time.Now(), FileSize: fileSize}, window)
+}
+
+// IncrementBytes records bytes uploaded by an IP without counting a new upload
+func (s *memoryStore) IncrementBytes(ip string, bytes int64, window time.Duration) error {
+	return s.addRecord(ip, UploadRecord{Timestamp: time.Now(), FileSize: bytes, BytesOnly: true}, window)
+}
+
+// DecrementUpload takes back the most recent upload counted for an IP
+func (s *memoryStore) DecrementUpload(ip string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	records := s.uploads[ip]
+	for i := len(records) - 1; i >= 0; i-- {
+		if !records[i].BytesOnly {
+			s.uploads[ip] = append(records[:i], records[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+// addRecord appends an upload record for an IP
+func (s *memoryStore) addRecord(ip string, record UploadRecord, window time.Duration) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -108,12 +139,6 @@ func (s *memoryStore) IncrementUpload(ip string, fileSize int64, window time.Dur
 		}
 	}
 
-	now := time.Now()
-	record := UploadRecord{
-		Timestamp: now,
-		FileSize:  fileSize,
-	}
-
 	s.uploads[ip] = append(s.uploads[ip], record)
 
 	return nil
@@ -79,6 +79,41 @@ func TestMemoryStore_GetBytesUsed(t *testing.T) {
 	}
 }
 
+func TestMemoryStore_IncrementBytes(t *testing.T) {
+	store := NewMemoryStore(100, time.Minute)
+	defer store.Close()
+
+	ip := "203.0.113.1"
+	window := time.Minute
+
+	// One upload followed by two chunks of the same upload
+	if err := store.IncrementUpload(ip, 0, window); err != nil {
+		t.Fatalf("IncrementUpload() error = %v", err)
+	}
+	for _, size := range []int64{1024, 2048} {
+		if err := store.IncrementBytes(ip, size, window); err != nil {
+			t.Fatalf("IncrementBytes() error = %v", err)
+		}
+	}
+
+	// Chunks count towards bytes but not towards the upload count
+	count, err := store.GetUploadCount(ip, window)
+	if err != nil {
+		t.Fatalf("GetUploadCount() error = %v", err)
+	}
+	if count != 1 {
+		t.Errorf("GetUploadCount() = %v, want 1", count)
+	}
+
+	bytes, err := store.GetBytesUsed(ip, window)
+	if err != nil {
+		t.Fatalf("GetBytesUsed() error = %v", err)
+	}
+	if bytes != 3072 {
+		t.Errorf("GetBytesUsed() = %v, want 3072", bytes)
+	}
+}
+
 func TestMemoryStore_SlidingWindow(t *testing.T) {
 	store := NewMemoryStore(100, time.Minute)
 	defer store.Close()
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -85,8 +87,8 @@ func (s *redisStore) GetBytesUsed(ip string, window time.Duration) (int64, error
 
 	var totalBytes int64
 	for _, entry := range entries {
-		// The member is the file size, score is timestamp
-		if size, err := strconv.ParseInt(entry.Member.(string), 10, 64); err == nil {
+		// The member ends with the byte count, score is timestamp
+		if size, err := memberBytes(entry.Member.(string)); err == nil {
 			totalBytes += size
 		}
 	}
@@ -111,10 +113,10 @@ func (s *redisStore) IncrementUpload(ip string, fileSize int64, window time.Dura
 		Member: fmt.Sprintf("%d_%d", timestamp, time.Now().UnixNano()),
 	})
 
-	// Add bytes record (score = timestamp, member = file size)
+	// Add bytes record (score = timestamp, member = unique id and file size)
 	pipe.ZAdd(s.ctx, bytesKey, redis.Z{
 		Score:  float64(timestamp),
-		Member: strconv.FormatInt(fileSize, 10),
+		Member: bytesMember(fileSize),
 	})
 
 	// Set expiry for keys (window + buffer)
@@ -135,6 +137,53 @@ func (s *redisStore) IncrementUpload(ip string, fileSize int64, window time.Dura
 	return nil
 }
 
+// IncrementBytes records bytes uploaded by an IP without counting a new upload
+func (s *redisStore) IncrementBytes(ip string, bytes int64, window time.Duration) error {
+	now := time.Now()
+	bytesKey := s.keyPrefix + "bytes:" + ip
+
+	pipe := s.client.Pipeline()
+	pipe.ZAdd(s.ctx, bytesKey, redis.Z{
+		Score:  float64(now.Unix()),
+		Member: bytesMember(bytes),
+	})
+	pipe.Expire(s.ctx, bytesKey, window+time.Hour)
+	pipe.ZRemRangeByScore(s.ctx, bytesKey, "0", strconv.FormatInt(now.Add(-window).Unix(), 10))
+
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		return fmt.Errorf("Redis increment error: %w", err)
+	}
+
+	return nil
+}
+
+// DecrementUpload takes back the most recent upload counted for an IP
+func (s *redisStore) DecrementUpload(ip string) error {
+	if err := s.client.ZPopMax(s.ctx, s.keyPrefix+"uploads:"+ip).Err(); err != nil {
+		return fmt.Errorf("Redis decrement error: %w", err)
+	}
+
+	return nil
+}
+
+// bytesSequence keeps members unique when the clock does not advance
+var bytesSequence atomic.Uint64
+
+// bytesMember returns a sorted set member recording a byte count. Members of
+// a sorted set are unique, so the count alone would merge equal increments
+func bytesMember(bytes int64) string {
+	return fmt.Sprintf("%d_%d:%d", time.Now().UnixNano(), bytesSequence.Add(1), bytes)
+}
+
+// memberBytes returns the byte count recorded in a sorted set member. Members
+// written before they carried a unique prefix are the bare count
+func memberBytes(member string) (int64, error) {
+	if i := strings.LastIndexByte(member, ':'); i >= 0 {
+		member = member[i+1:]
+	}
+	return strconv.ParseInt(member, 10, 64)
+}
+
 // Cleanup removes expired entries from the store
 func (s *redisStore) Cleanup() error {
 	// Get all rate limit keys
@@ -209,7 +258,7 @@ local bytes_entries = redis.call('ZRANGEBYSCORE', bytes_key, cutoff, '+inf')
 
 local total_bytes = 0
 for i = 1, #bytes_entries do
-    total_bytes = total_bytes + tonumber(bytes_entries[i])
+    total_bytes = total_bytes + (tonumber(string.match(bytes_entries[i], '(%d+)$')) or 0)
 end
 
 -- Check limits
@@ -224,7 +273,7 @@ end
 -- Add new entries
 local unique_id = current_time .. '_' .. redis.call('INCR', 'ratelimit:counter')
 redis.call('ZADD', uploads_key, current_time, unique_id)
-redis.call('ZADD', bytes_key, current_time, file_size)
+redis.call('ZADD', bytes_key, current_time, unique_id .. ':' .. file_size)
 
 -- Set expiry
 local expiry = window_seconds + 3600 -- window + 1 hour buffer
@@ -67,6 +67,64 @@ func TestRedisStore_Integration(t *testing.T) {
 	})
 }
 
+func TestRedisStore_EqualIncrements(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping Redis integration test in short mode")
+	}
+
+	store, err := NewRedisStore("redis://localhost:6379", "", 0, 10, 5)
+	if err != nil {
+		t.Skipf("Redis not available, skipping test: %v", err)
+	}
+	defer store.Close()
+
+	ip := "203.0.113.3"
+	window := time.Minute
+
+	// Equal byte counts in the same second are each counted
+	for i := 0; i < 3; i++ {
+		if err := store.IncrementBytes(ip, 512, window); err != nil {
+			t.Fatalf("IncrementBytes() error = %v", err)
+		}
+	}
+	if err := store.IncrementUpload(ip, 512, window); err != nil {
+		t.Fatalf("IncrementUpload() error = %v", err)
+	}
+
+	bytes, err := store.GetBytesUsed(ip, window)
+	if err != nil {
+		t.Fatalf("GetBytesUsed() error = %v", err)
+	}
+	if bytes != 2048 {
+		t.Errorf("GetBytesUsed() = %v, want 2048", bytes)
+	}
+}
+
+func TestBytesMember(t *testing.T) {
+	a, b := bytesMember(512), bytesMember(512)
+	if a == b {
+		t.Errorf("bytesMember() = %q twice, want unique members", a)
+	}
+
+	tests := []struct {
+		member string
+		want   int64
+	}{
+		{a, 512},
+		{"1700000000_42:1024", 1024},
+		{"2048", 2048},
+	}
+	for _, tt := range tests {
+		got, err := memberBytes(tt.member)
+		if err != nil {
+			t.Errorf("memberBytes(%q) error = %v", tt.member, err)
+		}
+		if got != tt.want {
+			t.Errorf("memberBytes(%q) = %v, want %v", tt.member, got, tt.want)
+		}
+	}
+}
+
 func TestRedisStore_AtomicOperations(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping Redis integration test in short mode")
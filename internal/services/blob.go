@@ -0,0 +1,370 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pandeptwidyaop/tempfile/internal/metadata"
+	"github.com/pandeptwidyaop/tempfile/internal/models"
+	"github.com/pandeptwidyaop/tempfile/internal/storage"
+	"github.com/pandeptwidyaop/tempfile/internal/utils"
+)
+
+const (
+	// blobReleaseTimeout is how long deleting a blob may take once its last
+	// reference was dropped. A blob left longer, by a server that stopped
+	// midway, is created again
+	blobReleaseTimeout = 5 * time.Minute
+
+	// blobAttempts is how often a blob being deleted is read again before
+	// giving up, blobRetryDelay apart
+	blobAttempts   = 20
+	blobRetryDelay = 50 * time.Millisecond
+)
+
+var (
+	// errBlobReleasing indicates a blob whose last reference was dropped, and
+	// which cannot be shared while it is being deleted
+	errBlobReleasing = errors.New("blob is being deleted")
+
+	// errBlobUnchanged indicates a blob that needs no update
+	errBlobUnchanged = errors.New("blob unchanged")
+)
+
+// blobKey returns the storage key of the content of the blob with a name, as
+// used before every blob got a key of its own
+func blobKey(name string) string {
+	return "blobs/" + name
+}
+
+// newBlobKey returns a new storage key for the content of the blob with a
+// name. Every time a blob is created its content gets a new key, so a server
+// still deleting an earlier blob with the same name cannot delete it
+func newBlobKey(name string) (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("failed to generate blob key: %w", err)
+	}
+
+	return blobKey(name) + "." + hex.EncodeToString(suffix), nil
+}
+
+// blobContentKey returns the storage key of a blob's content
+func blobContentKey(blob *metadata.Blob) string {
+	if blob.Key != "" {
+		return blob.Key
+	}
+	return blobKey(blob.Name)
+}
+
+// blobName returns the name of the blob for content with the given digest.
+// Content encrypted at rest is named by a keyed hash of its digest, so it is
+// only ever shared with content encrypted under the same master key, and the
+// storage does not reveal what it holds
+func (s *FileService) blobName(sha256 string, encrypted bool) string {
+	if encrypted {
+		return s.keyring.BlobName(sha256)
+	}
+	return sha256
+}
+
+// recordBlobName returns the name of the blob holding a file's content
+func recordBlobName(record *metadata.Record) string {
+	if record.BlobName != "" {
+		return record.BlobName
+	}
+	return record.SHA256
+}
+
+// contentKey returns the storage key a file's content is read from
+func contentKey(record *metadata.Record) string {
+	if record.BlobKey != "" {
+		return record.BlobKey
+	}
+	if record.Blob {
+		return blobKey(record.SHA256)
+	}
+	return record.ID
+}
+
+// acquireBlob moves content just stored under key into the blob for its
+// digest, or discards it if that blob already exists, and counts the reference.
+// dataKey is the key the content was encrypted with, or nil for plaintext.
+// Plaintext whose blob was encrypted before encryption was disabled is kept
+// under the file's own ID instead
+func (s *FileService) acquireBlob(record *metadata.Record, key string, dataKey []byte) error {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	name := s.blobName(record.SHA256, dataKey != nil)
+
+	// The content is moved to newKey at most once, however often the
+	// update is retried
+	var newKey, wrapped, keyID string
+	created := false
+	create := func(blob *metadata.Blob) error {
+		if newKey == "" {
+			moveTo, err := newBlobKey(name)
+			if err != nil {
+				return err
+			}
+			if dataKey != nil {
+				if wrapped, keyID, err = s.keyring.Wrap(dataKey, name); err != nil {
+					return err
+				}
+			}
+			if err := s.storage.Move(key, moveTo); err != nil {
+				return fmt.Errorf("failed to store blob: %w", err)
+			}
+			newKey = moveTo
+		}
+
+		*blob = metadata.Blob{
+			Name:      name,
+			Size:      record.Size,
+			Refs:      1,
+			CreatedAt: time.Now(),
+			Key:       newKey,
+			DataKey:   wrapped,
+			KeyID:     keyID,
+		}
+		if dataKey == nil {
+			blob.SHA256 = record.SHA256
+		}
+		created = true
+		return nil
+	}
+
+	var blob *metadata.Blob
+	var err error
+	for attempt := 1; ; attempt++ {
+		blob, err = s.blobs.Update(name, func(blob *metadata.Blob) error {
+			created = false
+
+			switch {
+			case blob.Refs > 0:
+				// A count left behind without its content starts over
+				_, err := s.storage.Stat(blobContentKey(blob))
+				if errors.Is(err, storage.ErrNotFound) {
+					return create(blob)
+				}
+				if err != nil {
+					return fmt.Errorf("failed to read blob: %w", err)
+				}
+
+				// Plaintext is never shared with a blob encrypted before
+				// encryption was disabled
+				if blob.DataKey != "" && dataKey == nil {
+					return errBlobUnchanged
+				}
+				blob.Refs++
+				return nil
+			case !blob.ReleasedAt.IsZero() && time.Since(blob.ReleasedAt) < blobReleaseTimeout:
+				return errBlobReleasing
+			default:
+				return create(blob)
+			}
+		})
+		if !errors.Is(err, errBlobReleasing) || attempt == blobAttempts {
+			break
+		}
+		time.Sleep(blobRetryDelay)
+	}
+	if errors.Is(err, errBlobUnchanged) {
+		if newKey != "" {
+			key = newKey
+		}
+		if err := s.storage.Move(key, record.ID); err != nil {
+			return fmt.Errorf("failed to store file: %w", err)
+		}
+		record.Blob, record.Encrypted = false, false
+		return nil
+	}
+	if err != nil {
+		// Content nobody counts would never be deleted
+		if newKey != "" {
+			_ = s.storage.Delete(newKey)
+		}
+		return err
+	}
+
+	if !created {
+		duplicate := key
+		if newKey != "" {
+			duplicate = newKey
+		}
+		if err := s.storage.Delete(duplicate); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Error deleting duplicate of blob %s: %v", name, err)
+		}
+
+		if s.config.Debug {
+			log.Printf("Stored %s as a duplicate of blob %s (%d references)", record.ID, name, blob.Refs)
+		}
+	}
+	record.Blob = true
+	record.BlobName, record.BlobKey = name, blobContentKey(blob)
+	record.Encrypted = blob.DataKey != ""
+
+	return nil
+}
+
+// dataKey returns the key a file's content is encrypted with, or nil if it is
+// stored in plaintext
+func (s *FileService) dataKey(record *metadata.Record) ([]byte, error) {
+	if !record.Encrypted {
+		return nil, nil
+	}
+
+	blob, err := s.blobs.Get(recordBlobName(record))
+	if err != nil {
+		if errors.Is(err, metadata.ErrNotFound) {
+			return nil, metadata.ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to read blob: %w", err)
+	}
+
+	if s.keyring == nil {
+		return nil, fmt.Errorf("file %s is encrypted but no encryption key is configured", record.ID)
+	}
+
+	return s.keyring.Unwrap(blob.DataKey, blob.KeyID, blob.Name)
+}
+
+// RewrapKeys re-wraps the data keys of all blobs with the current master key,
+// after which previous master keys can be retired. The encrypted content
+// itself is left untouched. It returns how many data keys were re-wrapped
+func (s *FileService) RewrapKeys() (int, error) {
+	if s.keyring == nil {
+		return 0, nil
+	}
+
+	blobs, err := s.blobs.List()
+	if err != nil {
+		return 0, err
+	}
+
+	rewrapped := 0
+	for _, listed := range blobs {
+		if listed.DataKey == "" || listed.KeyID == s.keyring.CurrentKeyID() {
+			continue
+		}
+
+		done, err := s.rewrapKey(listed.Name)
+		if err != nil {
+			return rewrapped, fmt.Errorf("failed to re-wrap key of blob %s: %w", listed.Name, err)
+		}
+		if done {
+			rewrapped++
+		}
+	}
+
+	return rewrapped, nil
+}
+
+// rewrapKey re-wraps the data key of one blob, reporting whether it changed
+func (s *FileService) rewrapKey(name string) (bool, error) {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	// Applied to the blob as it is stored, which may have changed since it was listed
+	_, err := s.blobs.Update(name, func(blob *metadata.Blob) error {
+		if blob.Refs == 0 || blob.DataKey == "" || blob.KeyID == s.keyring.CurrentKeyID() {
+			return errBlobUnchanged
+		}
+
+		var err error
+		blob.DataKey, blob.KeyID, err = s.keyring.Rewrap(blob.DataKey, blob.KeyID, blob.Name)
+		return err
+	})
+	if errors.Is(err, errBlobUnchanged) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// releaseBlob drops a file's reference to its blob, deleting the blob
+// together with its last reference. The blob is marked released before it
+// is deleted, so no other server shares it in the meantime
+func (s *FileService) releaseBlob(record *metadata.Record) error {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	name := recordBlobName(record)
+	blob, err := s.blobs.Update(name, func(blob *metadata.Blob) error {
+		// Without a count, or with the count of a blob created again after
+		// the file's content was lost, the file holds no reference
+		if blob.Refs == 0 || (record.BlobKey != "" && blob.Key != record.BlobKey) {
+			return errBlobUnchanged
+		}
+
+		blob.Refs--
+		if blob.Refs == 0 {
+			blob.ReleasedAt = time.Now()
+		}
+		return nil
+	})
+	if errors.Is(err, errBlobUnchanged) {
+		if err := s.storage.Delete(contentKey(record)); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return fmt.Errorf("failed to delete blob: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if blob.Refs > 0 {
+		return nil
+	}
+
+	if err := s.storage.Delete(blobContentKey(blob)); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("failed to delete blob: %w", err)
+	}
+	if err := s.blobs.Delete(name); err != nil && !errors.Is(err, metadata.ErrNotFound) {
+		return err
+	}
+
+	if s.config.Debug {
+		log.Printf("Removed blob %s", name)
+	}
+
+	return nil
+}
+
+// Stats reports how many files are stored and how much space deduplication saves
+func (s *FileService) Stats() (*models.StatsResponse, error) {
+	records, err := s.metadata.List()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &models.StatsResponse{Files: len(records), StorageStats: &models.StorageStats{}}
+	blobs := make(map[string]bool, len(records))
+
+	for _, record := range records {
+		stats.LogicalBytes += record.Size
+
+		if record.Blob {
+			if blobs[contentKey(record)] {
+				continue
+			}
+			blobs[contentKey(record)] = true
+		}
+		stats.StoredObjects++
+		stats.StoredBytes += record.Size
+	}
+
+	stats.SavedBytes = stats.LogicalBytes - stats.StoredBytes
+	stats.LogicalBytesHuman = utils.FormatBytes(stats.LogicalBytes)
+	stats.StoredBytesHuman = utils.FormatBytes(stats.StoredBytes)
+	stats.SavedBytesHuman = utils.FormatBytes(stats.SavedBytes)
+
+	return stats, nil
+}
@@ -2,23 +2,28 @@ package services
 
 import (
 	"log"
-	"os"
-	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/pandeptwidyaop/tempfile/internal/config"
-	"github.com/pandeptwidyaop/tempfile/internal/utils"
 )
 
 // CleanupService handles expired file cleanup
 type CleanupService struct {
-	config *config.Config
+	config      *config.Config
+	files       *FileService
+	tus         *TusService
+	collections *CollectionService
 }
 
-// NewCleanupService creates a new cleanup service instance
-func NewCleanupService(cfg *config.Config) *CleanupService {
+// NewCleanupService creates a new cleanup service instance. tusSvc may be nil
+// when resumable uploads are disabled
+func NewCleanupService(cfg *config.Config, fileSvc *FileService, tusSvc *TusService, collectionSvc *CollectionService) *CleanupService {
 	return &CleanupService{
-		config: cfg,
+		config:      cfg,
+		files:       fileSvc,
+		tus:         tusSvc,
+		collections: collectionSvc,
 	}
 }
 
@@ -31,37 +36,98 @@ func (s *CleanupService) Start() {
 
 	for range ticker.C {
 		s.cleanupExpiredFiles()
+		s.cleanupExpiredUploads()
+		s.cleanupExpiredCollections()
 	}
 }
 
-// cleanupExpiredFiles removes expired files from the upload directory
+// cleanupExpiredCollections forgets collections that have expired or lost all their files
+func (s *CleanupService) cleanupExpiredCollections() {
+	removed, err := s.collections.CleanupExpired(time.Now())
+	if err != nil {
+		log.Printf("Error cleaning up collections: %v", err)
+		return
+	}
+
+	if removed > 0 {
+		log.Printf("🗑️  Cleaned up %d expired collection(s)", removed)
+	}
+}
+
+// cleanupExpiredUploads discards resumable uploads that were not finished in time
+func (s *CleanupService) cleanupExpiredUploads() {
+	if s.tus == nil {
+		return
+	}
+
+	removed, err := s.tus.CleanupExpired(time.Now())
+	if err != nil {
+		log.Printf("Error cleaning up resumable uploads: %v", err)
+		return
+	}
+
+	if removed > 0 {
+		log.Printf("🗑️  Cleaned up %d expired resumable upload(s)", removed)
+	}
+}
+
+// cleanupExpiredFiles removes expired files and their metadata from the storage backend
 func (s *CleanupService) cleanupExpiredFiles() {
-	files, err := os.ReadDir(s.config.UploadDir)
+	records, err := s.files.metadata.List()
 	if err != nil {
-		log.Printf("Error reading upload directory: %v", err)
+		log.Printf("Error listing file metadata: %v", err)
 		return
 	}
 
 	now := time.Now()
 	cleanedCount := 0
+	tracked := make(map[string]bool, len(records))
 
-	for _, file := range files {
-		if file.IsDir() {
+	for _, record := range records {
+		tracked[record.ID] = true
+
+		// Used up files are normally removed after their last download,
+		// unless the server stopped before it finished
+		if !record.IsExpired(now) && !record.DownloadsExhausted() {
 			continue
 		}
 
-		filename := file.Name()
+		if err := s.files.Remove(record.ID); err != nil {
+			log.Printf("Error removing expired file %s: %v", record.ID, err)
+		} else {
+			cleanedCount++
+			if s.config.Debug {
+				log.Printf("Removed expired file: %s", record.ID)
+			}
+		}
+	}
+
+	// Legacy files without metadata carry their expiry in the filename. Their
+	// name is not authoritative otherwise, as the expiry may have been changed
+	objects, err := s.files.storage.List("")
+	if err != nil {
+		log.Printf("Error listing stored files: %v", err)
+		return
+	}
+
+	for _, object := range objects {
+		filename := object.Key
+
+		// Uploaded files live at the top level; nested keys hold metadata and blobs
+		if strings.Contains(filename, "/") || tracked[filename] {
+			continue
+		}
 
-		// Check if file has expired using utility function
-		expired, err := utils.IsFileExpired(filename, now)
+		// Look the file up rather than trusting its name: a record that could
+		// not be listed still holds the authoritative, possibly updated, expiry
+		record, err := s.files.Lookup(filename)
 		if err != nil {
-			// Skip files that are not in valid timestamp format
+			// Skip files without a usable expiry, such as names without a timestamp
 			continue
 		}
 
-		if expired {
-			filePath := filepath.Join(s.config.UploadDir, filename)
-			if err := os.Remove(filePath); err != nil {
+		if record.IsExpired(now) {
+			if err := s.files.Remove(filename); err != nil {
 				log.Printf("Error removing expired file %s: %v", filename, err)
 			} else {
 				cleanedCount++
@@ -0,0 +1,180 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pandeptwidyaop/tempfile/internal/config"
+	"github.com/pandeptwidyaop/tempfile/internal/metadata"
+)
+
+// MaxCollectionFiles is the largest number of files a collection may hold
+const MaxCollectionFiles = 100
+
+// ErrInvalidCollection indicates a collection without files, with too many
+// files, or with files that do not exist or have expired
+var ErrInvalidCollection = errors.New("invalid collection")
+
+// CollectionService groups stored files so they can be shared under one link
+type CollectionService struct {
+	config *config.Config
+	files  *FileService
+	store  metadata.CollectionStore
+}
+
+// NewCollectionService creates a new collection service instance
+func NewCollectionService(cfg *config.Config, fileSvc *FileService, store metadata.CollectionStore) *CollectionService {
+	return &CollectionService{
+		config: cfg,
+		files:  fileSvc,
+		store:  store,
+	}
+}
+
+// Create groups stored files into a new collection. Repeated files are listed
+// once. expiresIn optionally ends the collection before its last member
+// expires, and is resolved like an upload's expires_in. A non-zero
+// linksExpireAt is when the first of the signed links the files were listed
+// by expires, and the collection ends then at the latest
+func (s *CollectionService) Create(fileIDs []string, expiresIn string, linksExpireAt, now time.Time) (*metadata.Collection, error) {
+	collection := &metadata.Collection{
+		ID:        uuid.NewString(),
+		CreatedAt: now,
+	}
+
+	seen := make(map[string]bool, len(fileIDs))
+	for _, id := range fileIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		record, err := s.files.Lookup(id)
+		if errors.Is(err, metadata.ErrNotFound) || errors.Is(err, ErrInvalidFilename) || (err == nil && !isAvailable(record, now)) {
+			return nil, fmt.Errorf("%w: file %s not found", ErrInvalidCollection, id)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		collection.FileIDs = append(collection.FileIDs, record.ID)
+	}
+
+	if len(collection.FileIDs) == 0 || len(collection.FileIDs) > MaxCollectionFiles {
+		return nil, fmt.Errorf("%w: %d files", ErrInvalidCollection, len(collection.FileIDs))
+	}
+
+	if expiresIn != "" {
+		expiresAt, err := s.files.ResolveExpiry(expiresIn, now)
+		if err != nil {
+			return nil, err
+		}
+		collection.ExpiresAt = expiresAt
+	}
+	if !linksExpireAt.IsZero() && (collection.ExpiresAt.IsZero() || linksExpireAt.Before(collection.ExpiresAt)) {
+		collection.ExpiresAt = linksExpireAt
+	}
+
+	if err := s.store.Save(collection); err != nil {
+		return nil, fmt.Errorf("failed to save collection: %w", err)
+	}
+
+	return collection, nil
+}
+
+// Lookup returns a collection together with the records of the members that
+// are still available, in collection order. A collection past its own expiry,
+// or without any member left, is reported as metadata.ErrNotFound
+func (s *CollectionService) Lookup(id string, now time.Time) (*metadata.Collection, []*metadata.Record, error) {
+	collection, err := s.store.Get(id)
+	if err != nil {
+		if errors.Is(err, metadata.ErrInvalidID) {
+			return nil, nil, metadata.ErrNotFound
+		}
+		return nil, nil, err
+	}
+
+	if collection.IsExpired(now) {
+		return nil, nil, metadata.ErrNotFound
+	}
+
+	members, err := s.members(collection, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(members) == 0 {
+		return nil, nil, metadata.ErrNotFound
+	}
+
+	return collection, members, nil
+}
+
+// CollectionExpiresAt returns when a collection with the given available members ends:
+// at its own expiry, or when its last member expires if that comes first
+func CollectionExpiresAt(collection *metadata.Collection, members []*metadata.Record) time.Time {
+	var last time.Time
+	for _, record := range members {
+		if record.ExpiresAt.After(last) {
+			last = record.ExpiresAt
+		}
+	}
+
+	if collection.ExpiresAt.IsZero() || last.Before(collection.ExpiresAt) {
+		return last
+	}
+	return collection.ExpiresAt
+}
+
+// CleanupExpired removes collections past their own expiry or without any
+// member left, and returns how many were removed. Members are left alone,
+// as they keep their own expiry
+func (s *CollectionService) CleanupExpired(now time.Time) (int, error) {
+	collections, err := s.store.List()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, collection := range collections {
+		if !collection.IsExpired(now) {
+			members, err := s.members(collection, now)
+			if err != nil || len(members) > 0 {
+				continue
+			}
+		}
+
+		if err := s.store.Delete(collection.ID); err != nil && !errors.Is(err, metadata.ErrNotFound) {
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// members returns the records of the collection's files that are still available
+func (s *CollectionService) members(collection *metadata.Collection, now time.Time) ([]*metadata.Record, error) {
+	members := make([]*metadata.Record, 0, len(collection.FileIDs))
+	for _, id := range collection.FileIDs {
+		record, err := s.files.Lookup(id)
+		if errors.Is(err, metadata.ErrNotFound) || errors.Is(err, ErrInvalidFilename) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if isAvailable(record, now) {
+			members = append(members, record)
+		}
+	}
+
+	return members, nil
+}
+
+// isAvailable reports whether a file can still be downloaded
+func isAvailable(record *metadata.Record, now time.Time) bool {
+	return !record.IsExpired(now) && !record.DownloadsExhausted()
+}
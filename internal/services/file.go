@@ -0,0 +1,595 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pandeptwidyaop/tempfile/internal/clamd"
+	"github.com/pandeptwidyaop/tempfile/internal/config"
+	"github.com/pandeptwidyaop/tempfile/internal/encryption"
+	"github.com/pandeptwidyaop/tempfile/internal/metadata"
+	"github.com/pandeptwidyaop/tempfile/internal/storage"
+	"github.com/pandeptwidyaop/tempfile/internal/utils"
+)
+
+var (
+	// ErrInvalidFilename indicates a file without metadata whose name does not carry an expiry
+	ErrInvalidFilename = errors.New("invalid filename format")
+
+	// ErrInvalidExpiry indicates a requested expiry that is neither a duration nor an RFC 3339 time
+	ErrInvalidExpiry = errors.New("invalid expiry")
+
+	// ErrInvalidMaxDownloads indicates a requested download limit that is not a positive number
+	ErrInvalidMaxDownloads = errors.New("invalid download limit")
+
+	// ErrDownloadsExhausted indicates a file whose download limit has been reached
+	ErrDownloadsExhausted = errors.New("download limit reached")
+
+	// ErrInvalidToken indicates a delete token that does not belong to the file
+	ErrInvalidToken = errors.New("invalid delete token")
+
+	// ErrDigestMismatch indicates content whose SHA-256 digest is not the expected one
+	ErrDigestMismatch = errors.New("digest mismatch")
+)
+
+// FileService resolves stored files together with their metadata
+type FileService struct {
+	config   *config.Config
+	storage  storage.Backend
+	metadata metadata.Store
+	blobs    metadata.BlobStore
+	keyring  *encryption.Keyring
+	signer   *LinkSigner
+	scanner  *clamd.Client
+
+	// recordMu serializes updates of stored records, so that concurrent
+	// downloads cannot overrun a limit and no update is lost
+	recordMu sync.Mutex
+
+	// blobMu serializes changes of blob reference counts by this server.
+	// Servers sharing storage with conditional writes never overwrite each
+	// other's counts either
+	blobMu sync.Mutex
+}
+
+// NewFileService creates a new file service instance. Identical content is
+// stored once, in blobs counted by blobStore. keyring encrypts new content at
+// rest, and may be nil when encryption is disabled
+func NewFileService(cfg *config.Config, backend storage.Backend, store metadata.Store, blobStore metadata.BlobStore, keyring *encryption.Keyring) *FileService {
+	return &FileService{
+		config:   cfg,
+		storage:  backend,
+		metadata: store,
+		blobs:    blobStore,
+		keyring:  keyring,
+		signer:   newLinkSigner(cfg),
+		scanner:  newScanner(cfg),
+	}
+}
+
+// ResolveExpiry returns when a file stored at now expires. value is an optional
+// duration such as "6h" or "3d", or an absolute RFC 3339 time, and the result is
+// clamped between MIN_EXPIRY and MAX_EXPIRY. Without a value FILE_EXPIRY_HOURS applies
+func (s *FileService) ResolveExpiry(value string, now time.Time) (time.Time, error) {
+	expiry := s.config.DefaultExpiry()
+
+	if value = strings.TrimSpace(value); value != "" {
+		if at, err := time.Parse(time.RFC3339, value); err == nil {
+			expiry = at.Sub(now)
+		} else if duration, err := utils.ParseDuration(value); err == nil {
+			expiry = duration
+		} else {
+			return time.Time{}, ErrInvalidExpiry
+		}
+	}
+
+	if s.config.MinExpiry > 0 && expiry < s.config.MinExpiry {
+		expiry = s.config.MinExpiry
+	}
+	if s.config.MaxExpiry > 0 && expiry > s.config.MaxExpiry {
+		expiry = s.config.MaxExpiry
+	}
+
+	return now.Add(expiry), nil
+}
+
+// ParseMaxDownloads parses a requested download limit, where 1 means the file
+// is deleted after its first download. An empty value means unlimited
+func ParseMaxDownloads(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 {
+		return 0, ErrInvalidMaxDownloads
+	}
+
+	return limit, nil
+}
+
+// Lookup returns the metadata record of a stored file. Files uploaded before
+// metadata was recorded fall back to the expiry encoded in their filename.
+// Quarantined files are never served, so they are not found
+func (s *FileService) Lookup(id string) (*metadata.Record, error) {
+	record, err := s.metadata.Get(id)
+	if err == nil {
+		if record.IsQuarantined() {
+			return nil, metadata.ErrNotFound
+		}
+		return record, nil
+	}
+
+	if errors.Is(err, metadata.ErrInvalidID) {
+		return nil, metadata.ErrNotFound
+	}
+	if !errors.Is(err, metadata.ErrNotFound) {
+		return nil, err
+	}
+
+	return s.legacyRecord(id)
+}
+
+// Create stores the content of a new file together with its metadata record.
+// A record.SHA256 already set is the digest the client expects, and content
+// that does not match fails with ErrDigestMismatch. Content whose type the
+// configuration rules out fails with ErrFileTypeNotAllowed or
+// ErrFileTypeMismatch. With scanning enabled, infected content fails with
+// ErrMalwareDetected, even when kept in quarantine, and content that could
+// not be scanned fails with ErrScannerUnavailable unless scanning fails open.
+// Content already stored is shared instead of kept twice, and is encrypted
+// with a new data key when encryption is enabled. A negative record.Size means
+// the size is not known in advance. Nothing is left behind if any step fails
+func (s *FileService) Create(record *metadata.Record, content io.Reader) error {
+	// The digest is only known once everything has been received, so the
+	// content is written under the file's own ID first
+	staged, err := s.Stage(record.ID, content, record.Size)
+	if err != nil {
+		return err
+	}
+
+	return s.Commit(record, staged)
+}
+
+// StagedContent is content stored by Stage that is not part of a file yet
+type StagedContent struct {
+	key     string
+	size    int64
+	sha256  string
+	dataKey []byte
+
+	// head is the start of the content, which its type is detected from
+	head []byte
+}
+
+// Size returns the size of the staged content
+func (c *StagedContent) Size() int64 {
+	return c.size
+}
+
+// ContentType returns the type of the staged content, detected from its first bytes
+func (c *StagedContent) ContentType() string {
+	return utils.DetectContentType(c.head)
+}
+
+// Stage stores content under key without creating a file for it, so it can
+// be received before everything needed for its record is known. size may be
+// negative if it is not known in advance. As the content is written it is
+// hashed, its start is kept to detect its type, and with encryption enabled
+// it is encrypted with a new data key. key should be a name with an expiry,
+// like any file's, so staged content that is never committed or discarded is
+// cleaned up once it has passed
+func (s *FileService) Stage(key string, content io.Reader, size int64) (*StagedContent, error) {
+	hasher := sha256.New()
+	var received byteCounter
+	head := &headBuffer{max: utils.SniffLen}
+	body := io.TeeReader(content, io.MultiWriter(hasher, &received, head))
+
+	var dataKey []byte
+	if s.keyring != nil {
+		var err error
+		if dataKey, err = s.keyring.GenerateDataKey(); err != nil {
+			return nil, err
+		}
+		if body, err = encryption.NewEncryptReader(body, dataKey); err != nil {
+			return nil, err
+		}
+		if size >= 0 {
+			size = encryption.EncryptedSize(size)
+		}
+	}
+
+	if err := s.storage.Put(key, body, size); err != nil {
+		return nil, fmt.Errorf("failed to store file: %w", err)
+	}
+
+	return &StagedContent{
+		key:     key,
+		size:    int64(received),
+		sha256:  hex.EncodeToString(hasher.Sum(nil)),
+		dataKey: dataKey,
+		head:    head.data,
+	}, nil
+}
+
+// Commit creates the file for record from staged content, like Create. The
+// staged content is used up whether or not this succeeds
+func (s *FileService) Commit(record *metadata.Record, staged *StagedContent) error {
+	if record.SHA256 != "" && !strings.EqualFold(record.SHA256, staged.sha256) {
+		s.Discard(staged)
+		return ErrDigestMismatch
+	}
+	record.SHA256 = staged.sha256
+	record.Size = staged.size
+
+	if err := s.checkType(record, staged); err != nil {
+		s.Discard(staged)
+		return err
+	}
+	if err := s.scan(record, staged); err != nil {
+		s.Discard(staged)
+		return err
+	}
+
+	if err := s.acquireBlob(record, staged.key, staged.dataKey); err != nil {
+		s.Discard(staged)
+		return err
+	}
+
+	// Without metadata the file could not be served correctly
+	if err := s.metadata.Save(record); err != nil {
+		if !record.Blob {
+			_ = s.storage.Delete(record.ID)
+		} else if err := s.releaseBlob(record); err != nil {
+			log.Printf("Error releasing blob %s: %v", record.BlobName, err)
+		}
+		return fmt.Errorf("failed to save metadata: %w", err)
+	}
+
+	// Quarantined files are stored only to be looked into, never downloaded
+	if record.IsQuarantined() {
+		return ErrMalwareDetected
+	}
+
+	return nil
+}
+
+// Discard deletes staged content that will not be committed
+func (s *FileService) Discard(staged *StagedContent) {
+	if err := s.storage.Delete(staged.key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Printf("Error deleting staged content %s: %v", staged.key, err)
+	}
+}
+
+// headBuffer keeps the first max bytes written to it
+type headBuffer struct {
+	data []byte
+	max  int
+}
+
+func (b *headBuffer) Write(p []byte) (int, error) {
+	if left := b.max - len(b.data); left > 0 {
+		b.data = append(b.data, p[:min(left, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// byteCounter counts the bytes written to it
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// Authorize returns the record of a file if token is its delete token, and
+// ErrInvalidToken otherwise. Files stored without a token can never be authorized
+func (s *FileService) Authorize(id, token string) (*metadata.Record, error) {
+	record, err := s.Lookup(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !utils.TokenMatches(record.DeleteTokenHash, token) {
+		return nil, ErrInvalidToken
+	}
+
+	return record, nil
+}
+
+// DownloadURL returns the path a file is downloaded from. Signed links are
+// valid for as long as the file
+func (s *FileService) DownloadURL(record *metadata.Record) string {
+	return s.signer.Sign(record.ID, record.ExpiresAt)
+}
+
+// DownloadURLUntil returns the path a file is downloaded from, with a signed
+// link valid until expiresAt or for as long as the file if that comes first
+func (s *FileService) DownloadURLUntil(record *metadata.Record, expiresAt time.Time) string {
+	return s.signer.Sign(record.ID, earlier(record.ExpiresAt, expiresAt))
+}
+
+// VerifyLink checks the expires and signature parameters of a request for the
+// file id. Every request is accepted when links are not signed
+func (s *FileService) VerifyLink(id, expires, signature string, now time.Time) error {
+	return s.signer.Verify(id, expires, signature, now)
+}
+
+// MintLink returns an additional signed download link to a file, authorized
+// by its delete token, and when the link expires. value is a duration such as
+// "10m" or an RFC 3339 time, SIGNED_LINK_EXPIRY if empty; the link never
+// outlives the file
+func (s *FileService) MintLink(id, token, value string, now time.Time) (string, time.Time, error) {
+	if s.signer == nil {
+		return "", time.Time{}, ErrSignedLinksDisabled
+	}
+
+	record, err := s.Authorize(id, token)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if record.IsExpired(now) {
+		return "", time.Time{}, metadata.ErrNotFound
+	}
+
+	expiresAt := now.Add(s.config.SignedLinkExpiry)
+	if value = strings.TrimSpace(value); value != "" {
+		if at, err := time.Parse(time.RFC3339, value); err == nil {
+			expiresAt = at
+		} else if duration, err := utils.ParseDuration(value); err == nil {
+			expiresAt = now.Add(duration)
+		} else {
+			return "", time.Time{}, ErrInvalidExpiry
+		}
+	}
+	if !expiresAt.After(now) {
+		return "", time.Time{}, ErrInvalidExpiry
+	}
+	if expiresAt.After(record.ExpiresAt) {
+		expiresAt = record.ExpiresAt
+	}
+
+	return s.signer.Sign(record.ID, expiresAt), expiresAt, nil
+}
+
+// UpdateExpiry moves the expiry of a file, authorized by its delete token.
+// value is resolved like an upload's expires_in, counting from now, so the
+// new expiry lies within the configured bounds. The download URL is unchanged,
+// but a signed one still expires when it did
+func (s *FileService) UpdateExpiry(id, token, value string, now time.Time) (*metadata.Record, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, ErrInvalidExpiry
+	}
+
+	s.recordMu.Lock()
+	defer s.recordMu.Unlock()
+
+	record, err := s.Authorize(id, token)
+	if err != nil {
+		return nil, err
+	}
+
+	// An expired file is gone, even if cleanup has not removed it yet
+	if record.IsExpired(now) {
+		return nil, metadata.ErrNotFound
+	}
+
+	expiresAt, err := s.ResolveExpiry(value, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the expiry is changed, keeping downloads counted meanwhile
+	record, err = s.metadata.Update(id, func(record *metadata.Record) error {
+		record.ExpiresAt = expiresAt
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, metadata.ErrNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to update expiry: %w", err)
+	}
+
+	return record, nil
+}
+
+// ClaimDownload counts one download of a file with a download limit and
+// returns its updated record, or ErrDownloadsExhausted once the limit was
+// reached. Claims are serialized within this process, and on S3 each claim
+// is a conditional write of the record, so concurrent downloads never succeed
+// past the limit, even when several servers share the bucket. The local
+// backend has no conditional writes, so there the limit only holds for one
+// process using the upload directory. Files without a limit are returned
+// unchanged
+func (s *FileService) ClaimDownload(id string) (*metadata.Record, error) {
+	s.recordMu.Lock()
+	defer s.recordMu.Unlock()
+
+	record, err := s.Lookup(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if record.MaxDownloads == 0 {
+		return record, nil
+	}
+
+	record, err = s.metadata.Update(id, func(record *metadata.Record) error {
+		if record.IsQuarantined() {
+			return metadata.ErrNotFound
+		}
+		if record.DownloadsExhausted() {
+			return ErrDownloadsExhausted
+		}
+		record.Downloads++
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, ErrDownloadsExhausted) || errors.Is(err, metadata.ErrNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to count download: %w", err)
+	}
+
+	return record, nil
+}
+
+// Open opens the stored content of a file, decrypting it if it was encrypted
+// at rest. Content with a recorded digest is
+// verified while it is read: if it no longer matches, the final read fails with
+// ErrDigestMismatch instead of returning the last bytes, so corruption on disk
+// is never passed on as a complete file
+func (s *FileService) Open(record *metadata.Record) (io.ReadCloser, *storage.ObjectInfo, error) {
+	dataKey, err := s.dataKey(record)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reader, info, err := s.storage.Get(contentKey(record))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, nil, metadata.ErrNotFound
+		}
+		return nil, nil, err
+	}
+
+	if dataKey != nil {
+		if reader, err = encryption.NewDecryptReader(reader, dataKey, record.Size); err != nil {
+			return nil, nil, err
+		}
+		info = &storage.ObjectInfo{Key: info.Key, Size: record.Size, ModTime: info.ModTime}
+	}
+
+	if record.SHA256 != "" {
+		reader = &verifyingReader{
+			ReadCloser: reader,
+			id:         record.ID,
+			hash:       sha256.New(),
+			want:       record.SHA256,
+			remaining:  record.Size,
+		}
+	}
+
+	return reader, info, nil
+}
+
+// verifyingReader checks the SHA-256 digest of a file as it is read
+type verifyingReader struct {
+	io.ReadCloser
+	id        string
+	hash      hash.Hash
+	want      string
+	remaining int64
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	r.remaining -= int64(n)
+
+	// Readers may stop at exactly the size without waiting for io.EOF
+	if r.remaining <= 0 || err == io.EOF {
+		if got := hex.EncodeToString(r.hash.Sum(nil)); r.remaining != 0 || !strings.EqualFold(got, r.want) {
+			log.Printf("Stored content of %s does not match its SHA-256 digest", r.id)
+			return 0, ErrDigestMismatch
+		}
+	}
+
+	return n, err
+}
+
+// OpenRange opens length bytes of a file's content, starting at offset,
+// decrypting them if the content was encrypted at rest
+func (s *FileService) OpenRange(record *metadata.Record, offset, length int64) (io.ReadCloser, error) {
+	dataKey, err := s.dataKey(record)
+	if err != nil {
+		return nil, err
+	}
+
+	key := contentKey(record)
+	var reader io.ReadCloser
+	if dataKey != nil {
+		// Only the encrypted chunks spanning the range are read
+		reader, err = encryption.DecryptRange(func(offset, length int64) (io.ReadCloser, error) {
+			return s.storage.GetRange(key, offset, length)
+		}, dataKey, record.Size, offset, length)
+	} else {
+		reader, err = s.storage.GetRange(key, offset, length)
+	}
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, metadata.ErrNotFound
+		}
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+// Remove deletes both the content and the metadata of a file. Content in a
+// shared blob is only deleted along with the last file referring to it
+func (s *FileService) Remove(id string) error {
+	// Holding recordMu, a file removed twice concurrently releases its blob once
+	s.recordMu.Lock()
+	record, err := s.metadata.Get(id)
+	if err == nil && record.Blob {
+		err = s.metadata.Delete(id)
+		s.recordMu.Unlock()
+
+		if err != nil {
+			if errors.Is(err, metadata.ErrNotFound) {
+				return nil
+			}
+			return err
+		}
+		return s.releaseBlob(record)
+	}
+	s.recordMu.Unlock()
+
+	if err := s.storage.Delete(id); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+
+	if err := s.metadata.Delete(id); err != nil && !errors.Is(err, metadata.ErrNotFound) {
+		return err
+	}
+
+	return nil
+}
+
+// legacyRecord builds a record for a file stored without metadata
+func (s *FileService) legacyRecord(id string) (*metadata.Record, error) {
+	info, err := s.storage.Stat(id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidKey) {
+			return nil, metadata.ErrNotFound
+		}
+		return nil, err
+	}
+
+	timestamp, err := utils.ParseTimestampFromFilename(id)
+	if err != nil {
+		return nil, ErrInvalidFilename
+	}
+
+	return &metadata.Record{
+		ID:           id,
+		OriginalName: id,
+		Size:         info.Size,
+		ContentType:  utils.GetContentType(id),
+		CreatedAt:    info.ModTime,
+		ExpiresAt:    time.Unix(timestamp, 0),
+		Legacy:       true,
+	}, nil
+}
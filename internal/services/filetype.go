@@ -0,0 +1,88 @@
+package services
+
+import (
+	"errors"
+
+	"github.com/pandeptwidyaop/tempfile/internal/metadata"
+	"github.com/pandeptwidyaop/tempfile/internal/utils"
+)
+
+var (
+	// ErrFileTypeNotAllowed indicates a file whose extension or detected type
+	// the allowed and denied types or extensions rule out
+	ErrFileTypeNotAllowed = errors.New("file type not allowed")
+
+	// ErrFileTypeMismatch indicates a file whose content does not agree with
+	// its extension, while such files are rejected
+	ErrFileTypeMismatch = errors.New("file content does not match its extension")
+
+	// ErrClientEncryptedNotAllowed indicates a file encrypted by the client
+	// while the content of every file must be checked
+	ErrClientEncryptedNotAllowed = errors.New("files encrypted by the client are not accepted")
+)
+
+// CheckName reports ErrFileTypeNotAllowed if the extension of a file named
+// name is denied, or not among the allowed extensions. It only needs the
+// name, so uploads can be rejected before their content is received
+func (s *FileService) CheckName(name string) error {
+	if utils.MatchesExtension(name, s.config.DeniedExtensions) {
+		return ErrFileTypeNotAllowed
+	}
+	if len(s.config.AllowedExtensions) > 0 && !utils.MatchesExtension(name, s.config.AllowedExtensions) {
+		return ErrFileTypeNotAllowed
+	}
+	return nil
+}
+
+// CheckClientEncrypted reports ErrClientEncryptedNotAllowed if files
+// encrypted by the client are not accepted, see
+// config.Config.ClientEncryptionAllowed. Like CheckName it lets uploads be
+// rejected before their content is received
+func (s *FileService) CheckClientEncrypted() error {
+	if !s.config.ClientEncryptionAllowed() {
+		return ErrClientEncryptedNotAllowed
+	}
+	return nil
+}
+
+// checkType sets the content type of record to the type detected from staged
+// content, and checks it against the allowed and denied types and the
+// extension of the file. Files encrypted by the client cannot be told apart
+// from random bytes, so their type is left as it is, and they are refused
+// while there are types to check
+func (s *FileService) checkType(record *metadata.Record, staged *StagedContent) error {
+	if record.ClientEncrypted {
+		return s.CheckClientEncrypted()
+	}
+
+	claimed := utils.GetContentType(record.ID)
+	detected := staged.ContentType()
+	agree := utils.ContentTypesAgree(claimed, detected)
+
+	// Text, zip files and unknown binaries are what many formats look like,
+	// which the extension then tells apart
+	record.ContentType = detected
+	if agree && utils.IsGenericType(detected) && claimed != "application/octet-stream" {
+		record.ContentType = claimed
+	}
+
+	// The extension counts as well, since clients go by it when opening a download
+	if utils.MatchesContentType(detected, s.config.DeniedTypes) || utils.MatchesContentType(claimed, s.config.DeniedTypes) {
+		return ErrFileTypeNotAllowed
+	}
+	if len(s.config.AllowedTypes) > 0 && !utils.MatchesContentType(record.ContentType, s.config.AllowedTypes) {
+		return ErrFileTypeNotAllowed
+	}
+
+	if !agree {
+		switch s.config.TypeMismatchAction {
+		case "reject":
+			return ErrFileTypeMismatch
+		case "allow":
+		default:
+			record.TypeMismatch = true
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pandeptwidyaop/tempfile/internal/clamd"
+	"github.com/pandeptwidyaop/tempfile/internal/config"
+	"github.com/pandeptwidyaop/tempfile/internal/encryption"
+	"github.com/pandeptwidyaop/tempfile/internal/metadata"
+)
+
+var (
+	// ErrMalwareDetected indicates a file the malware scanner found infected
+	ErrMalwareDetected = errors.New("malware detected")
+
+	// ErrScannerUnavailable indicates a file that could not be scanned while
+	// unscanned files are refused
+	ErrScannerUnavailable = errors.New("malware scanner unavailable")
+)
+
+// newScanner returns the clamd client scanning uploads for cfg, or nil if
+// scanning is disabled
+func newScanner(cfg *config.Config) *clamd.Client {
+	if !cfg.ScanningEnabled() {
+		return nil
+	}
+	network, address := cfg.ClamdEndpoint()
+	return clamd.NewClient(network, address, cfg.ClamdTimeout)
+}
+
+// scan sends staged content to clamd before it becomes a file, and records the
+// result in record. Infected content fails with ErrMalwareDetected, unless it
+// is to be quarantined. Files encrypted by the client look like random bytes
+// to a scanner, so they are refused with ErrClientEncryptedNotAllowed, or
+// stored unscanned where the configuration allows it
+func (s *FileService) scan(record *metadata.Record, staged *StagedContent) error {
+	if s.scanner == nil {
+		return nil
+	}
+
+	now := time.Now()
+	if record.ClientEncrypted {
+		if err := s.CheckClientEncrypted(); err != nil {
+			return err
+		}
+		record.Scan = &metadata.ScanResult{Status: metadata.ScanSkipped, ScannedAt: now}
+		return nil
+	}
+
+	result, err := s.scanStaged(staged)
+	if err != nil {
+		if s.config.ScanFailMode != "open" {
+			return fmt.Errorf("%w: %v", ErrScannerUnavailable, err)
+		}
+		log.Printf("Error scanning %s, storing it unscanned: %v", record.ID, err)
+		record.Scan = &metadata.ScanResult{Status: metadata.ScanFailed, ScannedAt: now}
+		return nil
+	}
+
+	if !result.Infected {
+		record.Scan = &metadata.ScanResult{Status: metadata.ScanClean, ScannedAt: now}
+		return nil
+	}
+
+	record.Scan = &metadata.ScanResult{Status: metadata.ScanInfected, Signature: result.Signature, ScannedAt: now}
+	log.Printf("Malware found in %s (original: %s, uploader: %s): %s", record.ID, record.OriginalName, record.UploaderIP, result.Signature)
+
+	if s.config.ScanInfectedAction == "quarantine" {
+		return nil
+	}
+	return ErrMalwareDetected
+}
+
+// scanStaged streams staged content to clamd, decrypting it if it was
+// encrypted at rest
+func (s *FileService) scanStaged(staged *StagedContent) (*clamd.Result, error) {
+	content, _, err := s.storage.Get(staged.key)
+	if err != nil {
+		return nil, err
+	}
+	if staged.dataKey != nil {
+		decrypted, err := encryption.NewDecryptReader(content, staged.dataKey, staged.size)
+		if err != nil {
+			_ = content.Close()
+			return nil, err
+		}
+		content = decrypted
+	}
+	defer content.Close()
+
+	return s.scanner.Scan(content)
+}
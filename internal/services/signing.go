@@ -0,0 +1,95 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pandeptwidyaop/tempfile/internal/config"
+)
+
+var (
+	// ErrInvalidSignature indicates a download link that is unsigned or whose
+	// signature does not match
+	ErrInvalidSignature = errors.New("invalid link signature")
+
+	// ErrLinkExpired indicates a signed download link past its own expiry
+	ErrLinkExpired = errors.New("link expired")
+
+	// ErrSignedLinksDisabled indicates a request for a signed link while download
+	// links are not signed
+	ErrSignedLinksDisabled = errors.New("signed links are not enabled")
+)
+
+// LinkSigner signs download links with a server secret, so that a file is only
+// served from links handed out by the server, and each only until its own
+// expiry. A nil LinkSigner leaves links unsigned
+type LinkSigner struct {
+	secret []byte
+}
+
+// newLinkSigner returns the signer of download links for cfg, or nil if no
+// signing secret is configured
+func newLinkSigner(cfg *config.Config) *LinkSigner {
+	if !cfg.SignedLinksEnabled() {
+		return nil
+	}
+	return &LinkSigner{secret: []byte(cfg.LinkSigningSecret)}
+}
+
+// Sign returns the download path of the file id, valid until expires
+func (s *LinkSigner) Sign(id string, expires time.Time) string {
+	if s == nil {
+		return "/" + id
+	}
+
+	unix := strconv.FormatInt(expires.Unix(), 10)
+	query := url.Values{}
+	query.Set("expires", unix)
+	query.Set("signature", base64.RawURLEncoding.EncodeToString(s.mac(id, unix)))
+
+	return "/" + id + "?" + query.Encode()
+}
+
+// Verify checks the expires and signature parameters of a download link to
+// the file id. Any link is valid when links are not signed
+func (s *LinkSigner) Verify(id, expires, signature string, now time.Time) error {
+	if s == nil {
+		return nil
+	}
+
+	sum, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || signature == "" || !hmac.Equal(sum, s.mac(id, expires)) {
+		return ErrInvalidSignature
+	}
+
+	// A valid signature vouches for the expiry it covers
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if now.After(time.Unix(unix, 0)) {
+		return ErrLinkExpired
+	}
+
+	return nil
+}
+
+// mac returns the HMAC-SHA256 of a link to the file id expiring at the unix time expires
+func (s *LinkSigner) mac(id, expires string) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(id + "\n" + expires))
+	return mac.Sum(nil)
+}
+
+// earlier returns whichever of two times comes first
+func earlier(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
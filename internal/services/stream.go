@@ -0,0 +1,243 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime/multipart"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandeptwidyaop/tempfile/internal/utils"
+)
+
+var (
+	// ErrFileTooLarge indicates a file exceeding the maximum file size
+	ErrFileTooLarge = errors.New("file exceeds maximum file size")
+
+	// ErrRequestTooLarge indicates an upload request exceeding the maximum request size
+	ErrRequestTooLarge = errors.New("upload exceeds maximum request size")
+
+	// ErrRateLimited indicates an upload exceeding the bytes the client may
+	// still upload within the rate limit
+	ErrRateLimited = errors.New("upload exceeds rate limit")
+
+	// ErrUploadInterrupted indicates a request body that could not be read to its end
+	ErrUploadInterrupted = errors.New("upload interrupted")
+
+	// errFieldsTooLarge indicates form fields too large to be upload options
+	errFieldsTooLarge = errors.New("form fields too large")
+
+	// errTooManyFiles indicates a form with more files than allowed at once
+	errTooManyFiles = errors.New("too many files")
+)
+
+// maxFieldsSize limits the form fields other than files, which only hold
+// options, together
+const maxFieldsSize = 64 * 1024
+
+// stagingExpiry is how long content staged for an upload may outlive a
+// request that failed to commit or discard it, before it is cleaned up
+const stagingExpiry = time.Hour
+
+// uploadBudget enforces the size limits of an upload request while it is
+// received, so an upload is stopped as soon as it exceeds one rather than
+// after it has been read completely
+type uploadBudget struct {
+	maxFileSize int64
+	requestLeft int64
+	fieldsLeft  int64
+
+	// allowance is what the rate limiter still allows the client to upload,
+	// or negative if unlimited
+	allowance int64
+}
+
+// newUploadBudget returns the budget of an upload request: files of up to
+// maxFileSize bytes, maxRequestSize bytes in total, and no more than the rate
+// limiter middleware left the client in its rate_limit_byte_allowance local
+func newUploadBudget(c *fiber.Ctx, maxFileSize, maxRequestSize int64) *uploadBudget {
+	allowance := int64(-1)
+	if value, ok := c.Locals("rate_limit_byte_allowance").(int64); ok {
+		allowance = value
+	}
+
+	return &uploadBudget{
+		maxFileSize: maxFileSize,
+		requestLeft: maxRequestSize,
+		fieldsLeft:  maxFieldsSize,
+		allowance:   allowance,
+	}
+}
+
+// file returns a reader of one file's content from r, failing as soon as the
+// file or the request exceeds a limit
+func (b *uploadBudget) file(r io.Reader) io.Reader {
+	return &budgetReader{r: r, left: b.maxFileSize, tooLarge: ErrFileTooLarge, take: b.take}
+}
+
+// field returns a reader of a form field from r, failing as soon as the fields
+// of the form together exceed maxFieldsSize
+func (b *uploadBudget) field(r io.Reader) io.Reader {
+	return &budgetReader{r: r, left: b.fieldsLeft, tooLarge: errFieldsTooLarge, take: func(n int64) error {
+		b.fieldsLeft -= n
+		return nil
+	}}
+}
+
+// take counts n received bytes of files against the limits of the whole request
+func (b *uploadBudget) take(n int64) error {
+	b.requestLeft -= n
+	if b.requestLeft < 0 {
+		return ErrRequestTooLarge
+	}
+
+	if b.allowance >= 0 {
+		b.allowance -= n
+		if b.allowance < 0 {
+			return ErrRateLimited
+		}
+	}
+
+	return nil
+}
+
+// budgetReader reads one part of an upload, counting it against its own limit
+// and, with take, against the limits of the request
+type budgetReader struct {
+	r        io.Reader
+	left     int64
+	tooLarge error
+	take     func(n int64) error
+}
+
+func (r *budgetReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+
+	r.left -= int64(n)
+	if r.left < 0 {
+		return n, r.tooLarge
+	}
+	if limitErr := r.take(int64(n)); limitErr != nil {
+		return n, limitErr
+	}
+
+	// The client went away or sent a malformed body
+	if err != nil && !errors.Is(err, io.EOF) {
+		return n, fmt.Errorf("%w: %v", ErrUploadInterrupted, err)
+	}
+
+	return n, err
+}
+
+// ChunkReader reads the request body of a resumable upload chunk as it
+// arrives, failing with ErrRateLimited as soon as the client uploads more than
+// the rate limiter allows
+type ChunkReader struct {
+	r        io.Reader
+	received int64
+}
+
+// NewChunkReader returns a reader of the request body of a chunk
+func NewChunkReader(c *fiber.Ctx) *ChunkReader {
+	budget := newUploadBudget(c, math.MaxInt64, math.MaxInt64)
+	return &ChunkReader{r: budget.file(utils.RequestBody(c))}
+}
+
+func (r *ChunkReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.received += int64(n)
+	return n, err
+}
+
+// Received returns how many bytes of the chunk have been read
+func (r *ChunkReader) Received() int64 {
+	return r.received
+}
+
+// uploadForm is a multipart upload form that has been read completely, with
+// its files staged until they are committed or discarded
+type uploadForm struct {
+	files  []*formFile
+	values map[string][]string
+}
+
+// formFile is a file of an upload form
+type formFile struct {
+	name        string
+	contentType string
+	content     *StagedContent
+}
+
+// readForm reads a multipart upload form as it arrives, staging the files in
+// the parts named by formFileFields. Nothing stays staged if it fails
+func (s *UploadService) readForm(reader *multipart.Reader, budget *uploadBudget) (*uploadForm, error) {
+	form := &uploadForm{values: make(map[string][]string)}
+
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return form, nil
+		}
+		if err != nil {
+			s.discardFiles(form.files)
+			return nil, fmt.Errorf("%w: %v", ErrUploadInterrupted, err)
+		}
+
+		if err := s.readPart(form, part, budget); err != nil {
+			_ = part.Close()
+			s.discardFiles(form.files)
+			return nil, err
+		}
+		_ = part.Close()
+	}
+}
+
+// readPart adds a part of a multipart upload form to form
+func (s *UploadService) readPart(form *uploadForm, part *multipart.Part, budget *uploadBudget) error {
+	if !isFormFileField(part.FormName()) || part.FileName() == "" {
+		value, err := io.ReadAll(budget.field(part))
+		if err != nil {
+			return err
+		}
+		form.values[part.FormName()] = append(form.values[part.FormName()], string(value))
+		return nil
+	}
+
+	if len(form.files) == s.config.MaxFilesPerUpload {
+		return errTooManyFiles
+	}
+
+	// The final name depends on options that may only follow, so the file is
+	// staged under a name of its own that expires soon
+	key := utils.GenerateFilename(part.FileName(), time.Now().Add(stagingExpiry))
+	content, err := s.files.Stage(key, budget.file(part), -1)
+	if err != nil {
+		return err
+	}
+
+	form.files = append(form.files, &formFile{
+		name:        part.FileName(),
+		contentType: part.Header.Get("Content-Type"),
+		content:     content,
+	})
+	return nil
+}
+
+// discardFiles discards the staged content of files that will not be stored
+func (s *UploadService) discardFiles(files []*formFile) {
+	for _, file := range files {
+		s.files.Discard(file.content)
+	}
+}
+
+// isFormFileField reports whether files may be uploaded in the form field name
+func isFormFileField(name string) bool {
+	for _, field := range formFileFields {
+		if name == field {
+			return true
+		}
+	}
+	return false
+}
@@ -5,21 +5,75 @@ import (
 	"fmt"
 	"html/template"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/pandeptwidyaop/tempfile/internal/config"
+	"github.com/pandeptwidyaop/tempfile/internal/metadata"
 	"github.com/pandeptwidyaop/tempfile/internal/models"
+	"github.com/pandeptwidyaop/tempfile/internal/utils"
 )
 
+// DeleteTokensCookie names the cookie passing the delete tokens of an upload
+// to the success page, keyed by file ID. Unlike the query of the success page
+// it never ends up in access logs, browser history or Referer headers, and
+// the success page clears it once read
+const DeleteTokensCookie = "delete_tokens"
+
+// deleteTokensMaxAge is how long the delete tokens of an upload wait for the
+// success page, in seconds
+const deleteTokensMaxAge = 600
+
+// SetDeleteTokens passes tokens, the delete tokens of an upload keyed by file
+// ID, to the success page the response redirects to
+func SetDeleteTokens(c *fiber.Ctx, baseURL string, tokens url.Values) {
+	c.Cookie(&fiber.Cookie{
+		Name:     DeleteTokensCookie,
+		Value:    tokens.Encode(),
+		Path:     "/success",
+		MaxAge:   deleteTokensMaxAge,
+		Secure:   strings.HasPrefix(baseURL, "https://"),
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteStrictMode,
+	})
+}
+
+// takeDeleteTokens returns the delete tokens passed to the success page, and
+// clears them so they are shown only once
+func takeDeleteTokens(c *fiber.Ctx) url.Values {
+	value := c.Cookies(DeleteTokensCookie)
+	if value == "" {
+		return url.Values{}
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     DeleteTokensCookie,
+		Path:     "/success",
+		Expires:  time.Unix(0, 0),
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteStrictMode,
+	})
+
+	tokens, err := url.ParseQuery(value)
+	if err != nil {
+		return url.Values{}
+	}
+	return tokens
+}
+
 // TemplateService handles HTML template rendering with hybrid loading
 type TemplateService struct {
 	config        *config.Config
 	templates     *template.Template
 	useFileSystem bool
 	embeddedFS    embed.FS
+	signer        *LinkSigner
 }
 
 // NewTemplateService creates a new template service instance with hybrid loading
@@ -27,6 +81,7 @@ func NewTemplateService(cfg *config.Config, embeddedFS embed.FS) *TemplateServic
 	return &TemplateService{
 		config:     cfg,
 		embeddedFS: embeddedFS,
+		signer:     newLinkSigner(cfg),
 	}
 }
 
@@ -118,17 +173,70 @@ func (s *TemplateService) GetMode() string {
 // RenderUploadPage renders the upload page
 func (s *TemplateService) RenderUploadPage(c *fiber.Ctx, baseURL string) error {
 	data := models.WebPageData{
-		Title:            "Upload File",
-		Theme:            s.config.DefaultTheme,
-		FileExpiryHours:  s.config.FileExpiryHours,
-		MaxFileSize:      s.config.MaxFileSize,
-		MaxFileSizeHuman: s.formatBytes(s.config.MaxFileSize),
-		BaseURL:          baseURL,
+		Title:               "Upload File",
+		Theme:               s.config.DefaultTheme,
+		FileExpiryHours:     s.config.FileExpiryHours,
+		DefaultExpiry:       utils.FormatDuration(s.config.DefaultExpiry()),
+		ExpiryOptions:       s.expiryOptions(),
+		MaxFileSize:         s.config.MaxFileSize,
+		MaxFileSizeHuman:    s.formatBytes(s.config.MaxFileSize),
+		MaxFiles:            s.config.MaxFilesPerUpload,
+		MaxRequestSize:      s.config.MaxRequestSize,
+		MaxRequestSizeHuman: s.formatBytes(s.config.MaxRequestSize),
+		ClientEncryption:    s.config.ClientEncryptionAllowed(),
+		BaseURL:             baseURL,
 	}
 
 	return s.Render(c, "upload.html", data)
 }
 
+// expiryPresets are the expiries offered on the upload page, as allowed by the configured bounds
+var expiryPresets = []time.Duration{
+	10 * time.Minute,
+	time.Hour,
+	6 * time.Hour,
+	24 * time.Hour,
+	3 * 24 * time.Hour,
+	7 * 24 * time.Hour,
+	30 * 24 * time.Hour,
+}
+
+// expiryOptions builds the upload page expiry choices, with the default expiry selected
+func (s *TemplateService) expiryOptions() []models.ExpiryOption {
+	defaultExpiry := s.config.DefaultExpiry()
+	durations := []time.Duration{defaultExpiry}
+
+	for _, preset := range expiryPresets {
+		if preset != defaultExpiry && preset >= s.config.MinExpiry && preset <= s.config.MaxExpiry {
+			durations = append(durations, preset)
+		}
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+	options := make([]models.ExpiryOption, 0, len(durations))
+	for _, d := range durations {
+		options = append(options, models.ExpiryOption{
+			Value:    expiryValue(d),
+			Label:    utils.FormatDuration(d),
+			Selected: d == defaultExpiry,
+		})
+	}
+
+	return options
+}
+
+// expiryValue formats a duration in the largest whole unit accepted by expires_in
+func expiryValue(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	default:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+}
+
 // RenderSuccessPage renders the success page
 func (s *TemplateService) RenderSuccessPage(c *fiber.Ctx, baseURL string) error {
 	// Get upload result from query params
@@ -138,12 +246,21 @@ func (s *TemplateService) RenderSuccessPage(c *fiber.Ctx, baseURL string) error
 	sizeHuman := c.Query("size_human")
 	expiresAt := c.Query("expires_at")
 	expiresIn := c.Query("expires_in")
+	maxDownloads := c.QueryInt("max_downloads")
+	protected := c.QueryBool("protected")
+	clientEncrypted := c.QueryBool("encrypted")
 
 	if filename == "" {
 		// Redirect to home if no file info
 		return c.Redirect("/")
 	}
 
+	tokens := takeDeleteTokens(c)
+	var deleteURL string
+	if deleteToken := tokens.Get(filename); deleteToken != "" {
+		deleteURL = DeleteURL(filename, deleteToken)
+	}
+
 	data := models.WebPageData{
 		Title:        "Upload Successful",
 		Theme:        s.config.DefaultTheme,
@@ -153,12 +270,198 @@ func (s *TemplateService) RenderSuccessPage(c *fiber.Ctx, baseURL string) error
 		SizeHuman:    sizeHuman,
 		ExpiresAt:    expiresAt,
 		ExpiresIn:    expiresIn,
+		MaxDownloads: maxDownloads,
+		Protected:    protected,
+		DownloadURL:  uploadedLink(filename, c.Query("link")),
+		DeleteURL:    deleteURL,
 		BaseURL:      baseURL,
+		Files:        uploadedFiles(c, tokens),
+
+		ClientEncrypted: clientEncrypted,
+	}
+	if collectionID := c.Query("collection"); collectionID != "" {
+		data.CollectionURL = CollectionURL(collectionID)
 	}
 
 	return s.Render(c, "success.html", data)
 }
 
+// uploadedFiles lists the files of an upload of several files from the
+// repeated success page query params, with delete links for those in tokens.
+// It is empty for a single file
+func uploadedFiles(c *fiber.Ctx, tokens url.Values) []models.UploadedFile {
+	args := c.Context().QueryArgs()
+	filenames := args.PeekMulti("file")
+	if len(filenames) < 2 {
+		return nil
+	}
+
+	value := func(key string, i int) string {
+		if values := args.PeekMulti(key); i < len(values) {
+			return string(values[i])
+		}
+		return ""
+	}
+
+	files := make([]models.UploadedFile, 0, len(filenames))
+	for i, filename := range filenames {
+		file := models.UploadedFile{
+			Filename:     string(filename),
+			OriginalName: value("original", i),
+			SizeHuman:    value("size_human", i),
+			DownloadURL:  uploadedLink(string(filename), value("link", i)),
+		}
+		if deleteToken := tokens.Get(file.Filename); deleteToken != "" {
+			file.DeleteURL = DeleteURL(file.Filename, deleteToken)
+		}
+		files = append(files, file)
+	}
+
+	return files
+}
+
+// uploadedLink returns the download link of an uploaded file from the success
+// page query params. Only a link to the file itself is taken, so the page
+// cannot be made to point elsewhere
+func uploadedLink(filename, link string) string {
+	if strings.HasPrefix(link, "/"+filename+"?") {
+		return link
+	}
+	return "/" + filename
+}
+
+// linkQuery returns the query of the download link the request was made
+// with, keeping its signature if any, so it carries over to links of the same
+// file
+func linkQuery(c *fiber.Ctx) string {
+	if c.Query("signature") == "" {
+		return ""
+	}
+
+	query := url.Values{}
+	query.Set("expires", c.Query("expires"))
+	query.Set("signature", c.Query("signature"))
+	return "?" + query.Encode()
+}
+
+// RenderCollectionPage renders the landing page of a collection, listing its
+// available members
+func (s *TemplateService) RenderCollectionPage(c *fiber.Ctx, baseURL string, collection *metadata.Collection, members []*metadata.Record) error {
+	now := time.Now()
+	expiresAt := CollectionExpiresAt(collection, members)
+
+	var total int64
+	files := make([]models.UploadedFile, 0, len(members))
+	for _, record := range members {
+		total += record.Size
+		files = append(files, models.UploadedFile{
+			Filename:     record.ID,
+			OriginalName: record.OriginalName,
+			SizeHuman:    utils.FormatBytes(record.Size),
+			ExpiresIn:    utils.FormatDuration(record.ExpiresAt.Sub(now)),
+			Protected:    record.PasswordHash != "",
+			DownloadURL:  s.signer.Sign(record.ID, earlier(record.ExpiresAt, expiresAt)),
+		})
+	}
+
+	data := models.WebPageData{
+		Title:         "Shared Files",
+		Theme:         s.config.DefaultTheme,
+		BaseURL:       baseURL,
+		SizeHuman:     utils.FormatBytes(total),
+		ExpiresAt:     expiresAt.Format(time.RFC3339),
+		ExpiresIn:     utils.FormatDuration(expiresAt.Sub(now)),
+		Files:         files,
+		CollectionURL: CollectionURL(collection.ID),
+	}
+
+	return s.Render(c, "collection.html", data)
+}
+
+// RenderDecryptPage renders the landing page of a file encrypted by its
+// uploader's browser, which downloads and decrypts the file with the key from
+// the URL fragment. The server never sees the key, the name or the content
+func (s *TemplateService) RenderDecryptPage(c *fiber.Ctx, record *metadata.Record) error {
+	data := models.WebPageData{
+		Title:        "Encrypted File",
+		Theme:        s.config.DefaultTheme,
+		Filename:     record.ID,
+		SizeHuman:    utils.FormatBytes(record.Size),
+		ExpiresAt:    record.ExpiresAt.Format(time.RFC3339),
+		ExpiresIn:    utils.FormatDuration(time.Until(record.ExpiresAt)),
+		MaxDownloads: record.MaxDownloads,
+		Protected:    record.PasswordHash != "",
+		DownloadURL:  "/" + record.ID + "/raw" + linkQuery(c),
+	}
+
+	return s.Render(c, "decrypt.html", data)
+}
+
+// RenderFilePage renders the landing page of a file, describing it and linking
+// to its content at /:filename/raw. It carries OpenGraph metadata and an
+// oEmbed link for link previews, and does not count as a download
+func (s *TemplateService) RenderFilePage(c *fiber.Ctx, baseURL string, record *metadata.Record) error {
+	contentType := record.ContentType
+	if contentType == "" {
+		contentType = utils.GetContentType(record.ID)
+	}
+
+	pageURL := baseURL + "/" + record.ID + linkQuery(c)
+	data := models.WebPageData{
+		Title:           record.OriginalName,
+		Theme:           s.config.DefaultTheme,
+		BaseURL:         baseURL,
+		Filename:        record.ID,
+		OriginalName:    record.OriginalName,
+		Size:            strconv.FormatInt(record.Size, 10),
+		SizeHuman:       utils.FormatBytes(record.Size),
+		ContentType:     contentType,
+		ExpiresAt:       record.ExpiresAt.Format(time.RFC3339),
+		ExpiresIn:       utils.FormatDuration(time.Until(record.ExpiresAt)),
+		MaxDownloads:    record.MaxDownloads,
+		Protected:       record.PasswordHash != "",
+		ClientEncrypted: record.ClientEncrypted,
+		DownloadURL:     "/" + record.ID + "/raw" + linkQuery(c),
+		PageURL:         pageURL,
+		OEmbedURL:       baseURL + "/oembed?format=json&url=" + url.QueryEscape(pageURL),
+	}
+	if record.ClientEncrypted {
+		data.Title = "Encrypted File"
+	}
+
+	return s.Render(c, "file.html", data)
+}
+
+// RenderPasswordPage renders the password prompt of a protected file.
+// errorMessage explains why a previous attempt failed, if any
+func (s *TemplateService) RenderPasswordPage(c *fiber.Ctx, filename, originalName, errorMessage string) error {
+	data := models.WebPageData{
+		Title:        "Password Required",
+		Theme:        s.config.DefaultTheme,
+		Filename:     filename,
+		OriginalName: originalName,
+		ErrorMessage: errorMessage,
+		DownloadURL:  c.Path() + linkQuery(c),
+	}
+
+	return s.Render(c, "password.html", data)
+}
+
+// RenderDeletePage renders the page confirming the deletion of a file, or
+// reporting it once deleted
+func (s *TemplateService) RenderDeletePage(c *fiber.Ctx, filename, originalName, deleteToken string, deleted bool) error {
+	data := models.WebPageData{
+		Title:        "Delete File",
+		Theme:        s.config.DefaultTheme,
+		Filename:     filename,
+		OriginalName: originalName,
+		DeleteToken:  deleteToken,
+		Deleted:      deleted,
+	}
+
+	return s.Render(c, "delete.html", data)
+}
+
 // RenderErrorPage renders an error page
 func (s *TemplateService) RenderErrorPage(c *fiber.Ctx, title, message, detail string) error {
 	data := models.WebPageData{
@@ -169,7 +472,10 @@ func (s *TemplateService) RenderErrorPage(c *fiber.Ctx, title, message, detail s
 		ErrorDetail:  detail,
 	}
 
-	c.Status(400)
+	// Callers may have chosen a more specific error status already
+	if c.Response().StatusCode() == fiber.StatusOK {
+		c.Status(400)
+	}
 	return s.Render(c, "error.html", data)
 }
 
@@ -0,0 +1,782 @@
+package services
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pandeptwidyaop/tempfile/internal/config"
+	"github.com/pandeptwidyaop/tempfile/internal/encryption"
+	"github.com/pandeptwidyaop/tempfile/internal/metadata"
+	"github.com/pandeptwidyaop/tempfile/internal/storage"
+	"github.com/pandeptwidyaop/tempfile/internal/utils"
+)
+
+// Resumable upload errors
+var (
+	// ErrUploadNotFound indicates an unknown resumable upload
+	ErrUploadNotFound = errors.New("upload not found")
+
+	// ErrUploadExpired indicates a resumable upload that was not finished in time
+	ErrUploadExpired = errors.New("upload expired")
+
+	// ErrUploadLocked indicates another request is currently writing to the upload
+	ErrUploadLocked = errors.New("upload is locked by another request")
+
+	// ErrUploadTooLarge indicates an upload longer than the maximum file size
+	ErrUploadTooLarge = errors.New("upload exceeds maximum file size")
+
+	// ErrOffsetMismatch indicates a chunk that does not start at the current offset
+	ErrOffsetMismatch = errors.New("upload offset mismatch")
+
+	// ErrChunkTooLarge indicates a chunk that would grow the upload past its length
+	ErrChunkTooLarge = errors.New("chunk exceeds upload length")
+
+	// ErrInvalidUploadMetadata indicates a malformed Upload-Metadata header
+	ErrInvalidUploadMetadata = errors.New("invalid upload metadata")
+
+	// ErrInvalidChecksum indicates a malformed Upload-Checksum header or unsupported algorithm
+	ErrInvalidChecksum = errors.New("invalid or unsupported checksum")
+
+	// ErrChecksumMismatch indicates a chunk whose content does not match its checksum
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// TusChecksumAlgorithms lists the algorithms accepted in Upload-Checksum headers
+var TusChecksumAlgorithms = []string{"md5", "sha1", "sha256"}
+
+// tusPrefix is the storage prefix under which unfinished uploads are kept
+const tusPrefix = "tus/"
+
+// TusUpload is the state of a resumable upload
+type TusUpload struct {
+	ID          string    `json:"id"`
+	Length      int64     `json:"length"`
+	Offset      int64     `json:"-"`
+	Metadata    string    `json:"metadata,omitempty"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	UploaderIP  string    `json:"uploader_ip"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+
+	// FileExpiresIn, FileMaxDownloads, FilePasswordHash and
+	// FileClientEncrypted are the options requested for the stored file,
+	// applied once complete
+	FileExpiresIn       string `json:"file_expires_in,omitempty"`
+	FileMaxDownloads    int    `json:"file_max_downloads,omitempty"`
+	FilePasswordHash    string `json:"file_password_hash,omitempty"`
+	FileClientEncrypted bool   `json:"file_client_encrypted,omitempty"`
+
+	// FileDeleteTokenHash is the hash of the stored file's delete token.
+	// DeleteToken itself is only known right after Create
+	FileDeleteTokenHash string `json:"file_delete_token_hash,omitempty"`
+	DeleteToken         string `json:"-"`
+
+	// FileID is the stored file once all chunks have arrived
+	FileID string `json:"file_id,omitempty"`
+
+	// DataKey encrypts the chunks at rest when encryption is enabled, wrapped
+	// by the master key KeyID like the data keys of stored files. Each chunk
+	// is sealed with a key derived from it and a random salt stored in front
+	// of the chunk, so chunks never share nonces, not even a retried one
+	DataKey string `json:"data_key,omitempty"`
+	KeyID   string `json:"key_id,omitempty"`
+}
+
+// IsComplete reports whether all chunks have arrived and the file was stored
+func (u *TusUpload) IsComplete() bool {
+	return u.FileID != ""
+}
+
+// TusService handles resumable uploads following the tus 1.0 protocol. Chunks
+// are stored as separate objects and joined into a regular file once complete,
+// so any storage backend works without append support. Uploads are locked in
+// memory, so requests for one upload must reach the same server
+type TusService struct {
+	config *config.Config
+	files  *FileService
+
+	mu    sync.Mutex
+	locks map[string]bool
+}
+
+// tusPart is a stored chunk of an upload
+type tusPart struct {
+	key    string
+	offset int64
+	size   int64
+}
+
+// NewTusService creates a new resumable upload service instance
+func NewTusService(cfg *config.Config, fileSvc *FileService) *TusService {
+	return &TusService{
+		config: cfg,
+		files:  fileSvc,
+		locks:  make(map[string]bool),
+	}
+}
+
+// Create starts a new resumable upload of length bytes
+func (s *TusService) Create(length int64, rawMetadata, uploaderIP, userAgent string) (*TusUpload, error) {
+	if length > s.config.MaxFileSize {
+		return nil, ErrUploadTooLarge
+	}
+
+	meta, err := parseTusMetadata(rawMetadata)
+	if err != nil {
+		return nil, err
+	}
+
+	filename := meta["filename"]
+	if filename == "" {
+		filename = meta["name"]
+	}
+	contentType := meta["filetype"]
+	if contentType == "" {
+		contentType = meta["type"]
+	}
+	if err := s.files.CheckName(filename); err != nil {
+		return nil, err
+	}
+	if parseFlag(meta["client_encrypted"]) {
+		if err := s.files.CheckClientEncrypted(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Reject a bad expiry now rather than after the whole file was sent
+	now := time.Now()
+	if _, err := s.files.ResolveExpiry(meta["expires_in"], now); err != nil {
+		return nil, err
+	}
+	maxDownloads, err := ParseMaxDownloads(meta["max_downloads"])
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the hash of a password is kept, never the metadata carrying it
+	var passwordHash string
+	if password := meta["password"]; password != "" {
+		if passwordHash, err = utils.HashPassword(password); err != nil {
+			return nil, err
+		}
+	}
+	rawMetadata = removeTusMetadata(rawMetadata, "password")
+
+	deleteToken, err := utils.GenerateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	upload := &TusUpload{
+		ID:          uuid.New().String(),
+		Length:      length,
+		Metadata:    rawMetadata,
+		Filename:    utils.SanitizeFilename(filename),
+		ContentType: contentType,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(time.Duration(s.config.TusUploadExpiryHours) * time.Hour),
+		UploaderIP:  uploaderIP,
+		UserAgent:   userAgent,
+
+		FileExpiresIn:       meta["expires_in"],
+		FileMaxDownloads:    maxDownloads,
+		FilePasswordHash:    passwordHash,
+		FileClientEncrypted: parseFlag(meta["client_encrypted"]),
+
+		FileDeleteTokenHash: utils.HashToken(deleteToken),
+		DeleteToken:         deleteToken,
+	}
+
+	if keyring := s.files.keyring; keyring != nil {
+		dataKey, err := keyring.GenerateDataKey()
+		if err != nil {
+			return nil, err
+		}
+		if upload.DataKey, upload.KeyID, err = keyring.Wrap(dataKey, upload.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.save(upload); err != nil {
+		return nil, err
+	}
+
+	// An empty upload is complete as soon as it exists
+	if length == 0 {
+		if err := s.finish(upload, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return upload, nil
+}
+
+// Get returns the current state of a resumable upload
+func (s *TusService) Get(id string) (*TusUpload, error) {
+	upload, err := s.load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(upload.ExpiresAt) {
+		return nil, ErrUploadExpired
+	}
+
+	if upload.IsComplete() {
+		upload.Offset = upload.Length
+		return upload, nil
+	}
+
+	parts, err := s.parts(upload)
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range parts {
+		upload.Offset += part.size
+	}
+
+	return upload, nil
+}
+
+// WriteChunk stores a chunk of size bytes, or of unknown size if negative, at
+// offset and completes the upload once its last byte has arrived. checksum is
+// the optional Upload-Checksum header value
+func (s *TusService) WriteChunk(id string, offset int64, chunk io.Reader, size int64, checksum string) (*TusUpload, error) {
+	if !s.lock(id) {
+		return nil, ErrUploadLocked
+	}
+	defer s.unlock(id)
+
+	upload, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset != upload.Offset {
+		return nil, ErrOffsetMismatch
+	}
+	if size >= 0 && offset+size > upload.Length {
+		return nil, ErrChunkTooLarge
+	}
+
+	var verify func() error
+	if checksum != "" {
+		if chunk, verify, err = checkTusChecksum(checksum, chunk); err != nil {
+			return nil, err
+		}
+	}
+
+	if size != 0 {
+		received, err := s.writePart(upload, offset, chunk, size, verify)
+		if err != nil {
+			return nil, err
+		}
+		upload.Offset += received
+	} else if verify != nil {
+		if err := verify(); err != nil {
+			return nil, err
+		}
+	}
+
+	// A previous attempt to join the chunks may have failed, so retry it as well
+	if upload.Offset == upload.Length && !upload.IsComplete() {
+		parts, err := s.parts(upload)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.finish(upload, parts); err != nil {
+			return nil, err
+		}
+	}
+
+	return upload, nil
+}
+
+// writePart stores a chunk at offset and returns how much it held. The chunk is streamed to storage as it
+// is received, and removed again unless it fits the upload and passes verify
+func (s *TusService) writePart(upload *TusUpload, offset int64, chunk io.Reader, size int64, verify func() error) (int64, error) {
+	// Reading one byte more than fits reveals a chunk of unknown size that is too long
+	var received byteCounter
+	var body io.Reader = io.TeeReader(&io.LimitedReader{R: chunk, N: upload.Length - offset + 1}, &received)
+
+	storedSize := size
+	dataKey, err := s.dataKey(upload)
+	if err != nil {
+		return 0, err
+	}
+	if dataKey != nil {
+		salt := make([]byte, encryption.SaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return 0, fmt.Errorf("failed to generate salt: %w", err)
+		}
+		partKey, err := encryption.DeriveKey(dataKey, salt)
+		if err != nil {
+			return 0, err
+		}
+
+		encrypted, err := encryption.NewEncryptReader(body, partKey)
+		if err != nil {
+			return 0, err
+		}
+		body = io.MultiReader(bytes.NewReader(salt), encrypted)
+		if size >= 0 {
+			storedSize = encryption.SaltSize + encryption.EncryptedSize(size)
+		}
+	}
+
+	key := tusPartKey(upload.ID, offset)
+	if err := s.files.storage.Put(key, body, storedSize); err != nil {
+		return 0, fmt.Errorf("failed to store chunk: %w", err)
+	}
+
+	switch {
+	case offset+int64(received) > upload.Length:
+		err = ErrChunkTooLarge
+	case verify != nil:
+		err = verify()
+	}
+	if err != nil || received == 0 {
+		if deleteErr := s.files.storage.Delete(key); deleteErr != nil && !errors.Is(deleteErr, storage.ErrNotFound) {
+			log.Printf("Error removing chunk %s: %v", key, deleteErr)
+		}
+		return 0, err
+	}
+
+	return int64(received), nil
+}
+
+// DownloadURL returns the path the file of a complete upload is downloaded from
+func (s *TusService) DownloadURL(upload *TusUpload) string {
+	record, err := s.files.Lookup(upload.FileID)
+	if err != nil {
+		// Without a record the link cannot be signed, and the file is gone anyway
+		return "/" + upload.FileID
+	}
+	return s.files.DownloadURL(record)
+}
+
+// Terminate discards a resumable upload and all chunks stored so far
+func (s *TusService) Terminate(id string) error {
+	if !s.lock(id) {
+		return ErrUploadLocked
+	}
+	defer s.unlock(id)
+
+	if _, err := s.load(id); err != nil {
+		return err
+	}
+
+	return s.remove(id)
+}
+
+// CleanupExpired removes resumable uploads that were not finished in time and
+// returns how many were removed
+func (s *TusService) CleanupExpired(now time.Time) (int, error) {
+	objects, err := s.files.storage.List(tusPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	// Group the stored objects by upload
+	newest := make(map[string]time.Time)
+	for _, object := range objects {
+		id, _, ok := strings.Cut(strings.TrimPrefix(object.Key, tusPrefix), "/")
+		if !ok {
+			continue
+		}
+		if object.ModTime.After(newest[id]) {
+			newest[id] = object.ModTime
+		}
+	}
+
+	maxAge := time.Duration(s.config.TusUploadExpiryHours) * time.Hour
+	removed := 0
+
+	for id, modTime := range newest {
+		upload, err := s.load(id)
+		switch {
+		case err == nil:
+			if !now.After(upload.ExpiresAt) {
+				continue
+			}
+		case errors.Is(err, ErrUploadNotFound):
+			// Chunks without state are only removed once they could no longer be resumed
+			if now.Sub(modTime) < maxAge {
+				continue
+			}
+		default:
+			log.Printf("Error reading upload %s: %v", id, err)
+			continue
+		}
+
+		// Never pull chunks out from under a request that is writing them
+		if !s.lock(id) {
+			continue
+		}
+		err = s.remove(id)
+		s.unlock(id)
+
+		if err != nil {
+			log.Printf("Error removing expired upload %s: %v", id, err)
+			continue
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// finish joins the chunks of a complete upload into a regular file
+func (s *TusService) finish(upload *TusUpload, parts []tusPart) error {
+	// Relative expiries count from completion, like any other upload
+	now := time.Now()
+	expiryTime, err := s.files.ResolveExpiry(upload.FileExpiresIn, now)
+	if err != nil {
+		return err
+	}
+	filename := utils.GenerateFilename(upload.Filename, expiryTime)
+
+	contentType := upload.ContentType
+	if upload.FileClientEncrypted {
+		contentType = ClientEncryptedContentType
+	} else if contentType == "" {
+		contentType = utils.GetContentType(filename)
+	}
+
+	record := &metadata.Record{
+		ID:           filename,
+		OriginalName: upload.Filename,
+		Size:         upload.Length,
+		ContentType:  contentType,
+		CreatedAt:    now,
+		ExpiresAt:    expiryTime,
+		MaxDownloads: upload.FileMaxDownloads,
+		PasswordHash: upload.FilePasswordHash,
+		UploaderIP:   upload.UploaderIP,
+		UserAgent:    upload.UserAgent,
+
+		ClientEncrypted: upload.FileClientEncrypted,
+		DeleteTokenHash: upload.FileDeleteTokenHash,
+	}
+
+	dataKey, err := s.dataKey(upload)
+	if err != nil {
+		return err
+	}
+
+	// Stream the chunks in order without holding more than one open at a time
+	pr, pw := io.Pipe()
+	go func() {
+		for _, part := range parts {
+			reader, _, err := s.files.storage.Get(part.key)
+			if err != nil {
+				_ = pw.CloseWithError(err)
+				return
+			}
+			if dataKey != nil {
+				if reader, err = openPart(reader, dataKey, part.size); err != nil {
+					_ = pw.CloseWithError(err)
+					return
+				}
+			}
+
+			_, err = io.Copy(pw, reader)
+			_ = reader.Close()
+			if err != nil {
+				_ = pw.CloseWithError(err)
+				return
+			}
+		}
+		_ = pw.Close()
+	}()
+
+	err = s.files.Create(record, pr)
+	_ = pr.Close()
+	if errors.Is(err, ErrFileTypeNotAllowed) || errors.Is(err, ErrFileTypeMismatch) || errors.Is(err, ErrClientEncryptedNotAllowed) || errors.Is(err, ErrMalwareDetected) {
+		// Joining the chunks again would only fail the same way
+		if removeErr := s.remove(upload.ID); removeErr != nil {
+			log.Printf("Error removing rejected upload %s: %v", upload.ID, removeErr)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	upload.FileID = filename
+	if err := s.save(upload); err != nil {
+		log.Printf("Error saving completed upload %s: %v", upload.ID, err)
+	}
+
+	for _, part := range parts {
+		if err := s.files.storage.Delete(part.key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Error removing chunk %s: %v", part.key, err)
+		}
+	}
+
+	if s.config.Debug {
+		log.Printf("Resumable upload %s completed: %s (original: %s, size: %s)",
+			upload.ID, filename, upload.Filename, utils.FormatBytes(upload.Length))
+	}
+
+	return nil
+}
+
+// parts returns the contiguous chunks stored for an upload, ordered by offset
+func (s *TusService) parts(upload *TusUpload) ([]tusPart, error) {
+	objects, err := s.files.storage.List(tusPrefix + upload.ID + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []tusPart
+	for _, object := range objects {
+		name := path.Base(object.Key)
+		if !strings.HasSuffix(name, ".part") {
+			continue
+		}
+
+		offset, err := strconv.ParseInt(strings.TrimSuffix(name, ".part"), 10, 64)
+		if err != nil {
+			continue
+		}
+		// Encrypted chunks are larger than the content they hold
+		size := object.Size
+		if upload.DataKey != "" {
+			if size = encryption.PlainSize(object.Size - encryption.SaltSize); size < 0 {
+				continue
+			}
+		}
+		parts = append(parts, tusPart{key: object.Key, offset: offset, size: size})
+	}
+
+	sort.Slice(parts, func(i, j int) bool { return parts[i].offset < parts[j].offset })
+
+	// Anything after a gap cannot be part of the upload
+	var next int64
+	for i, part := range parts {
+		if part.offset != next {
+			return parts[:i], nil
+		}
+		next += part.size
+	}
+
+	return parts, nil
+}
+
+// openPart returns a reader of the size bytes of content of an encrypted
+// chunk read from r, decrypted with the key derived from dataKey and the salt
+// the chunk starts with. Closing it closes r
+func openPart(r io.ReadCloser, dataKey []byte, size int64) (io.ReadCloser, error) {
+	salt := make([]byte, encryption.SaltSize)
+	if _, err := io.ReadFull(r, salt); err != nil {
+		_ = r.Close()
+		return nil, fmt.Errorf("failed to read salt: %w", err)
+	}
+
+	partKey, err := encryption.DeriveKey(dataKey, salt)
+	if err != nil {
+		_ = r.Close()
+		return nil, err
+	}
+
+	reader, err := encryption.NewDecryptReader(r, partKey, size)
+	if err != nil {
+		_ = r.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// dataKey returns the key the chunks of an upload are encrypted with, or nil
+// if they are stored in plaintext
+func (s *TusService) dataKey(upload *TusUpload) ([]byte, error) {
+	if upload.DataKey == "" {
+		return nil, nil
+	}
+	if s.files.keyring == nil {
+		return nil, fmt.Errorf("upload %s is encrypted but no encryption key is configured", upload.ID)
+	}
+
+	return s.files.keyring.Unwrap(upload.DataKey, upload.KeyID, upload.ID)
+}
+
+// load reads the stored state of an upload
+func (s *TusService) load(id string) (*TusUpload, error) {
+	// Only canonical IDs as handed out by Create are accepted
+	if parsed, err := uuid.Parse(id); err != nil || parsed.String() != id {
+		return nil, ErrUploadNotFound
+	}
+
+	reader, _, err := s.files.storage.Get(tusInfoKey(id))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, ErrUploadNotFound
+		}
+		return nil, err
+	}
+	defer reader.Close()
+
+	var upload TusUpload
+	if err := json.NewDecoder(reader).Decode(&upload); err != nil {
+		return nil, fmt.Errorf("failed to decode upload %s: %w", id, err)
+	}
+
+	return &upload, nil
+}
+
+// save stores the state of an upload
+func (s *TusService) save(upload *TusUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return fmt.Errorf("failed to encode upload: %w", err)
+	}
+
+	return s.files.storage.Put(tusInfoKey(upload.ID), bytes.NewReader(data), int64(len(data)))
+}
+
+// remove deletes the state and all chunks of an upload
+func (s *TusService) remove(id string) error {
+	objects, err := s.files.storage.List(tusPrefix + id + "/")
+	if err != nil {
+		return err
+	}
+
+	for _, object := range objects {
+		if err := s.files.storage.Delete(object.Key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lock marks an upload as being written, reporting false if it already is.
+// The lock is held by this process only; another server sharing the storage
+// does not see it
+func (s *TusService) lock(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.locks[id] {
+		return false
+	}
+	s.locks[id] = true
+	return true
+}
+
+// unlock releases an upload locked by lock
+func (s *TusService) unlock(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.locks, id)
+}
+
+// tusInfoKey returns the storage key of an upload's state
+func tusInfoKey(id string) string {
+	return tusPrefix + id + "/info.json"
+}
+
+// tusPartKey returns the storage key of the chunk starting at offset; offsets
+// are zero padded so keys sort in upload order
+func tusPartKey(id string, offset int64) string {
+	return fmt.Sprintf("%s%s/%020d.part", tusPrefix, id, offset)
+}
+
+// parseTusMetadata decodes an Upload-Metadata header of comma separated
+// "key base64value" pairs
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return meta, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" || strings.ContainsAny(key, " \t") {
+			return nil, ErrInvalidUploadMetadata
+		}
+		if _, exists := meta[key]; exists {
+			return nil, ErrInvalidUploadMetadata
+		}
+
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, ErrInvalidUploadMetadata
+		}
+		meta[key] = string(value)
+	}
+
+	return meta, nil
+}
+
+// removeTusMetadata removes a key from an Upload-Metadata header value
+func removeTusMetadata(header, key string) string {
+	pairs := strings.Split(header, ",")
+	kept := pairs[:0]
+
+	for _, pair := range pairs {
+		if name, _, _ := strings.Cut(strings.TrimSpace(pair), " "); name != key {
+			kept = append(kept, pair)
+		}
+	}
+
+	return strings.Join(kept, ",")
+}
+
+// checkTusChecksum parses an Upload-Checksum header value such as
+// "sha1 Kq5sNclPz7QV2+lfQIuc6R7oRu0=". It returns a reader of chunk that hashes
+// what it reads, and a function checking the hash once chunk has been read
+func checkTusChecksum(header string, chunk io.Reader) (io.Reader, func() error, error) {
+	algorithm, encoded, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok {
+		return nil, nil, ErrInvalidChecksum
+	}
+
+	var h hash.Hash
+	switch strings.ToLower(algorithm) {
+	case "md5":
+		h = md5.New() // #nosec G401 - Integrity check requested by the client
+	case "sha1":
+		h = sha1.New() // #nosec G401 - Integrity check requested by the client
+	case "sha256":
+		h = sha256.New()
+	default:
+		return nil, nil, ErrInvalidChecksum
+	}
+
+	expected, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, nil, ErrInvalidChecksum
+	}
+
+	verify := func() error {
+		if subtle.ConstantTimeCompare(h.Sum(nil), expected) != 1 {
+			return ErrChecksumMismatch
+		}
+		return nil
+	}
+
+	return io.TeeReader(chunk, h), verify, nil
+}
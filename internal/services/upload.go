@@ -1,67 +1,408 @@
 package services
 
 import (
+	"errors"
 	"fmt"
 	"log"
-	"path/filepath"
+	"mime/multipart"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/pandeptwidyaop/tempfile/internal/config"
+	"github.com/pandeptwidyaop/tempfile/internal/metadata"
 	"github.com/pandeptwidyaop/tempfile/internal/models"
+	"github.com/pandeptwidyaop/tempfile/internal/ratelimit"
 	"github.com/pandeptwidyaop/tempfile/internal/utils"
 )
 
+// UploadOptions holds the optional settings a client may send along with an upload
+type UploadOptions struct {
+	// ExpiresIn is the requested expiry, see FileService.ResolveExpiry
+	ExpiresIn string
+
+	// MaxDownloads is the requested download limit, see ParseMaxDownloads
+	MaxDownloads string
+
+	// Password is required to download the file if set
+	Password string
+
+	// SHA256 is the hex encoded SHA-256 digest the client expects the file to
+	// have. The upload is rejected if it does not match
+	SHA256 string
+
+	// ClientEncrypted marks a file encrypted by the client, see
+	// metadata.Record.ClientEncrypted
+	ClientEncrypted bool
+}
+
+// ClientEncryptedContentType is the content type of every file encrypted by the client
+const ClientEncryptedContentType = "application/octet-stream"
+
+// clientEncryptedNotAllowedMessage explains why a file encrypted by the client was refused
+const clientEncryptedNotAllowedMessage = "Files encrypted by the client are not accepted: the server has to check the content of every file"
+
 // UploadService handles file upload operations
 type UploadService struct {
-	config *config.Config
+	config      *config.Config
+	files       *FileService
+	collections *CollectionService
+	ipDetector  ratelimit.IPDetector
 }
 
 // NewUploadService creates a new upload service instance
-func NewUploadService(cfg *config.Config) *UploadService {
+func NewUploadService(cfg *config.Config, fileSvc *FileService, collectionSvc *CollectionService) *UploadService {
 	return &UploadService{
-		config: cfg,
+		config:      cfg,
+		files:       fileSvc,
+		collections: collectionSvc,
+		ipDetector:  ratelimit.NewIPDetector(cfg.RateLimitTrustedProxies, cfg.RateLimitIPHeaders),
 	}
 }
 
-// ProcessFileUpload handles the core file upload logic
-func (s *UploadService) ProcessFileUpload(c *fiber.Ctx) (*models.UploadResponse, error) {
-	// Get file from form
-	file, err := c.FormFile("file")
+// formFileFields are the multipart fields files may be uploaded in
+var formFileFields = []string{"file", "files[]"}
+
+// ProcessFileUploads handles a multipart upload of one or more files, sent in
+// any number of file or files[] parts. All files share the upload options and
+// are stored only if every one of them is within the limits. Several files are
+// grouped into a collection, shared under one link.
+//
+// The form is read as it arrives, and every file is streamed to storage and
+// checked against the size and rate limits while it is received. Options may
+// follow the files in the form, so the files are staged until it has been read
+func (s *UploadService) ProcessFileUploads(c *fiber.Ctx) ([]*models.UploadResponse, error) {
+	boundary := string(c.Request().Header.MultipartFormBoundary())
+	if boundary == "" {
+		return nil, fiber.NewError(400, "No file uploaded")
+	}
+
+	budget := newUploadBudget(c, s.config.MaxFileSize, s.config.MaxRequestSize)
+	form, err := s.readForm(multipart.NewReader(utils.RequestBody(c), boundary), budget)
 	if err != nil {
+		return nil, s.receiveError(err)
+	}
+
+	if len(form.files) == 0 {
 		return nil, fiber.NewError(400, "No file uploaded")
 	}
 
-	// Check file size
-	if file.Size > s.config.MaxFileSize {
+	// Expected digests are sent as one sha256 field per file, in the same order
+	digests := form.values["sha256"]
+	if len(digests) > 0 && len(digests) != len(form.files) {
+		s.discardFiles(form.files)
+		return nil, fiber.NewError(400, "Invalid sha256: send one value for every file")
+	}
+
+	opts := uploadOptions(c, form.values)
+	results := make([]*models.UploadResponse, 0, len(form.files))
+	for i, file := range form.files {
+		if len(digests) > 0 {
+			opts.SHA256 = digests[i]
+		}
+
+		result, err := s.storeUpload(c, file.name, file.contentType, file.content, opts)
+		if err != nil {
+			s.removeUploads(results)
+			s.discardFiles(form.files[i+1:])
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	if len(results) > 1 {
+		fileIDs := make([]string, 0, len(results))
+		for _, result := range results {
+			fileIDs = append(fileIDs, result.Filename)
+		}
+
+		collection, err := s.collections.Create(fileIDs, "", time.Time{}, time.Now())
+		if err != nil {
+			log.Printf("Error creating collection: %v", err)
+			s.removeUploads(results)
+			return nil, fiber.NewError(500, "Failed to save file")
+		}
+
+		for _, result := range results {
+			result.CollectionID = collection.ID
+			result.CollectionURL = CollectionURL(collection.ID)
+		}
+	}
+
+	return results, nil
+}
+
+// removeUploads removes the files stored so far by a failed upload, so that no
+// partial upload is left behind
+func (s *UploadService) removeUploads(results []*models.UploadResponse) {
+	for _, stored := range results {
+		if err := s.files.Remove(stored.Filename); err != nil {
+			log.Printf("Error removing file %s after a failed upload: %v", stored.Filename, err)
+		}
+	}
+}
+
+// receiveError converts an error receiving uploaded content into the error response
+func (s *UploadService) receiveError(err error) error {
+	switch {
+	case errors.Is(err, ErrFileTooLarge):
+		return fiber.NewError(400, fmt.Sprintf("File size exceeds %s limit", utils.FormatBytes(s.config.MaxFileSize)))
+	case errors.Is(err, ErrRequestTooLarge):
+		return fiber.NewError(400, fmt.Sprintf("Total upload size exceeds %s limit", utils.FormatBytes(s.config.MaxRequestSize)))
+	case errors.Is(err, ErrRateLimited):
+		return fiber.NewError(429, "Rate limit exceeded: the upload is larger than the bytes remaining in the current window")
+	case errors.Is(err, errTooManyFiles):
+		return fiber.NewError(400, fmt.Sprintf("Too many files: at most %d may be uploaded at once", s.config.MaxFilesPerUpload))
+	case errors.Is(err, errFieldsTooLarge):
+		return fiber.NewError(400, "Invalid upload form: the form fields are too large")
+	case errors.Is(err, ErrUploadInterrupted):
+		return fiber.NewError(400, "Upload interrupted: the request body is incomplete or malformed")
+	default:
+		log.Printf("Error receiving upload: %v", err)
+		return fiber.NewError(500, "Failed to save file")
+	}
+}
+
+// ProcessRawUpload handles an upload sent as the raw request body instead of a
+// multipart form, as with curl -T. name is the original filename. The body is
+// streamed to storage as it arrives
+func (s *UploadService) ProcessRawUpload(c *fiber.Ctx, name string) (*models.UploadResponse, error) {
+	size := int64(c.Request().Header.ContentLength())
+	if size == 0 {
+		return nil, fiber.NewError(400, "No file uploaded")
+	}
+	if size > s.config.MaxFileSize {
 		return nil, fiber.NewError(400, fmt.Sprintf("File size exceeds %s limit", utils.FormatBytes(s.config.MaxFileSize)))
 	}
+	// Chunked bodies have no length until they have been received
+	if size < 0 {
+		size = -1
+	}
+
+	// Generic types say nothing about the file, so guess from the name instead
+	contentType := c.Get("Content-Type")
+	if mediaType, _, _ := strings.Cut(contentType, ";"); mediaType == "application/octet-stream" || mediaType == "application/x-www-form-urlencoded" {
+		contentType = ""
+	}
 
-	// Generate filename based on unix timestamp (now + expiry hours) + extension
-	expiryTime := time.Now().Add(time.Duration(s.config.FileExpiryHours) * time.Hour)
-	filename := utils.GenerateFilename(file.Filename, expiryTime)
+	opts := uploadOptions(c, nil)
 
-	// Save file with unix timestamp + extension as filename
-	filePath := filepath.Join(s.config.UploadDir, filename)
-	if err := c.SaveFile(file, filePath); err != nil {
-		log.Printf("Error saving file: %v", err)
+	// The body is the file itself, so its Content-Digest is the file's digest
+	digest, err := utils.ParseContentDigest(c.Get("Content-Digest"))
+	if err != nil {
+		return nil, fiber.NewError(400, "Invalid Content-Digest header: use sha-256=:<base64 digest>:")
+	}
+	opts.SHA256 = digest
+
+	// Invalid options are rejected before the body is read
+	record, deleteToken, err := s.newRecord(c, name, contentType, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	budget := newUploadBudget(c, s.config.MaxFileSize, s.config.MaxRequestSize)
+	content, err := s.files.Stage(record.ID, budget.file(utils.RequestBody(c)), size)
+	if err != nil {
+		return nil, s.receiveError(err)
+	}
+	if content.Size() == 0 {
+		s.files.Discard(content)
+		return nil, fiber.NewError(400, "No file uploaded")
+	}
+
+	return s.commitUpload(c, record, deleteToken, content)
+}
+
+// uploadOptions reads the upload options from the X-Expires-In, X-Max-Downloads
+// and X-File-Password headers, preferring the fields of a form upload
+func uploadOptions(c *fiber.Ctx, fields map[string][]string) UploadOptions {
+	value := func(field, header string) string {
+		if values := fields[field]; len(values) > 0 && values[0] != "" {
+			return values[0]
+		}
+		return c.Get(header)
+	}
+
+	return UploadOptions{
+		ExpiresIn:       value("expires_in", "X-Expires-In"),
+		MaxDownloads:    value("max_downloads", "X-Max-Downloads"),
+		Password:        value("password", "X-File-Password"),
+		ClientEncrypted: parseFlag(value("client_encrypted", "X-Client-Encrypted")),
+	}
+}
+
+// parseFlag reports whether an option value such as 1 or true enables it
+func parseFlag(value string) bool {
+	enabled, _ := strconv.ParseBool(value)
+	return enabled
+}
+
+// storeUpload stores staged upload content with its metadata and builds the
+// upload response. The staged content is used up whether or not this succeeds
+func (s *UploadService) storeUpload(c *fiber.Ctx, originalName, contentType string, content *StagedContent, opts UploadOptions) (*models.UploadResponse, error) {
+	record, deleteToken, err := s.newRecord(c, originalName, contentType, opts)
+	if err != nil {
+		s.files.Discard(content)
+		return nil, err
+	}
+
+	return s.commitUpload(c, record, deleteToken, content)
+}
+
+// newRecord validates the upload options and builds the record of an upload,
+// along with the delete token handed to the uploader
+func (s *UploadService) newRecord(c *fiber.Ctx, originalName, contentType string, opts UploadOptions) (*metadata.Record, string, error) {
+	now := time.Now()
+	expiryTime, err := s.files.ResolveExpiry(opts.ExpiresIn, now)
+	if err != nil {
+		return nil, "", fiber.NewError(400, "Invalid expires_in: use a duration such as 10m, 6h or 3d, or an RFC 3339 time")
+	}
+
+	maxDownloads, err := ParseMaxDownloads(opts.MaxDownloads)
+	if err != nil {
+		return nil, "", fiber.NewError(400, "Invalid max_downloads: use a whole number of at least 1")
+	}
+
+	var expectedDigest string
+	if opts.SHA256 != "" {
+		if expectedDigest, err = utils.ParseSHA256(opts.SHA256); err != nil {
+			return nil, "", fiber.NewError(400, "Invalid sha256: use the hex encoded SHA-256 digest of the file")
+		}
+	}
+
+	var passwordHash string
+	if opts.Password != "" {
+		if passwordHash, err = utils.HashPassword(opts.Password); err != nil {
+			log.Printf("Error hashing password: %v", err)
+			return nil, "", fiber.NewError(500, "Failed to save file")
+		}
+	}
+
+	if err := s.files.CheckName(originalName); err != nil {
+		return nil, "", fiber.NewError(415, "File type not allowed: the extension is not accepted")
+	}
+	if opts.ClientEncrypted {
+		if err := s.files.CheckClientEncrypted(); err != nil {
+			return nil, "", fiber.NewError(415, clientEncryptedNotAllowedMessage)
+		}
+	}
+
+	// Generate filename based on unix timestamp (expiry time) + extension
+	filename := utils.GenerateFilename(originalName, expiryTime)
+
+	// The server cannot know what an encrypted file really is
+	if opts.ClientEncrypted {
+		contentType = ClientEncryptedContentType
+	} else if contentType == "" {
+		contentType = utils.GetContentType(filename)
+	}
+
+	// The uploader gets the delete token once; only its hash is kept
+	deleteToken, err := utils.GenerateToken()
+	if err != nil {
+		log.Printf("Error generating delete token: %v", err)
+		return nil, "", fiber.NewError(500, "Failed to save file")
+	}
+
+	record := &metadata.Record{
+		ID:           filename,
+		OriginalName: utils.SanitizeFilename(originalName),
+		ContentType:  contentType,
+		CreatedAt:    now,
+		ExpiresAt:    expiryTime,
+		SHA256:       expectedDigest,
+		MaxDownloads: maxDownloads,
+		PasswordHash: passwordHash,
+		UploaderIP:   utils.GetClientIP(c, s.ipDetector),
+		UserAgent:    c.Get("User-Agent"),
+
+		ClientEncrypted: opts.ClientEncrypted,
+		DeleteTokenHash: utils.HashToken(deleteToken),
+	}
+
+	return record, deleteToken, nil
+}
+
+// commitUpload creates the file of an upload record from its staged content
+func (s *UploadService) commitUpload(c *fiber.Ctx, record *metadata.Record, deleteToken string, content *StagedContent) (*models.UploadResponse, error) {
+	if err := s.files.Commit(record, content); err != nil {
+		switch {
+		case errors.Is(err, ErrDigestMismatch):
+			return nil, fiber.NewError(400, "Checksum mismatch: the file does not match the expected SHA-256 digest")
+		case errors.Is(err, ErrClientEncryptedNotAllowed):
+			return nil, fiber.NewError(415, clientEncryptedNotAllowedMessage)
+		case errors.Is(err, ErrFileTypeNotAllowed):
+			return nil, fiber.NewError(415, fmt.Sprintf("File type not allowed: the content is %s", record.ContentType))
+		case errors.Is(err, ErrFileTypeMismatch):
+			return nil, fiber.NewError(415, fmt.Sprintf("File type mismatch: the content is %s, which does not match the extension", record.ContentType))
+		case errors.Is(err, ErrMalwareDetected):
+			return nil, fiber.NewError(422, fmt.Sprintf("Malware detected: %s", record.Scan.Signature))
+		case errors.Is(err, ErrScannerUnavailable):
+			log.Printf("Error scanning file %s: %v", record.ID, err)
+			return nil, fiber.NewError(503, "The file could not be scanned for malware, try again later")
+		}
+		log.Printf("Error saving file %s: %v", record.ID, err)
 		return nil, fiber.NewError(500, "Failed to save file")
 	}
 
+	// Let the rate limiter count every stored file and its size
+	sizes, _ := c.Locals("uploaded_file_sizes").([]int64)
+	c.Locals("uploaded_file_sizes", append(sizes, record.Size))
+
+	if record.TypeMismatch {
+		log.Printf("File %s is %s, which does not match its extension (original: %s)", record.ID, record.ContentType, record.OriginalName)
+	}
+
 	if s.config.Debug {
-		log.Printf("File uploaded: %s (original: %s, size: %s)", filename, file.Filename, utils.FormatBytes(file.Size))
+		log.Printf("File uploaded: %s (original: %s, size: %s)", record.ID, record.OriginalName, utils.FormatBytes(record.Size))
 	}
 
-	response := &models.UploadResponse{
+	return s.newUploadResponse(record, deleteToken), nil
+}
+
+// newUploadResponse builds the upload response for a stored file
+func (s *UploadService) newUploadResponse(record *metadata.Record, deleteToken string) *models.UploadResponse {
+	return &models.UploadResponse{
 		Message:      "File uploaded successfully",
-		Filename:     filename,
-		OriginalName: file.Filename,
-		Size:         file.Size,
-		SizeHuman:    utils.FormatBytes(file.Size),
-		ExpiresAt:    expiryTime,
-		ExpiresIn:    fmt.Sprintf("%d hour(s)", s.config.FileExpiryHours),
-		DownloadURL:  fmt.Sprintf("/%s", filename),
+		Filename:     record.ID,
+		OriginalName: record.OriginalName,
+		Size:         record.Size,
+		SizeHuman:    utils.FormatBytes(record.Size),
+		ExpiresAt:    record.ExpiresAt,
+		ExpiresIn:    utils.FormatDuration(record.ExpiresAt.Sub(record.CreatedAt)),
+		SHA256:       record.SHA256,
+		ContentType:  record.ContentType,
+		MaxDownloads: record.MaxDownloads,
+		Protected:    record.PasswordHash != "",
+		DownloadURL:  s.files.DownloadURL(record),
+		DeleteToken:  deleteToken,
+		DeleteURL:    DeleteURL(record.ID, deleteToken),
+
+		ClientEncrypted: record.ClientEncrypted,
+		TypeMismatch:    record.TypeMismatch,
+		ScanStatus:      scanStatus(record),
 	}
+}
+
+// scanStatus returns the status of the malware scan of a file, or an empty
+// string if it was not scanned
+func scanStatus(record *metadata.Record) string {
+	if record.Scan == nil {
+		return ""
+	}
+	return record.Scan.Status
+}
+
+// CollectionURL returns the path of the landing page of a collection
+func CollectionURL(id string) string {
+	return "/c/" + id
+}
 
-	return response, nil
+// DeleteURL returns the path of the page confirming the deletion of a file.
+// The token goes in the fragment, so browsers never send it to the server,
+// proxies or other sites in a Referer
+func DeleteURL(id, deleteToken string) string {
+	return fmt.Sprintf("/%s/delete#token=%s", id, url.QueryEscape(deleteToken))
 }
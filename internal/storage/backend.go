@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"io"
+	"strings"
+	"time"
+)
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+
+	// ETag identifies the version of the object, for backends that are
+	// a ConditionalBackend. It is empty otherwise
+	ETag string `json:"etag,omitempty"`
+}
+
+// Backend interface defines where uploaded files are persisted
+type Backend interface {
+	// Put stores the content read from r under key. size is the expected
+	// content length, or -1 if unknown
+	Put(key string, r io.Reader, size int64) error
+
+	// Get opens the object stored under key for reading
+	Get(key string) (io.ReadCloser, *ObjectInfo, error)
+
+	// GetRange opens length bytes of the object stored under key, starting at offset
+	GetRange(key string, offset, length int64) (io.ReadCloser, error)
+
+	// Stat returns information about the object stored under key
+	Stat(key string) (*ObjectInfo, error)
+
+	// Delete removes the object stored under key
+	Delete(key string) error
+
+	// Move renames the object stored under src to dst, replacing any object
+	// already stored under dst
+	Move(src, dst string) error
+
+	// List returns all objects whose key starts with prefix
+	List(prefix string) ([]ObjectInfo, error)
+}
+
+// ConditionalBackend is implemented by backends that can replace an object
+// only while it is still the version that was read, so that servers sharing
+// the storage never overwrite each other's updates
+type ConditionalBackend interface {
+	Backend
+
+	// PutIfMatch stores the content read from r under key like Put, but only
+	// if the object stored under key still has the given ETag. It fails with
+	// ErrPreconditionFailed if the object changed in the meantime
+	PutIfMatch(key string, r io.Reader, size int64, etag string) error
+
+	// PutIfAbsent stores the content read from r under key like Put, but only
+	// if no object is stored under key yet. It fails with
+	// ErrPreconditionFailed if one was stored in the meantime
+	PutIfAbsent(key string, r io.Reader, size int64) error
+}
+
+// ValidateKey rejects keys that are empty, absolute or escape the storage root
+func ValidateKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return ErrInvalidKey
+	}
+
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return ErrInvalidKey
+		}
+	}
+
+	return nil
+}
+
+// limitedReadCloser reads a section of an object and closes the underlying stream
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
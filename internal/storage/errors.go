@@ -0,0 +1,19 @@
+package storage
+
+import "errors"
+
+// Common storage errors
+var (
+	// ErrNotFound indicates the requested object does not exist
+	ErrNotFound = errors.New("object not found")
+
+	// ErrInvalidKey indicates an object key that is empty or escapes the storage root
+	ErrInvalidKey = errors.New("invalid object key")
+
+	// ErrSizeMismatch indicates fewer or more bytes were stored than announced
+	ErrSizeMismatch = errors.New("stored size does not match expected size")
+
+	// ErrPreconditionFailed indicates a conditional write of an object that
+	// changed since it was read
+	ErrPreconditionFailed = errors.New("object changed since it was read")
+)
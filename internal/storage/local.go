@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// localBackend implements the Backend interface on the local filesystem
+type localBackend struct {
+	root string
+}
+
+// NewLocalBackend creates a storage backend rooted at dir, creating it if needed
+func NewLocalBackend(dir string) (Backend, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	return &localBackend{root: dir}, nil
+}
+
+// Put stores the content read from r under key
+func (b *localBackend) Put(key string, r io.Reader, size int64) error {
+	path, err := b.path(key)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see a partial object
+	tmp, err := b.createTemp(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	written, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write object: %w", err)
+	}
+
+	if size >= 0 && written != size {
+		return ErrSizeMismatch
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to commit object: %w", err)
+	}
+
+	return nil
+}
+
+// createTemp creates a temporary file in dir, creating dir if needed. A
+// concurrent Delete may prune the directory in between, so that is retried once
+func (b *localBackend) createTemp(dir string) (*os.File, error) {
+	for attempt := 0; ; attempt++ {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return nil, fmt.Errorf("failed to create directory: %w", err)
+		}
+
+		tmp, err := os.CreateTemp(dir, ".tmp-*")
+		if err == nil {
+			return tmp, nil
+		}
+		if attempt > 0 || !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to create temporary file: %w", err)
+		}
+	}
+}
+
+// Get opens the object stored under key for reading
+func (b *localBackend) Get(key string) (io.ReadCloser, *ObjectInfo, error) {
+	path, err := b.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(path) // #nosec G304 - Path is validated by b.path
+	if err != nil {
+		return nil, nil, mapError(err)
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, mapError(err)
+	}
+
+	if stat.IsDir() {
+		_ = file.Close()
+		return nil, nil, ErrNotFound
+	}
+
+	return file, &ObjectInfo{Key: key, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+// GetRange opens length bytes of the object stored under key, starting at offset
+func (b *localBackend) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	reader, _, err := b.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file := reader.(*os.File)
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to seek object: %w", err)
+	}
+
+	return &limitedReadCloser{Reader: io.LimitReader(file, length), Closer: file}, nil
+}
+
+// Stat returns information about the object stored under key
+func (b *localBackend) Stat(key string) (*ObjectInfo, error) {
+	path, err := b.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, mapError(err)
+	}
+
+	if stat.IsDir() {
+		return nil, ErrNotFound
+	}
+
+	return &ObjectInfo{Key: key, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+// Delete removes the object stored under key
+func (b *localBackend) Delete(key string) error {
+	path, err := b.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return mapError(err)
+	}
+
+	// Prune directories left empty by nested keys, stopping at the first non-empty one
+	root := filepath.Clean(b.root)
+	for dir := filepath.Dir(path); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Move renames the object stored under src to dst
+func (b *localBackend) Move(src, dst string) error {
+	srcPath, err := b.path(src)
+	if err != nil {
+		return err
+	}
+	dstPath, err := b.path(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(srcPath); err != nil {
+		return mapError(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0750); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	if err := os.Rename(srcPath, dstPath); err != nil {
+		return fmt.Errorf("failed to move object: %w", err)
+	}
+
+	return nil
+}
+
+// List returns all objects whose key starts with prefix
+func (b *localBackend) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	err := filepath.WalkDir(b.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		// Skip in-flight temporary files
+		if strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(b.root, path)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			// File disappeared while walking
+			return nil
+		}
+
+		objects = append(objects, ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	return objects, nil
+}
+
+// path converts an object key into a filesystem path inside the root
+func (b *localBackend) path(key string) (string, error) {
+	if err := ValidateKey(key); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(b.root, filepath.FromSlash(key)), nil
+}
+
+// mapError converts filesystem errors into storage errors
+func mapError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalBackend_PutGet(t *testing.T) {
+	backend, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+
+	content := "hello, world"
+	if err := backend.Put("file_123.txt", strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	reader, info, err := backend.Get("file_123.txt")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if string(data) != content {
+		t.Errorf("Get() content = %q, want %q", data, content)
+	}
+	if info.Size != int64(len(content)) {
+		t.Errorf("Get() size = %v, want %v", info.Size, len(content))
+	}
+}
+
+func TestLocalBackend_GetRange(t *testing.T) {
+	backend, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+
+	content := "0123456789"
+	if err := backend.Put("digits.txt", strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	tests := []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, 10, "0123456789"},
+		{3, 4, "3456"},
+		{8, 5, "89"},
+	}
+
+	for _, tt := range tests {
+		reader, err := backend.GetRange("digits.txt", tt.offset, tt.length)
+		if err != nil {
+			t.Fatalf("GetRange(%d, %d) error = %v", tt.offset, tt.length, err)
+		}
+		data, _ := io.ReadAll(reader)
+		reader.Close()
+		if string(data) != tt.want {
+			t.Errorf("GetRange(%d, %d) = %q, want %q", tt.offset, tt.length, data, tt.want)
+		}
+	}
+}
+
+func TestLocalBackend_SizeMismatch(t *testing.T) {
+	backend, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+
+	err = backend.Put("short.txt", strings.NewReader("abc"), 10)
+	if !errors.Is(err, ErrSizeMismatch) {
+		t.Errorf("Put() error = %v, want %v", err, ErrSizeMismatch)
+	}
+
+	// Nothing should have been committed
+	if _, err := backend.Stat("short.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat() error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestLocalBackend_StatDelete(t *testing.T) {
+	backend, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+
+	if _, err := backend.Stat("missing.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat() error = %v, want %v", err, ErrNotFound)
+	}
+
+	if err := backend.Put("a.txt", strings.NewReader("a"), -1); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	info, err := backend.Stat("a.txt")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if info.Size != 1 {
+		t.Errorf("Stat() size = %v, want 1", info.Size)
+	}
+
+	if err := backend.Delete("a.txt"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	if err := backend.Delete("a.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete() error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestLocalBackend_Move(t *testing.T) {
+	backend, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+
+	if err := backend.Put("a.txt", strings.NewReader("content"), -1); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	if err := backend.Move("a.txt", "blobs/abc"); err != nil {
+		t.Fatalf("Move() error = %v", err)
+	}
+	if _, err := backend.Stat("a.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat() of the source error = %v, want %v", err, ErrNotFound)
+	}
+
+	reader, _, err := backend.Get("blobs/abc")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	data, _ := io.ReadAll(reader)
+	reader.Close()
+	if string(data) != "content" {
+		t.Errorf("moved content = %q, want %q", data, "content")
+	}
+
+	if err := backend.Move("missing.txt", "blobs/def"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Move() of a missing object error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestLocalBackend_List(t *testing.T) {
+	backend, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+
+	for _, key := range []string{"a.txt", "b.txt", "nested/c.txt"} {
+		if err := backend.Put(key, strings.NewReader(key), -1); err != nil {
+			t.Fatalf("Put(%s) error = %v", key, err)
+		}
+	}
+
+	objects, err := backend.List("")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(objects) != 3 {
+		t.Errorf("List() returned %d objects, want 3", len(objects))
+	}
+
+	objects, err = backend.List("nested/")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(objects) != 1 || objects[0].Key != "nested/c.txt" {
+		t.Errorf("List(nested/) = %v, want [nested/c.txt]", objects)
+	}
+}
+
+func TestLocalBackend_DeletePrunesDirectories(t *testing.T) {
+	root := t.TempDir()
+	backend, err := NewLocalBackend(root)
+	if err != nil {
+		t.Fatalf("NewLocalBackend() error = %v", err)
+	}
+
+	for _, key := range []string{"a/b/one.txt", "a/two.txt"} {
+		if err := backend.Put(key, strings.NewReader(key), -1); err != nil {
+			t.Fatalf("Put(%s) error = %v", key, err)
+		}
+	}
+
+	// a/b becomes empty and is removed; a still holds two.txt
+	if err := backend.Delete("a/b/one.txt"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a", "b")); !os.IsNotExist(err) {
+		t.Errorf("Stat(a/b) error = %v, want not exist", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a")); err != nil {
+		t.Errorf("Stat(a) error = %v, want nil", err)
+	}
+
+	// The root itself is never removed
+	if err := backend.Delete("a/two.txt"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := os.Stat(root); err != nil {
+		t.Errorf("Stat(root) error = %v, want nil", err)
+	}
+}
+
+func TestValidateKey(t *testing.T) {
+	tests := []struct {
+		key     string
+		wantErr bool
+	}{
+		{"file.txt", false},
+		{"nested/file.txt", false},
+		{"", true},
+		{"/etc/passwd", true},
+		{"../secret", true},
+		{"a/../../b", true},
+		{"a//b", true},
+		{"a\\b", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			err := ValidateKey(tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateKey(%q) error = %v, wantErr %v", tt.key, err, tt.wantErr)
+			}
+		})
+	}
+}
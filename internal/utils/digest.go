@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// ErrInvalidDigest indicates a checksum that is not a well-formed SHA-256 digest
+var ErrInvalidDigest = errors.New("invalid digest")
+
+// ParseSHA256 validates a hex encoded SHA-256 digest and returns it in lower case
+func ParseSHA256(value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if len(value) != 64 {
+		return "", ErrInvalidDigest
+	}
+	if _, err := hex.DecodeString(value); err != nil {
+		return "", ErrInvalidDigest
+	}
+
+	return value, nil
+}
+
+// ParseContentDigest returns the hex encoded SHA-256 digest from an RFC 9530
+// Content-Digest header such as "sha-256=:<base64>:", or "" if the header
+// carries no SHA-256 digest. Other algorithms are ignored
+func ParseContentDigest(header string) (string, error) {
+	for _, member := range strings.Split(header, ",") {
+		algorithm, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(algorithm), "sha-256") {
+			continue
+		}
+
+		value = strings.TrimSpace(value)
+		if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+			return "", ErrInvalidDigest
+		}
+
+		sum, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+		if err != nil || len(sum) != 32 {
+			return "", ErrInvalidDigest
+		}
+
+		return hex.EncodeToString(sum), nil
+	}
+
+	return "", nil
+}
+
+// DigestBase64 re-encodes a hex encoded digest in base64, as used by the
+// Repr-Digest and Digest headers
+func DigestBase64(hexDigest string) string {
+	sum, err := hex.DecodeString(hexDigest)
+	if err != nil {
+		return ""
+	}
+
+	return base64.StdEncoding.EncodeToString(sum)
+}
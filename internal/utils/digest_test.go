@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+// helloSHA256 is the SHA-256 digest of "hello"
+const helloSHA256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+func TestParseContentDigest(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    string
+		wantErr bool
+	}{
+		{"SHA256", "sha-256=:LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=:", helloSHA256, false},
+		{"AmongOthers", "sha-512=:abc=:, SHA-256=:LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=:", helloSHA256, false},
+		{"OtherAlgorithm", "sha-512=:abc=:", "", false},
+		{"Empty", "", "", false},
+		{"NotBase64", "sha-256=:not base64:", "", true},
+		{"WrongLength", "sha-256=:aGVsbG8=:", "", true},
+		{"Unwrapped", "sha-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseContentDigest(tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseContentDigest(%q) error = %v, wantErr %v", tt.header, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseContentDigest(%q) = %q, want %q", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSHA256(t *testing.T) {
+	if got, err := ParseSHA256(" 2CF24DBA5FB0A30E26E83B2AC5B9E29E1B161E5C1FA7425E73043362938B9824 "); err != nil || got != helloSHA256 {
+		t.Errorf("ParseSHA256() = %q, %v, want %q", got, err, helloSHA256)
+	}
+
+	for _, value := range []string{"", "abc", helloSHA256[:63] + "z"} {
+		if _, err := ParseSHA256(value); !errors.Is(err, ErrInvalidDigest) {
+			t.Errorf("ParseSHA256(%q) error = %v, want %v", value, err, ErrInvalidDigest)
+		}
+	}
+}
+
+func TestDigestBase64(t *testing.T) {
+	if got := DigestBase64(helloSHA256); got != "LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=" {
+		t.Errorf("DigestBase64() = %q", got)
+	}
+}
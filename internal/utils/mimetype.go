@@ -0,0 +1,203 @@
+package utils
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// SniffLen is how much of the start of some content DetectContentType looks at
+const SniffLen = 512
+
+// Types of executables, which http.DetectContentType does not tell apart from
+// other binary content
+const (
+	TypePE     = "application/vnd.microsoft.portable-executable"
+	TypeELF    = "application/x-executable"
+	TypeMachO  = "application/x-mach-binary"
+	typeScript = "text/x-shellscript"
+	typeBinary = "application/octet-stream"
+	typeText   = "text/plain"
+)
+
+// machOMagics are the magic numbers of 32 and 64 bit Mach-O binaries in either byte order
+var machOMagics = [][]byte{
+	{0xfe, 0xed, 0xfa, 0xce}, {0xfe, 0xed, 0xfa, 0xcf},
+	{0xce, 0xfa, 0xed, 0xfe}, {0xcf, 0xfa, 0xed, 0xfe},
+}
+
+// typeAliases map the names some systems give to a type to the one
+// DetectContentType uses
+var typeAliases = map[string]string{
+	"application/x-gzip":              "application/gzip",
+	"application/x-zip-compressed":    "application/zip",
+	"application/x-rar-compressed":    "application/vnd.rar",
+	"application/x-pdf":               "application/pdf",
+	"application/javascript":          "text/javascript",
+	"application/x-javascript":        "text/javascript",
+	"application/x-font-ttf":          "font/ttf",
+	"application/x-font-truetype":     "font/ttf",
+	"application/x-font-otf":          "font/otf",
+	"application/x-font-opentype":     "font/otf",
+	"application/font-woff":           "font/woff",
+	"application/x-font-woff":         "font/woff",
+	"application/font-woff2":          "font/woff2",
+	"application/x-msdownload":        TypePE,
+	"application/x-msdos-program":     TypePE,
+	"application/x-dosexec":           TypePE,
+	"application/x-sharedlib":         TypeELF,
+	"application/x-elf":               TypeELF,
+	"application/x-sh":                typeScript,
+	"application/x-shellscript":       typeScript,
+	"application/vnd.microsoft.icon":  "image/x-icon",
+	"image/vnd.microsoft.icon":        "image/x-icon",
+	"application/x-mach-o-executable": TypeMachO,
+}
+
+// DetectContentType returns the MIME type of content from its first bytes,
+// like http.DetectContentType but also recognizing executables. It returns
+// application/octet-stream if the type cannot be told
+func DetectContentType(head []byte) string {
+	if len(head) > SniffLen {
+		head = head[:SniffLen]
+	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte("MZ")):
+		return TypePE
+	case bytes.HasPrefix(head, []byte("\x7fELF")):
+		return TypeELF
+	case bytes.HasPrefix(head, []byte("#!")):
+		return typeScript
+	}
+	for _, magic := range machOMagics {
+		if bytes.HasPrefix(head, magic) {
+			return TypeMachO
+		}
+	}
+
+	return http.DetectContentType(head)
+}
+
+// ContentTypesAgree reports whether content detected as detected may be what
+// a file's extension says it is, claimed. Types that say nothing, such as
+// application/octet-stream, agree with anything, and so do the containers
+// and text that many formats are made of
+func ContentTypesAgree(claimed, detected string) bool {
+	claimed, detected = canonicalType(claimed), canonicalType(detected)
+
+	switch {
+	case claimed == detected, claimed == typeBinary, detected == typeBinary:
+		return true
+	case detected == typeText:
+		return !isBinaryType(claimed)
+	case detected == "text/xml":
+		return claimed == "application/xml" || strings.HasSuffix(claimed, "+xml")
+	case detected == "text/html":
+		return claimed == "application/xhtml+xml"
+	case detected == "application/zip":
+		// Office documents, Java archives, e-books and more are zip files
+		return strings.HasPrefix(claimed, "application/") && claimed != "application/pdf"
+	}
+
+	// Image formats are told apart by browsers anyway, and audio and video
+	// share container formats
+	family := func(t string) string {
+		switch {
+		case strings.HasPrefix(t, "image/") && !strings.HasSuffix(t, "+xml"):
+			return "image"
+		case strings.HasPrefix(t, "audio/"), strings.HasPrefix(t, "video/"), t == "application/ogg":
+			return "media"
+		}
+		return t
+	}
+
+	return family(claimed) == family(detected)
+}
+
+// IsGenericType reports whether DetectContentType detecting contentType only
+// tells what content is made of, such as text or a zip file, rather than its
+// format
+func IsGenericType(contentType string) bool {
+	switch canonicalType(contentType) {
+	case typeBinary, typeText, "text/xml", "application/zip":
+		return true
+	}
+	return false
+}
+
+// MatchesContentType reports whether a MIME type matches one of patterns,
+// which are types such as image/png or wildcards such as image/*. Names of
+// the same type on different systems match each other
+func MatchesContentType(contentType string, patterns []string) bool {
+	contentType = canonicalType(contentType)
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		switch {
+		case pattern == "":
+			continue
+		case pattern == "*/*", strings.HasSuffix(pattern, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(pattern, "*")):
+			return true
+		case canonicalType(pattern) == contentType:
+			return true
+		}
+	}
+
+	return false
+}
+
+// MatchesExtension reports whether the extension of filename is one of
+// extensions, given with or without their leading dot
+func MatchesExtension(filename string, extensions []string) bool {
+	ext := strings.ToLower(GetFileExtension(filename))
+	if ext == "" {
+		return false
+	}
+
+	for _, candidate := range extensions {
+		candidate = strings.ToLower(strings.TrimSpace(candidate))
+		if candidate != "" && "."+strings.TrimPrefix(candidate, ".") == ext {
+			return true
+		}
+	}
+
+	return false
+}
+
+// canonicalType returns the media type of a MIME type without parameters,
+// under the name DetectContentType uses for it
+func canonicalType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return typeBinary
+	}
+	if alias, ok := typeAliases[mediaType]; ok {
+		return alias
+	}
+	return mediaType
+}
+
+// isBinaryType reports whether a type is a binary format that text content
+// cannot be
+func isBinaryType(t string) bool {
+	switch {
+	case strings.HasPrefix(t, "image/"):
+		return !strings.HasSuffix(t, "+xml")
+	case strings.HasPrefix(t, "audio/"), strings.HasPrefix(t, "video/"), strings.HasPrefix(t, "font/"),
+		strings.HasPrefix(t, "application/vnd.ms-"), strings.HasPrefix(t, "application/vnd.openxmlformats-"),
+		strings.HasPrefix(t, "application/vnd.oasis.opendocument."):
+		return true
+	}
+
+	switch t {
+	case "application/pdf", "application/zip", "application/gzip", "application/vnd.rar",
+		"application/x-7z-compressed", "application/x-tar", "application/x-bzip2", "application/x-xz",
+		"application/wasm", "application/msword", "application/java-archive", "application/ogg",
+		TypePE, TypeELF, TypeMachO:
+		return true
+	}
+
+	return false
+}
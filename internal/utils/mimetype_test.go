@@ -0,0 +1,121 @@
+package utils
+
+import "testing"
+
+func TestDetectContentType(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"PE", "MZ\x90\x00\x03\x00\x00\x00", TypePE},
+		{"ELF", "\x7fELF\x02\x01\x01\x00", TypeELF},
+		{"MachO", "\xcf\xfa\xed\xfe\x07\x00\x00\x01", TypeMachO},
+		{"Script", "#!/bin/sh\nrm -rf /\n", "text/x-shellscript"},
+		{"PNG", "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", "image/png"},
+		{"PDF", "%PDF-1.7\n", "application/pdf"},
+		{"HTML", "<!DOCTYPE html><html>", "text/html; charset=utf-8"},
+		{"Text", "hello world\n", "text/plain; charset=utf-8"},
+		{"Unknown", "\x00\x01\x02\x03\xff", "application/octet-stream"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectContentType([]byte(tt.content)); got != tt.want {
+				t.Errorf("DetectContentType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentTypesAgree(t *testing.T) {
+	tests := []struct {
+		claimed  string
+		detected string
+		want     bool
+	}{
+		{"image/png", "image/png", true},
+		{"image/jpeg", "image/png", true},
+		{"audio/mp4", "video/mp4", true},
+		{"application/json", "text/plain; charset=utf-8", true},
+		{"text/csv; charset=utf-8", "text/plain; charset=utf-8", true},
+		{"image/svg+xml", "text/xml; charset=utf-8", true},
+		{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", "application/zip", true},
+		{"application/x-msdos-program", TypePE, true},
+		{"application/x-gzip", "application/gzip", true},
+		{"application/octet-stream", TypeELF, true},
+		{"image/jpeg", "application/octet-stream", true},
+		{"image/jpeg", TypePE, false},
+		{"image/png", "text/html; charset=utf-8", false},
+		{"text/plain; charset=utf-8", "text/html; charset=utf-8", false},
+		{"application/pdf", "text/plain; charset=utf-8", false},
+		{"application/pdf", "application/zip", false},
+		{"image/gif", "application/pdf", false},
+	}
+
+	for _, tt := range tests {
+		if got := ContentTypesAgree(tt.claimed, tt.detected); got != tt.want {
+			t.Errorf("ContentTypesAgree(%q, %q) = %v, want %v", tt.claimed, tt.detected, got, tt.want)
+		}
+	}
+}
+
+func TestIsGenericType(t *testing.T) {
+	tests := map[string]bool{
+		"application/octet-stream":  true,
+		"text/plain; charset=utf-8": true,
+		"application/zip":           true,
+		"image/png":                 false,
+		TypePE:                      false,
+	}
+
+	for contentType, want := range tests {
+		if got := IsGenericType(contentType); got != want {
+			t.Errorf("IsGenericType(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
+
+func TestMatchesContentType(t *testing.T) {
+	patterns := []string{"image/*", " application/x-msdownload", "text/plain"}
+
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"image/png", true},
+		{TypePE, true},
+		{"text/plain; charset=utf-8", true},
+		{"text/html; charset=utf-8", false},
+		{"application/zip", false},
+	}
+
+	for _, tt := range tests {
+		if got := MatchesContentType(tt.contentType, patterns); got != tt.want {
+			t.Errorf("MatchesContentType(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestMatchesExtension(t *testing.T) {
+	extensions := []string{".exe", "DLL", " .scr"}
+
+	tests := []struct {
+		filename string
+		want     bool
+	}{
+		{"setup.exe", true},
+		{"SETUP.EXE", true},
+		{"library.dll", true},
+		{"screen.scr", true},
+		{"exe", false},
+		{"notes.txt", false},
+		{"archive.exe.zip", false},
+	}
+
+	for _, tt := range tests {
+		if got := MatchesExtension(tt.filename, extensions); got != tt.want {
+			t.Errorf("MatchesExtension(%q) = %v, want %v", tt.filename, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatalf("HashPassword() error = %v", err)
+	}
+
+	if !strings.HasPrefix(hash, "$argon2id$v=19$") {
+		t.Errorf("hash = %q, want an argon2id PHC string", hash)
+	}
+	if strings.Contains(hash, "correct horse") {
+		t.Error("hash contains the plaintext password")
+	}
+
+	other, _ := HashPassword("correct horse")
+	if other == hash {
+		t.Error("hashing the same password twice gave the same hash, want a random salt")
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatalf("HashPassword() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		encoded  string
+		password string
+		want     bool
+	}{
+		{"Match", hash, "correct horse", true},
+		{"WrongPassword", hash, "battery staple", false},
+		{"Empty", hash, "", false},
+		{"Malformed", "$argon2id$v=19$garbage", "correct horse", false},
+		{"OtherAlgorithm", strings.Replace(hash, "argon2id", "argon2i", 1), "correct horse", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VerifyPassword(tt.encoded, tt.password); got != tt.want {
+				t.Errorf("VerifyPassword() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package utils
+
+import "testing"
+
+func TestTokenMatches(t *testing.T) {
+	token, err := GenerateToken()
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	if len(token) != 43 {
+		t.Errorf("len(token) = %d, want 43", len(token))
+	}
+
+	hash := HashToken(token)
+	if !TokenMatches(hash, token) {
+		t.Error("TokenMatches() = false for the generated token")
+	}
+	if TokenMatches(hash, token+"x") {
+		t.Error("TokenMatches() = true for a different token")
+	}
+	if TokenMatches("", "") {
+		t.Error("TokenMatches() = true for an empty hash")
+	}
+}
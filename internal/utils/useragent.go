@@ -0,0 +1,23 @@
+package utils
+
+import "strings"
+
+// botUserAgents are parts of the user agents of crawlers, link previews of
+// chat apps and social networks, and link scanners
+var botUserAgents = []string{
+	"bot", "crawler", "spider", "slurp", "preview", "scanner",
+	"facebookexternalhit", "facebookcatalog", "whatsapp", "slack-imgproxy",
+	"embedly", "iframely", "vkshare", "pinterest", "mastodon", "google-pagerenderer",
+}
+
+// IsBot reports whether a user agent belongs to an automated client that
+// fetches links on its own, such as a crawler or a chat app unfurling a link
+func IsBot(userAgent string) bool {
+	userAgent = strings.ToLower(userAgent)
+	for _, bot := range botUserAgents {
+		if strings.Contains(userAgent, bot) {
+			return true
+		}
+	}
+	return false
+}
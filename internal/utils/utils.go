@@ -1,12 +1,23 @@
 package utils
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"mime"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
+	"github.com/pandeptwidyaop/tempfile/internal/ratelimit"
 )
 
 // FormatBytes converts bytes to human readable format
@@ -39,6 +50,26 @@ func GetBaseURL(c *fiber.Ctx, publicURL string) string {
 	return fmt.Sprintf("%s://%s", scheme, c.Get("Host"))
 }
 
+// GetClientIP returns the real client IP, honoring proxy headers from trusted proxies only
+func GetClientIP(c *fiber.Ctx, ipDetector ratelimit.IPDetector) string {
+	headers := make(map[string]string)
+	c.Request().Header.VisitAll(func(key, value []byte) {
+		headers[string(key)] = string(value)
+	})
+
+	return ipDetector.GetRealIP(headers, c.Context().RemoteAddr().String())
+}
+
+// RequestBody returns a reader of the request body. With the request body
+// streamed it reads from the connection as it is consumed, so that a large
+// body is never held in memory
+func RequestBody(c *fiber.Ctx) io.Reader {
+	if stream := c.Context().RequestBodyStream(); stream != nil {
+		return stream
+	}
+	return bytes.NewReader(c.Body())
+}
+
 // GenerateFilename generates a filename based on expiry time and extension
 func GenerateFilename(originalFilename string, expiryTime time.Time) string {
 	// Get extension from original file
@@ -65,6 +96,34 @@ func GetFileExtension(filename string) string {
 	return ""
 }
 
+// GetContentType returns the MIME type for a filename based on its extension
+func GetContentType(filename string) string {
+	if contentType := mime.TypeByExtension(GetFileExtension(filename)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// IsActiveContent reports whether browsers may run content of the given MIME
+// type as a document with scripts, as they do with HTML, SVG and XML
+func IsActiveContent(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// What a browser makes of a malformed type is anyone's guess
+		return true
+	}
+
+	switch mediaType {
+	case "text/html", "application/xhtml+xml", "image/svg+xml",
+		"text/xml", "application/xml", "text/xsl", "application/xslt+xml",
+		"text/javascript", "application/javascript", "application/ecmascript",
+		"application/x-shockwave-flash", "multipart/x-mixed-replace":
+		return true
+	}
+
+	return strings.HasSuffix(mediaType, "+xml")
+}
+
 // ParseTimestampFromFilename extracts unix timestamp from filename
 func ParseTimestampFromFilename(filename string) (int64, error) {
 	// Remove filename uuid prefix
@@ -91,7 +150,9 @@ func ParseTimestampFromFilename(filename string) (int64, error) {
 	return timestamp, nil
 }
 
-// IsFileExpired checks if a file has expired based on its filename
+// IsFileExpired checks if a file has expired based on its filename. The name
+// only records the expiry at upload time, so this is only authoritative for
+// files without a metadata record, whose expiry can never change
 func IsFileExpired(filename string, currentTime time.Time) (bool, error) {
 	timestamp, err := ParseTimestampFromFilename(filename)
 	if err != nil {
@@ -101,3 +162,143 @@ func IsFileExpired(filename string, currentTime time.Time) (bool, error) {
 	expiryTime := time.Unix(timestamp, 0)
 	return currentTime.After(expiryTime), nil
 }
+
+// durationUnits maps the units accepted by ParseDuration to their length
+var durationUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+}
+
+// durationTerm matches one number and unit at the start of a duration
+var durationTerm = regexp.MustCompile(`^(\d+(?:\.\d+)?)([smhdw])`)
+
+// ParseDuration parses a duration such as "10m", "6h", "3d" or "1d12h". Unlike
+// time.ParseDuration it accepts days and weeks, and it rejects negative values
+func ParseDuration(value string) (time.Duration, error) {
+	rest := strings.ToLower(strings.TrimSpace(value))
+	if rest == "" {
+		return 0, errors.New("empty duration")
+	}
+
+	var total float64
+	for rest != "" {
+		match := durationTerm.FindStringSubmatch(rest)
+		if match == nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+
+		n, err := strconv.ParseFloat(match[1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		total += n * float64(durationUnits[match[2]])
+		rest = rest[len(match[0]):]
+	}
+
+	if total >= math.MaxInt64 {
+		return 0, fmt.Errorf("duration %q is too long", value)
+	}
+
+	return time.Duration(total), nil
+}
+
+// FormatDuration converts a duration to human readable format such as
+// "1 day 6 hours", rounded to the minute
+func FormatDuration(d time.Duration) string {
+	if d < time.Minute {
+		return pluralize(int64(d.Round(time.Second)/time.Second), "second")
+	}
+
+	d = d.Round(time.Minute)
+	days := int64(d / (24 * time.Hour))
+	hours := int64(d % (24 * time.Hour) / time.Hour)
+	minutes := int64(d % time.Hour / time.Minute)
+
+	var parts []string
+	if days > 0 {
+		parts = append(parts, pluralize(days, "day"))
+	}
+	if hours > 0 {
+		parts = append(parts, pluralize(hours, "hour"))
+	}
+	if minutes > 0 {
+		parts = append(parts, pluralize(minutes, "minute"))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// pluralize formats a count with its unit, adding an "s" unless the count is one
+func pluralize(n int64, unit string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, unit)
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// SanitizeFilename strips path components, control characters and other
+// unsafe characters from a client-supplied filename
+func SanitizeFilename(filename string) string {
+	// Drop any directory part, whichever separator the client used
+	filename = strings.ReplaceAll(filename, "\\", "/")
+	filename = path.Base(filename)
+
+	filename = strings.Map(func(r rune) rune {
+		if r == utf8.RuneError || unicode.IsControl(r) || r == '"' || r == '/' {
+			return -1
+		}
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+		return r
+	}, filename)
+
+	filename = strings.Trim(strings.TrimSpace(filename), ".")
+
+	// Keep names within common filesystem limits
+	for len(filename) > 255 {
+		_, size := utf8.DecodeLastRuneInString(filename)
+		filename = filename[:len(filename)-size]
+	}
+
+	if filename == "" {
+		return "download"
+	}
+	return filename
+}
+
+// ContentDisposition builds an RFC 6266 Content-Disposition header value with
+// an ASCII fallback filename and an RFC 5987 encoded UTF-8 filename
+func ContentDisposition(dispositionType, filename string) string {
+	filename = SanitizeFilename(filename)
+
+	// ASCII fallback for clients without RFC 5987 support
+	fallback := strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII || r == '\\' || r == '%' || r == ';' {
+			return '_'
+		}
+		return r
+	}, filename)
+
+	var encoded strings.Builder
+	for _, b := range []byte(filename) {
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+
+	return fmt.Sprintf("%s; filename=\"%s\"; filename*=UTF-8''%s", dispositionType, fallback, encoded.String())
+}
+
+// isAttrChar reports whether b may appear unencoded in an RFC 5987 value
+func isAttrChar(b byte) bool {
+	if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') {
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
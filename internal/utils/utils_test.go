@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		want     string
+	}{
+		{"Plain", "quarterly-report.pdf", "quarterly-report.pdf"},
+		{"UnixPath", "../../etc/passwd", "passwd"},
+		{"WindowsPath", "C:\\Users\\me\\report.pdf", "report.pdf"},
+		{"Quotes", "a\"b.txt", "ab.txt"},
+		{"ControlChars", "a\r\nb\x00.txt", "ab.txt"},
+		{"Tabs", "a\tb.txt", "ab.txt"},
+		{"UnicodeSpace", "a\u00a0b.txt", "a b.txt"},
+		{"Unicode", "résumé 日本.pdf", "résumé 日本.pdf"},
+		{"DotsOnly", "..", "download"},
+		{"Empty", "", "download"},
+		{"HiddenFile", ".env", "env"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SanitizeFilename(tt.filename); got != tt.want {
+				t.Errorf("SanitizeFilename(%q) = %q, want %q", tt.filename, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		name            string
+		dispositionType string
+		filename        string
+		want            string
+	}{
+		{
+			"ASCII",
+			"attachment", "quarterly-report.pdf",
+			`attachment; filename="quarterly-report.pdf"; filename*=UTF-8''quarterly-report.pdf`,
+		},
+		{
+			"Spaces",
+			"inline", "my file.txt",
+			`inline; filename="my file.txt"; filename*=UTF-8''my%20file.txt`,
+		},
+		{
+			"NonASCII",
+			"attachment", "résumé.pdf",
+			`attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`,
+		},
+		{
+			"HeaderInjection",
+			"attachment", "evil\"; filename=x.exe\r\nSet-Cookie: a=b",
+			`attachment; filename="evil_ filename=x.exeSet-Cookie: a=b"; filename*=UTF-8''evil%3B%20filename%3Dx.exeSet-Cookie%3A%20a%3Db`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ContentDisposition(tt.dispositionType, tt.filename); got != tt.want {
+				t.Errorf("ContentDisposition() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsActiveContent(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"text/html; charset=utf-8", true},
+		{"TEXT/HTML", true},
+		{"image/svg+xml", true},
+		{"application/xml", true},
+		{"text/xml; charset=utf-8", true},
+		{"application/atom+xml", true},
+		{"application/xhtml+xml", true},
+		{"text/javascript", true},
+		{"text/html;;", true},
+		{"text/plain; charset=utf-8", false},
+		{"image/png", false},
+		{"application/pdf", false},
+		{"application/octet-stream", false},
+		{"video/mp4", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsActiveContent(tt.contentType); got != tt.want {
+			t.Errorf("IsActiveContent(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"10m", 10 * time.Minute, false},
+		{"6h", 6 * time.Hour, false},
+		{"3d", 72 * time.Hour, false},
+		{"1w", 168 * time.Hour, false},
+		{"1d12h", 36 * time.Hour, false},
+		{"1.5h", 90 * time.Minute, false},
+		{" 30S ", 30 * time.Second, false},
+		{"", 0, true},
+		{"10", 0, true},
+		{"-5m", 0, true},
+		{"5x", 0, true},
+		{"1h garbage", 0, true},
+		{"99999999999w", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseDuration(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseDuration(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseDuration(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{time.Hour, "1 hour"},
+		{10 * time.Minute, "10 minutes"},
+		{72 * time.Hour, "3 days"},
+		{30*time.Hour + time.Minute, "1 day 6 hours 1 minute"},
+		{2*time.Hour + 29*time.Second, "2 hours"},
+		{45 * time.Second, "45 seconds"},
+	}
+
+	for _, tt := range tests {
+		if got := FormatDuration(tt.d); got != tt.want {
+			t.Errorf("FormatDuration(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
@@ -10,6 +10,7 @@ class TempFilesUI {
         this.progressText = document.querySelector('.progress-text');
         this.fileInfo = document.querySelector('.file-info');
         this.alertContainer = document.querySelector('.alert');
+        this.clientEncrypt = document.getElementById('clientEncrypt');
         
         // Read max file size from data attribute, fallback to 100MB
         const uploadAreaEl = document.getElementById('uploadArea');
@@ -17,7 +18,14 @@ class TempFilesUI {
             ? parseInt(uploadAreaEl.dataset.maxFileSize, 10) 
             : 100 * 1024 * 1024;
         this.maxFileSizeHuman = uploadAreaEl?.dataset.maxFileSizeHuman || '100.0 MB';
-        this.selectedFile = null;
+        this.maxFiles = uploadAreaEl?.dataset.maxFiles
+            ? parseInt(uploadAreaEl.dataset.maxFiles, 10)
+            : 1;
+        this.maxRequestSize = uploadAreaEl?.dataset.maxRequestSize
+            ? parseInt(uploadAreaEl.dataset.maxRequestSize, 10)
+            : this.maxFileSize;
+        this.maxRequestSizeHuman = uploadAreaEl?.dataset.maxRequestSizeHuman || this.maxFileSizeHuman;
+        this.selectedFiles = [];
         
         this.init();
     }
@@ -31,7 +39,7 @@ class TempFilesUI {
     setupEventListeners() {
         // File input change
         this.fileInput?.addEventListener('change', (e) => {
-            this.handleFileSelect(e.target.files[0]);
+            this.handleFileSelect(e.target.files);
         });
         
         // Upload area click
@@ -41,16 +49,23 @@ class TempFilesUI {
         
         // Form submit
         this.uploadForm?.addEventListener('submit', (e) => {
-            if (!this.selectedFile) {
+            if (this.selectedFiles.length === 0) {
                 e.preventDefault();
                 this.showAlert('Please select a file first', 'error');
                 return;
             }
             
-            // Ensure the file input has the selected file
-            if (this.fileInput && this.selectedFile) {
+            // Encrypted uploads are sent by script, after encrypting every file
+            if (this.clientEncrypt?.checked) {
+                e.preventDefault();
+                this.uploadEncrypted();
+                return;
+            }
+            
+            // Ensure the file input has the selected files
+            if (this.fileInput) {
                 const dt = new DataTransfer();
-                dt.items.add(this.selectedFile);
+                this.selectedFiles.forEach(file => dt.items.add(file));
                 this.fileInput.files = dt.files;
             }
             
@@ -199,7 +214,7 @@ class TempFilesUI {
         this.uploadArea.addEventListener('drop', (e) => {
             const files = e.dataTransfer.files;
             if (files.length > 0) {
-                this.handleFileSelect(files[0]);
+                this.handleFileSelect(files);
             }
         }, false);
     }
@@ -209,28 +224,44 @@ class TempFilesUI {
         e.stopPropagation();
     }
     
-    handleFileSelect(file) {
-        if (!file) return;
+    handleFileSelect(fileList) {
+        const files = Array.from(fileList || []);
+        if (files.length === 0) return;
         
-        // Validate file size
-        if (file.size > this.maxFileSize) {
+        // Validate file count and sizes
+        if (files.length > this.maxFiles) {
+            this.showAlert(this.maxFiles === 1 ? 'Please select a single file' : `Please select at most ${this.maxFiles} files`, 'error');
+            return;
+        }
+        
+        if (files.some(file => file.size > this.maxFileSize)) {
             this.showAlert(`File size exceeds ${this.maxFileSizeHuman} limit`, 'error');
             return;
         }
         
-        this.selectedFile = file;
-        this.showFileInfo(file);
+        const totalSize = files.reduce((total, file) => total + file.size, 0);
+        if (totalSize > this.maxRequestSize) {
+            this.showAlert(`Total upload size exceeds ${this.maxRequestSizeHuman} limit`, 'error');
+            return;
+        }
+        
+        this.selectedFiles = files;
+        this.showFileInfo(files, totalSize);
         this.hideAlert();
     }
     
-    showFileInfo(file) {
+    showFileInfo(files, totalSize) {
         if (!this.fileInfo) return;
         
         const fileName = this.fileInfo.querySelector('.file-name');
         const fileSize = this.fileInfo.querySelector('.file-size');
         
-        if (fileName) fileName.textContent = file.name;
-        if (fileSize) fileSize.textContent = this.formatFileSize(file.size);
+        if (fileName) {
+            fileName.textContent = files.length === 1
+                ? files[0].name
+                : `${files.length} files: ${files.map(file => file.name).join(', ')}`;
+        }
+        if (fileSize) fileSize.textContent = this.formatFileSize(totalSize);
         
         this.fileInfo.style.display = 'block';
         this.fileInfo.classList.add('fade-in');
@@ -264,6 +295,66 @@ class TempFilesUI {
         }, 100);
     }
     
+    async uploadEncrypted() {
+        this.showProgress();
+        this.disableUploadArea();
+        
+        try {
+            // The options are sent as usual, the names and contents only encrypted
+            const form = new FormData(this.uploadForm);
+            form.delete('file');
+            form.set('client_encrypted', '1');
+            
+            const keys = [];
+            for (const file of this.selectedFiles) {
+                const encrypted = await E2E.encrypt(file);
+                form.append('file', encrypted.blob, 'encrypted.bin');
+                keys.push(encrypted.key);
+            }
+            
+            const response = await fetch('/', {
+                method: 'POST',
+                body: form,
+                headers: { 'Accept': 'application/json' }
+            });
+            if (!response.ok) {
+                throw new Error(await E2E.errorMessage(response, 'Upload failed'));
+            }
+            const body = await response.json();
+            const results = Array.isArray(body) ? body : [body];
+            
+            // Keys go in the fragment, which is never sent to the server, and
+            // delete tokens in a cookie, which is never logged
+            const params = new URLSearchParams();
+            const fragment = new URLSearchParams();
+            const tokens = new URLSearchParams();
+            results.forEach((result, i) => {
+                params.append('file', result.filename);
+                params.append('original', result.original_name);
+                params.append('size', result.size);
+                params.append('size_human', result.size_human);
+                params.append('link', result.download_url);
+                fragment.append(result.filename, keys[i]);
+                tokens.set(result.filename, result.delete_token);
+            });
+            
+            const first = results[0];
+            params.set('expires_at', first.expires_at);
+            params.set('expires_in', first.expires_in);
+            if (first.max_downloads) params.set('max_downloads', first.max_downloads);
+            if (first.password_protected) params.set('protected', '1');
+            params.set('encrypted', '1');
+            
+            const secure = window.location.protocol === 'https:' ? '; secure' : '';
+            document.cookie = `delete_tokens=${tokens.toString()}; path=/success; max-age=600; samesite=strict${secure}`;
+            window.location.href = '/success?' + params.toString() + '#' + fragment.toString();
+        } catch (err) {
+            this.hideProgress();
+            this.enableUploadArea();
+            this.showAlert(err.message, 'error');
+        }
+    }
+    
     disableUploadArea() {
         if (this.uploadArea) {
             this.uploadArea.style.pointerEvents = 'none';
@@ -306,7 +397,7 @@ class TempFilesUI {
     }
     
     resetForm() {
-        this.selectedFile = null;
+        this.selectedFiles = [];
         if (this.fileInput) this.fileInput.value = '';
         if (this.fileInfo) this.fileInfo.style.display = 'none';
     }
@@ -333,6 +424,186 @@ class TempFilesUI {
     }
 }
 
+// End-to-end encryption of uploads. Files are encrypted in the browser before
+// they are uploaded, and the key is kept in the URL fragment, which browsers
+// never send to the server.
+//
+// The encrypted data is a 4 byte big-endian header length, a JSON header with
+// the file's name and type, and the file itself, sealed with AES-256-GCM in
+// chunks of 64 KiB. The IV of a chunk is its big-endian index, with the last
+// byte set on the final chunk, so chunks can neither be reordered nor cut off
+const E2E = {
+    chunkSize: 64 * 1024,
+    tagSize: 16,
+    
+    iv(index, final) {
+        const iv = new Uint8Array(12);
+        new DataView(iv.buffer).setBigUint64(0, BigInt(index));
+        if (final) iv[11] = 1;
+        return iv;
+    },
+    
+    async encrypt(file) {
+        const header = new TextEncoder().encode(JSON.stringify({ name: file.name, type: file.type }));
+        const length = new Uint8Array(4);
+        new DataView(length.buffer).setUint32(0, header.length);
+        const plain = new Blob([length, header, file]);
+        
+        const key = await crypto.subtle.generateKey({ name: 'AES-GCM', length: 256 }, true, ['encrypt', 'decrypt']);
+        const chunks = Math.ceil(plain.size / this.chunkSize);
+        const sealed = [];
+        for (let i = 0; i < chunks; i++) {
+            const chunk = await plain.slice(i * this.chunkSize, (i + 1) * this.chunkSize).arrayBuffer();
+            sealed.push(await crypto.subtle.encrypt({ name: 'AES-GCM', iv: this.iv(i, i === chunks - 1) }, key, chunk));
+        }
+        
+        const raw = new Uint8Array(await crypto.subtle.exportKey('raw', key));
+        return {
+            blob: new Blob(sealed, { type: 'application/octet-stream' }),
+            key: btoa(String.fromCharCode(...raw)).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '')
+        };
+    },
+    
+    async decrypt(buffer, encodedKey) {
+        const base64 = encodedKey.replace(/-/g, '+').replace(/_/g, '/');
+        const raw = Uint8Array.from(atob(base64), c => c.charCodeAt(0));
+        const key = await crypto.subtle.importKey('raw', raw, 'AES-GCM', false, ['decrypt']);
+        
+        const sealedSize = this.chunkSize + this.tagSize;
+        const chunks = Math.ceil(buffer.byteLength / sealedSize);
+        const plain = [];
+        for (let i = 0; i < chunks; i++) {
+            const chunk = buffer.slice(i * sealedSize, (i + 1) * sealedSize);
+            plain.push(await crypto.subtle.decrypt({ name: 'AES-GCM', iv: this.iv(i, i === chunks - 1) }, key, chunk));
+        }
+        
+        const data = new Blob(plain);
+        const length = new DataView(await data.slice(0, 4).arrayBuffer()).getUint32(0);
+        const header = JSON.parse(await data.slice(4, 4 + length).text());
+        const type = header.type || 'application/octet-stream';
+        
+        return {
+            name: header.name || 'download',
+            blob: data.slice(4 + length, data.size, type)
+        };
+    },
+    
+    async errorMessage(response, fallback) {
+        const text = await response.text();
+        try {
+            return JSON.parse(text).error || fallback;
+        } catch {
+            return text || fallback;
+        }
+    }
+};
+
+// Decrypt Page for end-to-end encrypted files
+class DecryptPage {
+    constructor(element, ui) {
+        this.element = element;
+        this.ui = ui;
+        this.form = element.querySelector('.decrypt-form');
+        this.progress = element.querySelector('.progress-container');
+        this.progressText = element.querySelector('.progress-text');
+        this.key = window.location.hash.slice(1);
+        
+        if (!this.key) {
+            this.ui.showAlert('This link is missing its key: the part after # is needed to decrypt the file', 'error');
+            this.form.querySelector('button[type="submit"]').disabled = true;
+            return;
+        }
+        
+        // Downloads may be limited, so nothing is fetched until asked for
+        this.form.addEventListener('submit', (e) => {
+            e.preventDefault();
+            this.decrypt();
+        });
+    }
+    
+    async decrypt() {
+        const button = this.form.querySelector('button[type="submit"]');
+        button.disabled = true;
+        this.ui.hideAlert();
+        this.setProgress('Downloading...');
+        
+        try {
+            const headers = { 'Accept': 'application/octet-stream' };
+            const password = this.form.querySelector('input[name="password"]')?.value;
+            if (password) headers['X-File-Password'] = password;
+            
+            const response = await fetch(this.element.dataset.url, { headers });
+            if (!response.ok) {
+                throw new Error(await E2E.errorMessage(response, 'Download failed'));
+            }
+            const buffer = await response.arrayBuffer();
+            
+            this.setProgress('Decrypting...');
+            let file;
+            try {
+                file = await E2E.decrypt(buffer, this.key);
+            } catch {
+                throw new Error('The file could not be decrypted: the key in the link is wrong or incomplete');
+            }
+            
+            this.element.querySelector('.decrypt-name').textContent = file.name;
+            this.save(file);
+            this.ui.showAlert('File decrypted and saved', 'success');
+        } catch (err) {
+            this.ui.showAlert(err.message, 'error');
+        } finally {
+            this.progress.style.display = 'none';
+            button.disabled = false;
+        }
+    }
+    
+    save(file) {
+        const url = URL.createObjectURL(file.blob);
+        const link = document.createElement('a');
+        link.href = url;
+        link.download = file.name;
+        document.body.appendChild(link);
+        link.click();
+        link.remove();
+        setTimeout(() => URL.revokeObjectURL(url), 60000);
+    }
+    
+    setProgress(text) {
+        this.progress.style.display = 'block';
+        this.progressText.textContent = text;
+    }
+}
+
+// Adds the keys of end-to-end encrypted uploads, passed in the fragment, to
+// the links shown on the success page
+function addEncryptionKeys() {
+    const keys = new URLSearchParams(window.location.hash.slice(1));
+    document.querySelectorAll('[data-key-for]').forEach(element => {
+        const key = keys.get(element.dataset.keyFor);
+        if (!key) return;
+        
+        if (element.tagName === 'A') {
+            element.href += '#' + key;
+        } else if (element.classList.contains('copy-btn')) {
+            element.dataset.text += '#' + key;
+        } else {
+            element.textContent += '#' + key;
+        }
+    });
+}
+
+// Delete links carry their token in the fragment, which never reaches the
+// server, so the confirmation form picks it up from there
+function addDeleteToken() {
+    const input = document.getElementById('deleteToken');
+    if (!input || input.value) return;
+    
+    const token = new URLSearchParams(window.location.hash.slice(1)).get('token');
+    if (token) {
+        input.value = token;
+    }
+}
+
 // Countdown Timer for Success Page
 class CountdownTimer {
     constructor(expiryTime) {
@@ -365,7 +636,15 @@ class CountdownTimer {
 
 // Initialize when DOM is loaded
 document.addEventListener('DOMContentLoaded', () => {
-    new TempFilesUI();
+    const ui = new TempFilesUI();
+    
+    const decryptPage = document.getElementById('decryptPage');
+    if (decryptPage) {
+        new DecryptPage(decryptPage, ui);
+    }
+    
+    addEncryptionKeys();
+    addDeleteToken();
     
     // Initialize countdown if on success page
     const expiryTime = document.querySelector('[data-expiry]');